@@ -0,0 +1,219 @@
+// Command presencebench measures how many presence updates a running server
+// delivers. It connects thousands of simulated sockets, puts them in rooms,
+// then makes some users flap (disconnect and reconnect right away) and
+// others leave for good, and counts the user_status events received.
+//
+// Usage:
+//
+//	go run ./cmd/presencebench -url http://localhost:8080 -clients 2000
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// userStatusPrefix starts Socket.IO event packets carrying presence updates
+const userStatusPrefix = `42["user_status"`
+
+// client is a simulated Socket.IO client speaking Engine.IO v4 over WebSocket
+type client struct {
+	userName string
+	roomID   string
+	conn     *websocket.Conn
+	joined   chan struct{}
+	done     chan struct{}
+}
+
+// bench holds the settings and counters of a run
+type bench struct {
+	endpoint string
+	origin   string
+	received atomic.Int64 // user_status events received by all clients
+}
+
+func main() {
+	serverURL := flag.String("url", "http://localhost:8080", "server base URL")
+	clients := flag.Int("clients", 2000, "simulated sockets")
+	roomSize := flag.Int("room-size", 20, "sockets per room")
+	flappers := flag.Int("flappers", 100, "users that reconnect right after disconnecting")
+	flaps := flag.Int("flaps", 3, "reconnects per flapping user")
+	leavers := flag.Int("leavers", 100, "users that disconnect for good")
+	concurrency := flag.Int("concurrency", 100, "sockets connected at the same time")
+	settle := flag.Duration("settle", 5*time.Second, "wait for presence updates, longer than the server's coalesce window")
+	flag.Parse()
+
+	if *flappers+*leavers > *clients {
+		log.Fatal("flappers and leavers must not outnumber clients")
+	}
+
+	base, err := url.Parse(*serverURL)
+	if err != nil {
+		log.Fatalf("invalid url: %v", err)
+	}
+	scheme := "ws"
+	if base.Scheme == "https" {
+		scheme = "wss"
+	}
+	b := &bench{
+		endpoint: fmt.Sprintf("%s://%s/socket.io/?EIO=4&transport=websocket", scheme, base.Host),
+		origin:   base.String(),
+	}
+
+	// Names are unique per run so that earlier runs do not share rooms
+	run := fmt.Sprintf("bench-%x", time.Now().UnixNano()&0xffffff)
+	all := make([]*client, *clients)
+	for i := range all {
+		all[i] = &client{
+			userName: fmt.Sprintf("%s-user-%d", run, i),
+			roomID:   fmt.Sprintf("%s-room-%d", run, i / *roomSize),
+		}
+	}
+
+	start := time.Now()
+	b.connectAll(all, *concurrency)
+	log.Printf("connected %d sockets in %d rooms in %s", len(all), (len(all)+*roomSize-1) / *roomSize, time.Since(start).Round(time.Millisecond))
+
+	time.Sleep(*settle)
+	b.received.Store(0)
+
+	// Flapping users are spread over the rooms; leavers come after them
+	flapping := all[:*flappers]
+	leaving := all[*flappers : *flappers+*leavers]
+
+	start = time.Now()
+	for range *flaps {
+		for _, c := range flapping {
+			c.close()
+		}
+		b.connectAll(flapping, *concurrency)
+	}
+	for _, c := range leaving {
+		c.close()
+	}
+	elapsed := time.Since(start)
+
+	time.Sleep(*settle)
+	received := b.received.Load()
+
+	// Each leaver goes offline once; flaps should not be announced at all.
+	// Without scoping, every change would reach every socket.
+	changes := *flappers*(*flaps)*2 + *leavers
+	remaining := int64(len(all) - *leavers)
+	global := int64(changes) * remaining
+
+	fmt.Printf("sockets:                    %d\n", len(all))
+	fmt.Printf("room size:                  %d\n", *roomSize)
+	fmt.Printf("online/offline changes:     %d (%d flapping users x %d flaps x 2 + %d leavers)\n", changes, *flappers, *flaps, *leavers)
+	fmt.Printf("changes made in:            %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("user_status received:       %d\n", received)
+	fmt.Printf("expected with scoping:      ~%d (each leaver's room mates)\n", int64(*leavers)*int64(*roomSize-1))
+	fmt.Printf("global fan-out would send:  %d\n", global)
+	if received > 0 {
+		fmt.Printf("reduction:                  %.1fx\n", float64(global)/float64(received))
+	}
+
+	for _, c := range all[*flappers+*leavers:] {
+		c.close()
+	}
+	for _, c := range flapping {
+		c.close()
+	}
+}
+
+// connectAll connects and joins clients, at most concurrency at a time
+func (b *bench) connectAll(clients []*client, concurrency int) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for _, c := range clients {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(c *client) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := b.connect(c); err != nil {
+				log.Fatalf("%s: %v", c.userName, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// connect opens a socket, joins as the client's user and enters its room
+func (b *bench) connect(c *client) error {
+	conn, err := websocket.Dial(b.endpoint, "", b.origin)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.joined = make(chan struct{})
+	c.done = make(chan struct{})
+
+	// Engine.IO open packet, then the Socket.IO connect handshake
+	var open string
+	if err := websocket.Message.Receive(conn, &open); err != nil || !strings.HasPrefix(open, "0") {
+		return fmt.Errorf("unexpected open packet %q: %v", open, err)
+	}
+	if err := websocket.Message.Send(conn, "40"); err != nil {
+		return err
+	}
+
+	go b.read(c)
+
+	if err := c.emit("join", map[string]interface{}{"userName": c.userName, "deviceInfo": "presencebench"}); err != nil {
+		return err
+	}
+	select {
+	case <-c.joined:
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timed out joining")
+	}
+	return c.emit("join_room", map[string]interface{}{"roomId": c.roomID, "userName": c.userName})
+}
+
+// read answers pings and counts presence updates until the socket closes
+func (b *bench) read(c *client) {
+	defer close(c.done)
+	for {
+		var packet string
+		if err := websocket.Message.Receive(c.conn, &packet); err != nil {
+			return
+		}
+		switch {
+		case packet == "2":
+			websocket.Message.Send(c.conn, "3")
+		case strings.HasPrefix(packet, userStatusPrefix):
+			b.received.Add(1)
+		case strings.HasPrefix(packet, `42["joined"`):
+			close(c.joined)
+		}
+	}
+}
+
+// emit sends a Socket.IO event
+func (c *client) emit(event string, data interface{}) error {
+	payload, err := json.Marshal([]interface{}{event, data})
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(c.conn, "42"+string(payload))
+}
+
+// close disconnects the socket and waits for its reader to stop
+func (c *client) close() {
+	if c.conn == nil {
+		return
+	}
+	c.conn.Close()
+	<-c.done
+	c.conn = nil
+}
@@ -11,6 +11,7 @@ import (
 
 	"im-demo/internal/config"
 	"im-demo/internal/handlers"
+	"im-demo/internal/models"
 	"im-demo/internal/services"
 
 	"github.com/gin-gonic/gin"
@@ -58,22 +59,19 @@ func main() {
 
 	router := gin.Default()
 
-	// Add CORS middleware
-	router.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	// Assign every request an ID for error correlation
+	router.Use(handlers.RequestID())
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-
-		c.Next()
-	})
+	// Let browsers on the allowed origins call the API
+	router.Use(handlers.CORS(cfg.SocketIO))
 
-	// Static file serving for uploads
-	router.Static("/uploads", cfg.Upload.UploadDir)
+	// Optionally serve HTTP/3, so clients can use WebTransport and fall back
+	// to WebSocket or polling over TCP
+	webTransportServer, err := socketIOHandler.NewWebTransportServer(router)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize WebTransport listener")
+	}
+	router.Use(handlers.AdvertiseHTTP3(webTransportServer))
 
 	// Serve web client
 	router.Static("/web", "web")
@@ -89,8 +87,8 @@ func main() {
 		socketIOHandler.ServeHTTP(c)
 	})
 
-	// File upload endpoint
-	router.POST("/api/upload", socketIOHandler.HandleFileUpload)
+	// File upload endpoint, sends the file as a message from the authenticated user
+	router.POST("/api/upload", socketIOHandler.RequireAuth(), socketIOHandler.HandleFileUpload)
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
@@ -104,28 +102,61 @@ func main() {
 	api := router.Group("/api")
 	{
 		// Get room members
-		api.GET("/rooms/:roomId/members", func(c *gin.Context) {
-			roomID := c.Param("roomId")
-			ctx := context.Background()
-			members, err := redisService.GetRoomMembers(ctx, roomID)
-			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(200, gin.H{"members": members})
-		})
+		api.GET("/rooms/:roomId/members", socketIOHandler.HandleGetRoomMembers)
 
 		// Get message by ID
-		api.GET("/messages/:messageId", func(c *gin.Context) {
-			messageID := c.Param("messageId")
-			ctx := context.Background()
-			message, err := redisService.GetMessage(ctx, messageID)
-			if err != nil {
-				c.JSON(404, gin.H{"error": "Message not found"})
-				return
-			}
-			c.JSON(200, message)
-		})
+		api.GET("/messages/:messageId", socketIOHandler.RequireAuth(), socketIOHandler.HandleGetMessage)
+
+		// Issue a fresh signed download URL for a message's file
+		api.GET("/messages/:messageId/download-url", socketIOHandler.RequireAuth(), socketIOHandler.HandleDownloadURL)
+
+		// Manage the authenticated user's block list
+		api.GET("/blocks", socketIOHandler.RequireAuth(), socketIOHandler.HandleGetBlockedUsers)
+		api.PUT("/blocks/:userName", socketIOHandler.RequireAuth(), socketIOHandler.HandleBlockUser)
+		api.DELETE("/blocks/:userName", socketIOHandler.RequireAuth(), socketIOHandler.HandleUnblockUser)
+
+		// Get and update who may send direct messages to the authenticated user
+		api.GET("/privacy", socketIOHandler.RequireAuth(), socketIOHandler.HandleGetPrivacy)
+		api.PUT("/privacy", socketIOHandler.RequireAuth(), socketIOHandler.HandleSetPrivacy)
+
+		// Get a user's presence, with when they were last seen if offline
+		api.GET("/users/:userName/presence", socketIOHandler.RequireAuth(), socketIOHandler.HandleGetPresence)
+
+		// Download a message's file, authorized by signed URL or session token
+		api.GET("/files/:messageId", socketIOHandler.HandleFileDownload)
+	}
+
+	// Moderation endpoints, restricted to the configured admins
+	if cfg.Auth.AdminKey == "" && (!cfg.Server.TLS.Enabled || cfg.Server.TLS.ClientAuth == "none") {
+		logger.Warn("No admin key or TLS client certificates configured, the admin API is unavailable")
+	}
+	admin := router.Group("/api/admin", socketIOHandler.RequireAdmin())
+	{
+		// Review and resolve the abuse report queue
+		admin.GET("/reports", socketIOHandler.HandleListReports)
+		admin.GET("/reports/:reportId", socketIOHandler.HandleGetReport)
+		admin.POST("/reports/:reportId/resolve", socketIOHandler.HandleResolveReport)
+
+		// Delete a message for everyone
+		admin.DELETE("/messages/:messageId", socketIOHandler.HandleDeleteMessage)
+
+		// Mute or ban users, taking effect on all of their sessions
+		admin.PUT("/users/:userName/mute", socketIOHandler.HandleSanctionUser(models.SanctionMute))
+		admin.DELETE("/users/:userName/mute", socketIOHandler.HandleLiftSanction(models.SanctionMute))
+		admin.PUT("/users/:userName/ban", socketIOHandler.HandleSanctionUser(models.SanctionBan))
+		admin.DELETE("/users/:userName/ban", socketIOHandler.HandleLiftSanction(models.SanctionBan))
+
+		// Inspect online users, nodes and rooms across the cluster
+		admin.GET("/users", socketIOHandler.HandleListOnlineUsers)
+		admin.GET("/nodes", socketIOHandler.HandleListNodes)
+		admin.GET("/rooms/:roomId", socketIOHandler.HandleGetRoom)
+
+		// Force-disconnect a session or all of a user's devices
+		admin.DELETE("/sessions/:sessionId", socketIOHandler.HandleDisconnectSession)
+		admin.DELETE("/users/:userName/sessions", socketIOHandler.HandleDisconnectUser)
+
+		// Broadcast a system announcement to all or specific rooms
+		admin.POST("/announcements", socketIOHandler.HandleAnnounce)
 	}
 
 	// Create HTTP server
@@ -134,14 +165,58 @@ func main() {
 		Handler: router,
 	}
 
+	// Optionally terminate TLS, with HTTP/2, instead of a proxy in front
+	if cfg.Server.TLS.Enabled {
+		certs, err := services.NewTLSReloader(cfg.Server.TLS, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load TLS certificates")
+		}
+		go certs.Watch()
+		srv.TLSConfig = certs.TLSConfig("h2", "http/1.1")
+	}
+
 	// Start server in a goroutine
 	go func() {
-		logger.WithField("port", cfg.Server.Port).Info("Server starting")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithFields(logrus.Fields{
+			"port": cfg.Server.Port,
+			"tls":  cfg.Server.TLS.Enabled,
+		}).Info("Server starting")
+
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Fatal("Failed to start server")
 		}
 	}()
 
+	// Send plain HTTP requests to HTTPS
+	var redirectServer *http.Server
+	if cfg.Server.TLS.Enabled && cfg.Server.TLS.RedirectPort > 0 {
+		redirectServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.Server.TLS.RedirectPort),
+			Handler: handlers.RedirectToHTTPS(cfg.Server.Port),
+		}
+		go func() {
+			logger.WithField("port", cfg.Server.TLS.RedirectPort).Info("HTTPS redirect server starting")
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Fatal("Failed to start HTTPS redirect server")
+			}
+		}()
+	}
+
+	if webTransportServer != nil {
+		go func() {
+			logger.WithField("port", cfg.Server.WebTransport.Port).Info("HTTP/3 server starting")
+			if err := webTransportServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Fatal("Failed to start HTTP/3 server")
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -157,5 +232,17 @@ func main() {
 		logger.WithError(err).Fatal("Server forced to shutdown")
 	}
 
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			logger.WithError(err).Warn("Failed to shut down HTTPS redirect server")
+		}
+	}
+
+	if webTransportServer != nil {
+		if err := webTransportServer.Close(); err != nil {
+			logger.WithError(err).Warn("Failed to close HTTP/3 server")
+		}
+	}
+
 	logger.Info("Server exited")
 }
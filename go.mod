@@ -5,10 +5,17 @@ go 1.24.1
 toolchain go1.24.4
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/gin-gonic/gin v1.9.1
+	github.com/quic-go/quic-go v0.54.0
 	github.com/redis/go-redis/v9 v9.3.0
 	github.com/sirupsen/logrus v1.9.3
+	github.com/zishang520/socket.io/servers/engine/v3 v3.0.0-rc.6
 	github.com/zishang520/socket.io/servers/socket/v3 v3.0.0-rc.6
+	github.com/zishang520/socket.io/v3 v3.0.0-rc.6
+	github.com/zishang520/webtransport-go v0.9.1
+	golang.org/x/net v0.44.0
+	golang.org/x/text v0.29.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -36,25 +43,20 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
-	github.com/quic-go/quic-go v0.54.0 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	github.com/zishang520/socket.io/parsers/engine/v3 v3.0.0-rc.6 // indirect
 	github.com/zishang520/socket.io/parsers/socket/v3 v3.0.0-rc.6 // indirect
-	github.com/zishang520/socket.io/servers/engine/v3 v3.0.0-rc.6 // indirect
-	github.com/zishang520/socket.io/v3 v3.0.0-rc.6 // indirect
-	github.com/zishang520/webtransport-go v0.9.1 // indirect
 	go.uber.org/mock v0.6.0 // indirect
 	golang.org/x/arch v0.3.0 // indirect
 	golang.org/x/crypto v0.42.0 // indirect
 	golang.org/x/mod v0.28.0 // indirect
-	golang.org/x/net v0.44.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
-	golang.org/x/text v0.29.0 // indirect
 	golang.org/x/tools v0.37.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,18 +16,50 @@ import (
 
 // Config holds all application configuration
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Redis    RedisConfig    `yaml:"redis"`
-	SocketIO SocketIOConfig `yaml:"socketio"`
-	Upload   UploadConfig   `yaml:"upload"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Server     ServerConfig     `yaml:"server"`
+	Redis      RedisConfig      `yaml:"redis"`
+	SocketIO   SocketIOConfig   `yaml:"socketio"`
+	Upload     UploadConfig     `yaml:"upload"`
+	Message    MessageConfig    `yaml:"message"`
+	Moderation ModerationConfig `yaml:"moderation"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Devices    DevicesConfig    `yaml:"devices"`
+	Presence   PresenceConfig   `yaml:"presence"`
+	Typing     TypingConfig     `yaml:"typing"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Logging    LoggingConfig    `yaml:"logging"`
 }
 
 // ServerConfig holds server configuration
 type ServerConfig struct {
-	Port int    `yaml:"port"`
-	Host string `yaml:"host"`
-	Env  string `yaml:"env"`
+	Port   int    `yaml:"port"`
+	Host   string `yaml:"host"`
+	Env    string `yaml:"env"`
+	NodeID string `yaml:"node_id"` // identifies this instance in a cluster, unique per process
+
+	TLS          TLSConfig          `yaml:"tls"`
+	WebTransport WebTransportConfig `yaml:"webtransport"`
+}
+
+// TLSConfig holds TLS termination by the server itself. Certificates are
+// reloaded when their files change.
+type TLSConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ClientCAFile   string        `yaml:"client_ca_file"`  // CA that signs the certificates of internal clients
+	ClientAuth     string        `yaml:"client_auth"`     // none, request (verified if given) or require
+	RedirectPort   int           `yaml:"redirect_port"`   // plain HTTP port redirected to HTTPS, 0 disables
+	ReloadInterval time.Duration `yaml:"reload_interval"` // how often the files are checked for changes
+}
+
+// WebTransportConfig holds the optional HTTP/3 listener, which serves the
+// API and Socket.IO's WebTransport transport over QUIC
+type WebTransportConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Port     int    `yaml:"port"`      // UDP port, defaults to the server port that clients upgrade from
+	CertFile string `yaml:"cert_file"` // HTTP/3 always uses TLS, defaults to the server's certificate
+	KeyFile  string `yaml:"key_file"`
 }
 
 // RedisConfig holds Redis configuration
@@ -34,16 +71,153 @@ type RedisConfig struct {
 
 // SocketIOConfig holds Socket.IO configuration
 type SocketIOConfig struct {
-	CORSOrigins  string        `yaml:"cors_origins"`
-	PingTimeout  time.Duration `yaml:"ping_timeout"`
-	PingInterval time.Duration `yaml:"ping_interval"`
+	CORSOrigins          string        `yaml:"cors_origins"` // comma-separated origins allowed by the Socket.IO and REST endpoints, "*" allows any
+	PingTimeout          time.Duration `yaml:"ping_timeout"`
+	PingInterval         time.Duration `yaml:"ping_interval"`
+	Transports           []string      `yaml:"transports"`            // polling, websocket or webtransport
+	MaxHTTPBufferSize    int64         `yaml:"max_http_buffer_size"`  // largest message or polling request, in bytes
+	PerMessageDeflate    bool          `yaml:"per_message_deflate"`   // compress WebSocket messages
+	CompressionThreshold int           `yaml:"compression_threshold"` // smaller messages are sent uncompressed, in bytes
 }
 
 // UploadConfig holds file upload configuration
 type UploadConfig struct {
-	MaxFileSize int64  `yaml:"max_file_size"`
-	UploadDir   string `yaml:"upload_dir"`
-	BaseURL     string `yaml:"base_url"`
+	MaxFileSize    int64         `yaml:"max_file_size"`
+	UploadDir      string        `yaml:"upload_dir"`
+	BaseURL        string        `yaml:"base_url"`
+	MaxChunkSize   int64         `yaml:"max_chunk_size"`
+	SessionTTL     time.Duration `yaml:"session_ttl"`
+	MaxOpenUploads int           `yaml:"max_open_uploads"` // unfinished chunked uploads per user
+	Backend        string        `yaml:"backend"`          // local or s3
+	DownloadTTL    time.Duration `yaml:"download_ttl"`
+	GCInterval     time.Duration `yaml:"gc_interval"`
+	GCGrace        time.Duration `yaml:"gc_grace"`
+	S3             S3Config      `yaml:"s3"`
+	Image          ImageConfig   `yaml:"image"`
+	Policy         PolicyConfig  `yaml:"policy"`
+}
+
+// PolicyConfig holds upload validation, quota and scanning configuration
+type PolicyConfig struct {
+	AllowedTypes      []string      `yaml:"allowed_types"` // detected MIME types, "type/*" wildcards allowed
+	MaxFileNameLength int           `yaml:"max_file_name_length"`
+	UserQuota         int64         `yaml:"user_quota"` // bytes per quota window, 0 disables
+	RoomQuota         int64         `yaml:"room_quota"` // bytes per quota window, 0 disables
+	QuotaWindow       time.Duration `yaml:"quota_window"`
+	Scanner           string        `yaml:"scanner"`     // none or eicar
+	ScanAction        string        `yaml:"scan_action"` // reject or quarantine
+	ScanTimeout       time.Duration `yaml:"scan_timeout"`
+}
+
+// ImageConfig holds image processing configuration
+type ImageConfig struct {
+	ThumbnailSizes []int `yaml:"thumbnail_sizes"`
+	Workers        int   `yaml:"workers"`
+	MaxPixels      int   `yaml:"max_pixels"` // per image, and over all frames of an animation
+	MaxFrames      int   `yaml:"max_frames"` // frames of an animated GIF
+	JPEGQuality    int   `yaml:"jpeg_quality"`
+}
+
+// S3Config holds S3-compatible object storage configuration
+type S3Config struct {
+	Endpoint     string        `yaml:"endpoint"`
+	Region       string        `yaml:"region"`
+	Bucket       string        `yaml:"bucket"`
+	AccessKey    string        `yaml:"access_key"`
+	SecretKey    string        `yaml:"secret_key"`
+	UsePathStyle bool          `yaml:"use_path_style"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// MessageConfig holds message retention and expiry configuration
+type MessageConfig struct {
+	MaxTTL           time.Duration     `yaml:"max_ttl"`
+	SweepInterval    time.Duration     `yaml:"sweep_interval"`
+	MaxContentLength int               `yaml:"max_content_length"` // characters
+	MaxMetadataSize  int               `yaml:"max_metadata_size"`  // bytes of JSON
+	LinkPreview      LinkPreviewConfig `yaml:"link_preview"`
+}
+
+// LinkPreviewConfig holds link preview fetching configuration
+type LinkPreviewConfig struct {
+	Enabled              bool          `yaml:"enabled"`
+	Timeout              time.Duration `yaml:"timeout"`
+	MaxBodySize          int64         `yaml:"max_body_size"`
+	MaxLinks             int           `yaml:"max_links"`
+	CacheTTL             time.Duration `yaml:"cache_ttl"`
+	AllowPrivateNetworks bool          `yaml:"allow_private_networks"`
+}
+
+// ModerationConfig holds message filtering configuration
+type ModerationConfig struct {
+	Enabled        bool                `yaml:"enabled"`
+	Admins         []string            `yaml:"admins"`      // receive reports of every room
+	RoomAdmins     map[string][]string `yaml:"room_admins"` // room ID -> users receiving its reports
+	Report         bool                `yaml:"report"`      // send filter decisions to admins
+	WordList       WordListConfig      `yaml:"word_list"`
+	Flood          FloodConfig         `yaml:"flood"`
+	BlockedDomains []string            `yaml:"blocked_domains"` // links to these domains and their subdomains are rejected
+}
+
+// WordListConfig holds the word list filter configuration
+type WordListConfig struct {
+	Words  []string `yaml:"words"`  // matched case-insensitively
+	Action string   `yaml:"action"` // mask or reject
+}
+
+// FloodConfig holds repeated message detection configuration
+type FloodConfig struct {
+	MaxRepeats int           `yaml:"max_repeats"` // identical messages allowed per window, 0 disables
+	Window     time.Duration `yaml:"window"`
+}
+
+// AuthConfig holds session token configuration
+type AuthConfig struct {
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	AdminKey string        `yaml:"admin_key"` // sent by admins in X-Admin-Key, empty requires client certificates
+}
+
+// DevicesConfig holds limits on the devices a user is connected with at
+// the same time, across the cluster
+type DevicesConfig struct {
+	MaxPerUser int            `yaml:"max_per_user"` // 0 allows any number
+	MaxPerType map[string]int `yaml:"max_per_type"` // device type -> limit, unlisted types are only limited by max_per_user
+	Policy     string         `yaml:"policy"`       // reject or evict_oldest, for logins beyond a limit
+}
+
+// PresenceConfig holds presence configuration
+type PresenceConfig struct {
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`      // users none of whose devices were used for this long appear away
+	MaxSubscriptions int           `yaml:"max_subscriptions"` // users whose presence one device can follow
+	MaxStatusText    int           `yaml:"max_status_text"`   // characters of custom status text
+	CoalesceWindow   time.Duration `yaml:"coalesce_window"`   // presence changes are announced at most once per window
+}
+
+// TypingConfig holds typing indicator configuration
+type TypingConfig struct {
+	Throttle time.Duration `yaml:"throttle"` // "typing" is relayed at most once per throttle per user and conversation
+	Timeout  time.Duration `yaml:"timeout"`  // "stop_typing" is sent for users who stop sending "typing" for this long
+}
+
+// RateLimitConfig holds per-event rate limits for Socket.IO events
+type RateLimitConfig struct {
+	Enabled bool                   `yaml:"enabled"`
+	Events  map[string]EventLimits `yaml:"events"` // keyed by event name
+}
+
+// EventLimits holds the token buckets applied to one event. Each scope is
+// limited independently; a zero rate leaves that scope unlimited.
+type EventLimits struct {
+	Session RateLimit `yaml:"session"` // per connected device
+	User    RateLimit `yaml:"user"`    // per user, across devices and nodes
+	Room    RateLimit `yaml:"room"`    // per room, across all senders
+}
+
+// RateLimit configures a token bucket
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`  // tokens added per second
+	Burst int     `yaml:"burst"` // bucket capacity
 }
 
 // LoggingConfig holds logging configuration
@@ -96,10 +270,52 @@ func loadFromEnv(cfg *Config) {
 		cfg.Server.Host = host
 	}
 
+	if tlsEnabled := os.Getenv("TLS_ENABLED"); tlsEnabled != "" {
+		if enabled, err := strconv.ParseBool(tlsEnabled); err == nil {
+			cfg.Server.TLS.Enabled = enabled
+		}
+	}
+
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cfg.Server.TLS.CertFile = certFile
+	}
+
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		cfg.Server.TLS.KeyFile = keyFile
+	}
+
+	if clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE"); clientCAFile != "" {
+		cfg.Server.TLS.ClientCAFile = clientCAFile
+	}
+
+	if redirectPort := os.Getenv("TLS_REDIRECT_PORT"); redirectPort != "" {
+		if p, err := strconv.Atoi(redirectPort); err == nil {
+			cfg.Server.TLS.RedirectPort = p
+		}
+	}
+
+	if webTransport := os.Getenv("WEBTRANSPORT_ENABLED"); webTransport != "" {
+		if enabled, err := strconv.ParseBool(webTransport); err == nil {
+			cfg.Server.WebTransport.Enabled = enabled
+		}
+	}
+
+	if certFile := os.Getenv("WEBTRANSPORT_CERT_FILE"); certFile != "" {
+		cfg.Server.WebTransport.CertFile = certFile
+	}
+
+	if keyFile := os.Getenv("WEBTRANSPORT_KEY_FILE"); keyFile != "" {
+		cfg.Server.WebTransport.KeyFile = keyFile
+	}
+
 	if env := os.Getenv("ENV"); env != "" {
 		cfg.Server.Env = env
 	}
 
+	if nodeID := os.Getenv("NODE_ID"); nodeID != "" {
+		cfg.Server.NodeID = nodeID
+	}
+
 	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
 		cfg.Redis.Addr = redisAddr
 	}
@@ -118,6 +334,10 @@ func loadFromEnv(cfg *Config) {
 		cfg.SocketIO.CORSOrigins = corsOrigins
 	}
 
+	if transports := os.Getenv("SOCKET_IO_TRANSPORTS"); transports != "" {
+		cfg.SocketIO.Transports = strings.Split(transports, ",")
+	}
+
 	if maxFileSize := os.Getenv("MAX_FILE_SIZE"); maxFileSize != "" {
 		if size, err := strconv.ParseInt(maxFileSize, 10, 64); err == nil {
 			cfg.Upload.MaxFileSize = size
@@ -128,6 +348,38 @@ func loadFromEnv(cfg *Config) {
 		cfg.Upload.UploadDir = uploadDir
 	}
 
+	if uploadBackend := os.Getenv("UPLOAD_BACKEND"); uploadBackend != "" {
+		cfg.Upload.Backend = uploadBackend
+	}
+
+	if s3Endpoint := os.Getenv("S3_ENDPOINT"); s3Endpoint != "" {
+		cfg.Upload.S3.Endpoint = s3Endpoint
+	}
+
+	if s3Region := os.Getenv("S3_REGION"); s3Region != "" {
+		cfg.Upload.S3.Region = s3Region
+	}
+
+	if s3Bucket := os.Getenv("S3_BUCKET"); s3Bucket != "" {
+		cfg.Upload.S3.Bucket = s3Bucket
+	}
+
+	if s3AccessKey := os.Getenv("S3_ACCESS_KEY"); s3AccessKey != "" {
+		cfg.Upload.S3.AccessKey = s3AccessKey
+	}
+
+	if s3SecretKey := os.Getenv("S3_SECRET_KEY"); s3SecretKey != "" {
+		cfg.Upload.S3.SecretKey = s3SecretKey
+	}
+
+	if authSecret := os.Getenv("AUTH_SECRET"); authSecret != "" {
+		cfg.Auth.Secret = authSecret
+	}
+
+	if adminKey := os.Getenv("ADMIN_KEY"); adminKey != "" {
+		cfg.Auth.AdminKey = adminKey
+	}
+
 	if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
 		cfg.Logging.Level = logLevel
 	}
@@ -151,6 +403,20 @@ func (c *Config) validate() error {
 		c.Server.Env = "development"
 	}
 
+	if c.Server.NodeID == "" {
+		// Host name plus a random suffix, so that restarts and several
+		// processes per host get distinct IDs
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "node"
+		}
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		c.Server.NodeID = hostname + "-" + hex.EncodeToString(suffix)
+	}
+
 	if c.Redis.Addr == "" {
 		c.Redis.Addr = "localhost:6379"
 	}
@@ -167,6 +433,36 @@ func (c *Config) validate() error {
 		c.SocketIO.PingInterval = 25 * time.Second
 	}
 
+	if len(c.SocketIO.Transports) == 0 {
+		c.SocketIO.Transports = []string{"polling", "websocket"}
+	}
+
+	if c.Server.TLS.ClientAuth == "" {
+		c.Server.TLS.ClientAuth = "none"
+	}
+
+	if c.Server.TLS.ReloadInterval == 0 {
+		c.Server.TLS.ReloadInterval = time.Minute
+	}
+
+	if c.Server.WebTransport.Enabled {
+		if c.Server.WebTransport.Port <= 0 {
+			c.Server.WebTransport.Port = c.Server.Port
+		}
+		if c.Server.WebTransport.CertFile == "" && c.Server.WebTransport.KeyFile == "" {
+			c.Server.WebTransport.CertFile = c.Server.TLS.CertFile
+			c.Server.WebTransport.KeyFile = c.Server.TLS.KeyFile
+		}
+		// Clients only try WebTransport if the server offers it
+		if !slices.Contains(c.SocketIO.Transports, "webtransport") {
+			c.SocketIO.Transports = append(c.SocketIO.Transports, "webtransport")
+		}
+	}
+
+	if c.SocketIO.CompressionThreshold == 0 {
+		c.SocketIO.CompressionThreshold = 1024 // 1KB
+	}
+
 	if c.Upload.MaxFileSize == 0 {
 		c.Upload.MaxFileSize = 10485760 // 10MB
 	}
@@ -179,6 +475,186 @@ func (c *Config) validate() error {
 		c.Upload.BaseURL = "/uploads"
 	}
 
+	if c.Upload.MaxChunkSize == 0 {
+		c.Upload.MaxChunkSize = 262144 // 256KB
+	}
+
+	if c.SocketIO.MaxHTTPBufferSize == 0 {
+		// Room for a base64 encoded file_upload and the rest of its packet
+		c.SocketIO.MaxHTTPBufferSize = (c.Upload.MaxFileSize+2)/3*4 + 1048576
+	}
+
+	if c.Upload.SessionTTL == 0 {
+		c.Upload.SessionTTL = time.Hour
+	}
+
+	if c.Upload.MaxOpenUploads == 0 {
+		c.Upload.MaxOpenUploads = 5
+	}
+
+	if c.Upload.Backend == "" {
+		c.Upload.Backend = "local"
+	}
+
+	if c.Upload.DownloadTTL == 0 {
+		c.Upload.DownloadTTL = 15 * time.Minute
+	}
+
+	if c.Upload.GCInterval == 0 {
+		c.Upload.GCInterval = 10 * time.Minute
+	}
+
+	if c.Upload.GCGrace == 0 {
+		c.Upload.GCGrace = 10 * time.Minute
+	}
+
+	if len(c.Upload.Image.ThumbnailSizes) == 0 {
+		c.Upload.Image.ThumbnailSizes = []int{160, 480}
+	}
+
+	if c.Upload.Image.Workers == 0 {
+		c.Upload.Image.Workers = 4
+	}
+
+	if c.Upload.Image.MaxPixels == 0 {
+		c.Upload.Image.MaxPixels = 40000000 // 40 megapixels
+	}
+
+	if c.Upload.Image.MaxFrames == 0 {
+		c.Upload.Image.MaxFrames = 200
+	}
+
+	if c.Upload.Image.JPEGQuality == 0 {
+		c.Upload.Image.JPEGQuality = 85
+	}
+
+	if len(c.Upload.Policy.AllowedTypes) == 0 {
+		c.Upload.Policy.AllowedTypes = []string{
+			"image/*", "audio/*", "video/*", "text/plain", "application/pdf",
+			"application/zip", "application/x-gzip",
+		}
+	}
+
+	if c.Upload.Policy.MaxFileNameLength == 0 {
+		c.Upload.Policy.MaxFileNameLength = 128
+	}
+
+	if c.Upload.Policy.QuotaWindow == 0 {
+		c.Upload.Policy.QuotaWindow = 24 * time.Hour
+	}
+
+	if c.Upload.Policy.Scanner == "" {
+		c.Upload.Policy.Scanner = "none"
+	}
+
+	if c.Upload.Policy.ScanAction == "" {
+		c.Upload.Policy.ScanAction = "quarantine"
+	}
+
+	if c.Upload.Policy.ScanTimeout == 0 {
+		c.Upload.Policy.ScanTimeout = 30 * time.Second
+	}
+
+	if c.Upload.S3.Region == "" {
+		c.Upload.S3.Region = "us-east-1"
+	}
+
+	if c.Upload.S3.Timeout == 0 {
+		c.Upload.S3.Timeout = 30 * time.Second
+	}
+
+	if c.Message.MaxTTL == 0 {
+		c.Message.MaxTTL = 24 * time.Hour
+	}
+
+	if c.Message.SweepInterval == 0 {
+		c.Message.SweepInterval = time.Second
+	}
+
+	if c.Message.MaxContentLength == 0 {
+		c.Message.MaxContentLength = 4000
+	}
+
+	if c.Message.MaxMetadataSize == 0 {
+		c.Message.MaxMetadataSize = 4096
+	}
+
+	if c.Message.LinkPreview.Timeout == 0 {
+		c.Message.LinkPreview.Timeout = 5 * time.Second
+	}
+
+	if c.Message.LinkPreview.MaxBodySize == 0 {
+		c.Message.LinkPreview.MaxBodySize = 512 * 1024 // 512KB
+	}
+
+	if c.Message.LinkPreview.MaxLinks == 0 {
+		c.Message.LinkPreview.MaxLinks = 3
+	}
+
+	if c.Message.LinkPreview.CacheTTL == 0 {
+		c.Message.LinkPreview.CacheTTL = time.Hour
+	}
+
+	if c.Moderation.WordList.Action == "" {
+		c.Moderation.WordList.Action = "mask"
+	}
+
+	if c.Moderation.Flood.Window == 0 {
+		c.Moderation.Flood.Window = time.Minute
+	}
+
+	if c.Auth.Secret == "" {
+		// Tokens signed with a random secret do not survive restarts and are
+		// not accepted by other nodes, so this is only suitable for development
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		c.Auth.Secret = hex.EncodeToString(secret)
+		logrus.Warn("No auth secret configured, using a random one")
+	}
+
+	if c.Auth.TokenTTL == 0 {
+		c.Auth.TokenTTL = 12 * time.Hour
+	}
+
+	if c.Devices.Policy == "" {
+		c.Devices.Policy = "evict_oldest"
+	}
+
+	if c.Presence.IdleTimeout == 0 {
+		c.Presence.IdleTimeout = 5 * time.Minute
+	}
+
+	if c.Presence.MaxSubscriptions == 0 {
+		c.Presence.MaxSubscriptions = 200
+	}
+
+	if c.Presence.MaxStatusText == 0 {
+		c.Presence.MaxStatusText = 100
+	}
+
+	if c.Presence.CoalesceWindow == 0 {
+		c.Presence.CoalesceWindow = 2 * time.Second
+	}
+
+	if c.Typing.Throttle == 0 {
+		c.Typing.Throttle = 2 * time.Second
+	}
+
+	if c.Typing.Timeout == 0 {
+		c.Typing.Timeout = 6 * time.Second
+	}
+
+	for event, limits := range c.RateLimit.Events {
+		for _, limit := range []*RateLimit{&limits.Session, &limits.User, &limits.Room} {
+			if limit.Rate > 0 && limit.Burst < 1 {
+				limit.Burst = int(math.Ceil(limit.Rate))
+			}
+		}
+		c.RateLimit.Events[event] = limits
+	}
+
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
 	}
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultReportLimit is how many reports are listed when no limit is given
+	defaultReportLimit = 50
+	// maxReportLimit bounds how many reports are listed at once
+	maxReportLimit = 200
+	// systemSender is the sender of announcements
+	systemSender = "system"
+)
+
+// HandleListReports lists the moderation queue, newest first. The status
+// query parameter selects open (default) or resolved reports.
+func (h *SocketIOHandler) HandleListReports(c *gin.Context) {
+	status := models.ReportStatus(c.DefaultQuery("status", string(models.ReportOpen)))
+	if status != models.ReportOpen && status != models.ReportResolved {
+		respondError(c, errInvalidValue, "status must be open or resolved")
+		return
+	}
+
+	limit := defaultReportLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxReportLimit {
+			respondError(c, errOutOfRange, "limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+
+	reports, err := h.redisService.ListReports(c.Request.Context(), status, int64(limit))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list reports")
+		respondError(c, errInternal, "Failed to list reports")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+// HandleGetReport returns a single report
+func (h *SocketIOHandler) HandleGetReport(c *gin.Context) {
+	report, err := h.redisService.GetReport(c.Request.Context(), c.Param("reportId"))
+	if err != nil {
+		if errors.Is(err, services.ErrReportNotFound) {
+			respondError(c, errNotFound, "Report not found")
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get report")
+		respondError(c, errInternal, "Failed to get report")
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// HandleResolveReport closes a report with a resolution, such as
+// "dismissed" or "actioned", and an optional note
+func (h *SocketIOHandler) HandleResolveReport(c *gin.Context) {
+	var request struct {
+		Resolution string `json:"resolution"`
+		Note       string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, errInvalidPayload, "Invalid resolution")
+		return
+	}
+	if request.Resolution == "" {
+		respondError(c, errMissingField, "resolution is required")
+		return
+	}
+	if len(request.Resolution) > maxNameLength || len([]rune(request.Note)) > maxReasonLength {
+		respondError(c, errTooLong, "Resolution or note too long")
+		return
+	}
+
+	ctx := c.Request.Context()
+	report, err := h.redisService.GetReport(ctx, c.Param("reportId"))
+	if err != nil {
+		if errors.Is(err, services.ErrReportNotFound) {
+			respondError(c, errNotFound, "Report not found")
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get report")
+		respondError(c, errInternal, "Failed to resolve report")
+		return
+	}
+	if report.Status == models.ReportResolved {
+		respondError(c, errConflict, "Report already resolved")
+		return
+	}
+
+	now := time.Now()
+	report.Status = models.ReportResolved
+	report.Resolution = request.Resolution
+	report.Note = request.Note
+	report.ResolvedBy = currentUser(c)
+	report.ResolvedAt = &now
+
+	if err := h.redisService.StoreReport(ctx, report); err != nil {
+		h.logger.WithError(err).Error("Failed to store report")
+		respondError(c, errInternal, "Failed to resolve report")
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"report_id":   report.ID,
+		"resolution":  report.Resolution,
+		"resolved_by": report.ResolvedBy,
+	}).Info("Report resolved")
+
+	c.JSON(http.StatusOK, report)
+}
+
+// HandleDeleteMessage deletes a message for everyone
+func (h *SocketIOHandler) HandleDeleteMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	message, err := h.redisService.GetMessage(ctx, c.Param("messageId"))
+	if err != nil {
+		respondError(c, errNotFound, "Message not found")
+		return
+	}
+
+	if err := h.deleteMessageAsModerator(ctx, message); err != nil {
+		h.logger.WithError(err).Error("Failed to delete message")
+		respondError(c, errInternal, "Failed to delete message")
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": message.ID,
+		"sender":     message.Sender,
+		"deleted_by": currentUser(c),
+	}).Info("Message deleted by moderator")
+
+	c.JSON(http.StatusOK, gin.H{"messageId": message.ID, "deleted": true})
+}
+
+// HandleSanctionUser returns a handler that mutes or bans a user, for
+// "duration" seconds or permanently when it is omitted or zero
+func (h *SocketIOHandler) HandleSanctionUser(kind models.SanctionKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Duration int64  `json:"duration"` // seconds
+			Reason   string `json:"reason"`
+		}
+		// The body is optional
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				respondError(c, errInvalidPayload, "Invalid sanction")
+				return
+			}
+		}
+		if request.Duration < 0 {
+			respondError(c, errOutOfRange, "duration must not be negative")
+			return
+		}
+		if len([]rune(request.Reason)) > maxReasonLength {
+			respondError(c, errTooLong, "reason too long")
+			return
+		}
+
+		userName := c.Param("userName")
+		sanction := &models.Sanction{
+			Kind:      kind,
+			UserName:  userName,
+			Reason:    request.Reason,
+			By:        currentUser(c),
+			CreatedAt: time.Now(),
+		}
+		if request.Duration > 0 {
+			until := sanction.CreatedAt.Add(time.Duration(request.Duration) * time.Second)
+			sanction.Until = &until
+		}
+
+		if err := h.redisService.SetSanction(c.Request.Context(), sanction); err != nil {
+			h.logger.WithError(err).Error("Failed to store sanction")
+			respondError(c, errInternal, "Failed to apply sanction")
+			return
+		}
+
+		// Sanctions are checked on every event; this reaches live sessions
+		h.publishControl(&models.ControlEvent{Type: models.ControlSanction, Sanction: sanction})
+
+		h.logger.WithFields(logrus.Fields{
+			"user_name": userName,
+			"sanction":  kind,
+			"by":        sanction.By,
+			"until":     sanction.Until,
+		}).Info("User sanctioned")
+
+		c.JSON(http.StatusOK, sanction)
+	}
+}
+
+// HandleLiftSanction returns a handler that lifts a mute or ban
+func (h *SocketIOHandler) HandleLiftSanction(kind models.SanctionKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userName := c.Param("userName")
+
+		lifted, err := h.redisService.ClearSanction(c.Request.Context(), kind, userName)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to clear sanction")
+			respondError(c, errInternal, "Failed to lift sanction")
+			return
+		}
+		if !lifted {
+			respondError(c, errNotFound, "User is not sanctioned")
+			return
+		}
+
+		h.publishControl(&models.ControlEvent{
+			Type:     models.ControlSanctionLifted,
+			Sanction: &models.Sanction{Kind: kind, UserName: userName, By: currentUser(c), CreatedAt: time.Now()},
+		})
+
+		h.logger.WithFields(logrus.Fields{
+			"user_name": userName,
+			"sanction":  kind,
+			"by":        currentUser(c),
+		}).Info("Sanction lifted")
+
+		c.JSON(http.StatusOK, gin.H{"userName": userName, "kind": kind, "lifted": true})
+	}
+}
+
+// HandleListOnlineUsers lists online users and their devices on every node
+func (h *SocketIOHandler) HandleListOnlineUsers(c *gin.Context) {
+	users, err := h.GetOnlineUsers(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list online users")
+		respondError(c, errInternal, "Failed to list online users")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// HandleListNodes lists the live nodes with their socket and room counts,
+// as of their last heartbeat
+func (h *SocketIOHandler) HandleListNodes(c *gin.Context) {
+	nodes, err := h.redisService.GetNodes(c.Request.Context())
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list nodes")
+		respondError(c, errInternal, "Failed to list nodes")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nodes": nodes})
+}
+
+// HandleGetRoom returns a room's members and how many sockets each node has
+// in it
+func (h *SocketIOHandler) HandleGetRoom(c *gin.Context) {
+	ctx := c.Request.Context()
+	roomID := c.Param("roomId")
+
+	members, err := h.redisService.GetRoomMembers(ctx, roomID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get room members")
+		respondError(c, errInternal, "Failed to get room")
+		return
+	}
+
+	nodes, err := h.redisService.GetNodes(ctx)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list nodes")
+		respondError(c, errInternal, "Failed to get room")
+		return
+	}
+
+	total := 0
+	sockets := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		sockets[node.NodeID] = node.Rooms[roomID]
+		total += node.Rooms[roomID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"roomId":  roomID,
+		"members": members,
+		"sockets": total,
+		"nodes":   sockets,
+	})
+}
+
+// HandleDisconnectSession disconnects a single session, on whichever node
+// holds it
+func (h *SocketIOHandler) HandleDisconnectSession(c *gin.Context) {
+	sessionID := c.Param("sessionId")
+
+	h.publishControl(&models.ControlEvent{
+		Type:      models.ControlDisconnect,
+		SessionID: sessionID,
+		Reason:    "disconnected_by_admin",
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"session_id": sessionID,
+		"by":         currentUser(c),
+	}).Info("Session disconnected by admin")
+
+	c.JSON(http.StatusOK, gin.H{"sessionId": sessionID, "disconnected": true})
+}
+
+// HandleDisconnectUser disconnects all of a user's devices
+func (h *SocketIOHandler) HandleDisconnectUser(c *gin.Context) {
+	userName := c.Param("userName")
+
+	h.publishControl(&models.ControlEvent{
+		Type:     models.ControlDisconnect,
+		UserName: userName,
+		Reason:   "disconnected_by_admin",
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name": userName,
+		"by":        currentUser(c),
+	}).Info("User disconnected by admin")
+
+	c.JSON(http.StatusOK, gin.H{"userName": userName, "disconnected": true})
+}
+
+// HandleAnnounce broadcasts a system message to the given rooms, or to
+// everyone when no rooms are given
+func (h *SocketIOHandler) HandleAnnounce(c *gin.Context) {
+	var request struct {
+		Content string   `json:"content"`
+		Rooms   []string `json:"rooms"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, errInvalidPayload, "Invalid announcement")
+		return
+	}
+	if request.Content == "" {
+		respondError(c, errMissingField, "content is required")
+		return
+	}
+	if len([]rune(request.Content)) > h.config.Message.MaxContentLength {
+		respondError(c, errTooLong, "content too long")
+		return
+	}
+
+	rooms := request.Rooms
+	if len(rooms) == 0 {
+		rooms = []string{""}
+	}
+
+	ctx := c.Request.Context()
+	messages := make([]*models.Message, 0, len(rooms))
+	for _, roomID := range rooms {
+		message := &models.Message{
+			ID:        generateMessageID(),
+			Type:      models.SystemMessage,
+			Content:   request.Content,
+			Sender:    systemSender,
+			Room:      roomID,
+			Timestamp: time.Now(),
+		}
+		if err := h.redisService.StoreMessage(ctx, message); err != nil {
+			h.logger.WithError(err).Error("Failed to store announcement")
+			respondError(c, errInternal, "Failed to send announcement")
+			return
+		}
+
+		h.publishControl(&models.ControlEvent{Type: models.ControlAnnouncement, Message: message})
+		messages = append(messages, message)
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"rooms": request.Rooms,
+		"by":    currentUser(c),
+	}).Info("Announcement sent")
+
+	c.JSON(http.StatusCreated, gin.H{"messages": messages})
+}
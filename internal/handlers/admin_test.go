@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAdminRouter serves the admin API of a node as an already
+// authenticated admin
+func newAdminRouter(h *SocketIOHandler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/api/admin", func(c *gin.Context) {
+		c.Set(contextUserKey, "root")
+	})
+	admin.GET("/users", h.HandleListOnlineUsers)
+	admin.GET("/nodes", h.HandleListNodes)
+	admin.GET("/rooms/:roomId", h.HandleGetRoom)
+	admin.DELETE("/sessions/:sessionId", h.HandleDisconnectSession)
+	admin.DELETE("/users/:userName/sessions", h.HandleDisconnectUser)
+	admin.PUT("/users/:userName/ban", h.HandleSanctionUser(models.SanctionBan))
+	admin.POST("/announcements", h.HandleAnnounce)
+	return router
+}
+
+// adminRequest sends a request to the admin API and decodes the response
+func adminRequest(t *testing.T, router *gin.Engine, method, path, body string, response interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if response != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s %s: invalid response %s: %v", method, path, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminClusterState(t *testing.T) {
+	h, mr := newTestHandler(t)
+	other := newTestNode(t, mr)
+	router := newAdminRouter(h)
+
+	alice, aliceTablet := dialTestClient(t, newTestServer(t, h)), dialTestClient(t, newTestServer(t, other))
+	bob := dialTestClient(t, newTestServer(t, other))
+	for c, name := range map[*testClient]string{alice: "alice", aliceTablet: "alice", bob: "bob"} {
+		c.join(name)
+		c.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+	}
+	for _, node := range []*SocketIOHandler{h, other} {
+		if err := node.redisService.StoreNodeStatus(t.Context(), node.nodeStatus(), nodeStatusTTL); err != nil {
+			t.Fatalf("failed to store node status: %v", err)
+		}
+	}
+
+	var users struct {
+		Users map[string]struct {
+			DeviceCount int `json:"deviceCount"`
+		} `json:"users"`
+	}
+	if code := adminRequest(t, router, http.MethodGet, "/api/admin/users", "", &users); code != http.StatusOK {
+		t.Fatalf("list users: status %d", code)
+	}
+	counts := map[string]int{}
+	for userName, user := range users.Users {
+		counts[userName] = user.DeviceCount
+	}
+	if counts["alice"] != 2 || counts["bob"] != 1 || len(counts) != 2 {
+		t.Errorf("device counts %v, want alice 2 and bob 1", counts)
+	}
+
+	var nodes struct {
+		Nodes []*models.NodeStatus `json:"nodes"`
+	}
+	if code := adminRequest(t, router, http.MethodGet, "/api/admin/nodes", "", &nodes); code != http.StatusOK {
+		t.Fatalf("list nodes: status %d", code)
+	}
+	sockets := map[string]int{}
+	for _, node := range nodes.Nodes {
+		sockets[node.NodeID] = node.Sockets
+	}
+	if sockets[h.nodeID] != 1 || sockets[other.nodeID] != 2 || len(sockets) != 2 {
+		t.Errorf("sockets per node %v, want 1 on %s and 2 on %s", sockets, h.nodeID, other.nodeID)
+	}
+
+	var room struct {
+		Members []string       `json:"members"`
+		Sockets int            `json:"sockets"`
+		Nodes   map[string]int `json:"nodes"`
+	}
+	if code := adminRequest(t, router, http.MethodGet, "/api/admin/rooms/general", "", &room); code != http.StatusOK {
+		t.Fatalf("get room: status %d", code)
+	}
+	slices.Sort(room.Members)
+	if !slices.Equal(room.Members, []string{"alice", "bob"}) || room.Sockets != 3 || room.Nodes[other.nodeID] != 2 {
+		t.Errorf("room %+v, want alice and bob with 3 sockets, 2 on %s", room, other.nodeID)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	h, mr := newTestHandler(t)
+	other := newTestNode(t, mr)
+	router := newAdminRouter(h)
+	endpoint := newTestServer(t, other)
+
+	// The sessions are held by another node than the one serving the API
+	phone, laptop, bob := dialTestClient(t, endpoint), dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+	phone.join("alice")
+	laptop.join("alice")
+	bob.join("bob")
+	phoneID, _ := phone.currentSession()
+
+	disconnected := func(c *testClient) {
+		t.Helper()
+		var event struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(c.waitEvent(string(models.EventForceDisconnect)), &event); err != nil {
+			t.Fatalf("invalid force_disconnect: %v", err)
+		}
+		if event.Reason != "disconnected_by_admin" {
+			t.Errorf("disconnected because of %q", event.Reason)
+		}
+	}
+
+	if code := adminRequest(t, router, http.MethodDelete, "/api/admin/sessions/"+phoneID, "", nil); code != http.StatusOK {
+		t.Fatalf("disconnect session: status %d", code)
+	}
+	disconnected(phone)
+	laptop.expectNoEvent(string(models.EventForceDisconnect), 100*time.Millisecond)
+
+	if code := adminRequest(t, router, http.MethodDelete, "/api/admin/users/alice/sessions", "", nil); code != http.StatusOK {
+		t.Fatalf("disconnect user: status %d", code)
+	}
+	disconnected(laptop)
+	bob.expectNoEvent(string(models.EventForceDisconnect), 100*time.Millisecond)
+}
+
+func TestAdminBan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, mr := newTestHandler(t)
+	other := newTestNode(t, mr)
+	router := newAdminRouter(h)
+	endpoint := newTestServer(t, other)
+	addTestMembers(t, h, "general", "alice")
+
+	phone, laptop, bob := dialTestClient(t, endpoint), dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+	phoneToken := joinDevice(t, phone, "alice", "mobile")
+	laptopToken := joinDevice(t, laptop, "alice", "desktop")
+	bobToken := joinDevice(t, bob, "bob", "desktop")
+
+	if code := adminRequest(t, router, http.MethodPut, "/api/admin/users/alice/ban", "", nil); code != http.StatusOK {
+		t.Fatalf("ban: status %d", code)
+	}
+	phone.waitEvent(string(models.EventForceDisconnect))
+	laptop.waitEvent(string(models.EventForceDisconnect))
+	bob.expectNoEvent(string(models.EventForceDisconnect), 100*time.Millisecond)
+
+	// The tokens of the banned user's devices are refused by the REST API
+	me := gin.New()
+	me.GET("/me", other.RequireAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, currentUser(c))
+	})
+	tokens := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "phone", token: phoneToken, status: http.StatusUnauthorized},
+		{name: "laptop", token: laptopToken, status: http.StatusUnauthorized},
+		{name: "other user", token: bobToken, status: http.StatusOK},
+	}
+	for _, tt := range tokens {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		me.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s token: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// Nor can the token of a session that was no longer connected be used
+	// to post files
+	if code := httpUpload(t, h, map[string]interface{}{"roomId": "general"}, []byte("quarterly numbers")); code != errForbidden.Code {
+		t.Errorf("upload by a banned user: got %q, want %s", code, errForbidden.Code)
+	}
+}
+
+func TestAdminAnnounce(t *testing.T) {
+	h, mr := newTestHandler(t)
+	other := newTestNode(t, mr)
+	router := newAdminRouter(h)
+
+	alice, bob := dialTestClient(t, newTestServer(t, h)), dialTestClient(t, newTestServer(t, other))
+	alice.join("alice")
+	alice.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+	bob.join("bob")
+
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		code      string
+		receivers []*testClient
+		others    []*testClient
+	}{
+		{name: "invalid body", body: `{"content":`, status: http.StatusBadRequest, code: errInvalidPayload.Code},
+		{name: "no content", body: `{"rooms":["general"]}`, status: http.StatusBadRequest, code: errMissingField.Code},
+		{name: "content too long", body: `{"content":"` + strings.Repeat("x", h.config.Message.MaxContentLength+1) + `"}`,
+			status: http.StatusBadRequest, code: errTooLong.Code},
+		{name: "room", body: `{"content":"maintenance tonight","rooms":["general"]}`, status: http.StatusCreated,
+			receivers: []*testClient{alice}, others: []*testClient{bob}},
+		{name: "everyone", body: `{"content":"maintenance tonight"}`, status: http.StatusCreated,
+			receivers: []*testClient{alice, bob}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response struct {
+				Messages []*models.Message `json:"messages"`
+				Error    errorPayload      `json:"error"`
+			}
+			if status := adminRequest(t, router, http.MethodPost, "/api/admin/announcements", tt.body, &response); status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			if response.Error.Code != tt.code {
+				t.Errorf("error %q, want %q", response.Error.Code, tt.code)
+			}
+
+			for _, c := range tt.receivers {
+				var message models.Message
+				if err := json.Unmarshal(c.waitEvent("message"), &message); err != nil {
+					t.Fatalf("invalid message: %v", err)
+				}
+				if message.Type != models.SystemMessage || message.Sender != systemSender || message.Content != "maintenance tonight" {
+					t.Errorf("got %+v, want a system announcement", message)
+				}
+			}
+			for _, c := range tt.others {
+				c.expectNoEvent("message", 100*time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"slices"
+	"strings"
+
+	"im-demo/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextUserKey is the gin context key holding the authenticated user name
+const contextUserKey = "userName"
+
+// RequireAuth is a gin middleware that rejects requests without a valid
+// session token. Tokens are handed out in the "joined" event.
+func (h *SocketIOHandler) RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := h.authenticate(c)
+		if err != nil {
+			respondError(c, errUnauthorized, "Authentication required")
+			return
+		}
+
+		c.Set(contextUserKey, claims.UserName)
+		c.Next()
+	}
+}
+
+// adminKeyHeader carries the admin API key
+const adminKeyHeader = "X-Admin-Key"
+
+// RequireAdmin is a gin middleware that only lets configured moderation
+// admins through. Session tokens are issued on join without a credential,
+// so a token alone does not make anyone an admin: requests must present a
+// TLS client certificate, verified against the client CA, whose common name
+// is an admin, or the admin key together with an admin's session token.
+func (h *SocketIOHandler) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userName, ok := verifiedClientName(c)
+		if !ok {
+			if !h.validAdminKey(c.GetHeader(adminKeyHeader)) {
+				respondError(c, errUnauthorized, "Admin credentials required")
+				return
+			}
+			claims, err := h.authenticate(c)
+			if err != nil {
+				respondError(c, errUnauthorized, "Authentication required")
+				return
+			}
+			userName = claims.UserName
+		}
+
+		if !slices.Contains(h.config.Moderation.Admins, userName) {
+			respondError(c, errForbidden, "Admin access required")
+			return
+		}
+
+		c.Set(contextUserKey, userName)
+		c.Next()
+	}
+}
+
+// validAdminKey compares a key with the configured admin key in constant time
+func (h *SocketIOHandler) validAdminKey(key string) bool {
+	adminKey := h.config.Auth.AdminKey
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+// verifiedClientName returns the common name of the client certificate of a
+// request, if the TLS handshake verified it against the client CA
+func verifiedClientName(c *gin.Context) (string, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// authenticate verifies the bearer token of a request
+func (h *SocketIOHandler) authenticate(c *gin.Context) (*services.TokenClaims, error) {
+	header := c.GetHeader("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return nil, services.ErrInvalidToken
+	}
+
+	claims, err := h.auth.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens of devices signed out from another device stay valid until
+	// they expire, so they are checked against the revocation list
+	revoked, err := h.redisService.IsSessionRevoked(c.Request.Context(), claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, services.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// currentUser returns the user name set by RequireAuth
+func currentUser(c *gin.Context) string {
+	return c.GetString(contextUserKey)
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"im-demo/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientCertificate returns connection state with a client certificate for
+// name, verified against the client CA or not
+func clientCertificate(name string, verified bool) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		state.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return state
+}
+
+func TestRequireAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Auth.AdminKey = "s3cret"
+		cfg.Moderation.Admins = []string{"root"}
+	})
+
+	token := func(userName string) string {
+		token, err := h.auth.IssueToken(userName, "sid-"+userName)
+		if err != nil {
+			t.Fatalf("failed to issue token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		key    string
+		tls    *tls.ConnectionState
+		status int
+		user   string
+	}{
+		{name: "nothing", status: http.StatusUnauthorized},
+		// Anyone can join as "root" and get a token
+		{name: "admin token alone", token: token("root"), status: http.StatusUnauthorized},
+		{name: "wrong key", token: token("root"), key: "guess", status: http.StatusUnauthorized},
+		{name: "key alone", key: "s3cret", status: http.StatusUnauthorized},
+		{name: "key and user token", token: token("alice"), key: "s3cret", status: http.StatusForbidden},
+		{name: "key and admin token", token: token("root"), key: "s3cret", status: http.StatusOK, user: "root"},
+		{name: "admin certificate", tls: clientCertificate("root", true), status: http.StatusOK, user: "root"},
+		{name: "user certificate", tls: clientCertificate("alice", true), status: http.StatusForbidden},
+		{name: "unverified certificate", tls: clientCertificate("root", false), status: http.StatusUnauthorized},
+		// The certificate names the admin; a token cannot change that
+		{name: "certificate wins over token", tls: clientCertificate("root", true), token: token("alice"), status: http.StatusOK, user: "root"},
+	}
+
+	router := gin.New()
+	router.GET("/api/admin/whoami", h.RequireAdmin(), func(c *gin.Context) {
+		c.String(http.StatusOK, currentUser(c))
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/whoami", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.key != "" {
+				req.Header.Set(adminKeyHeader, tt.key)
+			}
+			req.TLS = tt.tls
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.user != "" && w.Body.String() != tt.user {
+				t.Errorf("user = %q, want %q", w.Body, tt.user)
+			}
+		})
+	}
+}
+
+func TestRequireAdminWithoutKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Moderation.Admins = []string{"root"}
+	})
+	token, err := h.auth.IssueToken("root", "sid-root")
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+
+	router := gin.New()
+	router.GET("/api/admin/reports", h.RequireAdmin(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	// An empty key must not match an empty header
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/reports", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(adminKeyHeader, "")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+const (
+	// nodeHeartbeatInterval is how often a node refreshes its status
+	nodeHeartbeatInterval = 10 * time.Second
+	// nodeStatusTTL is how long a node is considered alive after a heartbeat
+	nodeStatusTTL = 3 * nodeHeartbeatInterval
+	// activityInterval is how stale the last activity in the registry may be
+	activityInterval = time.Minute
+)
+
+// registerSession adds a joined device to the cluster-wide session
+// registry, or refreshes its entry
+func (h *SocketIOHandler) registerSession(ctx context.Context, info *models.SessionInfo) {
+	if err := h.redisService.RegisterSession(ctx, info); err != nil {
+		h.logger.WithError(err).Warn("Failed to register session")
+	}
+}
+
+// recordActivity notes that a session sent an event. The registry is only
+// updated once per activityInterval to keep Redis writes down.
+func (h *SocketIOHandler) recordActivity(sessionID string) {
+	now := time.Now()
+
+	h.mu.Lock()
+	user, ok := h.sessions[sessionID]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	stale := now.Sub(user.LastSeen) >= activityInterval
+	idle := now.Sub(user.LastSeen) >= h.config.Presence.IdleTimeout
+	user.LastSeen = now
+	info := h.sessionInfo(user, sessionID)
+	h.mu.Unlock()
+
+	if stale {
+		ctx := context.Background()
+		h.registerSession(ctx, info)
+		// Users who turned away while idle are available again
+		if idle {
+			h.updatePresence(ctx, info.UserName)
+		}
+	}
+}
+
+// sessionInfo describes a local session for the registry; callers hold h.mu
+func (h *SocketIOHandler) sessionInfo(user *models.User, sessionID string) *models.SessionInfo {
+	deviceInfo, _ := user.Metadata["deviceInfo"].(string)
+	deviceType, _ := user.Metadata["deviceType"].(string)
+	connectedAt, _ := user.Metadata["connectedAt"].(time.Time)
+	return &models.SessionInfo{
+		SessionID:    sessionID,
+		UserName:     user.ID,
+		DeviceInfo:   deviceInfo,
+		DeviceType:   deviceType,
+		NodeID:       h.nodeID,
+		ConnectedAt:  connectedAt,
+		LastActiveAt: user.LastSeen,
+	}
+}
+
+// runHeartbeat periodically publishes this node's status
+func (h *SocketIOHandler) runHeartbeat() {
+	ticker := time.NewTicker(nodeHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.redisService.StoreNodeStatus(context.Background(), h.nodeStatus(), nodeStatusTTL); err != nil {
+			h.logger.WithError(err).Warn("Failed to store node status")
+		}
+		<-ticker.C
+	}
+}
+
+// nodeStatus reports the sockets and rooms of this node
+func (h *SocketIOHandler) nodeStatus() *models.NodeStatus {
+	namespace := h.server.Sockets()
+	sockets := namespace.Sockets()
+
+	rooms := make(map[string]int)
+	adapterRooms := namespace.Adapter().Rooms()
+	for _, room := range adapterRooms.Keys() {
+		// Every socket is in a private room named after it
+		if _, ok := sockets.Load(socket.SocketId(room)); ok {
+			continue
+		}
+		if members, ok := adapterRooms.Load(room); ok {
+			rooms[string(room)] = members.Len()
+		}
+	}
+
+	return &models.NodeStatus{
+		NodeID:    h.nodeID,
+		StartedAt: h.startedAt,
+		UpdatedAt: time.Now(),
+		Sockets:   sockets.Len(),
+		Rooms:     rooms,
+	}
+}
+
+// GetOnlineUsers returns information about online users and their devices
+// on every node of the cluster
+func (h *SocketIOHandler) GetOnlineUsers(ctx context.Context) (map[string]interface{}, error) {
+	sessions, err := h.redisService.GetClusterSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string][]map[string]interface{})
+	for _, session := range sessions {
+		devices[session.UserName] = append(devices[session.UserName], map[string]interface{}{
+			"sessionId":    session.SessionID,
+			"deviceInfo":   session.DeviceInfo,
+			"nodeId":       session.NodeID,
+			"connectedAt":  session.ConnectedAt,
+			"lastActiveAt": session.LastActiveAt,
+		})
+	}
+
+	users := make(map[string]interface{}, len(devices))
+	for userName, userDevices := range devices {
+		users[userName] = map[string]interface{}{
+			"deviceCount": len(userDevices),
+			"devices":     userDevices,
+			"status":      "online",
+		}
+	}
+
+	return users, nil
+}
+
+// disconnectSessions disconnects local sessions after telling them why
+func (h *SocketIOHandler) disconnectSessions(sessionIDs []string, reason string) {
+	for _, sessionID := range sessionIDs {
+		room := socket.Room(sessionID)
+		h.server.To(room).Emit(string(models.EventForceDisconnect), map[string]interface{}{
+			"reason": reason,
+		})
+		h.server.In(room).DisconnectSockets(true)
+	}
+}
+
+// revokeSessions revokes the tokens of sessions so that they are refused by
+// the REST API for the rest of their lifetime
+func (h *SocketIOHandler) revokeSessions(sessionIDs []string) {
+	ctx := context.Background()
+	for _, sessionID := range sessionIDs {
+		if err := h.redisService.RevokeSession(ctx, sessionID, h.config.Auth.TokenTTL); err != nil {
+			h.logger.WithError(err).WithField("session_id", sessionID).Error("Failed to revoke session")
+		}
+	}
+}
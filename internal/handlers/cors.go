@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"im-demo/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zishang520/socket.io/v3/pkg/types"
+)
+
+const (
+	// corsMethods are the methods browsers may use on the REST API
+	corsMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	// corsHeaders are the request headers browsers may send
+	corsHeaders = "Content-Type, Authorization, X-Request-ID, " + adminKeyHeader
+)
+
+// allowedOrigins parses the comma-separated CORS allow-list. A nil list
+// allows any origin.
+func allowedOrigins(cfg config.SocketIOConfig) []string {
+	var origins []string
+	for _, origin := range strings.Split(cfg.CORSOrigins, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			return nil
+		}
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// CORS lets browsers on the allowed origins call the REST API. Requests
+// from other origins get no CORS headers, so browsers refuse the response.
+func CORS(cfg config.SocketIOConfig) gin.HandlerFunc {
+	origins := allowedOrigins(cfg)
+	return func(c *gin.Context) {
+		if origins == nil {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Add("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); slices.Contains(origins, origin) {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+		}
+		c.Header("Access-Control-Allow-Methods", corsMethods)
+		c.Header("Access-Control-Allow-Headers", corsHeaders)
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID")
+
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// engineCORS applies the same allow-list to the Engine.IO transports
+func engineCORS(cfg config.SocketIOConfig) *types.Cors {
+	origins := allowedOrigins(cfg)
+	if origins == nil {
+		return &types.Cors{Origin: "*", Methods: []string{"GET", "POST"}}
+	}
+
+	allowed := make([]any, len(origins))
+	for i, origin := range origins {
+		allowed[i] = origin
+	}
+	return &types.Cors{Origin: allowed, Methods: []string{"GET", "POST"}}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins string
+		want    []string
+	}{
+		{name: "any", origins: "*", want: nil},
+		{name: "empty", origins: "", want: nil},
+		{name: "list", origins: " https://a.example/, https://b.example ,,", want: []string{"https://a.example", "https://b.example"}},
+		{name: "any in a list", origins: "https://a.example, *", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowedOrigins(config.SocketIOConfig{CORSOrigins: tt.origins}); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		origins string
+		method  string
+		path    string
+		origin  string
+		header  string // request header the preflight asks for
+		status  int
+		allowed string // Access-Control-Allow-Origin, empty for none
+		vary    bool
+	}{
+		{name: "allowed origin", origins: "https://a.example", method: http.MethodGet, origin: "https://a.example",
+			status: http.StatusOK, allowed: "https://a.example", vary: true},
+		{name: "other origin", origins: "https://a.example", method: http.MethodGet, origin: "https://evil.example",
+			status: http.StatusOK, vary: true},
+		{name: "any origin", origins: "*", method: http.MethodGet, origin: "https://evil.example",
+			status: http.StatusOK, allowed: "*"},
+		{name: "preflight", origins: "https://a.example", method: http.MethodOptions, origin: "https://a.example",
+			header: "Authorization", status: http.StatusNoContent, allowed: "https://a.example", vary: true},
+		{name: "admin preflight", origins: "https://a.example", method: http.MethodOptions, path: "/api/admin/users",
+			origin: "https://a.example", header: adminKeyHeader, status: http.StatusNoContent, allowed: "https://a.example", vary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(CORS(config.SocketIOConfig{CORSOrigins: tt.origins}))
+			path := tt.path
+			if path == "" {
+				path = "/api/rooms"
+			}
+			router.Handle(tt.method, path, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(tt.method, path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.header != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowed {
+				t.Errorf("allowed origin %q, want %q", got, tt.allowed)
+			}
+			if vary := slices.Contains(w.Header().Values("Vary"), "Origin"); vary != tt.vary {
+				t.Errorf("varies by origin: %v, want %v", vary, tt.vary)
+			}
+			allowedHeaders := strings.Split(w.Header().Get("Access-Control-Allow-Headers"), ", ")
+			if tt.header != "" && !slices.Contains(allowedHeaders, tt.header) {
+				t.Errorf("allowed headers %v, want %s among them", allowedHeaders, tt.header)
+			}
+		})
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	cfg := config.SocketIOConfig{
+		CORSOrigins:          "https://a.example,https://b.example",
+		PingTimeout:          10 * time.Second,
+		PingInterval:         20 * time.Second,
+		Transports:           []string{"WebSocket", " polling"},
+		MaxHTTPBufferSize:    1 << 20,
+		PerMessageDeflate:    true,
+		CompressionThreshold: 2048,
+	}
+
+	tests := []struct {
+		name       string
+		configure  func(cfg *config.SocketIOConfig)
+		transports []string
+		deflate    bool
+		err        bool
+	}{
+		{name: "configured", transports: []string{"polling", "websocket"}, deflate: true},
+		{name: "without compression", configure: func(cfg *config.SocketIOConfig) { cfg.PerMessageDeflate = false },
+			transports: []string{"polling", "websocket"}},
+		{name: "websocket only", configure: func(cfg *config.SocketIOConfig) { cfg.Transports = []string{"websocket"} },
+			transports: []string{"websocket"}, deflate: true},
+		{name: "unknown transport", configure: func(cfg *config.SocketIOConfig) { cfg.Transports = []string{"carrier-pigeon"} }, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := cfg
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			opts, err := serverOptions(cfg)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if opts.PingTimeout() != cfg.PingTimeout || opts.PingInterval() != cfg.PingInterval {
+				t.Errorf("ping timeout %v and interval %v", opts.PingTimeout(), opts.PingInterval())
+			}
+			if opts.MaxHttpBufferSize() != cfg.MaxHTTPBufferSize {
+				t.Errorf("buffer size %d, want %d", opts.MaxHttpBufferSize(), cfg.MaxHTTPBufferSize)
+			}
+			var transports []string
+			for _, transport := range opts.Transports().Keys() {
+				transports = append(transports, transport.Name())
+			}
+			slices.Sort(transports)
+			if !slices.Equal(transports, tt.transports) {
+				t.Errorf("transports %v, want %v", transports, tt.transports)
+			}
+			if deflate := opts.PerMessageDeflate(); (deflate != nil) != tt.deflate ||
+				deflate != nil && deflate.Threshold != cfg.CompressionThreshold {
+				t.Errorf("per-message deflate %+v, want enabled %v", deflate, tt.deflate)
+			}
+			if cors := opts.Cors(); cors == nil || !reflect.DeepEqual(cors.Origin, []any{"https://a.example", "https://b.example"}) {
+				t.Errorf("cors %+v, want the allow-list", cors)
+			}
+		})
+	}
+}
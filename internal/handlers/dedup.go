@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// blobLockTTL bounds how long a crashed writer can block a blob
+	blobLockTTL = time.Minute
+	// blobLockWait is how long an upload waits for a blob being written elsewhere
+	blobLockWait = 30 * time.Second
+	// blobBatchSize bounds how many blobs are examined per collection
+	blobBatchSize = 100
+)
+
+// contentBlobKey returns the storage key of the blob with the given hash
+func contentBlobKey(hash string) string {
+	return fmt.Sprintf("sha256/%s/%s", hash[:2], hash)
+}
+
+// contentHash returns the hex encoded SHA-256 of an upload. Chunked uploads
+// have already been verified against their checksum.
+func contentHash(upload *models.UploadSession, src io.ReadSeeker) (string, error) {
+	if upload.Checksum != "" {
+		return upload.Checksum, nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// storeDeduplicated stores upload contents under their content hash. If the
+// same contents were uploaded before, the existing blob (and its processed
+// image and thumbnails) is reused instead.
+func (h *SocketIOHandler) storeDeduplicated(ctx context.Context, hash string, metadata *models.FileMetadata, src io.ReadSeeker) (models.MessageType, error) {
+	if stored, err := h.redisService.GetBlob(ctx, hash); err == nil {
+		return reuseBlob(metadata, stored), nil
+	} else if !errors.Is(err, services.ErrBlobNotFound) {
+		return "", err
+	}
+
+	unlock, err := h.lockBlob(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Someone else may have stored it while we waited
+	if stored, err := h.redisService.GetBlob(ctx, hash); err == nil {
+		return reuseBlob(metadata, stored), nil
+	} else if !errors.Is(err, services.ErrBlobNotFound) {
+		return "", err
+	}
+
+	metadata.BlobKey = contentBlobKey(hash)
+	metadata.ContentHash = hash
+
+	messageType, err := h.storeUploadContent(ctx, metadata, src)
+	if err != nil {
+		return "", err
+	}
+
+	// The record describes the contents only; names and URLs are per message
+	stored := *metadata
+	stored.FileName = ""
+	stored.FileURL = ""
+	if err := h.redisService.StoreBlob(ctx, hash, &stored); err != nil {
+		return "", err
+	}
+
+	return messageType, nil
+}
+
+// reuseBlob points an upload's metadata at an already stored blob
+func reuseBlob(metadata, stored *models.FileMetadata) models.MessageType {
+	metadata.FileType = stored.FileType
+	metadata.FileSize = stored.FileSize
+	metadata.BlobKey = stored.BlobKey
+	metadata.ContentHash = stored.ContentHash
+	metadata.Width = stored.Width
+	metadata.Height = stored.Height
+	metadata.Thumbnails = append([]models.Thumbnail(nil), stored.Thumbnails...)
+
+	// Only images that went through the pipeline have dimensions
+	if stored.Width > 0 {
+		return models.ImageMessage
+	}
+	return models.FileMessage
+}
+
+// lockBlob waits for exclusive access to write or collect a blob
+func (h *SocketIOHandler) lockBlob(ctx context.Context, hash string) (func(), error) {
+	deadline := time.Now().Add(blobLockWait)
+	for {
+		token, err := h.redisService.LockBlob(ctx, hash, blobLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			return func() {
+				if err := h.redisService.UnlockBlob(context.Background(), hash, token); err != nil {
+					h.logger.WithError(err).Warn("Failed to unlock blob")
+				}
+			}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for blob %s", hash)
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaseMessageFile drops a message's reference to its attachment. Files
+// uploaded before deduplication are deleted right away.
+func (h *SocketIOHandler) releaseMessageFile(ctx context.Context, message *models.Message) {
+	metadata, err := message.DecodeFileMetadata()
+	if err != nil || metadata.BlobKey == "" {
+		return
+	}
+
+	if metadata.ContentHash == "" {
+		h.deleteBlobFiles(ctx, metadata)
+		return
+	}
+
+	if err := h.redisService.ReleaseBlob(ctx, metadata.ContentHash, message.ID); err != nil {
+		h.logger.WithError(err).WithField("message_id", message.ID).Error("Failed to release file")
+	}
+}
+
+// deleteBlobFiles removes a stored file and its thumbnails
+func (h *SocketIOHandler) deleteBlobFiles(ctx context.Context, metadata *models.FileMetadata) {
+	blobKeys := []string{metadata.BlobKey}
+	for _, thumb := range metadata.Thumbnails {
+		blobKeys = append(blobKeys, thumb.BlobKey)
+	}
+
+	for _, blobKey := range blobKeys {
+		if err := h.blobStore.Delete(ctx, blobKey); err != nil {
+			h.logger.WithError(err).WithField("blob_key", blobKey).Error("Failed to delete file")
+		}
+	}
+}
+
+// runBlobCollector periodically deletes blobs no message refers to anymore
+// and chunked uploads that were abandoned
+func (h *SocketIOHandler) runBlobCollector() {
+	ticker := time.NewTicker(h.config.Upload.GCInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.collectBlobs()
+		h.collectUploads()
+	}
+}
+
+// collectBlobs deletes every unreferenced blob that has been idle for the
+// grace period, which covers uploads whose message is still being created
+func (h *SocketIOHandler) collectBlobs() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-h.config.Upload.GCGrace)
+
+	hashes, err := h.redisService.GetDueBlobs(ctx, cutoff, blobBatchSize)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fetch blobs to collect")
+		return
+	}
+
+	collected := 0
+	for _, hash := range hashes {
+		if h.collectBlob(ctx, hash, cutoff) {
+			collected++
+		}
+	}
+
+	if collected > 0 {
+		h.logger.WithFields(logrus.Fields{
+			"collected": collected,
+			"checked":   len(hashes),
+		}).Info("Collected unreferenced files")
+	}
+}
+
+// collectBlob deletes a single blob if it is unreferenced
+func (h *SocketIOHandler) collectBlob(ctx context.Context, hash string, cutoff time.Time) bool {
+	// Skip blobs that are being written; they are checked again next time
+	token, err := h.redisService.LockBlob(ctx, hash, blobLockTTL)
+	if err != nil || token == "" {
+		return false
+	}
+	defer h.redisService.UnlockBlob(ctx, hash, token)
+
+	metadata, err := h.redisService.ClaimBlob(ctx, hash, cutoff)
+	if err != nil {
+		h.logger.WithError(err).WithField("content_hash", hash).Error("Failed to claim blob")
+		return false
+	}
+	if metadata == nil {
+		return false
+	}
+
+	if metadata.BlobKey == "" {
+		metadata.BlobKey = contentBlobKey(hash)
+	}
+	h.deleteBlobFiles(ctx, metadata)
+	return true
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+)
+
+// storedFiles lists the files in a handler's local blob store
+func storedFiles(t *testing.T, h *SocketIOHandler) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(h.config.Upload.UploadDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to list files: %v", err)
+	}
+	return files
+}
+
+// publishTestFile uploads content as sender and returns the message sent
+func publishTestFile(t *testing.T, h *SocketIOHandler, sender, fileName string, content []byte) (*models.Message, *models.FileMetadata) {
+	t.Helper()
+	addTestMembers(t, h, "general", sender)
+	upload := &models.UploadSession{Sender: sender, Room: "general", FileName: fileName, FileSize: int64(len(content))}
+	message, eventErr := h.publishUpload(t.Context(), upload, bytes.NewReader(content))
+	if eventErr != nil {
+		t.Fatalf("failed to publish %s: %v", fileName, eventErr)
+	}
+	metadata, err := message.DecodeFileMetadata()
+	if err != nil {
+		t.Fatalf("invalid file metadata: %v", err)
+	}
+	return message, metadata
+}
+
+// testPNG encodes a size x size image
+func testPNG(t *testing.T, size int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < size; i++ {
+		img.SetNRGBA(i, i, color.NRGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStoreDeduplicatedReusesBlobs(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		wantType models.MessageType
+		files    int // blob plus thumbnails
+	}{
+		{name: "file", content: []byte("quarterly numbers"), wantType: models.FileMessage, files: 1},
+		{name: "image", content: testPNG(t, 200), wantType: models.ImageMessage, files: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mr := newTestHandler(t, func(cfg *config.Config) {
+				cfg.Upload.Image.ThumbnailSizes = []int{160}
+			})
+
+			first, original := publishTestFile(t, h, "alice", "a", tt.content)
+			second, copied := publishTestFile(t, h, "bob", "b", tt.content)
+
+			if first.Type != tt.wantType || second.Type != tt.wantType {
+				t.Errorf("got types %s and %s, want %s", first.Type, second.Type, tt.wantType)
+			}
+			if copied.BlobKey != original.BlobKey || copied.ContentHash != original.ContentHash {
+				t.Errorf("second upload stored separately: %+v", copied)
+			}
+			if copied.FileName != "b" || copied.Width != original.Width || len(copied.Thumbnails) != len(original.Thumbnails) {
+				t.Errorf("reused metadata differs: %+v, want %+v", copied, original)
+			}
+			if files := storedFiles(t, h); len(files) != tt.files {
+				t.Errorf("stored %v, want %d files", files, tt.files)
+			}
+
+			refs, _ := mr.ZMembers("blob_refs:" + original.ContentHash)
+			if len(refs) != 2 {
+				t.Errorf("got references %v, want both messages", refs)
+			}
+		})
+	}
+}
+
+func TestCollectBlobs(t *testing.T) {
+	h, mr := newTestHandler(t, func(cfg *config.Config) {
+		// Every blob is past its grace period
+		cfg.Upload.GCGrace = -time.Hour
+	})
+	ctx := t.Context()
+
+	first, metadata := publishTestFile(t, h, "alice", "a", []byte("quarterly numbers"))
+	second, _ := publishTestFile(t, h, "bob", "b", []byte("quarterly numbers"))
+	hash := metadata.ContentHash
+
+	steps := []struct {
+		name    string
+		action  func()
+		removed bool
+	}{
+		{name: "referenced", action: func() {}},
+		{name: "one reference left", action: func() { h.releaseMessageFile(ctx, first) }},
+		{name: "locked", action: func() {
+			h.releaseMessageFile(ctx, second)
+			mr.Set("blob_lock:"+hash, "1")
+		}},
+		{name: "unreferenced", action: func() { mr.Del("blob_lock:" + hash) }, removed: true},
+	}
+	for _, step := range steps {
+		step.action()
+		h.collectBlobs()
+
+		if removed := len(storedFiles(t, h)) == 0; removed != step.removed {
+			t.Fatalf("%s: file removed %v, want %v", step.name, removed, step.removed)
+		}
+		if mr.Exists("blob:"+hash) == step.removed {
+			t.Fatalf("%s: blob record present %v", step.name, !step.removed)
+		}
+	}
+
+	// New uploads of the same contents are stored again
+	_, again := publishTestFile(t, h, "alice", "c", []byte("quarterly numbers"))
+	if again.BlobKey != metadata.BlobKey || len(storedFiles(t, h)) != 1 {
+		t.Errorf("re-upload not stored: %+v", again)
+	}
+}
+
+func TestReleaseMessageFileWithoutHash(t *testing.T) {
+	h, _ := newTestHandler(t)
+	ctx := t.Context()
+
+	// Files uploaded before deduplication are not shared
+	if err := h.blobStore.Put(ctx, "legacy.txt", bytes.NewReader([]byte("old")), 3, "text/plain"); err != nil {
+		t.Fatalf("failed to store file: %v", err)
+	}
+	message := &models.Message{ID: "1", Type: models.FileMessage, Metadata: &models.FileMetadata{BlobKey: "legacy.txt"}}
+
+	h.releaseMessageFile(ctx, message)
+	if files := storedFiles(t, h); len(files) != 0 {
+		t.Errorf("legacy file kept: %v", files)
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+const (
+	// revokeReason is sent to devices signed out from another device
+	revokeReason = "revoked"
+	// evictReason is sent to devices signed out to respect the device limits
+	evictReason = "device_limit"
+
+	// Device policies for logins beyond a device limit
+	devicePolicyReject      = "reject"
+	devicePolicyEvictOldest = "evict_oldest"
+
+	// deviceLockTTL bounds how long a crashed node can block logins of a user
+	deviceLockTTL = 10 * time.Second
+	// deviceLockWait bounds how long a login waits for another one to finish
+	deviceLockWait = 3 * time.Second
+)
+
+// handleListDevices sends the user the devices they are connected with on
+// any node, including the current one
+func (h *SocketIOHandler) handleListDevices(client *socket.Socket) error {
+	sessionID := string(client.Id())
+	user, ok := h.sessionUser(sessionID)
+	if !ok {
+		return newEventError(errUnauthorized, "Join before listing devices")
+	}
+
+	devices, err := h.userDevices(context.Background(), user.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list devices")
+		return newEventError(errInternal, "Failed to list devices")
+	}
+
+	client.Emit(string(models.EventDevices), map[string]interface{}{
+		"devices":          devices,
+		"currentSessionId": sessionID,
+	})
+	return nil
+}
+
+// handleRevokeDevice signs out another device of the user: it is
+// disconnected on whichever node holds it, the REST API refuses the tokens
+// issued to that session, and the user's other devices are told. Joining
+// needs no credential, so this ends the device's session but does not stop
+// it from joining again.
+func (h *SocketIOHandler) handleRevokeDevice(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	targetID, _ := data["sessionId"].(string)
+
+	sessionID := string(client.Id())
+	user, ok := h.sessionUser(sessionID)
+	if !ok {
+		return newEventError(errUnauthorized, "Join before managing devices")
+	}
+	if targetID == sessionID {
+		return newEventError(errInvalidValue, "Use disconnect to sign out the current device")
+	}
+
+	ctx := context.Background()
+	devices, err := h.userDevices(ctx, user.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list devices")
+		return newEventError(errInternal, "Failed to revoke device")
+	}
+
+	var target *models.SessionInfo
+	for _, device := range devices {
+		if device.SessionID == targetID {
+			target = device
+			break
+		}
+	}
+	// Sessions of other users are reported as missing too
+	if target == nil {
+		return newEventError(errNotFound, "Device not found").withDetail("sessionId", targetID)
+	}
+
+	if err := h.redisService.RevokeSession(ctx, targetID, h.config.Auth.TokenTTL); err != nil {
+		h.logger.WithError(err).Error("Failed to revoke session")
+		return newEventError(errInternal, "Failed to revoke device")
+	}
+	if err := h.redisService.UnregisterSession(ctx, target.NodeID, targetID); err != nil {
+		h.logger.WithError(err).Warn("Failed to unregister session")
+	}
+
+	h.publishControl(&models.ControlEvent{
+		Type:      models.ControlDeviceRevoked,
+		SessionID: targetID,
+		UserName:  user.ID,
+		Reason:    revokeReason,
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name":       user.ID,
+		"session_id":      sessionID,
+		"revoked_session": targetID,
+		"device_info":     target.DeviceInfo,
+	}).Info("Device revoked")
+
+	return nil
+}
+
+// userDevices returns the sessions of a user on every node
+func (h *SocketIOHandler) userDevices(ctx context.Context, userName string) ([]*models.SessionInfo, error) {
+	sessions, err := h.redisService.GetClusterSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*models.SessionInfo, 0)
+	for _, session := range sessions {
+		if session.UserName == userName {
+			devices = append(devices, session)
+		}
+	}
+	return devices, nil
+}
+
+// admitDevice registers a joining device in the session registry. When the
+// device would exceed the user's device limits, it is refused or the oldest
+// devices are signed out to make room, depending on the device policy.
+func (h *SocketIOHandler) admitDevice(ctx context.Context, info *models.SessionInfo) error {
+	limits := h.config.Devices
+	if limits.MaxPerUser == 0 && limits.MaxPerType[info.DeviceType] == 0 {
+		h.registerSession(ctx, info)
+		return nil
+	}
+
+	// Like rate limits, device limits are not enforced while Redis is
+	// unavailable
+	unlock, err := h.lockUserDevices(ctx, info.UserName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to lock user devices")
+		h.registerSession(ctx, info)
+		return nil
+	}
+	defer unlock()
+
+	devices, err := h.userDevices(ctx, info.UserName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to list devices")
+		h.registerSession(ctx, info)
+		return nil
+	}
+
+	evicted := h.devicesOverLimit(devices, info)
+	if len(evicted) > 0 {
+		if limits.Policy == devicePolicyReject {
+			err := newEventError(errConflict, "Too many devices signed in").withDetail("deviceType", info.DeviceType)
+			if limits.MaxPerUser > 0 {
+				err.withDetail("maxDevices", limits.MaxPerUser)
+			}
+			if limit := limits.MaxPerType[info.DeviceType]; limit > 0 {
+				err.withDetail("maxDevicesOfType", limit)
+			}
+			return err
+		}
+
+		for _, device := range evicted {
+			h.evictDevice(ctx, device)
+		}
+	}
+
+	h.registerSession(ctx, info)
+	return nil
+}
+
+// devicesOverLimit returns the oldest devices that must go for a new device
+// to fit within the limits for its type and for the user
+func (h *SocketIOHandler) devicesOverLimit(devices []*models.SessionInfo, info *models.SessionInfo) []*models.SessionInfo {
+	limits := h.config.Devices
+
+	// A socket that joins again replaces its own entry
+	others := slices.DeleteFunc(slices.Clone(devices), func(device *models.SessionInfo) bool {
+		return device.SessionID == info.SessionID
+	})
+	slices.SortFunc(others, func(a, b *models.SessionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	var evicted []*models.SessionInfo
+	if limit := limits.MaxPerType[info.DeviceType]; limit > 0 {
+		var sameType []*models.SessionInfo
+		for _, device := range others {
+			if device.DeviceType == info.DeviceType {
+				sameType = append(sameType, device)
+			}
+		}
+		if excess := len(sameType) + 1 - limit; excess > 0 {
+			evicted = append(evicted, sameType[:excess]...)
+		}
+	}
+
+	if limit := limits.MaxPerUser; limit > 0 {
+		remaining := slices.DeleteFunc(others, func(device *models.SessionInfo) bool {
+			return slices.Contains(evicted, device)
+		})
+		if excess := len(remaining) + 1 - limit; excess > 0 {
+			evicted = append(evicted, remaining[:excess]...)
+		}
+	}
+	return evicted
+}
+
+// evictDevice signs out a device on whichever node holds it, like a device
+// revoked by its user
+func (h *SocketIOHandler) evictDevice(ctx context.Context, device *models.SessionInfo) {
+	if err := h.redisService.RevokeSession(ctx, device.SessionID, h.config.Auth.TokenTTL); err != nil {
+		h.logger.WithError(err).Warn("Failed to revoke session")
+	}
+	if err := h.redisService.UnregisterSession(ctx, device.NodeID, device.SessionID); err != nil {
+		h.logger.WithError(err).Warn("Failed to unregister session")
+	}
+
+	h.publishControl(&models.ControlEvent{
+		Type:      models.ControlSessionEvicted,
+		SessionID: device.SessionID,
+		UserName:  device.UserName,
+		Reason:    evictReason,
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name":   device.UserName,
+		"session_id":  device.SessionID,
+		"device_type": device.DeviceType,
+	}).Info("Device evicted")
+}
+
+// lockUserDevices waits for exclusive access to the devices of a user
+func (h *SocketIOHandler) lockUserDevices(ctx context.Context, userName string) (func(), error) {
+	deadline := time.Now().Add(deviceLockWait)
+	for {
+		token, err := h.redisService.LockUserDevices(ctx, userName, deviceLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			return func() {
+				if err := h.redisService.UnlockUserDevices(context.Background(), userName, token); err != nil {
+					h.logger.WithError(err).Warn("Failed to unlock user devices")
+				}
+			}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for devices of %s", userName)
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// joinDevice joins as userName from a device of the given type and returns
+// the session token
+func joinDevice(t *testing.T, c *testClient, userName, deviceType string) string {
+	t.Helper()
+	c.emitOK("join", map[string]interface{}{"userName": userName, "deviceType": deviceType})
+	var joined struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(c.waitEvent("joined"), &joined); err != nil {
+		t.Fatalf("invalid joined event: %v", err)
+	}
+	return joined.Token
+}
+
+func TestRevokeDevice(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t)
+	endpoint := newTestServer(t, h)
+
+	phone, laptop, other := dialTestClient(t, endpoint), dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+	phoneToken := joinDevice(t, phone, "alice", "mobile")
+	laptopToken := joinDevice(t, laptop, "alice", "desktop")
+	joinDevice(t, other, "bob", "desktop")
+
+	phoneID, _ := phone.currentSession()
+	otherID, _ := other.currentSession()
+	laptopID, devices := laptop.currentSession()
+	if len(devices) != 2 {
+		t.Fatalf("listed %d devices, want 2", len(devices))
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		code   string
+	}{
+		{name: "current device", target: laptopID, code: errInvalidValue.Code},
+		{name: "another user's device", target: otherID, code: errNotFound.Code},
+		{name: "unknown device", target: "missing", code: errNotFound.Code},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(laptop.emit("revoke_device", map[string]interface{}{"sessionId": tt.target})); code != tt.code {
+				t.Errorf("got %q, want %s", code, tt.code)
+			}
+		})
+	}
+
+	laptop.emitOK("revoke_device", map[string]interface{}{"sessionId": phoneID})
+	phone.waitEvent(string(models.EventForceDisconnect))
+	var revoked struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.Unmarshal(laptop.waitEvent(string(models.EventDeviceRevoked)), &revoked); err != nil {
+		t.Fatalf("invalid device_revoked event: %v", err)
+	}
+	if revoked.SessionID != phoneID {
+		t.Errorf("device_revoked for %q, want %q", revoked.SessionID, phoneID)
+	}
+	if _, devices := laptop.currentSession(); len(devices) != 1 || devices[0].SessionID != laptopID {
+		t.Errorf("devices after revoking: %+v", devices)
+	}
+
+	// The revoked session's token is refused; the others still work
+	router := gin.New()
+	router.GET("/me", h.RequireAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, currentUser(c))
+	})
+	tokens := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "revoked", token: phoneToken, status: http.StatusUnauthorized},
+		{name: "other device", token: laptopToken, status: http.StatusOK},
+	}
+	for _, tt := range tokens {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s token: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// Joining needs no credential, so the device can sign in again as a new
+	// session
+	again := dialTestClient(t, endpoint)
+	joinDevice(t, again, "alice", "mobile")
+	if _, devices := again.currentSession(); len(devices) != 2 {
+		t.Errorf("listed %d devices after joining again, want 2", len(devices))
+	}
+}
+
+func TestDevicesOverLimit(t *testing.T) {
+	h, _ := newTestHandler(t)
+	start := time.Now()
+	device := func(sessionID, deviceType string, age int) *models.SessionInfo {
+		return &models.SessionInfo{SessionID: sessionID, DeviceType: deviceType, ConnectedAt: start.Add(-time.Duration(age) * time.Minute)}
+	}
+	devices := []*models.SessionInfo{
+		device("phone-new", "mobile", 1),
+		device("laptop", "desktop", 5),
+		device("phone-old", "mobile", 10),
+		device("tablet", "tablet", 3),
+	}
+
+	tests := []struct {
+		name    string
+		limits  config.DevicesConfig
+		joining *models.SessionInfo
+		evicted []string
+	}{
+		{name: "no limits", joining: device("new", "mobile", 0)},
+		{name: "within user limit", limits: config.DevicesConfig{MaxPerUser: 5}, joining: device("new", "mobile", 0)},
+		{name: "over user limit", limits: config.DevicesConfig{MaxPerUser: 3}, joining: device("new", "desktop", 0),
+			evicted: []string{"phone-old", "laptop"}},
+		{name: "over type limit", limits: config.DevicesConfig{MaxPerType: map[string]int{"mobile": 2}}, joining: device("new", "mobile", 0),
+			evicted: []string{"phone-old"}},
+		{name: "type limit of another type", limits: config.DevicesConfig{MaxPerType: map[string]int{"mobile": 1}}, joining: device("new", "desktop", 0)},
+		{name: "both limits", limits: config.DevicesConfig{MaxPerUser: 3, MaxPerType: map[string]int{"mobile": 1}}, joining: device("new", "mobile", 0),
+			evicted: []string{"phone-old", "phone-new"}},
+		{name: "type eviction makes room", limits: config.DevicesConfig{MaxPerUser: 4, MaxPerType: map[string]int{"mobile": 2}}, joining: device("new", "mobile", 0),
+			evicted: []string{"phone-old"}},
+		{name: "joining again", limits: config.DevicesConfig{MaxPerUser: 4}, joining: device("tablet", "tablet", 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.config.Devices = tt.limits
+			var evicted []string
+			for _, device := range h.devicesOverLimit(devices, tt.joining) {
+				evicted = append(evicted, device.SessionID)
+			}
+			if !slices.Equal(evicted, tt.evicted) {
+				t.Errorf("evicted %v, want %v", evicted, tt.evicted)
+			}
+		})
+	}
+}
+
+func TestDevicePolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		code   string // error joining the third device
+	}{
+		{policy: devicePolicyReject, code: errConflict.Code},
+		{policy: devicePolicyEvictOldest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h, _ := newTestHandler(t, func(cfg *config.Config) {
+				cfg.Devices = config.DevicesConfig{MaxPerUser: 2, Policy: tt.policy}
+			})
+			endpoint := newTestServer(t, h)
+
+			first, second := dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+			joinDevice(t, first, "alice", "mobile")
+			joinDevice(t, second, "alice", "desktop")
+
+			third := dialTestClient(t, endpoint)
+			reply := third.emit("join", map[string]interface{}{"userName": "alice", "deviceType": "tablet"})
+			if tt.code != "" {
+				if code := errorCode(reply); code != tt.code {
+					t.Fatalf("got %q, want %s", code, tt.code)
+				}
+				if _, devices := second.currentSession(); len(devices) != 2 {
+					t.Errorf("listed %d devices, want 2", len(devices))
+				}
+				return
+			}
+
+			if reply["ok"] != true {
+				t.Fatalf("join failed: %v", reply["error"])
+			}
+			third.waitEvent("joined")
+			var evicted struct {
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(first.waitEvent(string(models.EventSessionEvicted)), &evicted); err != nil {
+				t.Fatalf("invalid session_evicted event: %v", err)
+			}
+			if evicted.Reason != evictReason {
+				t.Errorf("evicted because of %q, want %s", evicted.Reason, evictReason)
+			}
+			_, devices := third.currentSession()
+			var types []string
+			for _, device := range devices {
+				types = append(types, device.DeviceType)
+			}
+			slices.Sort(types)
+			if !slices.Equal(types, []string{"desktop", "tablet"}) {
+				t.Errorf("devices %v, want desktop and tablet", types)
+			}
+		})
+	}
+}
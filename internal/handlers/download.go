@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// remoteRedirectTTL is how long redirect URLs to remote blob stores stay valid
+const remoteRedirectTTL = time.Minute
+
+// inlineContentTypes are served inline; everything else is forced to download
+var inlineContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"text/plain": true,
+}
+
+// fileResource names the signed resource for a message's attachment
+func fileResource(messageID string) string {
+	return "file:" + messageID
+}
+
+// signedFileURL returns a short-lived download URL for a message's attachment.
+// A non-zero thumbSize selects one of the image's thumbnails; the signature
+// covers the message, so it is valid for every variant of its file.
+func (h *SocketIOHandler) signedFileURL(messageID string, thumbSize int) string {
+	expiresAt := time.Now().Add(h.config.Upload.DownloadTTL)
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("sig", h.auth.SignResource(fileResource(messageID), expiresAt))
+	if thumbSize > 0 {
+		query.Set("thumb", strconv.Itoa(thumbSize))
+	}
+
+	return "/api/files/" + url.PathEscape(messageID) + "?" + query.Encode()
+}
+
+// signFileMetadata fills in fresh signed URLs for a file and its thumbnails
+func (h *SocketIOHandler) signFileMetadata(messageID string, metadata *models.FileMetadata) {
+	metadata.FileURL = h.signedFileURL(messageID, 0)
+	for i := range metadata.Thumbnails {
+		metadata.Thumbnails[i].FileURL = h.signedFileURL(messageID, metadata.Thumbnails[i].Size)
+	}
+}
+
+// canAccessMessage reports whether a user may see a message: its sender, the
+// DM counterpart, members of its room, or anyone for global broadcasts
+func (h *SocketIOHandler) canAccessMessage(ctx context.Context, message *models.Message, userName string) (bool, error) {
+	if userName == message.Sender || userName == message.Receiver {
+		return true, nil
+	}
+
+	if message.Room != "" {
+		return h.redisService.IsRoomMember(ctx, message.Room, userName)
+	}
+
+	return message.Receiver == "", nil
+}
+
+// loadAccessibleMessage loads a message and checks that the authenticated user may see it
+func (h *SocketIOHandler) loadAccessibleMessage(c *gin.Context) (*models.Message, bool) {
+	ctx := c.Request.Context()
+	message, err := h.redisService.GetMessage(ctx, c.Param("messageId"))
+	if err != nil {
+		respondError(c, errNotFound, "Message not found")
+		return nil, false
+	}
+
+	allowed, err := h.canAccessMessage(ctx, message, currentUser(c))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check message access")
+		respondError(c, errInternal, "Failed to check access")
+		return nil, false
+	}
+	if !allowed {
+		// Do not reveal that the message exists
+		respondError(c, errNotFound, "Message not found")
+		return nil, false
+	}
+
+	return message, true
+}
+
+// HandleGetMessage returns a message the authenticated user has access to,
+// with a freshly signed file URL for attachments
+func (h *SocketIOHandler) HandleGetMessage(c *gin.Context) {
+	message, ok := h.loadAccessibleMessage(c)
+	if !ok {
+		return
+	}
+
+	if message.Type == models.FileMessage || message.Type == models.ImageMessage {
+		if metadata, err := message.DecodeFileMetadata(); err == nil {
+			h.signFileMetadata(message.ID, metadata)
+			message.Metadata = metadata
+		}
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+// HandleDownloadURL issues a new signed download URL for a message's attachment
+func (h *SocketIOHandler) HandleDownloadURL(c *gin.Context) {
+	message, ok := h.loadAccessibleMessage(c)
+	if !ok {
+		return
+	}
+
+	if message.Type != models.FileMessage && message.Type != models.ImageMessage {
+		respondError(c, errNotFound, "Message has no file")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fileURL":   h.signedFileURL(message.ID, 0),
+		"expiresIn": int(h.config.Upload.DownloadTTL.Seconds()),
+	})
+}
+
+// HandleFileDownload serves a message's attachment. Requests are authorized
+// either by a signed URL or by a session token of a user with access to the
+// message. Range requests are supported.
+func (h *SocketIOHandler) HandleFileDownload(c *gin.Context) {
+	ctx := c.Request.Context()
+	messageID := c.Param("messageId")
+
+	signed := h.auth.VerifyResource(fileResource(messageID), c.Query("expires"), c.Query("sig"))
+
+	var userName string
+	if !signed {
+		claims, err := h.authenticate(c)
+		if err != nil {
+			respondError(c, errUnauthorized, "Authentication required")
+			return
+		}
+		userName = claims.UserName
+	}
+
+	message, err := h.redisService.GetMessage(ctx, messageID)
+	if err != nil {
+		respondError(c, errNotFound, "File not found")
+		return
+	}
+
+	if !signed {
+		allowed, err := h.canAccessMessage(ctx, message, userName)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to check message access")
+			respondError(c, errInternal, "Failed to check access")
+			return
+		}
+		if !allowed {
+			respondError(c, errNotFound, "File not found")
+			return
+		}
+	}
+
+	metadata, err := message.DecodeFileMetadata()
+	if err != nil || metadata.BlobKey == "" {
+		respondError(c, errNotFound, "File not found")
+		return
+	}
+
+	// Serve a thumbnail instead of the original when requested
+	if thumb := c.Query("thumb"); thumb != "" {
+		variant, ok := thumbnailVariant(metadata, thumb)
+		if !ok {
+			respondError(c, errNotFound, "File not found")
+			return
+		}
+		metadata = variant
+	}
+
+	// Remote stores serve the bytes (and ranges) themselves
+	seekable, ok := h.blobStore.(services.SeekableBlobStore)
+	if !ok {
+		contentType, disposition := downloadHeaders(metadata)
+		location, err := h.blobStore.URL(ctx, metadata.BlobKey, remoteRedirectTTL, &services.ResponseOverrides{
+			ContentType:        contentType,
+			ContentDisposition: disposition,
+		})
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to create download URL")
+			respondError(c, errInternal, "Failed to download file")
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Redirect(http.StatusFound, location)
+		return
+	}
+
+	file, err := seekable.OpenSeeker(ctx, metadata.BlobKey)
+	if err != nil {
+		if errors.Is(err, services.ErrBlobNotFound) {
+			respondError(c, errNotFound, "File not found")
+			return
+		}
+		h.logger.WithError(err).Error("Failed to open file")
+		respondError(c, errInternal, "Failed to download file")
+		return
+	}
+	defer file.Close()
+
+	setDownloadHeaders(c, metadata)
+	http.ServeContent(c.Writer, c.Request, "", message.Timestamp, file)
+}
+
+// thumbnailVariant returns metadata describing the thumbnail of the given size
+func thumbnailVariant(metadata *models.FileMetadata, size string) (*models.FileMetadata, bool) {
+	for _, thumb := range metadata.Thumbnails {
+		if strconv.Itoa(thumb.Size) == size {
+			return &models.FileMetadata{
+				FileName: strings.TrimSuffix(metadata.FileName, filepath.Ext(metadata.FileName)) +
+					"_" + size + filepath.Ext(thumb.BlobKey),
+				FileType: thumb.FileType,
+				BlobKey:  thumb.BlobKey,
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// downloadHeaders returns the Content-Type and Content-Disposition a file
+// is served with. Only types browsers render safely are shown inline.
+func downloadHeaders(metadata *models.FileMetadata) (string, string) {
+	contentType, _, err := mime.ParseMediaType(metadata.FileType)
+	disposition := "inline"
+	if err != nil || !inlineContentTypes[contentType] {
+		contentType = "application/octet-stream"
+		disposition = "attachment"
+	}
+
+	return contentType, mime.FormatMediaType(disposition, map[string]string{
+		"filename": safeDownloadName(metadata.FileName),
+	})
+}
+
+// setDownloadHeaders sets headers that keep browsers from executing uploads
+func setDownloadHeaders(c *gin.Context, metadata *models.FileMetadata) {
+	contentType, disposition := downloadHeaders(metadata)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", disposition)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	c.Header("Cache-Control", "private, max-age=300")
+}
+
+// safeDownloadName strips directories and control characters from a file name
+func safeDownloadName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+
+	if name == "" || name == "." || name == "/" {
+		return "download"
+	}
+	return name
+}
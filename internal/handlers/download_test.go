@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHandleFileDownload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t)
+	ctx := context.Background()
+
+	content := "<script>alert(1)</script>"
+	if err := h.blobStore.Put(ctx, "page.html", strings.NewReader(content), int64(len(content)), "text/html"); err != nil {
+		t.Fatalf("failed to store blob: %v", err)
+	}
+	message := &models.Message{
+		ID:     "m1",
+		Type:   models.FileMessage,
+		Sender: "alice",
+		Room:   "general",
+		Metadata: &models.FileMetadata{
+			FileName: "page.html",
+			FileSize: int64(len(content)),
+			FileType: "text/html",
+			BlobKey:  "page.html",
+		},
+		Timestamp: time.Now(),
+	}
+	if err := h.redisService.StoreMessage(ctx, message); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	for _, member := range []string{"alice", "bob"} {
+		if err := h.redisService.AddUserToRoom(ctx, "general", member); err != nil {
+			t.Fatalf("failed to add room member: %v", err)
+		}
+	}
+
+	token := func(userName, sessionID string) string {
+		token, err := h.auth.IssueToken(userName, sessionID)
+		if err != nil {
+			t.Fatalf("failed to issue token: %v", err)
+		}
+		return token
+	}
+	if err := h.redisService.RevokeSession(ctx, "revoked", time.Hour); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+
+	signed := h.signedFileURL("m1", 0)
+	expired := time.Now().Add(-time.Minute)
+	expiredURL := "/api/files/m1?expires=" + strconv.FormatInt(expired.Unix(), 10) +
+		"&sig=" + h.auth.SignResource(fileResource("m1"), expired)
+
+	tests := []struct {
+		name   string
+		url    string
+		token  string
+		status int
+	}{
+		{name: "signed url", url: signed, status: http.StatusOK},
+		{name: "signed url of another message", url: strings.Replace(signed, "/m1?", "/m2?", 1), status: http.StatusUnauthorized},
+		{name: "tampered signature", url: signed + "x", status: http.StatusUnauthorized},
+		{name: "expired signature", url: expiredURL, status: http.StatusUnauthorized},
+		{name: "no credentials", url: "/api/files/m1", status: http.StatusUnauthorized},
+		{name: "room member", url: "/api/files/m1", token: token("bob", "sid-bob"), status: http.StatusOK},
+		{name: "outsider", url: "/api/files/m1", token: token("mallory", "sid-mallory"), status: http.StatusNotFound},
+		{name: "revoked device", url: "/api/files/m1", token: token("bob", "revoked"), status: http.StatusUnauthorized},
+		{name: "unknown thumbnail", url: signed + "&thumb=160", status: http.StatusNotFound},
+	}
+
+	router := gin.New()
+	router.GET("/api/files/:messageId", h.HandleFileDownload)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			// Uploaded HTML must never render in the browser
+			if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+				t.Errorf("Content-Type = %s", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+				t.Errorf("Content-Disposition = %s", got)
+			}
+			if w.Body.String() != content {
+				t.Errorf("body = %q", w.Body)
+			}
+		})
+	}
+}
+
+// remoteBlobStore is a store that cannot be served directly, like S3. It
+// records the overrides its URLs are signed with.
+type remoteBlobStore struct {
+	services.BlobStore
+	overrides *services.ResponseOverrides
+}
+
+func (s *remoteBlobStore) URL(ctx context.Context, key string, expiry time.Duration, overrides *services.ResponseOverrides) (string, error) {
+	s.overrides = overrides
+	return "https://bucket.example/" + key, nil
+}
+
+func TestHandleFileDownloadRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t)
+	store := &remoteBlobStore{BlobStore: h.blobStore}
+	h.blobStore = store
+	ctx := context.Background()
+
+	router := gin.New()
+	router.GET("/api/files/:messageId", h.HandleFileDownload)
+
+	tests := []struct {
+		name        string
+		metadata    *models.FileMetadata
+		contentType string
+		disposition string
+	}{
+		{name: "html", metadata: &models.FileMetadata{FileName: "page.html", FileType: "text/html", BlobKey: "page"},
+			contentType: "application/octet-stream", disposition: `attachment; filename=page.html`},
+		{name: "image", metadata: &models.FileMetadata{FileName: "cat.png", FileType: "image/png", BlobKey: "cat"},
+			contentType: "image/png", disposition: `inline; filename=cat.png`},
+		{name: "name with quotes", metadata: &models.FileMetadata{FileName: "../\"evil\".svg", FileType: "image/svg+xml", BlobKey: "svg"},
+			contentType: "application/octet-stream", disposition: `attachment; filename=evil.svg`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := &models.Message{ID: "m-" + tt.metadata.BlobKey, Type: models.FileMessage, Sender: "alice",
+				Room: "general", Metadata: tt.metadata, Timestamp: time.Now()}
+			if err := h.redisService.StoreMessage(ctx, message); err != nil {
+				t.Fatalf("failed to store message: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, h.signedFileURL(message.ID, 0), nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusFound {
+				t.Fatalf("status = %d, want a redirect: %s", w.Code, w.Body)
+			}
+			if store.overrides == nil {
+				t.Fatal("redirect without response overrides")
+			}
+			if store.overrides.ContentType != tt.contentType || store.overrides.ContentDisposition != tt.disposition {
+				t.Errorf("overrides %+v, want %s and %s", *store.overrides, tt.contentType, tt.disposition)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// Expiry reasons reported in message tombstones
+const (
+	expiryReasonTTL  = "ttl"
+	expiryReasonRead = "read"
+)
+
+// ephemeralBatchSize bounds how many expired messages are collected per sweep
+const ephemeralBatchSize = 100
+
+// parseEphemeralOptions reads the optional "ttl" (seconds) and "burnAfterRead"
+// fields from an inbound event payload
+func (h *SocketIOHandler) parseEphemeralOptions(data map[string]interface{}) (time.Duration, bool, error) {
+	burnAfterRead, _ := data["burnAfterRead"].(bool)
+
+	seconds, present := data["ttl"].(float64)
+	if present && seconds <= 0 {
+		return 0, false, fmt.Errorf("ttl must be positive")
+	}
+
+	ttl := time.Duration(seconds * float64(time.Second))
+	if ttl > h.config.Message.MaxTTL {
+		return 0, false, fmt.Errorf("ttl exceeds maximum of %s", h.config.Message.MaxTTL)
+	}
+
+	// Burn-after-read messages still need an upper bound on their lifetime
+	if burnAfterRead && ttl == 0 {
+		ttl = h.config.Message.MaxTTL
+	}
+
+	return ttl, burnAfterRead, nil
+}
+
+// applyEphemeralOptions marks a message as self-destructing
+func applyEphemeralOptions(message *models.Message, ttl time.Duration, burnAfterRead bool) {
+	if ttl <= 0 {
+		return
+	}
+	expiresAt := message.Timestamp.Add(ttl)
+	message.ExpiresAt = &expiresAt
+	message.BurnAfterRead = burnAfterRead
+}
+
+// handleMessageRead records a read receipt and expires burn-after-read
+// messages once every recipient has read them
+func (h *SocketIOHandler) handleMessageRead(client *socket.Socket, args ...any) error {
+	if len(args) == 0 {
+		return newEventError(errInvalidPayload, "No read receipt data")
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return newEventError(errInvalidPayload, "Invalid read receipt data")
+	}
+
+	messageID, _ := data["messageId"].(string)
+	if messageID == "" {
+		return newEventError(errInvalidPayload, "Invalid read receipt data")
+	}
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before sending read receipts")
+	}
+
+	return h.markMessageRead(context.Background(), user.ID, messageID)
+}
+
+// markMessageRead records that reader has read a message. Only recipients
+// count towards burning a message; messages without recipients, such as
+// global messages, are never burnt by reads and expire at their TTL.
+func (h *SocketIOHandler) markMessageRead(ctx context.Context, reader, messageID string) error {
+	message, err := h.redisService.GetMessage(ctx, messageID)
+	if err != nil {
+		// Already expired or never existed; nothing to do
+		return nil
+	}
+
+	if !message.BurnAfterRead || reader == message.Sender {
+		return nil
+	}
+
+	recipients, err := h.messageRecipients(ctx, message)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to resolve message recipients")
+		return newEventError(errInternal, "Failed to record read receipt")
+	}
+
+	if !slices.Contains(recipients, reader) {
+		return newEventError(errForbidden, "Not a recipient of this message")
+	}
+
+	readers, err := h.redisService.MarkMessageRead(ctx, messageID, reader, time.Until(*message.ExpiresAt)+time.Minute)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to record message read")
+		return newEventError(errInternal, "Failed to record read receipt")
+	}
+
+	if !containsAll(readers, recipients) {
+		return nil
+	}
+
+	if err := h.redisService.ExpireMessageNow(ctx, messageID); err != nil {
+		h.logger.WithError(err).Error("Failed to expire read message")
+		return nil
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": messageID,
+		"readers":    len(readers),
+	}).Info("Burn-after-read message read by all recipients")
+
+	return nil
+}
+
+// messageRecipients returns the users expected to read a message
+func (h *SocketIOHandler) messageRecipients(ctx context.Context, message *models.Message) ([]string, error) {
+	if message.Room == "" {
+		if message.Receiver == "" {
+			return nil, nil
+		}
+		return []string{message.Receiver}, nil
+	}
+
+	members, err := h.redisService.GetRoomMembers(ctx, message.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != message.Sender {
+			recipients = append(recipients, member)
+		}
+	}
+	return recipients, nil
+}
+
+// runExpirySweeper periodically deletes ephemeral messages that have expired
+func (h *SocketIOHandler) runExpirySweeper() {
+	ticker := time.NewTicker(h.config.Message.SweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.sweepExpiredMessages()
+	}
+}
+
+// sweepExpiredMessages expires every message whose deadline has passed
+func (h *SocketIOHandler) sweepExpiredMessages() {
+	ctx := context.Background()
+	ids, err := h.redisService.GetDueEphemeralMessages(ctx, time.Now(), ephemeralBatchSize)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fetch expired messages")
+		return
+	}
+
+	for _, id := range ids {
+		// Another node may have picked this message up already
+		claimed, err := h.redisService.ClaimEphemeralMessage(ctx, id)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to claim expired message")
+			continue
+		}
+		if claimed {
+			h.expireMessage(ctx, id)
+		}
+	}
+}
+
+// expireMessage deletes a message and its attachment, then notifies clients
+func (h *SocketIOHandler) expireMessage(ctx context.Context, messageID string) {
+	message, err := h.redisService.GetMessage(ctx, messageID)
+	if err != nil {
+		h.logger.WithError(err).WithField("message_id", messageID).Warn("Expired message payload missing")
+		h.redisService.DeleteMessage(ctx, messageID)
+		return
+	}
+
+	if message.Type == models.FileMessage || message.Type == models.ImageMessage {
+		h.releaseMessageFile(ctx, message)
+	}
+
+	if err := h.redisService.DeleteMessage(ctx, messageID); err != nil {
+		h.logger.WithError(err).Error("Failed to delete expired message")
+		return
+	}
+
+	reason := expiryReasonTTL
+	if message.ExpiresAt != nil && time.Now().Before(*message.ExpiresAt) {
+		reason = expiryReasonRead
+	}
+
+	h.broadcastTombstone(&models.MessageTombstone{
+		MessageID: message.ID,
+		Room:      message.Room,
+		Sender:    message.Sender,
+		Receiver:  message.Receiver,
+		Reason:    reason,
+		ExpiredAt: time.Now(),
+	})
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": messageID,
+		"reason":     reason,
+	}).Info("Ephemeral message expired")
+}
+
+// broadcastTombstone notifies the audience of a message that it has expired
+func (h *SocketIOHandler) broadcastTombstone(tombstone *models.MessageTombstone) {
+	event := string(models.EventMessageExpired)
+	if tombstone.Room != "" {
+		h.server.To(socket.Room(tombstone.Room)).Emit(event, tombstone)
+	} else if tombstone.Receiver != "" {
+		data := map[string]interface{}{"tombstone": tombstone}
+		h.broadcastToUserDevices(tombstone.Receiver, event, data, "")
+		h.broadcastToUserDevices(tombstone.Sender, event, data, "")
+	} else {
+		h.server.Emit(event, tombstone)
+	}
+}
+
+// containsAll reports whether every element of want is present in have
+func containsAll(have, want []string) bool {
+	set := make(map[string]struct{}, len(have))
+	for _, v := range have {
+		set[v] = struct{}{}
+	}
+	for _, v := range want {
+		if _, ok := set[v]; !ok {
+			return false
+		}
+	}
+	return true
+}
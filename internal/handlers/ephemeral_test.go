@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"im-demo/internal/models"
+)
+
+func TestParseEphemeralOptions(t *testing.T) {
+	h, _ := newTestHandler(t)
+	maxTTL := h.config.Message.MaxTTL
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		ttl     time.Duration
+		burn    bool
+		wantErr bool
+	}{
+		{name: "none", data: map[string]interface{}{}},
+		{name: "ttl", data: map[string]interface{}{"ttl": 30.0}, ttl: 30 * time.Second},
+		{name: "zero ttl", data: map[string]interface{}{"ttl": 0.0}, wantErr: true},
+		{name: "negative ttl", data: map[string]interface{}{"ttl": -1.0}, wantErr: true},
+		{name: "ttl above maximum", data: map[string]interface{}{"ttl": maxTTL.Seconds() + 1}, wantErr: true},
+		{name: "burn without ttl", data: map[string]interface{}{"burnAfterRead": true}, ttl: maxTTL, burn: true},
+		{name: "burn with ttl", data: map[string]interface{}{"burnAfterRead": true, "ttl": 60.0}, ttl: time.Minute, burn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, burn, err := h.parseEphemeralOptions(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got ttl %s", ttl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ttl != tt.ttl || burn != tt.burn {
+				t.Errorf("got (%s, %v), want (%s, %v)", ttl, burn, tt.ttl, tt.burn)
+			}
+		})
+	}
+}
+
+func TestMarkMessageRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  models.Message
+		members  []string
+		readers  []string
+		wantKind *errorKind // error of the last read
+		burnt    bool
+	}{
+		{
+			name:    "direct message read by receiver",
+			message: models.Message{Sender: "alice", Receiver: "bob"},
+			readers: []string{"bob"},
+			burnt:   true,
+		},
+		{
+			name:     "direct message read by a stranger",
+			message:  models.Message{Sender: "alice", Receiver: "bob"},
+			readers:  []string{"mallory"},
+			wantKind: errForbidden,
+		},
+		{
+			name:    "sender reads own message",
+			message: models.Message{Sender: "alice", Receiver: "bob"},
+			readers: []string{"alice"},
+		},
+		{
+			name:    "room message read by some members",
+			message: models.Message{Sender: "alice", Room: "general"},
+			members: []string{"alice", "bob", "carol"},
+			readers: []string{"bob"},
+		},
+		{
+			name:    "room message read by all members",
+			message: models.Message{Sender: "alice", Room: "general"},
+			members: []string{"alice", "bob", "carol"},
+			readers: []string{"bob", "carol"},
+			burnt:   true,
+		},
+		{
+			name:     "room message read by a non-member",
+			message:  models.Message{Sender: "alice", Room: "general"},
+			members:  []string{"alice", "bob"},
+			readers:  []string{"mallory"},
+			wantKind: errForbidden,
+		},
+		{
+			name:     "empty room",
+			message:  models.Message{Sender: "alice", Room: "empty"},
+			readers:  []string{"bob"},
+			wantKind: errForbidden,
+		},
+		{
+			name:     "global message",
+			message:  models.Message{Sender: "alice"},
+			readers:  []string{"bob"},
+			wantKind: errForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t)
+			ctx := context.Background()
+
+			message := tt.message
+			message.ID = generateMessageID()
+			message.Type = models.TextMessage
+			message.Content = "secret"
+			message.Timestamp = time.Now()
+			applyEphemeralOptions(&message, time.Hour, true)
+			if err := h.redisService.StoreMessage(ctx, &message); err != nil {
+				t.Fatalf("failed to store message: %v", err)
+			}
+			for _, member := range tt.members {
+				if err := h.redisService.AddUserToRoom(ctx, message.Room, member); err != nil {
+					t.Fatalf("failed to add room member: %v", err)
+				}
+			}
+
+			var err error
+			for _, reader := range tt.readers {
+				err = h.markMessageRead(ctx, reader, message.ID)
+			}
+			if kind := eventErrorKind(err); kind != tt.wantKind {
+				t.Fatalf("got error %v, want kind %v", err, tt.wantKind)
+			}
+
+			due, err := h.redisService.GetDueEphemeralMessages(ctx, time.Now(), 10)
+			if err != nil {
+				t.Fatalf("failed to get due messages: %v", err)
+			}
+			if burnt := len(due) == 1; burnt != tt.burnt {
+				t.Errorf("burnt = %v, want %v", burnt, tt.burnt)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// errorKind is an entry of the error catalog shared by Socket.IO events and
+// the REST API. Clients branch on Code; Status is the equivalent HTTP status
+// and Retryable says whether repeating the same request may succeed.
+type errorKind struct {
+	Code      string
+	Status    int
+	Retryable bool
+	Message   string // default message when none is given
+}
+
+// Error catalog
+var (
+	errInvalidPayload  = &errorKind{"invalid_payload", http.StatusBadRequest, false, "Invalid payload"}
+	errMissingField    = &errorKind{"missing_field", http.StatusBadRequest, false, "Missing field"}
+	errInvalidType     = &errorKind{"invalid_type", http.StatusBadRequest, false, "Invalid field type"}
+	errInvalidValue    = &errorKind{"invalid_value", http.StatusBadRequest, false, "Invalid field value"}
+	errTooLong         = &errorKind{"too_long", http.StatusBadRequest, false, "Field too long"}
+	errOutOfRange      = &errorKind{"out_of_range", http.StatusBadRequest, false, "Field out of range"}
+	errUnauthorized    = &errorKind{"unauthorized", http.StatusUnauthorized, false, "Authentication required"}
+	errForbidden       = &errorKind{"forbidden", http.StatusForbidden, false, "Not allowed"}
+	errNotFound        = &errorKind{"not_found", http.StatusNotFound, false, "Not found"}
+	errConflict        = &errorKind{"conflict", http.StatusConflict, false, "Conflict"}
+	errTooLarge        = &errorKind{"payload_too_large", http.StatusRequestEntityTooLarge, false, "Payload too large"}
+	errChecksum        = &errorKind{"checksum_mismatch", http.StatusUnprocessableEntity, true, "Checksum mismatch"}
+	errUploadRejected  = &errorKind{"upload_rejected", http.StatusUnprocessableEntity, false, "Upload rejected"}
+	errMessageRejected = &errorKind{"message_rejected", http.StatusUnprocessableEntity, false, "Message rejected"}
+	errRateLimited     = &errorKind{"rate_limited", http.StatusTooManyRequests, true, "Too many requests"}
+	errInternal        = &errorKind{"internal_error", http.StatusInternalServerError, true, "Internal error"}
+)
+
+// eventError is an error reported to a client
+type eventError struct {
+	kind    *errorKind
+	message string
+	details map[string]interface{}
+}
+
+// newEventError creates an error of the given kind; an empty message uses
+// the catalog default
+func newEventError(kind *errorKind, message string) *eventError {
+	if message == "" {
+		message = kind.Message
+	}
+	return &eventError{kind: kind, message: message}
+}
+
+func (e *eventError) Error() string {
+	return e.message
+}
+
+// withDetail attaches structured information, such as the offending field
+func (e *eventError) withDetail(key string, value interface{}) *eventError {
+	if e.details == nil {
+		e.details = make(map[string]interface{})
+	}
+	e.details[key] = value
+	return e
+}
+
+// errorPayload is the wire format of errors, over Socket.IO and REST alike
+type errorPayload struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Status    int                    `json:"status"`
+	Retryable bool                   `json:"retryable"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Event     string                 `json:"event,omitempty"`
+	RequestID string                 `json:"requestId,omitempty"`
+}
+
+// newErrorPayload builds the wire format of an error
+func newErrorPayload(err *eventError, event, requestID string) *errorPayload {
+	return &errorPayload{
+		Code:      err.kind.Code,
+		Message:   err.message,
+		Status:    err.kind.Status,
+		Retryable: err.kind.Retryable,
+		Details:   err.details,
+		Event:     event,
+		RequestID: requestID,
+	}
+}
+
+// replyError reports a failed event to the client, through its
+// acknowledgement callback when it supplied one and as an "error" event
+// otherwise
+func (h *SocketIOHandler) replyError(client *socket.Socket, event, requestID string, ack socket.Ack, err error) {
+	// Unexpected errors are logged and reported without leaking their text
+	var eventErr *eventError
+	if !errors.As(err, &eventErr) {
+		h.logger.WithError(err).WithFields(logrus.Fields{
+			"session_id": string(client.Id()),
+			"event":      event,
+			"request_id": requestID,
+		}).Error("Event failed")
+		eventErr = newEventError(errInternal, "")
+	}
+
+	payload := newErrorPayload(eventErr, event, requestID)
+	if ack != nil {
+		ack([]any{map[string]interface{}{"ok": false, "error": payload}}, nil)
+		return
+	}
+	client.Emit("error", payload)
+}
+
+// respondError writes a catalog error as a REST response
+func respondError(c *gin.Context, kind *errorKind, message string) {
+	payload := newErrorPayload(newEventError(kind, message), "", c.GetString(contextRequestIDKey))
+	c.AbortWithStatusJSON(kind.Status, gin.H{"error": payload})
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+func TestErrorCatalog(t *testing.T) {
+	kinds := []*errorKind{
+		errInvalidPayload, errMissingField, errInvalidType, errInvalidValue, errTooLong, errOutOfRange,
+		errUnauthorized, errForbidden, errNotFound, errConflict, errTooLarge, errChecksum,
+		errUploadRejected, errMessageRejected, errRateLimited, errInternal,
+	}
+	codes := make(map[string]bool)
+	for _, kind := range kinds {
+		if codes[kind.Code] {
+			t.Errorf("code %s is used twice", kind.Code)
+		}
+		codes[kind.Code] = true
+		if kind.Status < 400 || kind.Message == "" {
+			t.Errorf("%s: status %d, message %q", kind.Code, kind.Status, kind.Message)
+		}
+	}
+}
+
+func TestEventErrorReplies(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.server.On("connection", func(clients ...any) {
+		client := clients[0].(*socket.Socket)
+		client.On("test_event", h.eventHandler(client, "test_event", func(args ...any) error {
+			data, _ := args[0].(map[string]interface{})
+			switch data["fail"] {
+			case "unexpected":
+				return errors.New("dial tcp 10.0.0.5:6379: connection refused")
+			case "detailed":
+				return newEventError(errTooLong, "").withDetail("field", "content")
+			}
+			return nil
+		}))
+	})
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	internal := &errorPayload{Code: "internal_error", Message: "Internal error", Status: http.StatusInternalServerError, Retryable: true, Event: "test_event"}
+	detailed := &errorPayload{Code: "too_long", Message: "Field too long", Status: http.StatusBadRequest, Event: "test_event", Details: map[string]interface{}{"field": "content"}}
+	longID := strings.Repeat("x", maxRequestIDLength+1)
+
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		ack       bool
+		want      *errorPayload // nil when the event succeeds
+		requestID string        // empty when one is generated
+	}{
+		{name: "success", data: map[string]interface{}{"requestId": "r1"}, ack: true, requestID: "r1"},
+		{name: "success with generated ID", data: map[string]interface{}{}, ack: true},
+		{name: "unexpected error", data: map[string]interface{}{"fail": "unexpected", "requestId": "r2"}, ack: true, want: internal, requestID: "r2"},
+		{name: "details", data: map[string]interface{}{"fail": "detailed", "requestId": "r3"}, ack: true, want: detailed, requestID: "r3"},
+		{name: "request ID too long", data: map[string]interface{}{"fail": "detailed", "requestId": longID}, ack: true, want: detailed},
+		{name: "without acknowledgement", data: map[string]interface{}{"fail": "unexpected", "requestId": "r4"}, want: internal, requestID: "r4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply map[string]interface{}
+			if tt.ack {
+				reply = c.emit("test_event", tt.data)
+			} else {
+				c.send("test_event", tt.data)
+				var payload map[string]interface{}
+				if err := json.Unmarshal(c.waitEvent("error"), &payload); err != nil {
+					t.Fatalf("invalid error event: %v", err)
+				}
+				reply = map[string]interface{}{"ok": false, "error": payload}
+			}
+
+			if tt.want == nil {
+				if reply["ok"] != true {
+					t.Fatalf("failed: %v", reply["error"])
+				}
+				requestID, _ := reply["requestId"].(string)
+				if tt.requestID != "" && requestID != tt.requestID || requestID == "" {
+					t.Errorf("request ID %q, want %q", requestID, tt.requestID)
+				}
+				return
+			}
+
+			if reply["ok"] != false {
+				t.Fatalf("got %v, want a failure", reply)
+			}
+			raw, _ := json.Marshal(reply["error"])
+			var got errorPayload
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatalf("invalid error: %v", err)
+			}
+			if tt.requestID == "" {
+				if got.RequestID == "" || got.RequestID == longID {
+					t.Errorf("request ID %q, want a generated one", got.RequestID)
+				}
+			} else if got.RequestID != tt.requestID {
+				t.Errorf("request ID %q, want %q", got.RequestID, tt.requestID)
+			}
+			got.RequestID = ""
+			if !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID())
+	router.GET("/missing", func(c *gin.Context) {
+		respondError(c, errNotFound, "")
+	})
+	router.GET("/limited", func(c *gin.Context) {
+		respondError(c, errRateLimited, "Slow down")
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		requestID string
+		status    int
+		want      errorPayload
+	}{
+		{name: "default message", path: "/missing", requestID: "req-1", status: http.StatusNotFound,
+			want: errorPayload{Code: "not_found", Message: "Not found", Status: http.StatusNotFound, RequestID: "req-1"}},
+		{name: "message", path: "/limited", requestID: "req-2", status: http.StatusTooManyRequests,
+			want: errorPayload{Code: "rate_limited", Message: "Slow down", Status: http.StatusTooManyRequests, Retryable: true, RequestID: "req-2"}},
+		{name: "generated request ID", path: "/missing", status: http.StatusNotFound,
+			want: errorPayload{Code: "not_found", Message: "Not found", Status: http.StatusNotFound}},
+		{name: "request ID too long", path: "/missing", requestID: strings.Repeat("x", maxRequestIDLength+1), status: http.StatusNotFound,
+			want: errorPayload{Code: "not_found", Message: "Not found", Status: http.StatusNotFound}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			var body struct {
+				Error errorPayload `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid body %s: %v", w.Body, err)
+			}
+
+			header := w.Header().Get("X-Request-ID")
+			if body.Error.RequestID != header {
+				t.Errorf("body request ID %q, header %q", body.Error.RequestID, header)
+			}
+			if tt.want.RequestID == "" && (header == "" || header == tt.requestID) {
+				t.Errorf("request ID %q, want a generated one", header)
+			}
+			if tt.want.RequestID == "" {
+				body.Error.RequestID = ""
+			}
+			if !reflect.DeepEqual(body.Error, tt.want) {
+				t.Errorf("got %+v, want %+v", body.Error, tt.want)
+			}
+		})
+	}
+}
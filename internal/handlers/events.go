@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// contextRequestIDKey is the gin context key holding the request ID
+const contextRequestIDKey = "requestId"
+
+// maxRequestIDLength bounds client supplied request IDs
+const maxRequestIDLength = 64
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// eventRequestID returns the client's "requestId" for an event, or a new one
+func eventRequestID(args []any) string {
+	if len(args) > 0 {
+		if data, ok := args[0].(map[string]interface{}); ok {
+			if id, ok := data["requestId"].(string); ok && id != "" && len(id) <= maxRequestIDLength {
+				return id
+			}
+		}
+	}
+	return newRequestID()
+}
+
+// anonymousEvents may be sent before joining; every other event acts on
+// behalf of the session's user
+var anonymousEvents = map[string]bool{
+	"join": true,
+}
+
+// checkJoined refuses events from sessions that have not joined yet
+func (h *SocketIOHandler) checkJoined(client *socket.Socket, event string) error {
+	if anonymousEvents[event] {
+		return nil
+	}
+	if _, ok := h.sessionUser(string(client.Id())); !ok {
+		return newEventError(errUnauthorized, "Join first")
+	}
+	return nil
+}
+
+// eventHandler adapts an event handler for registration: it requires a
+// joined session, applies rate limits, sanctions and schema validation,
+// then reports the outcome. Clients that emit
+// with an acknowledgement callback get {ok: true} or {ok: false, error}
+// back; failures of other events are sent as an "error" event.
+func (h *SocketIOHandler) eventHandler(client *socket.Socket, event string, handler func(args ...any) error) func(args ...any) {
+	return func(args ...any) {
+		// Socket.IO passes the acknowledgement callback as the last argument
+		var ack socket.Ack
+		if n := len(args); n > 0 {
+			if fn, ok := args[n-1].(socket.Ack); ok {
+				ack = fn
+				args = args[:n-1]
+			}
+		}
+
+		requestID := eventRequestID(args)
+
+		err := h.checkRateLimit(client, event, args)
+		if err == nil {
+			err = h.checkJoined(client, event)
+		}
+		if err == nil {
+			err = h.checkSanctions(client, event, args)
+		}
+		if err == nil {
+			err = h.validateEvent(event, args)
+		}
+		if err == nil {
+			h.recordActivity(string(client.Id()))
+			err = handler(args...)
+		}
+
+		if err != nil {
+			h.replyError(client, event, requestID, ack, err)
+			return
+		}
+		if ack != nil {
+			ack([]any{map[string]interface{}{"ok": true, "requestId": requestID}}, nil)
+		}
+	}
+}
+
+// RequestID is a gin middleware that assigns every request an ID, taken
+// from the X-Request-ID header when present, and echoes it in the response
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+
+		c.Set(contextRequestIDKey, requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
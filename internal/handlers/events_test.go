@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+
+	"im-demo/internal/models"
+)
+
+func TestEventsRequireJoin(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := dialTestClient(t, newTestServer(t, h))
+
+	events := map[string]map[string]interface{}{
+		"join_room":          {"roomId": "general", "userName": "alice"},
+		"leave_room":         {"roomId": "general", "userName": "alice"},
+		"typing":             {"roomId": "general", "userName": "alice"},
+		"message_read":       {"messageId": "1"},
+		"report_message":     {"messageId": "1", "reason": "spam"},
+		"list_devices":       {},
+		"revoke_device":      {"sessionId": "s1"},
+		"read_cursor":        {"messageId": "1"},
+		"mute_room":          {"roomId": "general", "muted": true},
+		"save_draft":         {"conversationId": "general", "content": "hi"},
+		"set_status":         {"status": "away"},
+		"subscribe_presence": {"users": []string{"bob"}},
+		"upload_abort":       {"uploadId": "u1"},
+	}
+	for event, data := range events {
+		if code := errorCode(c.emit(event, data)); code != errUnauthorized.Code {
+			t.Errorf("%s: got %q, want %s", event, code, errUnauthorized.Code)
+		}
+	}
+
+	if members, _ := h.redisService.GetRoomMembers(t.Context(), "general"); len(members) > 0 {
+		t.Errorf("room joined without a session: %v", members)
+	}
+}
+
+func TestJoinRoomUsesSessionUser(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("mallory")
+
+	// Other users cannot be added to or removed from rooms
+	addTestMembers(t, h, "general", "bob")
+	members := func() []string {
+		t.Helper()
+		members, err := h.redisService.GetRoomMembers(t.Context(), "general")
+		if err != nil {
+			t.Fatalf("failed to get members: %v", err)
+		}
+		slices.Sort(members)
+		return members
+	}
+
+	c.emitOK("join_room", map[string]interface{}{"roomId": "general", "userName": "alice"})
+	if got := members(); !slices.Equal(got, []string{"bob", "mallory"}) {
+		t.Errorf("after join_room: %v, want bob and mallory", got)
+	}
+	c.emitOK("leave_room", map[string]interface{}{"roomId": "general", "userName": "bob"})
+	if got := members(); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("after leave_room: %v, want bob", got)
+	}
+}
+
+func TestSanctionsFailClosed(t *testing.T) {
+	h, mr := newTestHandler(t)
+	addTestMembers(t, h, "general", "alice")
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	reply := c.emit("message", map[string]interface{}{"roomId": "general", "content": "hi"})
+	if code := errorCode(reply); code != errInternal.Code {
+		t.Errorf("got %v, want %s", reply, errInternal.Code)
+	}
+	mr.SetError("")
+
+	if err := h.redisService.SetSanction(t.Context(), &models.Sanction{Kind: models.SanctionMute, UserName: "alice"}); err != nil {
+		t.Fatalf("failed to mute: %v", err)
+	}
+	if code := errorCode(c.emit("message", map[string]interface{}{"roomId": "general", "content": "hi"})); code != errForbidden.Code {
+		t.Errorf("muted user: got %q, want %s", code, errForbidden.Code)
+	}
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// testTimeout bounds how long tests wait for the server
+const testTimeout = 5 * time.Second
+
+// newTestHandler creates a handler backed by an in-memory Redis. configure
+// may adjust the default configuration before the handler is created.
+func newTestHandler(t testing.TB, configure ...func(*config.Config)) (*SocketIOHandler, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return newTestNode(t, mr, configure...), mr
+}
+
+// newTestNode creates another node of the cluster sharing mr
+func newTestNode(t testing.TB, mr *miniredis.Miniredis, configure ...func(*config.Config)) *SocketIOHandler {
+	t.Helper()
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	cfg.Redis.Addr = mr.Addr()
+	cfg.Upload.UploadDir = t.TempDir()
+	// Background sweepers would race with the tests
+	cfg.Message.SweepInterval = time.Hour
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	redisService, err := services.NewRedisService(cfg, logger)
+	if err != nil {
+		t.Fatalf("failed to connect to redis: %v", err)
+	}
+	t.Cleanup(func() { redisService.Close() })
+
+	h, err := NewSocketIOHandler(cfg, redisService, logger)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	return h
+}
+
+// joinTestSession registers a session as if userName had joined on it
+func joinTestSession(h *SocketIOHandler, sessionID, userName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessions[sessionID] = &models.User{ID: userName, Name: userName}
+	h.userSessions[userName] = append(h.userSessions[userName], sessionID)
+}
+
+// addTestMembers adds users to a room
+func addTestMembers(t testing.TB, h *SocketIOHandler, roomID string, userNames ...string) {
+	t.Helper()
+	for _, userName := range userNames {
+		if err := h.redisService.AddUserToRoom(t.Context(), roomID, userName); err != nil {
+			t.Fatalf("failed to join room: %v", err)
+		}
+	}
+}
+
+// eventErrorKind returns the kind of an event error, or nil
+func eventErrorKind(err error) *errorKind {
+	var e *eventError
+	if errors.As(err, &e) {
+		return e.kind
+	}
+	return nil
+}
+
+// newTestServer serves the handler's Socket.IO endpoint and returns its
+// WebSocket URL
+func newTestServer(t testing.TB, h *SocketIOHandler) string {
+	t.Helper()
+	server := httptest.NewServer(h.server.ServeHandler(nil))
+	t.Cleanup(server.Close)
+	return "ws://" + server.Listener.Addr().String() + socketIOPath + "?EIO=4&transport=websocket"
+}
+
+// testEvent is an event received by a test client
+type testEvent struct {
+	name string
+	data json.RawMessage
+}
+
+// testClient is a Socket.IO client speaking Engine.IO v4 over WebSocket
+type testClient struct {
+	t    testing.TB
+	conn *websocket.Conn
+
+	mu      sync.Mutex
+	nextAck int
+	acks    map[int]chan map[string]interface{}
+	events  chan testEvent
+}
+
+// dialTestClient connects a client to a test server
+func dialTestClient(t testing.TB, endpoint string) *testClient {
+	t.Helper()
+
+	conn, err := websocket.Dial(endpoint, "", "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// Engine.IO open packet, then the Socket.IO connect handshake
+	var open string
+	if err := websocket.Message.Receive(conn, &open); err != nil || !strings.HasPrefix(open, "0") {
+		t.Fatalf("unexpected open packet %q: %v", open, err)
+	}
+	if err := websocket.Message.Send(conn, "40"); err != nil {
+		t.Fatalf("failed to connect namespace: %v", err)
+	}
+
+	c := &testClient{
+		t:      t,
+		conn:   conn,
+		acks:   make(map[int]chan map[string]interface{}),
+		events: make(chan testEvent, 100),
+	}
+	go c.read()
+	c.waitEvent("connected")
+	return c
+}
+
+// read answers pings and dispatches acknowledgements and events
+func (c *testClient) read() {
+	for {
+		var packet string
+		if err := websocket.Message.Receive(c.conn, &packet); err != nil {
+			return
+		}
+
+		switch {
+		case packet == "2":
+			websocket.Message.Send(c.conn, "3")
+
+		case strings.HasPrefix(packet, "40"):
+			c.events <- testEvent{name: "connected"}
+
+		case strings.HasPrefix(packet, "43"):
+			body := packet[2:]
+			end := strings.IndexByte(body, '[')
+			id, err := strconv.Atoi(body[:end])
+			if err != nil {
+				continue
+			}
+			var reply []map[string]interface{}
+			if err := json.Unmarshal([]byte(body[end:]), &reply); err != nil || len(reply) == 0 {
+				continue
+			}
+			c.mu.Lock()
+			ch := c.acks[id]
+			delete(c.acks, id)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- reply[0]
+			}
+
+		case strings.HasPrefix(packet, "42"):
+			var event []json.RawMessage
+			if err := json.Unmarshal([]byte(packet[2:]), &event); err != nil || len(event) == 0 {
+				continue
+			}
+			var name string
+			json.Unmarshal(event[0], &name)
+			var data json.RawMessage
+			if len(event) > 1 {
+				data = event[1]
+			}
+			c.events <- testEvent{name: name, data: data}
+		}
+	}
+}
+
+// emit sends an event and returns the server's acknowledgement
+func (c *testClient) emit(event string, data map[string]interface{}) map[string]interface{} {
+	c.t.Helper()
+
+	c.mu.Lock()
+	id := c.nextAck
+	c.nextAck++
+	ch := make(chan map[string]interface{}, 1)
+	c.acks[id] = ch
+	c.mu.Unlock()
+
+	payload, err := json.Marshal([]interface{}{event, data})
+	if err != nil {
+		c.t.Fatalf("failed to encode %s: %v", event, err)
+	}
+	if err := websocket.Message.Send(c.conn, "42"+strconv.Itoa(id)+string(payload)); err != nil {
+		c.t.Fatalf("failed to send %s: %v", event, err)
+	}
+
+	select {
+	case reply := <-ch:
+		return reply
+	case <-time.After(testTimeout):
+		c.t.Fatalf("no acknowledgement for %s", event)
+		return nil
+	}
+}
+
+// send sends an event without an acknowledgement callback
+func (c *testClient) send(event string, data map[string]interface{}) {
+	c.t.Helper()
+	payload, err := json.Marshal([]interface{}{event, data})
+	if err != nil {
+		c.t.Fatalf("failed to encode %s: %v", event, err)
+	}
+	if err := websocket.Message.Send(c.conn, "42"+string(payload)); err != nil {
+		c.t.Fatalf("failed to send %s: %v", event, err)
+	}
+}
+
+// emitOK sends an event and fails the test unless it succeeds
+func (c *testClient) emitOK(event string, data map[string]interface{}) {
+	c.t.Helper()
+	if reply := c.emit(event, data); reply["ok"] != true {
+		c.t.Fatalf("%s failed: %v", event, reply["error"])
+	}
+}
+
+// join joins as userName and waits until the server confirms it
+func (c *testClient) join(userName string) {
+	c.t.Helper()
+	c.emitOK("join", map[string]interface{}{"userName": userName})
+	c.waitEvent("joined")
+}
+
+// currentSession returns the session ID of the client and the devices of
+// its user
+func (c *testClient) currentSession() (string, []*models.SessionInfo) {
+	c.t.Helper()
+	c.emitOK("list_devices", map[string]interface{}{})
+	var listed struct {
+		Devices          []*models.SessionInfo `json:"devices"`
+		CurrentSessionID string                `json:"currentSessionId"`
+	}
+	if err := json.Unmarshal(c.waitEvent(string(models.EventDevices)), &listed); err != nil {
+		c.t.Fatalf("invalid devices event: %v", err)
+	}
+	return listed.CurrentSessionID, listed.Devices
+}
+
+// waitEvent returns the payload of the next event with the given name,
+// skipping others
+func (c *testClient) waitEvent(name string) json.RawMessage {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event := <-c.events:
+			if event.name == name {
+				return event.data
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", name)
+			return nil
+		}
+	}
+}
+
+// expectNoEvent fails if an event with the given name arrives within wait
+func (c *testClient) expectNoEvent(name string, wait time.Duration) {
+	c.t.Helper()
+	timeout := time.After(wait)
+	for {
+		select {
+		case event := <-c.events:
+			if event.name == name {
+				c.t.Fatalf("unexpected %s: %s", name, event.data)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// errorCode returns the error code of a failed acknowledgement
+func errorCode(reply map[string]interface{}) string {
+	payload, _ := reply["error"].(map[string]interface{})
+	code, _ := payload["code"].(string)
+	return code
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// RedirectToHTTPS permanently redirects plain HTTP requests to the same
+// host and path on the HTTPS port. Clients keep the method and body.
+func RedirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// No port in the Host header
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(httpsPort))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
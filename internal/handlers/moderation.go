@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+)
+
+// UseMessageFilter adds a custom filter to the moderation chain. Filters run
+// after the built-in ones, in the order they were added.
+func (h *SocketIOHandler) UseMessageFilter(filter services.MessageFilter) {
+	h.filters.Use(filter)
+}
+
+// moderateMessage runs a message through the filter chain before it is
+// stored. Masked words are replaced in the message; rejected messages
+// return a message_rejected error for the sender.
+func (h *SocketIOHandler) moderateMessage(ctx context.Context, message *models.Message) error {
+	content := message.Content
+
+	decisions := h.filters.Run(ctx, message)
+	if len(decisions) == 0 {
+		return nil
+	}
+
+	if h.config.Moderation.Report {
+		h.reportFilterDecisions(&models.ModerationReport{
+			MessageID: message.ID,
+			Sender:    message.Sender,
+			Room:      message.Room,
+			Receiver:  message.Receiver,
+			Content:   content,
+			Decisions: decisions,
+			Timestamp: time.Now(),
+		})
+	}
+
+	last := decisions[len(decisions)-1]
+	if last.Action == models.FilterReject {
+		return newEventError(errMessageRejected, last.Reason).withDetail("filter", last.Filter)
+	}
+	return nil
+}
+
+// moderators returns the users receiving moderation reports of a room.
+// Direct messages are reported to the global admins only.
+func (h *SocketIOHandler) moderators(roomID string) []string {
+	admins := slices.Clone(h.config.Moderation.Admins)
+	if roomID != "" {
+		for _, admin := range h.config.Moderation.RoomAdmins[roomID] {
+			if !slices.Contains(admins, admin) {
+				admins = append(admins, admin)
+			}
+		}
+	}
+	return admins
+}
+
+// reportFilterDecisions sends a moderation report to the admins' devices
+func (h *SocketIOHandler) reportFilterDecisions(report *models.ModerationReport) {
+	for _, admin := range h.moderators(report.Room) {
+		h.broadcastToUserDevices(admin, string(models.EventModerationReport), map[string]interface{}{
+			"report": report,
+		}, "")
+	}
+}
@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+const (
+	// presenceSweepInterval is how often idle users and expired statuses
+	// are checked
+	presenceSweepInterval = 30 * time.Second
+	// presenceTTL is how long the presence of an online user outlives the
+	// node that last stored it
+	presenceTTL = 3 * presenceSweepInterval
+	// maxStatusDuration bounds how long a chosen status can last
+	maxStatusDuration = 7 * 24 * time.Hour
+	// presenceRoomPrefix names the rooms of sockets following a user's presence
+	presenceRoomPrefix = "presence:"
+)
+
+// presenceRoom returns the room of sockets following a user's presence
+func presenceRoom(userName string) socket.Room {
+	return socket.Room(presenceRoomPrefix + userName)
+}
+
+// presenceOf works out a user's presence from their chosen status and
+// their devices across the cluster
+func (h *SocketIOHandler) presenceOf(ctx context.Context, userName string, devices []*models.SessionInfo) (*models.Presence, error) {
+	status, err := h.redisService.GetUserStatus(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invisible users look like they went offline
+	if len(devices) == 0 || (status != nil && status.Status == models.PresenceInvisible) {
+		lastSeen, err := h.redisService.GetLastSeen(ctx, userName)
+		if err != nil {
+			return nil, err
+		}
+		return &models.Presence{UserName: userName, Status: models.PresenceOffline, LastSeen: lastSeen}, nil
+	}
+
+	presence := &models.Presence{UserName: userName, Status: models.PresenceAvailable}
+	if status != nil {
+		presence.Status = status.Status
+		presence.Text = status.Text
+	}
+
+	if presence.Status == models.PresenceAvailable && idleDevices(devices, h.config.Presence.IdleTimeout) {
+		presence.Status = models.PresenceAway
+		presence.Idle = true
+	}
+	return presence, nil
+}
+
+// hiddenPresence is what users who blocked someone show them: offline,
+// without when they were last seen
+func hiddenPresence(userName string) *models.Presence {
+	return &models.Presence{UserName: userName, Status: models.PresenceOffline}
+}
+
+// hidePresences replaces the presences of the users who blocked viewer with
+// hidden ones
+func (h *SocketIOHandler) hidePresences(ctx context.Context, viewer string, presences []*models.Presence) error {
+	blockers, err := h.redisService.GetBlockers(ctx, viewer)
+	if err != nil {
+		return err
+	}
+	hidden := make(map[string]bool, len(blockers))
+	for _, blocker := range blockers {
+		hidden[blocker] = true
+	}
+	for i, presence := range presences {
+		if hidden[presence.UserName] {
+			presences[i] = hiddenPresence(presence.UserName)
+		}
+	}
+	return nil
+}
+
+// idleDevices reports whether none of the devices was used for timeout
+func idleDevices(devices []*models.SessionInfo, timeout time.Duration) bool {
+	for _, device := range devices {
+		lastActive := device.LastActiveAt
+		if lastActive.IsZero() {
+			lastActive = device.ConnectedAt
+		}
+		if time.Since(lastActive) < timeout {
+			return false
+		}
+	}
+	return true
+}
+
+// updatePresence recomputes a user's presence and tells their followers
+// if it changed
+func (h *SocketIOHandler) updatePresence(ctx context.Context, userName string) {
+	devices, err := h.userDevices(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to list devices")
+		return
+	}
+	h.refreshPresence(ctx, userName, devices)
+}
+
+// refreshPresence stores a user's presence and, if it changed, schedules
+// telling their audience
+func (h *SocketIOHandler) refreshPresence(ctx context.Context, userName string, devices []*models.SessionInfo) {
+	presence, err := h.presenceOf(ctx, userName, devices)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get presence")
+		return
+	}
+
+	changed, err := h.redisService.StorePresence(ctx, presence, presenceTTL)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to store presence")
+		return
+	}
+	if changed {
+		h.schedulePresenceAnnouncement(userName)
+	}
+}
+
+// schedulePresenceAnnouncement announces a user's presence at the end of
+// the coalescing window, so that rapid changes are announced once
+func (h *SocketIOHandler) schedulePresenceAnnouncement(userName string) {
+	h.presenceMu.Lock()
+	defer h.presenceMu.Unlock()
+
+	if h.pendingPresence[userName] {
+		return
+	}
+	h.pendingPresence[userName] = true
+
+	time.AfterFunc(h.config.Presence.CoalesceWindow, func() {
+		h.presenceMu.Lock()
+		delete(h.pendingPresence, userName)
+		h.presenceMu.Unlock()
+
+		h.announcePresence(context.Background(), userName)
+	})
+}
+
+// announcePresence tells the audience of a user, on every node, about their
+// current presence. Nothing is sent when it is the presence last announced,
+// by this node or another, as after a device reconnects quickly.
+func (h *SocketIOHandler) announcePresence(ctx context.Context, userName string) {
+	presences, err := h.redisService.GetPresences(ctx, []string{userName})
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get presence")
+		return
+	}
+	presence := presences[0]
+
+	changed, err := h.redisService.AnnouncePresence(ctx, presence)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to announce presence")
+		return
+	}
+	if !changed {
+		return
+	}
+
+	// The audience is the user's rooms and direct message contacts, plus
+	// anyone subscribed to the user
+	rooms, err := h.redisService.GetUserRooms(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get user rooms")
+	}
+	contacts, err := h.redisService.GetDMContacts(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get DM contacts")
+	}
+	// Users the user blocked are left out, even when they share a room or
+	// follow the user
+	blocked, err := h.redisService.GetBlockedUsers(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get blocked users")
+		return
+	}
+
+	h.publishControl(&models.ControlEvent{
+		Type:     models.ControlPresence,
+		Presence: presence,
+		Rooms:    rooms,
+		Users:    contacts,
+		Except:   blocked,
+	})
+}
+
+// deliverPresence sends a presence change to the sockets of this node in
+// its audience. Sockets in several of the audience rooms receive it once.
+func (h *SocketIOHandler) deliverPresence(event *models.ControlEvent) {
+	rooms := []socket.Room{presenceRoom(event.Presence.UserName)}
+	for _, room := range event.Rooms {
+		rooms = append(rooms, socket.Room(room))
+	}
+	for _, userName := range event.Users {
+		for _, sessionID := range h.userSessionIDs(userName) {
+			rooms = append(rooms, socket.Room(sessionID))
+		}
+	}
+	var except []socket.Room
+	for _, userName := range event.Except {
+		for _, sessionID := range h.userSessionIDs(userName) {
+			except = append(except, socket.Room(sessionID))
+		}
+	}
+
+	h.server.To(rooms...).Except(except...).Emit(string(models.EventUserStatus), event.Presence)
+}
+
+// recordLastSeen remembers when a user went offline. Invisible users were
+// last seen when they became invisible.
+func (h *SocketIOHandler) recordLastSeen(ctx context.Context, userName string) {
+	status, err := h.redisService.GetUserStatus(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get user status")
+	}
+	if status != nil && status.Status == models.PresenceInvisible {
+		return
+	}
+
+	if err := h.redisService.SetLastSeen(ctx, userName, time.Now()); err != nil {
+		h.logger.WithError(err).Warn("Failed to record last seen")
+	}
+}
+
+// runPresenceSweeper periodically refreshes the presence of the users
+// connected to this node, so that idle users turn away, expired statuses
+// are dropped and snapshots of online users do not expire
+func (h *SocketIOHandler) runPresenceSweeper() {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.mu.RLock()
+		users := make([]string, 0, len(h.userSessions))
+		for userName := range h.userSessions {
+			users = append(users, userName)
+		}
+		h.mu.RUnlock()
+		if len(users) == 0 {
+			continue
+		}
+
+		ctx := context.Background()
+		sessions, err := h.redisService.GetClusterSessions(ctx)
+		if err != nil {
+			h.logger.WithError(err).Warn("Failed to get cluster sessions")
+			continue
+		}
+
+		devices := make(map[string][]*models.SessionInfo)
+		for _, session := range sessions {
+			devices[session.UserName] = append(devices[session.UserName], session)
+		}
+		for _, userName := range users {
+			h.refreshPresence(ctx, userName, devices[userName])
+		}
+	}
+}
+
+// handleSetStatus sets the status the user chose, shown on all of their
+// devices. Choosing available without text or expiry clears it.
+func (h *SocketIOHandler) handleSetStatus(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	status, _ := data["status"].(string)
+	text, _ := data["text"].(string)
+	expiresIn, _ := data["expiresIn"].(float64)
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before setting a status")
+	}
+
+	ctx := context.Background()
+	var userStatus *models.UserStatus
+	if models.PresenceStatus(status) != models.PresenceAvailable || text != "" || expiresIn > 0 {
+		now := time.Now()
+		userStatus = &models.UserStatus{
+			Status: models.PresenceStatus(status),
+			Text:   text,
+			SetAt:  now,
+		}
+		if expiresIn > 0 {
+			expiresAt := now.Add(time.Duration(expiresIn) * time.Second)
+			userStatus.ExpiresAt = &expiresAt
+		}
+
+		if userStatus.Status == models.PresenceInvisible {
+			h.recordLastSeen(ctx, user.ID)
+		}
+		if err := h.redisService.SetUserStatus(ctx, user.ID, userStatus); err != nil {
+			h.logger.WithError(err).Error("Failed to set user status")
+			return newEventError(errInternal, "Failed to set status")
+		}
+	} else if err := h.redisService.ClearUserStatus(ctx, user.ID); err != nil {
+		h.logger.WithError(err).Error("Failed to clear user status")
+		return newEventError(errInternal, "Failed to set status")
+	}
+
+	h.publishStateUpdate(client, user.ID, &models.StateUpdate{
+		Kind:   models.StateStatus,
+		Status: userStatus,
+	})
+	h.updatePresence(ctx, user.ID)
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name": user.ID,
+		"status":    status,
+	}).Info("User status set")
+
+	return nil
+}
+
+// handleSubscribePresence makes the socket follow the presence of users and
+// sends their current presence. Users who blocked the follower look offline
+// and their changes are not sent.
+func (h *SocketIOHandler) handleSubscribePresence(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	users := stringList(data["users"])
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before following presence")
+	}
+
+	following := make(map[socket.Room]bool)
+	for _, room := range client.Rooms().Keys() {
+		if strings.HasPrefix(string(room), presenceRoomPrefix) {
+			following[room] = true
+		}
+	}
+	for _, userName := range users {
+		following[presenceRoom(userName)] = true
+	}
+	if limit := h.config.Presence.MaxSubscriptions; len(following) > limit {
+		return newEventError(errOutOfRange, "Too many presence subscriptions").withDetail("max", limit)
+	}
+
+	ctx := context.Background()
+	presences, err := h.redisService.GetPresences(ctx, users)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get presences")
+		return newEventError(errInternal, "Failed to get presence")
+	}
+	if err := h.hidePresences(ctx, user.ID, presences); err != nil {
+		h.logger.WithError(err).Error("Failed to get blockers")
+		return newEventError(errInternal, "Failed to get presence")
+	}
+
+	for _, userName := range users {
+		client.Join(presenceRoom(userName))
+	}
+	client.Emit(string(models.EventPresence), map[string]interface{}{
+		"presences": presences,
+	})
+	return nil
+}
+
+// handleUnsubscribePresence stops the socket following the presence of users
+func (h *SocketIOHandler) handleUnsubscribePresence(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	for _, userName := range stringList(data["users"]) {
+		client.Leave(presenceRoom(userName))
+	}
+	return nil
+}
+
+// stringList converts a validated list of strings
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// HandleGetPresence returns a user's presence, including when they were
+// last seen if they are offline. Users who blocked the caller look offline.
+func (h *SocketIOHandler) HandleGetPresence(c *gin.Context) {
+	ctx := c.Request.Context()
+	presences, err := h.redisService.GetPresences(ctx, []string{c.Param("userName")})
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get presence")
+		respondError(c, errInternal, "Failed to get presence")
+		return
+	}
+	if err := h.hidePresences(ctx, currentUser(c), presences); err != nil {
+		h.logger.WithError(err).Error("Failed to get blockers")
+		respondError(c, errInternal, "Failed to get presence")
+		return
+	}
+	c.JSON(http.StatusOK, presences[0])
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPresenceHidesBlockers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h, _ := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Presence.CoalesceWindow = 10 * time.Millisecond
+	})
+	endpoint := newTestServer(t, h)
+	addTestMembers(t, h, "general", "alice", "bob", "dave")
+	if err := h.redisService.BlockUser(t.Context(), "bob", "alice"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	clients := map[string]*testClient{}
+	for _, name := range []string{"alice", "dave", "bob"} {
+		c := dialTestClient(t, endpoint)
+		c.join(name)
+		c.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+		clients[name] = c
+	}
+	alice, bob, dave := clients["alice"], clients["bob"], clients["dave"]
+	bob.emitOK("set_status", map[string]interface{}{"status": "do_not_disturb"})
+
+	// bob's changes reach the room, except alice
+	for {
+		var presence models.Presence
+		if err := json.Unmarshal(dave.waitEvent(string(models.EventUserStatus)), &presence); err != nil {
+			t.Fatalf("invalid presence: %v", err)
+		}
+		if presence.UserName == "bob" && presence.Status == models.PresenceDoNotDisturb {
+			break
+		}
+	}
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-alice.events:
+			if event.name != string(models.EventUserStatus) {
+				continue
+			}
+			var presence models.Presence
+			if err := json.Unmarshal(event.data, &presence); err != nil {
+				t.Fatalf("invalid presence: %v", err)
+			}
+			if presence.UserName == "bob" {
+				t.Errorf("alice was told bob is %s", presence.Status)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	tests := []struct {
+		viewer string
+		client *testClient
+		want   models.PresenceStatus
+	}{
+		{viewer: "alice", client: alice, want: models.PresenceOffline},
+		{viewer: "dave", client: dave, want: models.PresenceDoNotDisturb},
+	}
+	for _, tt := range tests {
+		t.Run(tt.viewer, func(t *testing.T) {
+			tt.client.emitOK("subscribe_presence", map[string]interface{}{"users": []string{"bob"}})
+			var subscribed struct {
+				Presences []models.Presence `json:"presences"`
+			}
+			if err := json.Unmarshal(tt.client.waitEvent(string(models.EventPresence)), &subscribed); err != nil {
+				t.Fatalf("invalid presences: %v", err)
+			}
+			if len(subscribed.Presences) != 1 || subscribed.Presences[0].Status != tt.want {
+				t.Errorf("subscribe_presence: got %+v, want %s", subscribed.Presences, tt.want)
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/users/bob/presence", nil)
+			c.Params = gin.Params{{Key: "userName", Value: "bob"}}
+			c.Set(contextUserKey, tt.viewer)
+			h.HandleGetPresence(c)
+
+			var presence models.Presence
+			if err := json.Unmarshal(w.Body.Bytes(), &presence); err != nil {
+				t.Fatalf("invalid presence: %v", err)
+			}
+			if w.Code != http.StatusOK || presence.Status != tt.want {
+				t.Errorf("GET presence: got %d %+v, want %s", w.Code, presence, tt.want)
+			}
+			if tt.want == models.PresenceOffline && presence.LastSeen != nil {
+				t.Errorf("GET presence revealed when bob was last seen")
+			}
+		})
+	}
+
+	// Following bob does not let alice see his changes either
+	bob.emitOK("set_status", map[string]interface{}{"status": "available", "text": "back"})
+	dave.waitEvent(string(models.EventUserStatus))
+	alice.expectNoEvent(string(models.EventUserStatus), 200*time.Millisecond)
+}
+
+// benchRoomSize is how many sockets share a room in the presence benchmarks
+const benchRoomSize = 20
+
+// countEvents counts the events with the given name received by clients
+// until the benchmark ends
+func countEvents(b *testing.B, clients []*testClient, name string) *atomic.Int64 {
+	var count atomic.Int64
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	for _, c := range clients {
+		go func(c *testClient) {
+			for {
+				select {
+				case event := <-c.events:
+					if event.name == name {
+						count.Add(1)
+					}
+				case <-done:
+					return
+				}
+			}
+		}(c)
+	}
+	return &count
+}
+
+// joinBenchClients connects n clients, each joining as its own user and
+// a room shared with benchRoomSize-1 others
+func joinBenchClients(b *testing.B, endpoint string, n int) []*testClient {
+	clients := make([]*testClient, n)
+	for i := range clients {
+		c := dialTestClient(b, endpoint)
+		c.join(fmt.Sprintf("user-%d", i))
+		c.emitOK("join_room", map[string]interface{}{"roomId": fmt.Sprintf("room-%d", i/benchRoomSize)})
+		clients[i] = c
+	}
+	return clients
+}
+
+// BenchmarkPresenceCoalescing flaps a user offline and back online in a
+// room. Without coalescing each flap would send two user_status events to
+// every room member; with it, a flap that ends where it started sends none.
+func BenchmarkPresenceCoalescing(b *testing.B) {
+	h, _ := newTestHandler(b, func(cfg *config.Config) {
+		cfg.Presence.CoalesceWindow = 50 * time.Millisecond
+	})
+	clients := joinBenchClients(b, newTestServer(b, h), benchRoomSize-1)
+	addTestMembers(b, h, "room-0", "flapper")
+
+	ctx := b.Context()
+	devices := []*models.SessionInfo{{SessionID: "flapper-device", UserName: "flapper", ConnectedAt: time.Now()}}
+	h.refreshPresence(ctx, "flapper", devices)
+	time.Sleep(3 * h.config.Presence.CoalesceWindow)
+	received := countEvents(b, clients, string(models.EventUserStatus))
+
+	b.ResetTimer()
+	for range b.N {
+		h.refreshPresence(ctx, "flapper", nil)
+		h.refreshPresence(ctx, "flapper", devices)
+	}
+	b.StopTimer()
+
+	time.Sleep(3 * h.config.Presence.CoalesceWindow)
+	b.ReportMetric(float64(received.Load())/float64(b.N), "user_status/op")
+}
+
+// BenchmarkPresenceFanOut delivers a presence change to the sockets of one
+// node, scoped to the user's room or, for comparison, to every socket. It
+// measures the cost of sending; the engine drops all but the first of
+// several broadcasts flushed together, so arrivals are not counted.
+func BenchmarkPresenceFanOut(b *testing.B) {
+	for _, sockets := range []int{50, 200} {
+		h, _ := newTestHandler(b)
+		clients := joinBenchClients(b, newTestServer(b, h), sockets)
+		// Keep the clients reading so that the server never waits on them
+		countEvents(b, clients, string(models.EventUserStatus))
+
+		presence := &models.Presence{UserName: "user-0", Status: models.PresenceAway}
+		fanOuts := []struct {
+			name    string
+			deliver func()
+			reached int
+		}{
+			{
+				name: "scoped",
+				deliver: func() {
+					h.deliverPresence(&models.ControlEvent{
+						Type:     models.ControlPresence,
+						Presence: presence,
+						Rooms:    []string{"room-0"},
+					})
+				},
+				reached: benchRoomSize,
+			},
+			{
+				name:    "global",
+				deliver: func() { h.server.Emit(string(models.EventUserStatus), presence) },
+				reached: sockets,
+			},
+		}
+		for _, fanOut := range fanOuts {
+			b.Run(fmt.Sprintf("%s/sockets=%d", fanOut.name, sockets), func(b *testing.B) {
+				for range b.N {
+					fanOut.deliver()
+				}
+				b.ReportMetric(float64(fanOut.reached), "deliveries/op")
+			})
+		}
+	}
+}
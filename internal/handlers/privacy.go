@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// maxMentions bounds how many users one message can notify
+const maxMentions = 10
+
+// mentionPattern matches "@name" mentions in message text
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.\-]+)`)
+
+// canSendDirect reports whether the receiver accepts direct messages from
+// the sender, according to their block list and DM privacy mode
+func (h *SocketIOHandler) canSendDirect(ctx context.Context, sender, receiver string) (bool, error) {
+	if sender == receiver {
+		return true, nil
+	}
+
+	blocked, err := h.redisService.IsBlocked(ctx, receiver, sender)
+	if err != nil || blocked {
+		return false, err
+	}
+
+	privacy, err := h.redisService.GetDMPrivacy(ctx, receiver)
+	if err != nil {
+		return false, err
+	}
+
+	switch privacy {
+	case models.DMPrivacyNobody:
+		return false, nil
+	case models.DMPrivacySharedRooms:
+		return h.redisService.ShareRoom(ctx, sender, receiver)
+	default:
+		return true, nil
+	}
+}
+
+// checkSendAccess verifies that the sender may post where a message or file
+// is addressed: in a room they are a member of, or directly to a user who
+// accepts their messages, but not both at once
+func (h *SocketIOHandler) checkSendAccess(ctx context.Context, sender, roomID, receiver string) *eventError {
+	if roomID != "" && receiver != "" {
+		return newEventError(errInvalidValue, "Specify either roomId or receiver")
+	}
+
+	if roomID != "" {
+		member, err := h.redisService.IsRoomMember(ctx, roomID, sender)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to check room membership")
+			return newEventError(errInternal, "Failed to check access")
+		}
+		if !member {
+			return newEventError(errForbidden, "Not a member of this room")
+		}
+	}
+
+	return h.checkDirectMessage(ctx, sender, receiver)
+}
+
+// checkDirectMessage returns a forbidden error when the receiver does not
+// accept direct messages from the sender. Blocks and privacy modes are not
+// told apart so that senders cannot tell whether they were blocked.
+func (h *SocketIOHandler) checkDirectMessage(ctx context.Context, sender, receiver string) *eventError {
+	if receiver == "" {
+		return nil
+	}
+
+	allowed, err := h.canSendDirect(ctx, sender, receiver)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check direct message privacy")
+		return newEventError(errInternal, "Failed to check access")
+	}
+	if !allowed {
+		return newEventError(errForbidden, "This user does not accept direct messages from you")
+	}
+	return nil
+}
+
+// blockerSessions returns the local sessions of users who have blocked a
+// user, so that broadcasts can leave them out
+func (h *SocketIOHandler) blockerSessions(ctx context.Context, userName string) []socket.Room {
+	blockers, err := h.redisService.GetBlockers(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to get blockers")
+		return nil
+	}
+
+	var rooms []socket.Room
+	for _, blocker := range blockers {
+		for _, sessionID := range h.userSessionIDs(blocker) {
+			rooms = append(rooms, socket.Room(sessionID))
+		}
+	}
+	return rooms
+}
+
+// notifyMentions sends a "mention" event to the room members mentioned in a
+// message, except those who have blocked the sender
+func (h *SocketIOHandler) notifyMentions(ctx context.Context, message *models.Message) {
+	if message.Room == "" || message.Type == models.CodeMessage {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(message.Content, -1) {
+		// Mentions often end a sentence
+		userName := strings.TrimRight(match[1], ".-")
+		if userName == "" || userName == message.Sender || seen[userName] {
+			continue
+		}
+		seen[userName] = true
+		if len(seen) > maxMentions {
+			break
+		}
+
+		member, err := h.redisService.IsRoomMember(ctx, message.Room, userName)
+		if err != nil || !member {
+			continue
+		}
+		blocked, err := h.redisService.IsBlocked(ctx, userName, message.Sender)
+		if err != nil || blocked {
+			continue
+		}
+
+		h.broadcastToUserDevices(userName, string(models.EventMention), map[string]interface{}{
+			"message": message,
+		}, "")
+	}
+}
+
+// HandleGetBlockedUsers returns the authenticated user's block list
+func (h *SocketIOHandler) HandleGetBlockedUsers(c *gin.Context) {
+	blocked, err := h.redisService.GetBlockedUsers(c.Request.Context(), currentUser(c))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get blocked users")
+		respondError(c, errInternal, "Failed to get blocked users")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"blocked": blocked})
+}
+
+// HandleBlockUser adds a user to the authenticated user's block list
+func (h *SocketIOHandler) HandleBlockUser(c *gin.Context) {
+	userName := currentUser(c)
+	blockedName := c.Param("userName")
+
+	if blockedName == userName {
+		respondError(c, errInvalidValue, "You cannot block yourself")
+		return
+	}
+	if len(blockedName) > maxNameLength {
+		respondError(c, errTooLong, "User name too long")
+		return
+	}
+
+	if err := h.redisService.BlockUser(c.Request.Context(), userName, blockedName); err != nil {
+		h.logger.WithError(err).Error("Failed to block user")
+		respondError(c, errInternal, "Failed to block user")
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name":    userName,
+		"blocked_user": blockedName,
+	}).Info("User blocked")
+
+	h.HandleGetBlockedUsers(c)
+}
+
+// HandleUnblockUser removes a user from the authenticated user's block list
+func (h *SocketIOHandler) HandleUnblockUser(c *gin.Context) {
+	userName := currentUser(c)
+	blockedName := c.Param("userName")
+
+	if err := h.redisService.UnblockUser(c.Request.Context(), userName, blockedName); err != nil {
+		h.logger.WithError(err).Error("Failed to unblock user")
+		respondError(c, errInternal, "Failed to unblock user")
+		return
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"user_name":      userName,
+		"unblocked_user": blockedName,
+	}).Info("User unblocked")
+
+	h.HandleGetBlockedUsers(c)
+}
+
+// HandleGetPrivacy returns the authenticated user's privacy settings
+func (h *SocketIOHandler) HandleGetPrivacy(c *gin.Context) {
+	privacy, err := h.redisService.GetDMPrivacy(c.Request.Context(), currentUser(c))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get privacy settings")
+		respondError(c, errInternal, "Failed to get privacy settings")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dmPrivacy": privacy})
+}
+
+// HandleSetPrivacy updates the authenticated user's privacy settings
+func (h *SocketIOHandler) HandleSetPrivacy(c *gin.Context) {
+	var request struct {
+		DMPrivacy models.DMPrivacy `json:"dmPrivacy"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, errInvalidPayload, "Invalid privacy settings")
+		return
+	}
+	if !request.DMPrivacy.Valid() {
+		respondError(c, errInvalidValue, "dmPrivacy must be one of everyone, shared_rooms, nobody")
+		return
+	}
+
+	if err := h.redisService.SetDMPrivacy(c.Request.Context(), currentUser(c), request.DMPrivacy); err != nil {
+		h.logger.WithError(err).Error("Failed to set privacy settings")
+		respondError(c, errInternal, "Failed to update privacy settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dmPrivacy": request.DMPrivacy})
+}
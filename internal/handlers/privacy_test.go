@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSenderComesFromSession(t *testing.T) {
+	h, _ := newTestHandler(t)
+	endpoint := newTestServer(t, h)
+	addTestMembers(t, h, "general", "alice", "bob", "dave")
+	if err := h.redisService.BlockUser(t.Context(), "bob", "alice"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	clients := map[string]*testClient{}
+	for _, name := range []string{"alice", "bob", "dave"} {
+		c := dialTestClient(t, endpoint)
+		c.join(name)
+		c.emitOK("join_room", map[string]interface{}{"roomId": "general", "userName": name})
+		clients[name] = c
+	}
+	alice, bob, dave := clients["alice"], clients["bob"], clients["dave"]
+
+	// Claiming another sender does not get around bob's block
+	direct := []struct {
+		event string
+		data  map[string]interface{}
+	}{
+		{event: "message", data: map[string]interface{}{"sender": "carol", "receiver": "bob", "content": "hi"}},
+		{event: "file_upload", data: map[string]interface{}{
+			"sender": "carol", "receiver": "bob", "fileName": "notes.txt",
+			"fileData": base64.StdEncoding.EncodeToString([]byte("quarterly numbers")),
+		}},
+	}
+	for _, tt := range direct {
+		if code := errorCode(alice.emit(tt.event, tt.data)); code != errForbidden.Code {
+			t.Errorf("%s: got %q, want %s", tt.event, code, errForbidden.Code)
+		}
+	}
+
+	// Room messages are sent as alice, so bob is not told about the mention
+	alice.emitOK("message", map[string]interface{}{"sender": "carol", "roomId": "general", "content": "hi @bob @dave"})
+
+	var message struct {
+		Sender string `json:"sender"`
+	}
+	if err := json.Unmarshal(dave.waitEvent("message"), &message); err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	if message.Sender != "alice" {
+		t.Errorf("sent as %q, want alice", message.Sender)
+	}
+	dave.waitEvent("mention")
+	bob.expectNoEvent("mention", 200*time.Millisecond)
+}
+
+func TestWriteEventsRequireJoin(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := dialTestClient(t, newTestServer(t, h))
+
+	events := map[string]map[string]interface{}{
+		"message": {"sender": "alice", "roomId": "general", "content": "hi"},
+		"file_upload": {
+			"sender": "alice", "roomId": "general", "fileName": "notes.txt",
+			"fileData": base64.StdEncoding.EncodeToString([]byte("quarterly numbers")),
+		},
+	}
+	for event, data := range events {
+		if code := errorCode(c.emit(event, data)); code != errUnauthorized.Code {
+			t.Errorf("%s: got %q, want %s", event, code, errUnauthorized.Code)
+		}
+	}
+}
+
+func TestSendAccess(t *testing.T) {
+	h, _ := newTestHandler(t)
+	addTestMembers(t, h, "general", "alice")
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("mallory")
+
+	fileData := base64.StdEncoding.EncodeToString([]byte("quarterly numbers"))
+	tests := []struct {
+		name  string
+		event string
+		data  map[string]interface{}
+		want  *errorKind
+	}{
+		{
+			name:  "message to a room the sender is not in",
+			event: "message",
+			data:  map[string]interface{}{"roomId": "general", "content": "hi"},
+			want:  errForbidden,
+		},
+		{
+			name:  "message to a room and a user",
+			event: "message",
+			data:  map[string]interface{}{"roomId": "general", "receiver": "alice", "content": "hi"},
+			want:  errInvalidValue,
+		},
+		{
+			name:  "file to a room the sender is not in",
+			event: "file_upload",
+			data:  map[string]interface{}{"roomId": "general", "fileName": "notes.txt", "fileData": fileData},
+			want:  errForbidden,
+		},
+		{
+			name:  "file to a room and a user",
+			event: "file_upload",
+			data: map[string]interface{}{
+				"roomId": "general", "receiver": "alice", "fileName": "notes.txt", "fileData": fileData,
+			},
+			want: errInvalidValue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(c.emit(tt.event, tt.data)); code != tt.want.Code {
+				t.Errorf("got %q, want %s", code, tt.want.Code)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// checkRateLimit applies the configured session, user and room rate limits
+// to an event and returns a rate_limited error, with the delay after which
+// to retry, when any of them is exceeded
+func (h *SocketIOHandler) checkRateLimit(client *socket.Socket, event string, args []any) error {
+	ctx := context.Background()
+	sessionID := string(client.Id())
+
+	// Users are only known once the session has joined
+	var userName, roomID string
+	if user, ok := h.sessionUser(sessionID); ok {
+		userName = user.ID
+		roomID = h.rateLimitedRoom(ctx, userName, args)
+	}
+
+	allowed, retryAfter := h.rateLimiter.Allow(ctx, event, sessionID, userName, roomID)
+	if allowed {
+		return nil
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"session_id": sessionID,
+		"user_name":  userName,
+		"room_id":    roomID,
+		"event":      event,
+	}).Debug("Event rate limited")
+
+	return newEventError(errRateLimited, "").withDetail("retryAfterMs", retryAfter.Milliseconds())
+}
+
+// rateLimitedRoom returns the room whose bucket an event is charged to: the
+// room it names, if the user is a member. Anyone else could otherwise drain
+// the bucket of a room they are not in, so their events are only charged to
+// their own session and user buckets.
+func (h *SocketIOHandler) rateLimitedRoom(ctx context.Context, userName string, args []any) string {
+	if len(args) == 0 {
+		return ""
+	}
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	roomID, _ := data["roomId"].(string)
+	if roomID == "" {
+		return ""
+	}
+
+	member, err := h.redisService.IsRoomMember(ctx, roomID, userName)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to check room membership for rate limiting")
+		return ""
+	}
+	if !member {
+		return ""
+	}
+	return roomID
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"testing"
+
+	"im-demo/internal/config"
+)
+
+func TestEventRateLimit(t *testing.T) {
+	h, _ := newTestHandler(t, func(cfg *config.Config) {
+		cfg.RateLimit = config.RateLimitConfig{Enabled: true, Events: map[string]config.EventLimits{
+			"typing": {Session: config.RateLimit{Rate: 0.001, Burst: 2}},
+		}}
+	})
+	addTestMembers(t, h, "general", "alice")
+	endpoint := newTestServer(t, h)
+	c := dialTestClient(t, endpoint)
+	c.join("alice")
+
+	typing := map[string]interface{}{"roomId": "general", "isTyping": true}
+	for i := 0; i < 2; i++ {
+		if code := errorCode(c.emit("typing", typing)); code != "" {
+			t.Fatalf("event %d refused with %s", i+1, code)
+		}
+	}
+
+	reply := c.emit("typing", typing)
+	if code := errorCode(reply); code != errRateLimited.Code {
+		t.Fatalf("got %v, want %s", reply, errRateLimited.Code)
+	}
+	errPayload, _ := reply["error"].(map[string]interface{})
+	if retryable, _ := errPayload["retryable"].(bool); !retryable {
+		t.Errorf("rate limit not retryable: %v", reply)
+	}
+	details, _ := errPayload["details"].(map[string]interface{})
+	if wait, _ := details["retryAfterMs"].(float64); wait <= 0 {
+		t.Errorf("no retry delay: %v", reply)
+	}
+
+	// Session buckets are per device
+	other := dialTestClient(t, endpoint)
+	other.join("alice")
+	if code := errorCode(other.emit("typing", typing)); code != "" {
+		t.Error("another device of the user was limited")
+	}
+}
+
+func TestRoomRateLimitRequiresMembership(t *testing.T) {
+	h, _ := newTestHandler(t, func(cfg *config.Config) {
+		cfg.RateLimit = config.RateLimitConfig{Enabled: true, Events: map[string]config.EventLimits{
+			"message": {Room: config.RateLimit{Rate: 0.001, Burst: 2}},
+		}}
+	})
+	addTestMembers(t, h, "general", "alice")
+	endpoint := newTestServer(t, h)
+	message := map[string]interface{}{"roomId": "general", "content": "hi"}
+
+	// Outsiders cannot drain the room's bucket
+	stranger := dialTestClient(t, endpoint)
+	mallory := dialTestClient(t, endpoint)
+	mallory.join("mallory")
+	spam := []struct {
+		name   string
+		client *testClient
+		code   string
+	}{
+		{name: "not joined", client: stranger, code: errUnauthorized.Code},
+		{name: "not a member", client: mallory, code: errForbidden.Code},
+	}
+	for _, tt := range spam {
+		for range 5 {
+			if code := errorCode(tt.client.emit("message", message)); code != tt.code {
+				t.Fatalf("%s: got %q, want %s", tt.name, code, tt.code)
+			}
+		}
+	}
+
+	alice := dialTestClient(t, endpoint)
+	alice.join("alice")
+	for i := range 2 {
+		if code := errorCode(alice.emit("message", message)); code != "" {
+			t.Fatalf("message %d refused with %s", i+1, code)
+		}
+	}
+	if code := errorCode(alice.emit("message", message)); code != errRateLimited.Code {
+		t.Errorf("got %q, want %s once the room's bucket is empty", code, errRateLimited.Code)
+	}
+}
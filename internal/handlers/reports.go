@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+const (
+	// maxReasonLength bounds report reasons and moderator notes, in characters
+	maxReasonLength = 500
+	// expiryReasonModerated marks messages deleted by a moderator
+	expiryReasonModerated = "moderated"
+)
+
+// mutedEvents are refused while the sender is muted
+var mutedEvents = map[string]bool{
+	"message":         true,
+	"file_upload":     true,
+	"upload_init":     true,
+	"upload_complete": true,
+	"typing":          true,
+}
+
+// handleReportMessage files a user's report of a message in the moderation queue
+func (h *SocketIOHandler) handleReportMessage(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	messageID, _ := data["messageId"].(string)
+	reason, _ := data["reason"].(string)
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before reporting messages")
+	}
+	reporter := user.ID
+
+	ctx := context.Background()
+	message, err := h.redisService.GetMessage(ctx, messageID)
+	if err != nil {
+		return newEventError(errNotFound, "Message not found")
+	}
+
+	allowed, err := h.canAccessMessage(ctx, message, reporter)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check message access")
+		return newEventError(errInternal, "Failed to report message")
+	}
+	if !allowed {
+		return newEventError(errNotFound, "Message not found")
+	}
+	if message.Sender == reporter {
+		return newEventError(errInvalidValue, "You cannot report your own messages")
+	}
+
+	added, err := h.redisService.AddMessageReporter(ctx, messageID, reporter)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to record reporter")
+		return newEventError(errInternal, "Failed to report message")
+	}
+	if !added {
+		return newEventError(errConflict, "You already reported this message")
+	}
+
+	report := &models.MessageReport{
+		ID:        generateMessageID(),
+		MessageID: messageID,
+		Reporter:  reporter,
+		Reason:    reason,
+		Message:   message,
+		Status:    models.ReportOpen,
+		CreatedAt: time.Now(),
+	}
+	if err := h.redisService.StoreReport(ctx, report); err != nil {
+		h.logger.WithError(err).Error("Failed to store report")
+		return newEventError(errInternal, "Failed to report message")
+	}
+
+	client.Emit(string(models.EventMessageReported), map[string]interface{}{
+		"reportId":  report.ID,
+		"messageId": messageID,
+	})
+
+	for _, admin := range h.moderators(message.Room) {
+		h.broadcastToUserDevices(admin, string(models.EventReportCreated), map[string]interface{}{
+			"report": report,
+		}, "")
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"report_id":  report.ID,
+		"message_id": messageID,
+		"reporter":   reporter,
+		"sender":     message.Sender,
+	}).Info("Message reported")
+
+	return nil
+}
+
+// checkSanctions refuses events from banned users, and messages, files and
+// typing indicators from muted users. Users are identified by their session
+// or, for "join", by the name they join with; other events from sessions
+// that have not joined are refused before this.
+func (h *SocketIOHandler) checkSanctions(client *socket.Socket, event string, args []any) error {
+	var userName string
+	if user, ok := h.sessionUser(string(client.Id())); ok {
+		userName = user.ID
+	} else if event == "join" && len(args) > 0 {
+		if data, ok := args[0].(map[string]interface{}); ok {
+			userName, _ = data["userName"].(string)
+		}
+	}
+	if userName == "" {
+		return nil
+	}
+	if err := h.checkUserSanctions(context.Background(), userName, event); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkUserSanctions refuses an event, or its HTTP counterpart, from a
+// banned user, or from a muted user if it is one of mutedEvents
+func (h *SocketIOHandler) checkUserSanctions(ctx context.Context, userName, event string) *eventError {
+	// Unlike rate limits, sanctions fail closed: a banned user must not get
+	// back in during an outage, and little works without Redis anyway
+	sanctions, err := h.redisService.GetSanctions(ctx, userName)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check sanctions")
+		return newEventError(errInternal, "Failed to check access")
+	}
+
+	for _, sanction := range sanctions {
+		if sanction.Kind == models.SanctionBan || (sanction.Kind == models.SanctionMute && mutedEvents[event]) {
+			return sanctionError(sanction)
+		}
+	}
+	return nil
+}
+
+// sanctionError describes a sanction to the sanctioned user
+func sanctionError(sanction *models.Sanction) *eventError {
+	message := "You are muted"
+	if sanction.Kind == models.SanctionBan {
+		message = "You are banned"
+	}
+
+	err := newEventError(errForbidden, message).withDetail("sanction", sanction.Kind)
+	if sanction.Until != nil {
+		err.withDetail("until", *sanction.Until)
+	}
+	return err
+}
+
+// deleteMessageAsModerator removes a message and its attachment and tells
+// its audience on every node
+func (h *SocketIOHandler) deleteMessageAsModerator(ctx context.Context, message *models.Message) error {
+	if message.Type == models.FileMessage || message.Type == models.ImageMessage {
+		h.releaseMessageFile(ctx, message)
+	}
+
+	if err := h.redisService.DeleteMessage(ctx, message.ID); err != nil {
+		return err
+	}
+
+	h.publishControl(&models.ControlEvent{
+		Type: models.ControlMessageDeleted,
+		Tombstone: &models.MessageTombstone{
+			MessageID: message.ID,
+			Room:      message.Room,
+			Sender:    message.Sender,
+			Receiver:  message.Receiver,
+			Reason:    expiryReasonModerated,
+			ExpiredAt: time.Now(),
+		},
+	})
+	return nil
+}
+
+// publishControl sends a control event to every node. If that fails, the
+// event is at least applied to the connections of this node.
+func (h *SocketIOHandler) publishControl(event *models.ControlEvent) {
+	if err := h.redisService.PublishControl(context.Background(), event); err != nil {
+		h.logger.WithError(err).WithField("type", event.Type).Error("Failed to publish control event")
+		h.handleControlEvent(event)
+	}
+}
+
+// handleControlEvent applies a control event to the connections of this node
+func (h *SocketIOHandler) handleControlEvent(event *models.ControlEvent) {
+	switch event.Type {
+	case models.ControlSanction:
+		sanction := event.Sanction
+		h.broadcastToUserDevices(sanction.UserName, string(models.EventSanctioned), map[string]interface{}{
+			"sanction": sanction,
+		}, "")
+
+		// Banned users are disconnected from every device right away, and
+		// the tokens of those devices stop working for the REST API
+		if sanction.Kind == models.SanctionBan {
+			sessionIDs := h.userSessionIDs(sanction.UserName)
+			h.revokeSessions(sessionIDs)
+			h.disconnectSessions(sessionIDs, "banned")
+		}
+
+	case models.ControlSanctionLifted:
+		h.broadcastToUserDevices(event.Sanction.UserName, string(models.EventSanctionLifted), map[string]interface{}{
+			"sanction": event.Sanction,
+		}, "")
+
+	case models.ControlMessageDeleted:
+		h.broadcastTombstone(event.Tombstone)
+
+	case models.ControlDisconnect:
+		if event.SessionID != "" {
+			h.disconnectSessions([]string{event.SessionID}, event.Reason)
+		}
+		if event.UserName != "" {
+			h.disconnectSessions(h.userSessionIDs(event.UserName), event.Reason)
+		}
+
+	case models.ControlAnnouncement:
+		h.broadcastMessage(event.Message)
+
+	case models.ControlDeviceRevoked:
+		h.disconnectSessions([]string{event.SessionID}, event.Reason)
+		h.broadcastToUserDevices(event.UserName, string(models.EventDeviceRevoked), map[string]interface{}{
+			"sessionId": event.SessionID,
+		}, event.SessionID)
+
+	case models.ControlSessionEvicted:
+		room := socket.Room(event.SessionID)
+		h.server.To(room).Emit(string(models.EventSessionEvicted), map[string]interface{}{
+			"reason": event.Reason,
+		})
+		h.server.In(room).DisconnectSockets(true)
+
+	case models.ControlPresence:
+		h.deliverPresence(event)
+
+	case models.ControlStateUpdated:
+		// SessionID is the device that made the change
+		h.broadcastToUserDevices(event.UserName, string(models.EventStateUpdated), map[string]interface{}{
+			"update": event.State,
+		}, event.SessionID)
+	}
+}
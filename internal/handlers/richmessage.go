@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/sirupsen/logrus"
+)
+
+// codeLanguagePattern restricts code snippet languages to simple identifiers
+var codeLanguagePattern = regexp.MustCompile(`^[A-Za-z0-9+#._-]{1,32}$`)
+
+// parseMessagePayload validates the type-specific fields of an inbound message
+// and returns the message type together with its typed metadata
+func parseMessagePayload(data map[string]interface{}, content string) (models.MessageType, interface{}, error) {
+	rawType, _ := data["type"].(string)
+	messageType := models.MessageType(strings.TrimSpace(rawType))
+	if messageType == "" {
+		messageType = models.TextMessage
+	}
+
+	metadata, _ := data["metadata"].(map[string]interface{})
+
+	switch messageType {
+	case models.TextMessage, models.MarkdownMessage:
+		return messageType, nil, nil
+
+	case models.CodeMessage:
+		language, _ := metadata["language"].(string)
+		fileName, _ := metadata["fileName"].(string)
+		if language == "" {
+			language = "plaintext"
+		}
+		if !codeLanguagePattern.MatchString(language) {
+			return "", nil, fmt.Errorf("invalid code language")
+		}
+		return messageType, &models.CodeMetadata{
+			Language: language,
+			FileName: fileName,
+		}, nil
+
+	case models.LinkMessage:
+		link, _ := metadata["url"].(string)
+		if link == "" {
+			link = strings.TrimSpace(content)
+		}
+		if !isHTTPURL(link) {
+			return "", nil, fmt.Errorf("link messages require a valid http(s) URL")
+		}
+		return messageType, &models.LinkMetadata{URL: link}, nil
+
+	default:
+		// file/image messages go through uploads, system messages are server-only
+		return "", nil, fmt.Errorf("unsupported message type: %s", messageType)
+	}
+}
+
+// isHTTPURL reports whether s is an absolute http(s) URL
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// attachLinkPreviews fetches previews for links in a message and, if any are
+// found, updates the stored message and notifies clients via message_updated
+func (h *SocketIOHandler) attachLinkPreviews(message *models.Message) {
+	if !h.linkPreviews.Enabled() {
+		return
+	}
+
+	var urls []string
+	switch message.Type {
+	case models.TextMessage, models.MarkdownMessage:
+		urls = h.linkPreviews.ExtractURLs(message.Content)
+	case models.LinkMessage:
+		if metadata, ok := message.Metadata.(*models.LinkMetadata); ok {
+			urls = []string{metadata.URL}
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	previews := h.linkPreviews.Previews(ctx, urls)
+	if len(previews) == 0 {
+		return
+	}
+
+	// Work on a copy so the broadcast payload is never mutated concurrently
+	updated := *message
+	switch updated.Type {
+	case models.LinkMessage:
+		metadata := *updated.Metadata.(*models.LinkMetadata)
+		metadata.Preview = &previews[0]
+		updated.Metadata = &metadata
+	default:
+		updated.Metadata = &models.TextMetadata{LinkPreviews: previews}
+	}
+
+	err := h.redisService.UpdateMessage(ctx, &updated)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		// Expired, burnt or deleted while the previews were fetched; clients
+		// already got its tombstone
+		return
+	}
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to store link previews")
+		return
+	}
+
+	h.broadcastMessageEvent(string(models.EventMessageUpdated), &updated)
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": updated.ID,
+		"previews":   len(previews),
+	}).Debug("Link previews attached")
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAttachLinkPreviews(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Stub title"></head></html>`)
+	}))
+	defer site.Close()
+
+	tests := []struct {
+		name    string
+		deleted bool // removed, e.g. by a moderator, before the preview arrives
+	}{
+		{name: "stored message"},
+		{name: "deleted message", deleted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mr := newTestHandler(t, func(cfg *config.Config) {
+				cfg.Message.LinkPreview.Enabled = true
+				cfg.Message.LinkPreview.AllowPrivateNetworks = true // the stub listens on loopback
+			})
+			h.logger.SetLevel(logrus.DebugLevel)
+			hook := test.NewLocal(h.logger)
+			ctx := context.Background()
+
+			message := &models.Message{
+				ID:        generateMessageID(),
+				Type:      models.TextMessage,
+				Content:   "look at " + site.URL + "/page",
+				Sender:    "alice",
+				Room:      "general",
+				Timestamp: time.Now(),
+			}
+			if err := h.redisService.StoreMessage(ctx, message); err != nil {
+				t.Fatalf("failed to store message: %v", err)
+			}
+			if tt.deleted {
+				if err := h.redisService.DeleteMessage(ctx, message.ID); err != nil {
+					t.Fatalf("failed to delete message: %v", err)
+				}
+			}
+
+			h.attachLinkPreviews(message)
+
+			var updated bool
+			for _, entry := range hook.AllEntries() {
+				updated = updated || entry.Message == "Link previews attached"
+			}
+			if updated == tt.deleted {
+				t.Errorf("message_updated sent = %v, want %v", updated, !tt.deleted)
+			}
+
+			if tt.deleted {
+				if mr.Exists("message:" + message.ID) {
+					t.Error("deleted message was stored again")
+				}
+				return
+			}
+			stored, err := mr.Get("message:" + message.ID)
+			if err != nil {
+				t.Fatalf("failed to get message: %v", err)
+			}
+			if !strings.Contains(stored, "Stub title") {
+				t.Errorf("stored message %s has no preview", stored)
+			}
+		})
+	}
+}
@@ -1,13 +1,15 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"im-demo/internal/config"
@@ -16,31 +18,125 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/engine/v3"
 	"github.com/zishang520/socket.io/servers/socket/v3"
+	"github.com/zishang520/socket.io/v3/pkg/types"
 )
 
 // SocketIOHandler handles Socket.IO connections and events using v4+ protocol
 type SocketIOHandler struct {
 	server       *socket.Server
+	nodeID       string    // identifies this instance in the cluster
+	startedAt    time.Time // when this node started
 	redisService *services.RedisService
 	config       *config.Config
 	logger       *logrus.Logger
+	linkPreviews *services.LinkPreviewService
+	blobStore    services.BlobStore
+	auth         *services.AuthService
+	images       *services.ImageProcessor
+	uploadPolicy *services.UploadPolicy
+	rateLimiter  *services.RateLimiter
+	filters      *services.FilterChain
+	schemas      map[string]eventSchema // inbound event payload schemas
+
+	mu           sync.RWMutex            // guards sessions and userSessions
 	sessions     map[string]*models.User // session_id -> user
 	userSessions map[string][]string     // username -> []session_ids (支持多设备)
+
+	presenceMu      sync.Mutex      // guards pendingPresence
+	pendingPresence map[string]bool // users whose presence announcement is scheduled
+
+	typingMu sync.Mutex              // guards typing
+	typing   map[string]*typingState // typingKey -> user typing in a conversation
+}
+
+// transportsByName are the Engine.IO transports clients may be allowed to use
+var transportsByName = map[string]engine.TransportCtor{
+	"polling":      engine.Polling,
+	"websocket":    engine.WebSocket,
+	"webtransport": engine.WebTransport,
+}
+
+// serverOptions configures the Socket.IO server from the configuration
+func serverOptions(cfg config.SocketIOConfig) (*socket.ServerOptions, error) {
+	allowed := types.NewSet[engine.TransportCtor]()
+	for _, name := range cfg.Transports {
+		transport, ok := transportsByName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown transport: %s", name)
+		}
+		allowed.Add(transport)
+	}
+
+	opts := socket.DefaultServerOptions()
+	opts.SetCors(engineCORS(cfg))
+	opts.SetPingTimeout(cfg.PingTimeout)
+	opts.SetPingInterval(cfg.PingInterval)
+	opts.SetTransports(allowed)
+	opts.SetMaxHttpBufferSize(cfg.MaxHTTPBufferSize)
+	if cfg.PerMessageDeflate {
+		opts.SetPerMessageDeflate(&types.PerMessageDeflate{Threshold: cfg.CompressionThreshold})
+	}
+	return opts, nil
 }
 
 // NewSocketIOHandler creates a new Socket.IO handler with v4+ protocol support
 func NewSocketIOHandler(cfg *config.Config, redisService *services.RedisService, logger *logrus.Logger) (*SocketIOHandler, error) {
 	// Create server with v4+ protocol support
-	server := socket.NewServer(nil, nil)
+	opts, err := serverOptions(cfg.SocketIO)
+	if err != nil {
+		return nil, err
+	}
+	server := socket.NewServer(nil, opts)
+
+	// Link previews are fetched over HTTP and cached in Redis
+	previewFetcher := services.NewHTTPPreviewFetcher(cfg.Message.LinkPreview)
+	linkPreviews := services.NewLinkPreviewService(cfg, redisService, previewFetcher, logger)
+
+	// Uploaded files are kept in the configured blob storage backend
+	blobStore, err := services.NewBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uploads are checked against the upload policy before they are published
+	scanner, err := services.NewUploadScanner(cfg.Upload.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logins beyond the device limits are refused or replace older devices
+	if policy := cfg.Devices.Policy; policy != devicePolicyReject && policy != devicePolicyEvictOldest {
+		return nil, fmt.Errorf("unknown device policy: %s", policy)
+	}
+
+	// Messages pass the moderation filters before they are delivered
+	filters, err := services.NewFilterChain(cfg.Moderation, redisService, logger)
+	if err != nil {
+		return nil, err
+	}
 
 	handler := &SocketIOHandler{
 		server:       server,
+		nodeID:       cfg.Server.NodeID,
+		startedAt:    time.Now(),
 		redisService: redisService,
 		config:       cfg,
 		logger:       logger,
+		linkPreviews: linkPreviews,
+		blobStore:    blobStore,
+		auth:         services.NewAuthService(cfg),
+		images:       services.NewImageProcessor(cfg.Upload.Image),
+		uploadPolicy: services.NewUploadPolicy(cfg.Upload.Policy, redisService, scanner),
+		rateLimiter:  services.NewRateLimiter(cfg.RateLimit, redisService, logger),
+		filters:      filters,
+		schemas:      newEventSchemas(cfg),
 		sessions:     make(map[string]*models.User),
 		userSessions: make(map[string][]string), // 新增：用户名到会话列表的映射
+
+		pendingPresence: make(map[string]bool),
+		typing:          make(map[string]*typingState),
 	}
 
 	// Setup event handlers
@@ -49,6 +145,18 @@ func NewSocketIOHandler(cfg *config.Config, redisService *services.RedisService,
 	// Setup Redis subscription for distributed messaging
 	go handler.subscribeToRedis()
 
+	// Collect expired ephemeral messages
+	go handler.runExpirySweeper()
+
+	// Delete stored files no message refers to anymore
+	go handler.runBlobCollector()
+
+	// Report this node's sessions and rooms to the cluster
+	go handler.runHeartbeat()
+
+	// Turn idle users away and drop expired statuses
+	go handler.runPresenceSweeper()
+
 	return handler, nil
 }
 
@@ -64,61 +172,78 @@ func (h *SocketIOHandler) setupEventHandlers() {
 		// 为每个连接创建私有房间，用于点对点消息
 		client.Join(socket.Room(sessionID))
 
+		// on registers an event handler subject to the event's rate limits
+		// and payload schema
+		on := func(event string, handler func(args ...any) error) {
+			client.On(event, h.eventHandler(client, event, handler))
+		}
+
 		// User join event - 支持多设备登录
-		client.On("join", func(args ...any) {
+		on("join", func(args ...any) error {
 			if len(args) == 0 {
-				h.sendError(client, "No user data provided")
-				return
+				return newEventError(errInvalidPayload, "No user data provided")
 			}
 
 			data, ok := args[0].(map[string]interface{})
 			if !ok {
-				h.sendError(client, "Invalid user data")
-				return
+				return newEventError(errInvalidPayload, "Invalid user data")
 			}
 
 			userName, _ := data["userName"].(string)
 			deviceInfo, _ := data["deviceInfo"].(string) // 新增：设备信息
+			deviceType, _ := data["deviceType"].(string) // 设备类型，用于按类型限制设备数
 			avatar, _ := data["avatar"].(string)
 
 			if userName == "" {
-				h.sendError(client, "User name is required")
-				return
+				return newEventError(errMissingField, "User name is required")
 			}
 
 			// 使用用户名作为唯一标识，支持多设备
 			if deviceInfo == "" {
 				deviceInfo = "Unknown Device"
 			}
+			if deviceType == "" {
+				deviceType = "unknown"
+			}
 
+			now := time.Now()
 			user := &models.User{
 				ID:       userName, // 使用用户名作为用户ID
 				Name:     userName,
 				Avatar:   avatar,
 				Status:   "online",
-				LastSeen: time.Now(),
+				LastSeen: now,
 				Metadata: map[string]interface{}{
-					"deviceInfo": deviceInfo,
-					"sessionId":  sessionID,
+					"deviceInfo":  deviceInfo,
+					"deviceType":  deviceType,
+					"sessionId":   sessionID,
+					"connectedAt": now,
 				},
 			}
 
-			// 存储会话信息
-			h.sessions[sessionID] = user
-
-			// 添加到用户的会话列表
-			if h.userSessions[userName] == nil {
-				h.userSessions[userName] = []string{}
+			// 检查设备数量限制，必要时踢掉最早登录的设备
+			ctx := context.Background()
+			if err := h.admitDevice(ctx, h.sessionInfo(user, sessionID)); err != nil {
+				return err
 			}
+
+			// 存储会话信息，并添加到用户的会话列表
+			h.mu.Lock()
+			h.sessions[sessionID] = user
 			h.userSessions[userName] = append(h.userSessions[userName], sessionID)
+			deviceCount := len(h.userSessions[userName])
+			h.mu.Unlock()
 
 			// 在Redis中存储用户会话信息
-			ctx := context.Background()
 			h.redisService.StoreUserSession(ctx, userName, sessionID)
 
-			// 广播用户上线（如果是该用户的第一个设备）
-			if len(h.userSessions[userName]) == 1 {
-				h.broadcastUserStatus(userName, "online")
+			// 更新用户在线状态，通知关注该用户的客户端
+			h.updatePresence(ctx, userName)
+
+			// 为该设备签发访问令牌，用于 REST API 鉴权
+			token, err := h.auth.IssueToken(userName, sessionID)
+			if err != nil {
+				h.logger.WithError(err).Error("Failed to issue session token")
 			}
 
 			// 发送确认消息，包含设备信息
@@ -126,44 +251,53 @@ func (h *SocketIOHandler) setupEventHandlers() {
 				"userId":      userName,
 				"userName":    userName,
 				"deviceInfo":  deviceInfo,
+				"deviceType":  deviceType,
 				"status":      "online",
-				"deviceCount": len(h.userSessions[userName]), // 当前设备数量
+				"deviceCount": deviceCount, // 当前设备数量
+				"token":       token,
 			})
 
+			// 同步该用户在其他设备上的已读位置、免打扰房间和草稿
+			h.sendUserState(client, userName)
+
 			// 向用户的其他设备广播新设备登录
 			h.broadcastToUserDevices(userName, "device_connected", map[string]interface{}{
 				"deviceInfo":  deviceInfo,
 				"sessionId":   sessionID,
-				"deviceCount": len(h.userSessions[userName]),
+				"deviceCount": deviceCount,
 			}, sessionID) // 排除当前会话
 
 			h.logger.WithFields(logrus.Fields{
 				"user_name":    userName,
 				"session_id":   sessionID,
 				"device_info":  deviceInfo,
-				"device_count": len(h.userSessions[userName]),
+				"device_count": deviceCount,
 			}).Info("User joined with device")
+
+			return nil
 		})
 
 		// Join room event
-		client.On("join_room", func(args ...any) {
+		on("join_room", func(args ...any) error {
 			if len(args) == 0 {
-				h.sendError(client, "No room data provided")
-				return
+				return newEventError(errInvalidPayload, "No room data provided")
 			}
 
 			data, ok := args[0].(map[string]interface{})
 			if !ok {
-				h.sendError(client, "Invalid room data")
-				return
+				return newEventError(errInvalidPayload, "Invalid room data")
 			}
 
-			roomID, _ := data["roomId"].(string)
-			userName, _ := data["userName"].(string) // 改为userName
+			// Only the session's own user can be added to a room
+			user, ok := h.sessionUser(sessionID)
+			if !ok {
+				return newEventError(errUnauthorized, "Join before joining rooms")
+			}
+			userName := user.ID
 
-			if roomID == "" || userName == "" {
-				h.sendError(client, "Invalid room or user data")
-				return
+			roomID, _ := data["roomId"].(string)
+			if roomID == "" {
+				return newEventError(errInvalidPayload, "Invalid room data")
 			}
 
 			// Join the room
@@ -190,27 +324,30 @@ func (h *SocketIOHandler) setupEventHandlers() {
 				"room_id":    roomID,
 				"session_id": sessionID,
 			}).Info("User joined room")
+
+			return nil
 		})
 
 		// Leave room event
-		client.On("leave_room", func(args ...any) {
+		on("leave_room", func(args ...any) error {
 			if len(args) == 0 {
-				h.sendError(client, "No room data provided")
-				return
+				return newEventError(errInvalidPayload, "No room data provided")
 			}
 
 			data, ok := args[0].(map[string]interface{})
 			if !ok {
-				h.sendError(client, "Invalid room data")
-				return
+				return newEventError(errInvalidPayload, "Invalid room data")
 			}
 
-			roomID, _ := data["roomId"].(string)
-			userName, _ := data["userName"].(string) // 改为userName
+			user, ok := h.sessionUser(sessionID)
+			if !ok {
+				return newEventError(errUnauthorized, "Join before leaving rooms")
+			}
+			userName := user.ID
 
-			if roomID == "" || userName == "" {
-				h.sendError(client, "Invalid room or user data")
-				return
+			roomID, _ := data["roomId"].(string)
+			if roomID == "" {
+				return newEventError(errInvalidPayload, "Invalid room data")
 			}
 
 			// Leave the room
@@ -231,60 +368,80 @@ func (h *SocketIOHandler) setupEventHandlers() {
 				"room_id":    roomID,
 				"session_id": sessionID,
 			}).Info("User left room")
+
+			return nil
 		})
 
 		// Message event
-		client.On("message", func(args ...any) {
-			h.handleMessage(client, args...)
+		on("message", func(args ...any) error {
+			return h.handleMessage(client, args...)
 		})
 
 		// File upload event
-		client.On("file_upload", func(args ...any) {
-			h.handleFileUpload(client, args...)
+		on("file_upload", func(args ...any) error {
+			return h.handleFileUpload(client, args...)
 		})
 
-		// Typing event
-		client.On("typing", func(args ...any) {
-			if len(args) == 0 {
-				return
-			}
-
-			data, ok := args[0].(map[string]interface{})
-			if !ok {
-				return
-			}
+		// Chunked, resumable file upload events
+		on("upload_init", func(args ...any) error {
+			return h.handleUploadInit(client, args...)
+		})
+		on("upload_chunk", func(args ...any) error {
+			return h.handleUploadChunk(client, args...)
+		})
+		on("upload_complete", func(args ...any) error {
+			return h.handleUploadComplete(client, args...)
+		})
+		on("upload_abort", func(args ...any) error {
+			return h.handleUploadAbort(client, args...)
+		})
 
-			roomID, _ := data["roomId"].(string)
-			userName, _ := data["userName"].(string) // 改为userName
+		// Read receipt event, used to expire burn-after-read messages
+		on("message_read", func(args ...any) error {
+			return h.handleMessageRead(client, args...)
+		})
 
-			if roomID != "" && userName != "" {
-				h.server.To(socket.Room(roomID)).Emit("typing", map[string]interface{}{
-					"userName": userName,
-					"roomId":   roomID,
-				})
-			}
+		// Abuse report event
+		on("report_message", func(args ...any) error {
+			return h.handleReportMessage(client, args...)
 		})
 
-		// Stop typing event
-		client.On("stop_typing", func(args ...any) {
-			if len(args) == 0 {
-				return
-			}
+		// Device management events
+		on("list_devices", func(args ...any) error {
+			return h.handleListDevices(client)
+		})
+		on("revoke_device", func(args ...any) error {
+			return h.handleRevokeDevice(client, args...)
+		})
 
-			data, ok := args[0].(map[string]interface{})
-			if !ok {
-				return
-			}
+		// Synced state events
+		on("read_cursor", func(args ...any) error {
+			return h.handleReadCursor(client, args...)
+		})
+		on("mute_room", func(args ...any) error {
+			return h.handleMuteRoom(client, args...)
+		})
+		on("save_draft", func(args ...any) error {
+			return h.handleSaveDraft(client, args...)
+		})
 
-			roomID, _ := data["roomId"].(string)
-			userName, _ := data["userName"].(string) // 改为userName
+		// Presence events
+		on("set_status", func(args ...any) error {
+			return h.handleSetStatus(client, args...)
+		})
+		on("subscribe_presence", func(args ...any) error {
+			return h.handleSubscribePresence(client, args...)
+		})
+		on("unsubscribe_presence", func(args ...any) error {
+			return h.handleUnsubscribePresence(client, args...)
+		})
 
-			if roomID != "" && userName != "" {
-				h.server.To(socket.Room(roomID)).Emit("stop_typing", map[string]interface{}{
-					"userName": userName,
-					"roomId":   roomID,
-				})
-			}
+		// Typing events, throttled and stopped automatically
+		on("typing", func(args ...any) error {
+			return h.handleTyping(client, args...)
+		})
+		on("stop_typing", func(args ...any) error {
+			return h.handleStopTyping(client, args...)
 		})
 
 		// Disconnect event - 支持多设备登录
@@ -302,236 +459,274 @@ func (h *SocketIOHandler) setupEventHandlers() {
 			}).Info("Device disconnected")
 
 			// 清理用户会话
-			if user, exists := h.sessions[sessionID]; exists {
+			if user, deviceCount, ok := h.removeSession(sessionID); ok {
 				userName := user.ID
 
-				// 从用户会话列表中移除当前会话
-				if sessions, ok := h.userSessions[userName]; ok {
-					for i, sid := range sessions {
-						if sid == sessionID {
-							h.userSessions[userName] = append(sessions[:i], sessions[i+1:]...)
-							break
-						}
-					}
-
-					// 如果用户的所有设备都下线了，广播用户离线
-					if len(h.userSessions[userName]) == 0 {
-						delete(h.userSessions, userName)
-						ctx := context.Background()
-						h.redisService.DeleteUserSession(ctx, userName)
-						h.broadcastUserStatus(userName, "offline")
-					} else {
-						// 向用户的其他设备广播设备断开
-						h.broadcastToUserDevices(userName, "device_disconnected", map[string]interface{}{
-							"sessionId":   sessionID,
-							"deviceCount": len(h.userSessions[userName]),
-						}, "")
-					}
+				ctx := context.Background()
+				if err := h.redisService.UnregisterSession(ctx, h.nodeID, sessionID); err != nil {
+					h.logger.WithError(err).Warn("Failed to unregister session")
+				}
+
+				// 如果用户在本节点的所有设备都下线了，记录最后在线时间
+				if deviceCount == 0 {
+					h.redisService.DeleteUserSession(ctx, userName)
+					h.recordLastSeen(ctx, userName)
 				}
 
-				delete(h.sessions, sessionID)
+				// 其他节点上可能还有该用户的设备，由集群会话决定是否离线
+				h.updatePresence(ctx, userName)
+
+				if deviceCount > 0 {
+					// 向用户的其他设备广播设备断开
+					h.broadcastToUserDevices(userName, "device_disconnected", map[string]interface{}{
+						"sessionId":   sessionID,
+						"deviceCount": deviceCount,
+					}, "")
+				}
 			}
+
+			h.stopSessionTyping(sessionID)
+			h.rateLimiter.ForgetSession(sessionID)
 		})
 	})
 }
 
+// removeSession forgets a disconnected session and returns its user and how
+// many devices the user still has connected
+func (h *SocketIOHandler) removeSession(sessionID string) (*models.User, int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	user, ok := h.sessions[sessionID]
+	if !ok {
+		return nil, 0, false
+	}
+	delete(h.sessions, sessionID)
+
+	userName := user.ID
+	sessions := slices.DeleteFunc(h.userSessions[userName], func(sid string) bool {
+		return sid == sessionID
+	})
+	if len(sessions) == 0 {
+		delete(h.userSessions, userName)
+	} else {
+		h.userSessions[userName] = sessions
+	}
+	return user, len(sessions), true
+}
+
+// sessionUser returns the user that joined on a session
+func (h *SocketIOHandler) sessionUser(sessionID string) (*models.User, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	user, ok := h.sessions[sessionID]
+	return user, ok
+}
+
+// userSessionIDs returns the local sessions of a user
+func (h *SocketIOHandler) userSessionIDs(userName string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return slices.Clone(h.userSessions[userName])
+}
+
 // broadcastToUserDevices 向指定用户的所有设备广播消息
 func (h *SocketIOHandler) broadcastToUserDevices(userName, event string, data map[string]interface{}, excludeSessionID string) {
-	if sessions, ok := h.userSessions[userName]; ok {
-		for _, sessionID := range sessions {
-			if excludeSessionID != "" && sessionID == excludeSessionID {
-				continue // 排除指定的会话
-			}
-
-			// 通过session ID向指定socket发送消息
-			h.server.To(socket.Room(sessionID)).Emit(event, data)
+	for _, sessionID := range h.userSessionIDs(userName) {
+		if excludeSessionID != "" && sessionID == excludeSessionID {
+			continue // 排除指定的会话
 		}
+
+		// 通过session ID向指定socket发送消息
+		h.server.To(socket.Room(sessionID)).Emit(event, data)
 	}
 }
 
 // handleMessage handles incoming messages using v4+ protocol
-func (h *SocketIOHandler) handleMessage(client *socket.Socket, args ...any) {
+func (h *SocketIOHandler) handleMessage(client *socket.Socket, args ...any) error {
 	if len(args) == 0 {
-		h.sendError(client, "No message data")
-		return
+		return newEventError(errInvalidPayload, "No message data")
 	}
 
 	data, ok := args[0].(map[string]interface{})
 	if !ok {
-		h.sendError(client, "Invalid message data")
-		return
+		return newEventError(errInvalidPayload, "Invalid message data")
+	}
+
+	// Messages are sent as the session's user, whatever sender is claimed
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before sending messages")
 	}
+	sender := user.ID
 
-	messageType, _ := data["type"].(string)
 	content, _ := data["content"].(string)
-	sender, _ := data["sender"].(string)
 	roomID, _ := data["roomId"].(string)
 	receiver, _ := data["receiver"].(string)
 
-	if content == "" || sender == "" {
-		h.sendError(client, "Invalid message data")
-		return
+	if content == "" {
+		return newEventError(errInvalidPayload, "Invalid message data")
 	}
-	for i := 0; i < 10; i++ {
-		// Create message
-		message := &models.Message{
-			ID:        generateMessageID(),
-			Type:      models.MessageType(messageType),
-			Content:   content,
-			Sender:    sender,
-			Room:      roomID,
-			Receiver:  receiver,
-			Timestamp: time.Now(),
-		}
 
-		// Store message in Redis
-		ctx := context.Background()
-		if err := h.redisService.StoreMessage(ctx, message); err != nil {
-			h.logger.WithError(err).Error("Failed to store message")
-			h.sendError(client, "Failed to send message")
-			return
-		}
+	messageType, metadata, err := parseMessagePayload(data, content)
+	if err != nil {
+		return newEventError(errInvalidValue, err.Error())
+	}
 
-		// Broadcast message
+	ttl, burnAfterRead, err := h.parseEphemeralOptions(data)
+	if err != nil {
+		return newEventError(errInvalidValue, err.Error())
+	}
+
+	// Create message
+	message := &models.Message{
+		ID:        generateMessageID(),
+		Type:      messageType,
+		Content:   content,
+		Sender:    sender,
+		Room:      roomID,
+		Receiver:  receiver,
+		Timestamp: time.Now(),
+		Metadata:  metadata,
+	}
+	applyEphemeralOptions(message, ttl, burnAfterRead)
 
-		message.Content = message.Content + fmt.Sprintf("Message %d", i)
-		h.broadcastMessage(message)
+	ctx := context.Background()
+	if err := h.checkSendAccess(ctx, sender, roomID, receiver); err != nil {
+		return err
+	}
+
+	// Filter the message; masking may change its content
+	if err := h.moderateMessage(ctx, message); err != nil {
+		return err
+	}
 
-		h.logger.WithFields(logrus.Fields{
-			"message_id": message.ID,
-			"sender":     sender,
-			"room_id":    roomID,
-			"type":       messageType,
-		}).Info("Message sent")
+	// Store message in Redis
+	if err := h.redisService.StoreMessage(ctx, message); err != nil {
+		h.logger.WithError(err).Error("Failed to store message")
+		return newEventError(errInternal, "Failed to send message")
 	}
+
+	// Broadcast message
+	h.broadcastMessage(message)
+	h.notifyMentions(ctx, message)
+
+	// Attach link previews asynchronously
+	go h.attachLinkPreviews(message)
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": message.ID,
+		"sender":     sender,
+		"room_id":    roomID,
+		"type":       messageType,
+	}).Info("Message sent")
+
+	return nil
 }
 
 // handleFileUpload handles file uploads using v4+ protocol
-func (h *SocketIOHandler) handleFileUpload(client *socket.Socket, args ...any) {
+func (h *SocketIOHandler) handleFileUpload(client *socket.Socket, args ...any) error {
 	if len(args) == 0 {
-		h.sendError(client, "No file data")
-		return
+		return newEventError(errInvalidPayload, "No file data")
 	}
 
 	data, ok := args[0].(map[string]interface{})
 	if !ok {
-		h.sendError(client, "Invalid file data")
-		return
+		return newEventError(errInvalidPayload, "Invalid file data")
 	}
 
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before uploading files")
+	}
+	sender := user.ID
+
 	fileName, _ := data["fileName"].(string)
 	fileData, _ := data["fileData"].(string)
 	fileType, _ := data["fileType"].(string)
-	sender, _ := data["sender"].(string)
 	roomID, _ := data["roomId"].(string)
+	receiver, _ := data["receiver"].(string)
+	caption, _ := data["caption"].(string)
 
-	if fileName == "" || fileData == "" || sender == "" {
-		h.sendError(client, "Invalid file data")
-		return
+	if fileName == "" || fileData == "" {
+		return newEventError(errInvalidPayload, "Invalid file data")
+	}
+
+	ttl, burnAfterRead, err := h.parseEphemeralOptions(data)
+	if err != nil {
+		return newEventError(errInvalidValue, err.Error())
 	}
 
 	// Decode base64 file data
 	decodedData, err := base64.StdEncoding.DecodeString(fileData)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to decode file data")
-		h.sendError(client, "Invalid file data")
-		return
+		return newEventError(errInvalidPayload, "Invalid file data")
 	}
 
 	// Check file size
 	if int64(len(decodedData)) > h.config.Upload.MaxFileSize {
-		h.sendError(client, fmt.Sprintf("File too large, max size is %d bytes", h.config.Upload.MaxFileSize))
-		return
+		return newEventError(errTooLarge, fmt.Sprintf("File too large, max size is %d bytes", h.config.Upload.MaxFileSize))
 	}
 
-	// Generate unique filename
-	timestamp := time.Now().Unix()
-	ext := filepath.Ext(fileName)
-	baseName := strings.TrimSuffix(fileName, ext)
-	uniqueFileName := fmt.Sprintf("%s_%d_%s%s", baseName, timestamp, generateMessageID()[:8], ext)
-
-	// Save file
-	filePath := filepath.Join(h.config.Upload.UploadDir, uniqueFileName)
-	if err := os.WriteFile(filePath, decodedData, 0644); err != nil {
-		h.logger.WithError(err).Error("Failed to save file")
-		h.sendError(client, "Failed to save file")
-		return
+	upload := &models.UploadSession{
+		FileName:      fileName,
+		FileType:      fileType,
+		FileSize:      int64(len(decodedData)),
+		Sender:        sender,
+		Room:          roomID,
+		Receiver:      receiver,
+		Caption:       caption,
+		TTL:           ttl,
+		BurnAfterRead: burnAfterRead,
 	}
 
-	// Create file URL
-	fileURL := fmt.Sprintf("%s/%s", h.config.Upload.BaseURL, uniqueFileName)
-
-	// Create message with file metadata
-	message := &models.Message{
-		ID:      generateMessageID(),
-		Type:    models.FileMessage,
-		Content: fmt.Sprintf("File: %s", fileName),
-		Sender:  sender,
-		Room:    roomID,
-		Metadata: map[string]interface{}{
-			"fileName": fileName,
-			"fileURL":  fileURL,
-			"fileType": fileType,
-			"fileSize": len(decodedData),
-		},
-		Timestamp: time.Now(),
+	if _, err := h.publishUpload(context.Background(), upload, bytes.NewReader(decodedData)); err != nil {
+		return err
 	}
 
-	// Store message in Redis
-	ctx := context.Background()
-	if err := h.redisService.StoreMessage(ctx, message); err != nil {
-		h.logger.WithError(err).Error("Failed to store file message")
-		h.sendError(client, "Failed to send file")
-		return
-	}
-
-	// Broadcast message
-	h.broadcastMessage(message)
-
-	h.logger.WithFields(logrus.Fields{
-		"message_id": message.ID,
-		"sender":     sender,
-		"room_id":    roomID,
-		"file_name":  fileName,
-		"file_size":  len(decodedData),
-	}).Info("File uploaded and message sent")
+	return nil
 }
 
 // broadcastMessage broadcasts a message using v4+ protocol
 func (h *SocketIOHandler) broadcastMessage(message *models.Message) {
+	// Direct messages are only delivered when the receiver accepts them
+	if message.Room == "" && message.Receiver != "" {
+		allowed, err := h.canSendDirect(context.Background(), message.Sender, message.Receiver)
+		if err != nil {
+			h.logger.WithError(err).WithField("message_id", message.ID).Error("Failed to check direct message privacy")
+			return
+		}
+		if !allowed {
+			h.logger.WithField("message_id", message.ID).Debug("Direct message suppressed")
+			return
+		}
+	}
+
+	h.broadcastMessageEvent("message", message)
+}
+
+// broadcastMessageEvent emits a message-related event to the message's audience
+func (h *SocketIOHandler) broadcastMessageEvent(event string, message *models.Message) {
 	if message.Room != "" {
 		// Broadcast to room
-		h.server.To(socket.Room(message.Room)).Emit("message", message)
+		h.server.To(socket.Room(message.Room)).Emit(event, message)
 	} else if message.Receiver != "" {
 		// Direct message - 发送给指定用户的所有设备
-		h.broadcastToUserDevices(message.Receiver, "message", map[string]interface{}{
+		h.broadcastToUserDevices(message.Receiver, event, map[string]interface{}{
 			"message": message,
 		}, "")
 	} else {
 		// Broadcast to all
-		h.server.Emit("message", message)
+		h.server.Emit(event, message)
 	}
 }
 
-// broadcastUserStatus broadcasts user status changes
-func (h *SocketIOHandler) broadcastUserStatus(userName, status string) {
-	h.server.Emit("user_status", map[string]interface{}{
-		"userName": userName,
-		"status":   status,
-	})
-}
-
-// sendError sends an error message to a specific client
-func (h *SocketIOHandler) sendError(client *socket.Socket, message string) {
-	client.Emit("error", map[string]interface{}{
-		"message": message,
-	})
-}
-
 // subscribeToRedis subscribes to Redis channels for distributed messaging
 func (h *SocketIOHandler) subscribeToRedis() {
 	ctx := context.Background()
 	h.redisService.SubscribeToMessages(ctx, h.broadcastMessage)
+	h.redisService.SubscribeToControl(ctx, h.handleControlEvent)
 }
 
 // GetServer returns the Socket.IO server instance
@@ -545,69 +740,84 @@ func (h *SocketIOHandler) ServeHTTP(c *gin.Context) {
 	handler.ServeHTTP(c.Writer, c.Request)
 }
 
-// HandleFileUpload handles direct file upload via HTTP API
+// HandleFileUpload accepts a multipart file upload from an authenticated user
+// and sends it as a file message, like the file_upload event does. The
+// created message is returned.
 func (h *SocketIOHandler) HandleFileUpload(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		respondError(c, errMissingField, "No file uploaded")
 		return
 	}
 
 	// Check file size
 	if file.Size > int64(h.config.Upload.MaxFileSize) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large"})
+		respondError(c, errTooLarge, "File too large")
 		return
 	}
 
-	// Generate unique filename
-	timestamp := time.Now().Unix()
-	ext := filepath.Ext(file.Filename)
-	baseName := strings.TrimSuffix(file.Filename, ext)
-	uniqueFileName := fmt.Sprintf("%s_%d_%s%s", baseName, timestamp, generateMessageID()[:8], ext)
+	ctx := c.Request.Context()
+	sender := currentUser(c)
+	roomID := c.PostForm("roomId")
+	receiver := c.PostForm("receiver")
+
+	// Form values are strings; convert them to the event payload types
+	options := map[string]interface{}{}
+	if ttl := c.PostForm("ttl"); ttl != "" {
+		seconds, err := strconv.ParseFloat(ttl, 64)
+		if err != nil {
+			respondError(c, errInvalidValue, "Invalid ttl")
+			return
+		}
+		options["ttl"] = seconds
+	}
+	if burn, err := strconv.ParseBool(c.PostForm("burnAfterRead")); err == nil {
+		options["burnAfterRead"] = burn
+	}
+
+	ttl, burnAfterRead, err := h.parseEphemeralOptions(options)
+	if err != nil {
+		respondError(c, errInvalidValue, err.Error())
+		return
+	}
 
-	// Save file
-	filePath := filepath.Join(h.config.Upload.UploadDir, uniqueFileName)
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
-		h.logger.WithError(err).Error("Failed to save uploaded file")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	src, err := file.Open()
+	if err != nil {
+		respondError(c, errMissingField, "No file uploaded")
 		return
 	}
+	defer src.Close()
+
+	upload := &models.UploadSession{
+		FileName:      file.Filename,
+		FileType:      file.Header.Get("Content-Type"),
+		FileSize:      file.Size,
+		Sender:        sender,
+		Room:          roomID,
+		Receiver:      receiver,
+		Caption:       c.PostForm("caption"),
+		TTL:           ttl,
+		BurnAfterRead: burnAfterRead,
+	}
 
-	// Create file URL
-	fileURL := fmt.Sprintf("%s/%s", h.config.Upload.BaseURL, uniqueFileName)
+	message, eventErr := h.publishUpload(ctx, upload, src)
+	if eventErr != nil {
+		respondError(c, eventErr.kind, eventErr.message)
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"fileURL":  fileURL,
-		"fileName": file.Filename,
-		"fileSize": file.Size,
-	})
+	c.JSON(http.StatusCreated, message)
 }
 
-// GetOnlineUsers returns information about online users and their devices
-func (h *SocketIOHandler) GetOnlineUsers() map[string]interface{} {
-	users := make(map[string]interface{})
-
-	for userName, sessions := range h.userSessions {
-		devices := make([]map[string]interface{}, 0)
-		for _, sessionID := range sessions {
-			if user, ok := h.sessions[sessionID]; ok {
-				deviceInfo, _ := user.Metadata["deviceInfo"].(string)
-				devices = append(devices, map[string]interface{}{
-					"sessionId":  sessionID,
-					"deviceInfo": deviceInfo,
-					"lastSeen":   user.LastSeen,
-				})
-			}
-		}
-
-		users[userName] = map[string]interface{}{
-			"deviceCount": len(sessions),
-			"devices":     devices,
-			"status":      "online",
-		}
+// HandleGetRoomMembers returns the members of a room
+func (h *SocketIOHandler) HandleGetRoomMembers(c *gin.Context) {
+	members, err := h.redisService.GetRoomMembers(c.Request.Context(), c.Param("roomId"))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get room members")
+		respondError(c, errInternal, "Failed to get room members")
+		return
 	}
-
-	return users
+	c.JSON(http.StatusOK, gin.H{"members": members})
 }
 
 // generateMessageID generates a unique message ID
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// maxSyncedEntries bounds how many rooms a user can mute and how many
+// drafts they can keep
+const maxSyncedEntries = 200
+
+// sendUserState sends a newly joined device the state shared by the user's
+// devices
+func (h *SocketIOHandler) sendUserState(client *socket.Socket, userName string) {
+	state, err := h.redisService.GetUserState(context.Background(), userName)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get user state")
+		return
+	}
+
+	client.Emit(string(models.EventSyncState), map[string]interface{}{
+		"state": state,
+	})
+}
+
+// handleReadCursor moves the user's read cursor in a conversation to a message
+func (h *SocketIOHandler) handleReadCursor(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	messageID, _ := data["messageId"].(string)
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before updating read state")
+	}
+
+	ctx := context.Background()
+	message, err := h.redisService.GetMessage(ctx, messageID)
+	if err != nil {
+		return newEventError(errNotFound, "Message not found")
+	}
+	allowed, err := h.canAccessMessage(ctx, message, user.ID)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to check message access")
+		return newEventError(errInternal, "Failed to update read state")
+	}
+	if !allowed {
+		return newEventError(errNotFound, "Message not found")
+	}
+
+	conversationID := models.ConversationID(message, user.ID)
+	if conversationID == "" {
+		return newEventError(errInvalidValue, "Read state is kept for rooms and direct messages only")
+	}
+
+	cursor := &models.ReadCursor{
+		MessageID: message.ID,
+		Timestamp: message.Timestamp,
+	}
+	moved, err := h.redisService.SetReadCursor(ctx, user.ID, conversationID, cursor)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to set read cursor")
+		return newEventError(errInternal, "Failed to update read state")
+	}
+	if !moved {
+		// Another device already read further
+		return nil
+	}
+
+	h.publishStateUpdate(client, user.ID, &models.StateUpdate{
+		Kind:           models.StateReadCursor,
+		ConversationID: conversationID,
+		ReadCursor:     cursor,
+	})
+	return nil
+}
+
+// handleMuteRoom mutes or unmutes a room on all of the user's devices
+func (h *SocketIOHandler) handleMuteRoom(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	roomID, _ := data["roomId"].(string)
+	muted, _ := data["muted"].(bool)
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before muting rooms")
+	}
+
+	ctx := context.Background()
+	update := &models.StateUpdate{Kind: models.StateRoomUnmuted, ConversationID: roomID}
+	if muted {
+		update.Kind = models.StateRoomMuted
+		added, err := h.redisService.MuteRoom(ctx, user.ID, roomID, maxSyncedEntries)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to mute room")
+			return newEventError(errInternal, "Failed to mute room")
+		}
+		if !added {
+			return newEventError(errOutOfRange, "Too many muted rooms").withDetail("max", maxSyncedEntries)
+		}
+	} else if err := h.redisService.UnmuteRoom(ctx, user.ID, roomID); err != nil {
+		h.logger.WithError(err).Error("Failed to unmute room")
+		return newEventError(errInternal, "Failed to unmute room")
+	}
+
+	h.publishStateUpdate(client, user.ID, update)
+	return nil
+}
+
+// handleSaveDraft stores the user's draft for a conversation, or clears it
+// when the content is empty
+func (h *SocketIOHandler) handleSaveDraft(client *socket.Socket, args ...any) error {
+	data, _ := args[0].(map[string]interface{})
+	conversationID, _ := data["conversationId"].(string)
+	content, _ := data["content"].(string)
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before saving drafts")
+	}
+
+	ctx := context.Background()
+	update := &models.StateUpdate{Kind: models.StateDraft, ConversationID: conversationID}
+	if content == "" {
+		if err := h.redisService.DeleteDraft(ctx, user.ID, conversationID); err != nil {
+			h.logger.WithError(err).Error("Failed to delete draft")
+			return newEventError(errInternal, "Failed to save draft")
+		}
+	} else {
+		update.Draft = &models.Draft{Content: content, UpdatedAt: time.Now()}
+		saved, err := h.redisService.SaveDraft(ctx, user.ID, conversationID, update.Draft, maxSyncedEntries)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to save draft")
+			return newEventError(errInternal, "Failed to save draft")
+		}
+		if !saved {
+			return newEventError(errOutOfRange, "Too many drafts").withDetail("max", maxSyncedEntries)
+		}
+	}
+
+	h.publishStateUpdate(client, user.ID, update)
+	return nil
+}
+
+// publishStateUpdate tells the user's other devices, on every node, about a
+// change made on this one
+func (h *SocketIOHandler) publishStateUpdate(client *socket.Socket, userName string, update *models.StateUpdate) {
+	h.publishControl(&models.ControlEvent{
+		Type:      models.ControlStateUpdated,
+		SessionID: string(client.Id()),
+		UserName:  userName,
+		State:     update,
+	})
+}
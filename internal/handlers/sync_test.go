@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"im-demo/internal/models"
+)
+
+func TestStateSync(t *testing.T) {
+	h, _ := newTestHandler(t)
+	endpoint := newTestServer(t, h)
+	ctx := t.Context()
+	addTestMembers(t, h, "general", "alice", "bob")
+	addTestMembers(t, h, "secret", "bob")
+
+	now := time.Now()
+	messages := []*models.Message{
+		{ID: "older", Type: models.TextMessage, Sender: "bob", Room: "general", Content: "1", Timestamp: now.Add(-time.Minute)},
+		{ID: "newer", Type: models.TextMessage, Sender: "bob", Room: "general", Content: "2", Timestamp: now},
+		{ID: "hidden", Type: models.TextMessage, Sender: "bob", Room: "secret", Content: "3", Timestamp: now},
+		{ID: "direct", Type: models.TextMessage, Sender: "bob", Receiver: "alice", Content: "4", Timestamp: now},
+		{ID: "broadcast", Type: models.TextMessage, Sender: "bob", Content: "5", Timestamp: now},
+	}
+	for _, message := range messages {
+		if err := h.redisService.StoreMessage(ctx, message); err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+	}
+
+	phone, laptop := dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+	phone.join("alice")
+	laptop.join("alice")
+
+	steps := []struct {
+		name  string
+		event string
+		data  map[string]interface{}
+		code  string              // error code, empty on success
+		want  *models.StateUpdate // update sent to the other device, nil for none
+	}{
+		{name: "read newer", event: "read_cursor", data: map[string]interface{}{"messageId": "newer"},
+			want: &models.StateUpdate{Kind: models.StateReadCursor, ConversationID: "general", ReadCursor: &models.ReadCursor{MessageID: "newer"}}},
+		{name: "read older", event: "read_cursor", data: map[string]interface{}{"messageId": "older"}},
+		{name: "read direct", event: "read_cursor", data: map[string]interface{}{"messageId": "direct"},
+			want: &models.StateUpdate{Kind: models.StateReadCursor, ConversationID: "dm:bob", ReadCursor: &models.ReadCursor{MessageID: "direct"}}},
+		{name: "read hidden", event: "read_cursor", data: map[string]interface{}{"messageId": "hidden"}, code: errNotFound.Code},
+		{name: "read missing", event: "read_cursor", data: map[string]interface{}{"messageId": "missing"}, code: errNotFound.Code},
+		{name: "read broadcast", event: "read_cursor", data: map[string]interface{}{"messageId": "broadcast"}, code: errInvalidValue.Code},
+		{name: "mute", event: "mute_room", data: map[string]interface{}{"roomId": "general", "muted": true},
+			want: &models.StateUpdate{Kind: models.StateRoomMuted, ConversationID: "general"}},
+		{name: "mute and unmute", event: "mute_room", data: map[string]interface{}{"roomId": "random", "muted": true},
+			want: &models.StateUpdate{Kind: models.StateRoomMuted, ConversationID: "random"}},
+		{name: "unmute", event: "mute_room", data: map[string]interface{}{"roomId": "random", "muted": false},
+			want: &models.StateUpdate{Kind: models.StateRoomUnmuted, ConversationID: "random"}},
+		{name: "draft", event: "save_draft", data: map[string]interface{}{"conversationId": "general", "content": "half a thought"},
+			want: &models.StateUpdate{Kind: models.StateDraft, ConversationID: "general", Draft: &models.Draft{Content: "half a thought"}}},
+		{name: "other draft", event: "save_draft", data: map[string]interface{}{"conversationId": "dm:bob", "content": "hey"},
+			want: &models.StateUpdate{Kind: models.StateDraft, ConversationID: "dm:bob", Draft: &models.Draft{Content: "hey"}}},
+		{name: "clear draft", event: "save_draft", data: map[string]interface{}{"conversationId": "dm:bob", "content": ""},
+			want: &models.StateUpdate{Kind: models.StateDraft, ConversationID: "dm:bob"}},
+	}
+
+	for _, step := range steps {
+		reply := phone.emit(step.event, step.data)
+		if code := errorCode(reply); code != step.code {
+			t.Errorf("%s: got %q, want %q", step.name, code, step.code)
+			continue
+		}
+		if step.want == nil {
+			laptop.expectNoEvent(string(models.EventStateUpdated), 100*time.Millisecond)
+			continue
+		}
+
+		var updated struct {
+			Update models.StateUpdate `json:"update"`
+		}
+		if err := json.Unmarshal(laptop.waitEvent(string(models.EventStateUpdated)), &updated); err != nil {
+			t.Fatalf("%s: invalid state_updated: %v", step.name, err)
+		}
+		got := updated.Update
+		if got.Kind != step.want.Kind || got.ConversationID != step.want.ConversationID ||
+			(got.ReadCursor == nil) != (step.want.ReadCursor == nil) || (got.Draft == nil) != (step.want.Draft == nil) {
+			t.Errorf("%s: got %+v, want %+v", step.name, got, step.want)
+			continue
+		}
+		if got.ReadCursor != nil && got.ReadCursor.MessageID != step.want.ReadCursor.MessageID {
+			t.Errorf("%s: cursor at %s, want %s", step.name, got.ReadCursor.MessageID, step.want.ReadCursor.MessageID)
+		}
+		if got.Draft != nil && got.Draft.Content != step.want.Draft.Content {
+			t.Errorf("%s: draft %q, want %q", step.name, got.Draft.Content, step.want.Draft.Content)
+		}
+	}
+	// The device that made a change is not told about it
+	phone.expectNoEvent(string(models.EventStateUpdated), 100*time.Millisecond)
+
+	// A new device starts from the shared state
+	tablet := dialTestClient(t, endpoint)
+	tablet.emitOK("join", map[string]interface{}{"userName": "alice"})
+	var synced struct {
+		State models.UserState `json:"state"`
+	}
+	if err := json.Unmarshal(tablet.waitEvent(string(models.EventSyncState)), &synced); err != nil {
+		t.Fatalf("invalid sync_state: %v", err)
+	}
+	cursors := make(map[string]string)
+	for conversationID, cursor := range synced.State.ReadCursors {
+		cursors[conversationID] = cursor.MessageID
+	}
+	if want := map[string]string{"general": "newer", "dm:bob": "direct"}; !maps.Equal(cursors, want) {
+		t.Errorf("read cursors %v, want %v", cursors, want)
+	}
+	if !slices.Equal(synced.State.MutedRooms, []string{"general"}) {
+		t.Errorf("muted rooms %v, want general", synced.State.MutedRooms)
+	}
+	if len(synced.State.Drafts) != 1 || synced.State.Drafts["general"] == nil || synced.State.Drafts["general"].Content != "half a thought" {
+		t.Errorf("drafts %+v, want the draft for general", synced.State.Drafts)
+	}
+}
+
+func TestStateSyncLimits(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	ctx := t.Context()
+	for i := range maxSyncedEntries {
+		conversationID := fmt.Sprintf("room-%d", i)
+		if _, err := h.redisService.MuteRoom(ctx, "alice", conversationID, maxSyncedEntries); err != nil {
+			t.Fatalf("failed to mute room: %v", err)
+		}
+		if _, err := h.redisService.SaveDraft(ctx, "alice", conversationID, &models.Draft{Content: "x"}, maxSyncedEntries); err != nil {
+			t.Fatalf("failed to save draft: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		event string
+		data  map[string]interface{}
+		code  string
+	}{
+		{name: "another muted room", event: "mute_room", data: map[string]interface{}{"roomId": "one-more", "muted": true}, code: errOutOfRange.Code},
+		{name: "muted room again", event: "mute_room", data: map[string]interface{}{"roomId": "room-0", "muted": true}},
+		{name: "another draft", event: "save_draft", data: map[string]interface{}{"conversationId": "one-more", "content": "x"}, code: errOutOfRange.Code},
+		{name: "updated draft", event: "save_draft", data: map[string]interface{}{"conversationId": "room-0", "content": "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(c.emit(tt.event, tt.data)); code != tt.code {
+				t.Errorf("got %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"im-demo/internal/models"
+
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+// typingState is a user typing in a room or to a direct message receiver
+type typingState struct {
+	userName  string
+	roomID    string
+	receiver  string
+	sessionID string    // device the user last typed on
+	relayedAt time.Time // when "typing" was last relayed
+	expiresAt time.Time // when the user is considered to have stopped
+}
+
+// typingKey identifies a user typing in a conversation
+func typingKey(userName, roomID, receiver string) string {
+	if roomID != "" {
+		return userName + "\x00" + roomID
+	}
+	return userName + "\x00dm:" + receiver
+}
+
+// typingTarget reads the conversation of a typing event
+func typingTarget(args []any) (roomID, receiver string, err error) {
+	data, _ := args[0].(map[string]interface{})
+	roomID, _ = data["roomId"].(string)
+	receiver, _ = data["receiver"].(string)
+	if roomID == "" && receiver == "" {
+		return "", "", newEventError(errMissingField, "roomId or receiver is required").withDetail("field", "roomId")
+	}
+	if roomID != "" {
+		receiver = ""
+	}
+	return roomID, receiver, nil
+}
+
+// handleTyping relays that the user is typing, at most once per throttle
+// interval, and stops the indicator if no further typing events arrive
+// within the timeout
+func (h *SocketIOHandler) handleTyping(client *socket.Socket, args ...any) error {
+	roomID, receiver, err := typingTarget(args)
+	if err != nil {
+		return err
+	}
+
+	sessionID := string(client.Id())
+	user, ok := h.sessionUser(sessionID)
+	if !ok {
+		return newEventError(errUnauthorized, "Join before typing")
+	}
+	if receiver == user.ID {
+		return nil
+	}
+
+	now := time.Now()
+	key := typingKey(user.ID, roomID, receiver)
+
+	h.typingMu.Lock()
+	state, ok := h.typing[key]
+	if !ok {
+		state = &typingState{userName: user.ID, roomID: roomID, receiver: receiver}
+	}
+	relay := now.Sub(state.relayedAt) >= h.config.Typing.Throttle
+	h.typingMu.Unlock()
+
+	if relay {
+		if err := h.checkTypingAccess(context.Background(), state); err != nil {
+			return err
+		}
+	}
+
+	h.typingMu.Lock()
+	// Another event may have started or stopped the indicator meanwhile
+	if current, exists := h.typing[key]; exists {
+		state = current
+	} else {
+		h.typing[key] = state
+		time.AfterFunc(h.config.Typing.Timeout, func() { h.expireTyping(key, state) })
+	}
+	if relay {
+		state.relayedAt = now
+	}
+	state.sessionID = sessionID
+	state.expiresAt = now.Add(h.config.Typing.Timeout)
+	h.typingMu.Unlock()
+
+	if relay {
+		h.relayTyping(models.EventTyping, state)
+	}
+	return nil
+}
+
+// handleStopTyping relays that the user stopped typing
+func (h *SocketIOHandler) handleStopTyping(client *socket.Socket, args ...any) error {
+	roomID, receiver, err := typingTarget(args)
+	if err != nil {
+		return err
+	}
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before typing")
+	}
+
+	key := typingKey(user.ID, roomID, receiver)
+	h.typingMu.Lock()
+	state, ok := h.typing[key]
+	delete(h.typing, key)
+	h.typingMu.Unlock()
+
+	// Without a state, nobody was told the user was typing
+	if ok {
+		h.relayTyping(models.EventStopTyping, state)
+	}
+	return nil
+}
+
+// expireTyping stops the indicator of a user who went quiet, or checks
+// again later if they typed in the meantime
+func (h *SocketIOHandler) expireTyping(key string, state *typingState) {
+	h.typingMu.Lock()
+	if h.typing[key] != state {
+		h.typingMu.Unlock()
+		return
+	}
+	if remaining := time.Until(state.expiresAt); remaining > 0 {
+		h.typingMu.Unlock()
+		time.AfterFunc(remaining, func() { h.expireTyping(key, state) })
+		return
+	}
+	delete(h.typing, key)
+	h.typingMu.Unlock()
+
+	h.relayTyping(models.EventStopTyping, state)
+}
+
+// stopSessionTyping stops the indicators of a disconnected device
+func (h *SocketIOHandler) stopSessionTyping(sessionID string) {
+	var stopped []*typingState
+	h.typingMu.Lock()
+	for key, state := range h.typing {
+		if state.sessionID == sessionID {
+			delete(h.typing, key)
+			stopped = append(stopped, state)
+		}
+	}
+	h.typingMu.Unlock()
+
+	for _, state := range stopped {
+		h.relayTyping(models.EventStopTyping, state)
+	}
+}
+
+// checkTypingAccess refuses typing in rooms the user has not joined and to
+// receivers who do not accept direct messages from them
+func (h *SocketIOHandler) checkTypingAccess(ctx context.Context, state *typingState) error {
+	if state.roomID != "" {
+		member, err := h.redisService.IsRoomMember(ctx, state.roomID, state.userName)
+		if err != nil {
+			h.logger.WithError(err).Error("Failed to check room membership")
+			return newEventError(errInternal, "Failed to check access")
+		}
+		if !member {
+			return newEventError(errForbidden, "Join the room before typing in it").withDetail("roomId", state.roomID)
+		}
+		return nil
+	}
+
+	// Like messages, typing does not tell senders whether they were blocked
+	if err := h.checkDirectMessage(ctx, state.userName, state.receiver); err != nil {
+		return err
+	}
+	return nil
+}
+
+// relayTyping sends a typing event to the room, except the typist's own
+// devices and users who blocked them, or to the receiver's devices
+func (h *SocketIOHandler) relayTyping(event models.Event, state *typingState) {
+	if state.receiver != "" {
+		h.broadcastToUserDevices(state.receiver, string(event), map[string]interface{}{
+			"userName": state.userName,
+			"receiver": state.receiver,
+		}, "")
+		return
+	}
+
+	except := h.blockerSessions(context.Background(), state.userName)
+	for _, sessionID := range h.userSessionIDs(state.userName) {
+		except = append(except, socket.Room(sessionID))
+	}
+	h.server.To(socket.Room(state.roomID)).Except(except...).Emit(string(event), map[string]interface{}{
+		"userName": state.userName,
+		"roomId":   state.roomID,
+	})
+}
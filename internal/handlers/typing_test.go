@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+)
+
+// countTypingEvents counts the typing and stop_typing events a client
+// receives within wait
+func countTypingEvents(c *testClient, wait time.Duration) (typing, stopped int) {
+	timeout := time.After(wait)
+	for {
+		select {
+		case event := <-c.events:
+			switch event.name {
+			case string(models.EventTyping):
+				typing++
+			case string(models.EventStopTyping):
+				stopped++
+			}
+		case <-timeout:
+			return typing, stopped
+		}
+	}
+}
+
+func TestTypingIndicators(t *testing.T) {
+	const (
+		throttle = 300 * time.Millisecond
+		timeout  = 500 * time.Millisecond
+	)
+
+	tests := []struct {
+		name    string
+		run     func(alice *testClient)
+		wait    time.Duration
+		typing  int // typing events bob receives
+		stopped int // stop_typing events bob receives
+	}{
+		{name: "throttled", wait: 200 * time.Millisecond, typing: 1, run: func(alice *testClient) {
+			for range 5 {
+				alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+			}
+		}},
+		{name: "relayed again after the throttle", wait: 200 * time.Millisecond, typing: 2, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+			time.Sleep(throttle + 50*time.Millisecond)
+			alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+		}},
+		{name: "stopped", wait: timeout + 200*time.Millisecond, typing: 1, stopped: 1, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+			alice.emitOK("stop_typing", map[string]interface{}{"roomId": "general"})
+		}},
+		{name: "stopped without typing", wait: 200 * time.Millisecond, run: func(alice *testClient) {
+			alice.emitOK("stop_typing", map[string]interface{}{"roomId": "general"})
+		}},
+		{name: "expired", wait: timeout + 200*time.Millisecond, typing: 1, stopped: 1, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+		}},
+		{name: "kept alive", wait: 50 * time.Millisecond, typing: 2, run: func(alice *testClient) {
+			// Typing more often than the timeout keeps the indicator on
+			for range 4 {
+				alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+				time.Sleep(timeout / 2)
+			}
+		}},
+		{name: "direct message", wait: 200 * time.Millisecond, typing: 1, stopped: 1, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"receiver": "bob"})
+			alice.emitOK("stop_typing", map[string]interface{}{"receiver": "bob"})
+		}},
+		{name: "direct message to someone else", wait: 200 * time.Millisecond, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"receiver": "carol"})
+		}},
+		{name: "disconnected", wait: 200 * time.Millisecond, typing: 1, stopped: 1, run: func(alice *testClient) {
+			alice.emitOK("typing", map[string]interface{}{"roomId": "general"})
+			alice.conn.Close()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, func(cfg *config.Config) {
+				cfg.Typing = config.TypingConfig{Throttle: throttle, Timeout: timeout}
+			})
+			endpoint := newTestServer(t, h)
+			addTestMembers(t, h, "general", "alice", "bob")
+
+			alice, aliceLaptop, bob := dialTestClient(t, endpoint), dialTestClient(t, endpoint), dialTestClient(t, endpoint)
+			for name, c := range map[string]*testClient{"alice": alice, "bob": bob} {
+				c.join(name)
+				c.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+			}
+			aliceLaptop.join("alice")
+			aliceLaptop.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+
+			tt.run(alice)
+			typing, stopped := countTypingEvents(bob, tt.wait)
+			if typing != tt.typing || stopped != tt.stopped {
+				t.Errorf("bob got %d typing and %d stop_typing, want %d and %d", typing, stopped, tt.typing, tt.stopped)
+			}
+			// The typist's other devices are not told
+			if typing, stopped := countTypingEvents(aliceLaptop, 50*time.Millisecond); typing+stopped > 0 {
+				t.Errorf("alice's laptop got %d typing and %d stop_typing", typing, stopped)
+			}
+		})
+	}
+}
+
+func TestTypingAccess(t *testing.T) {
+	h, _ := newTestHandler(t)
+	endpoint := newTestServer(t, h)
+	addTestMembers(t, h, "general", "alice", "bob", "carol")
+	if err := h.redisService.BlockUser(t.Context(), "carol", "alice"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	clients := map[string]*testClient{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		c := dialTestClient(t, endpoint)
+		c.join(name)
+		c.emitOK("join_room", map[string]interface{}{"roomId": "general"})
+		clients[name] = c
+	}
+	alice, bob, carol := clients["alice"], clients["bob"], clients["carol"]
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		code string
+	}{
+		{name: "no conversation", data: map[string]interface{}{}, code: errMissingField.Code},
+		{name: "room not joined", data: map[string]interface{}{"roomId": "secret"}, code: errForbidden.Code},
+		{name: "blocked receiver", data: map[string]interface{}{"receiver": "carol"}, code: errForbidden.Code},
+		{name: "to themselves", data: map[string]interface{}{"receiver": "alice"}},
+		{name: "room", data: map[string]interface{}{"roomId": "general"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(alice.emit("typing", tt.data)); code != tt.code {
+				t.Errorf("got %q, want %q", code, tt.code)
+			}
+		})
+	}
+
+	// Room members who blocked the typist are left out
+	var typing struct {
+		UserName string `json:"userName"`
+		RoomID   string `json:"roomId"`
+	}
+	if err := json.Unmarshal(bob.waitEvent(string(models.EventTyping)), &typing); err != nil {
+		t.Fatalf("invalid typing event: %v", err)
+	}
+	if typing.UserName != "alice" || typing.RoomID != "general" {
+		t.Errorf("got %+v, want alice typing in general", typing)
+	}
+	carol.expectNoEvent(string(models.EventTyping), 200*time.Millisecond)
+}
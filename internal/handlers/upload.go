@@ -0,0 +1,828 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zishang520/socket.io/servers/socket/v3"
+)
+
+const (
+	// quarantineDir is the blob key prefix of files held back by the scanner
+	quarantineDir = "quarantine"
+	// partialDir is the blob key prefix of the chunks of unfinished uploads
+	partialDir = "partial"
+	// assemblyDir, under UploadDir, holds chunked uploads being verified
+	assemblyDir = "incoming"
+	// uploadBatchSize bounds how many expired uploads are discarded per collection
+	uploadBatchSize = 100
+	// uploadLockTTL bounds how long a crashed node can block an upload
+	uploadLockTTL = time.Minute
+	// uploadLockWait is how long a chunk waits for the upload to be free
+	uploadLockWait = 10 * time.Second
+)
+
+// errUploadCorrupt is returned when the chunks of an upload do not add up to
+// the size and checksum announced when it started
+var errUploadCorrupt = errors.New("upload does not match its checksum")
+
+// newUploadID returns a random, unguessable upload ID
+func newUploadID() string {
+	return rand.Text()
+}
+
+// uploadChunkKey returns the blob key of the index-th chunk of an upload
+func uploadChunkKey(uploadID string, index int) string {
+	return fmt.Sprintf("%s/%s-%d", partialDir, uploadID, index)
+}
+
+// lockUpload waits for exclusive access to a chunked upload, which may be
+// resumed on any node
+func (h *SocketIOHandler) lockUpload(ctx context.Context, uploadID string) (func(), error) {
+	deadline := time.Now().Add(uploadLockWait)
+	for {
+		token, err := h.redisService.LockUpload(ctx, uploadID, uploadLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			return func() {
+				if err := h.redisService.UnlockUpload(context.Background(), uploadID, token); err != nil {
+					h.logger.WithError(err).Warn("Failed to unlock upload")
+				}
+			}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for upload %s", uploadID)
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ownedUpload returns an upload of the session's user, locked for changes.
+// The lock is only taken once the upload is known to exist.
+func (h *SocketIOHandler) ownedUpload(ctx context.Context, client *socket.Socket, uploadID string) (*models.UploadSession, func(), error) {
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return nil, nil, newEventError(errUnauthorized, "Join before uploading files")
+	}
+
+	// Other users' uploads are reported as missing
+	session, err := h.redisService.GetUploadSession(ctx, uploadID)
+	if err != nil || session.Sender != user.ID {
+		return nil, nil, newEventError(errNotFound, "Upload not found")
+	}
+
+	unlock, err := h.lockUpload(ctx, uploadID)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to lock upload")
+		return nil, nil, newEventError(errConflict, "Upload is busy")
+	}
+
+	// Reload; it may have changed while waiting for the lock
+	session, err = h.redisService.GetUploadSession(ctx, uploadID)
+	if err != nil {
+		unlock()
+		return nil, nil, newEventError(errNotFound, "Upload not found")
+	}
+	return session, unlock, nil
+}
+
+// uniqueFileName generates a collision-free stored name for an uploaded
+// file. The random part is as long as an upload ID, so names made in the
+// same second do not collide.
+func uniqueFileName(fileName string) string {
+	timestamp := time.Now().Unix()
+	ext := filepath.Ext(fileName)
+	baseName := strings.TrimSuffix(fileName, ext)
+	return fmt.Sprintf("%s_%d_%s%s", baseName, timestamp, newUploadID(), ext)
+}
+
+// publishUpload is the one path by which uploads become messages, whether
+// they arrive over Socket.IO, in chunks or over HTTP. It checks sanctions
+// and access, moderates the caption, applies the upload policy and quotas,
+// saves the contents to the blob store and sends the file message. The type is
+// detected from the content rather than taken from the client. Images are
+// re-encoded without metadata and thumbnailed; other content is stored as-is.
+func (h *SocketIOHandler) publishUpload(ctx context.Context, upload *models.UploadSession, src io.ReadSeeker) (*models.Message, *eventError) {
+	upload.FileName = h.uploadPolicy.SanitizeFileName(upload.FileName)
+
+	// Socket.IO events are checked as they arrive; uploads over HTTP are not
+	if err := h.checkUserSanctions(ctx, upload.Sender, "file_upload"); err != nil {
+		return nil, err
+	}
+	if err := h.checkSendAccess(ctx, upload.Sender, upload.Room, upload.Receiver); err != nil {
+		return nil, err
+	}
+
+	message := newFileMessage(upload)
+	if err := h.moderateMessage(ctx, message); err != nil {
+		var eventErr *eventError
+		if errors.As(err, &eventErr) {
+			return nil, eventErr
+		}
+		h.logger.WithError(err).Error("Failed to moderate upload")
+		return nil, newEventError(errInternal, "Failed to save file")
+	}
+
+	messageType, metadata, release, err := h.storeUpload(ctx, upload, src)
+	if reason, rejected := uploadRejection(err); rejected {
+		return nil, newEventError(errUploadRejected, reason)
+	}
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to save file")
+		return nil, newEventError(errInternal, "Failed to save file")
+	}
+
+	// File URLs are signed and short-lived
+	h.signFileMetadata(message.ID, metadata)
+	message.Type = messageType
+	message.Metadata = metadata
+	if err := h.deliverFileMessage(upload, message); err != nil {
+		// An unreferenced blob is collected later; only the quota is given back now
+		release()
+		h.logger.WithError(err).Error("Failed to store file message")
+		return nil, newEventError(errInternal, "Failed to send file")
+	}
+	return message, nil
+}
+
+// storeUpload applies the upload policy and saves the contents of an upload.
+// The returned function gives back the quota taken if the file is not sent.
+func (h *SocketIOHandler) storeUpload(ctx context.Context, upload *models.UploadSession, src io.ReadSeeker) (models.MessageType, *models.FileMetadata, func(), error) {
+	// Sniff the first bytes to detect the content type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, nil, err
+	}
+	contentType := http.DetectContentType(head[:n])
+
+	if err := h.uploadPolicy.CheckType(contentType); err != nil {
+		h.logUploadRejected(upload, err)
+		return "", nil, nil, err
+	}
+
+	metadata := &models.FileMetadata{
+		FileName: upload.FileName,
+		FileType: contentType,
+		FileSize: upload.FileSize,
+	}
+
+	if err := h.scanUpload(ctx, upload, metadata, src); err != nil {
+		return "", nil, nil, err
+	}
+
+	hash, err := contentHash(upload, src)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// Chunked uploads took their quota when they started; it is given back
+	// when the upload is discarded
+	release := func() {}
+	if !upload.QuotaReserved {
+		release, err = h.uploadPolicy.ReserveQuota(ctx, upload.Sender, upload.Room, upload.FileSize)
+		if err != nil {
+			h.logUploadRejected(upload, err)
+			return "", nil, nil, err
+		}
+	}
+
+	messageType, err := h.storeDeduplicated(ctx, hash, metadata, src)
+	if err != nil {
+		release()
+		return "", nil, nil, err
+	}
+	return messageType, metadata, release, nil
+}
+
+// storeUploadContent writes an accepted upload to the blob store. Images
+// that cannot be stripped of their metadata are refused rather than stored
+// as they are.
+func (h *SocketIOHandler) storeUploadContent(ctx context.Context, metadata *models.FileMetadata, src io.ReadSeeker) (models.MessageType, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	switch {
+	case services.IsProcessableImage(metadata.FileType):
+		data, err := io.ReadAll(io.LimitReader(src, h.config.Upload.MaxFileSize+1))
+		if err != nil {
+			return "", err
+		}
+
+		processed, err := h.images.Process(ctx, data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			h.logger.WithError(err).WithField("file_name", metadata.FileName).Warn("Failed to process image")
+			return "", &services.PolicyViolation{Reason: "Image could not be processed"}
+		}
+		if err := h.storeProcessedImage(ctx, metadata, processed); err != nil {
+			return "", err
+		}
+		return models.ImageMessage, nil
+
+	case metadata.FileType == "image/webp":
+		// WebP cannot be decoded here; its metadata chunks are dropped instead
+		data, err := io.ReadAll(io.LimitReader(src, h.config.Upload.MaxFileSize+1))
+		if err != nil {
+			return "", err
+		}
+		stripped, err := services.StripWebPMetadata(data)
+		if err != nil {
+			h.logger.WithError(err).WithField("file_name", metadata.FileName).Warn("Failed to strip image metadata")
+			return "", &services.PolicyViolation{Reason: "Image could not be processed"}
+		}
+		metadata.FileSize = int64(len(stripped))
+		src = bytes.NewReader(stripped)
+	}
+
+	// Other images, BMP and ICO, carry no metadata
+	if err := h.blobStore.Put(ctx, metadata.BlobKey, src, metadata.FileSize, metadata.FileType); err != nil {
+		return "", err
+	}
+	return models.FileMessage, nil
+}
+
+// scanUpload runs the policy's scanner over an upload. Rejected files are
+// refused outright; quarantined files are set aside for review and never
+// published.
+func (h *SocketIOHandler) scanUpload(ctx context.Context, upload *models.UploadSession, metadata *models.FileMetadata, src io.ReadSeeker) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	result, err := h.uploadPolicy.Scan(ctx, upload.FileName, src)
+	if err != nil {
+		return err
+	}
+
+	switch result.Verdict {
+	case services.ScanClean:
+		return nil
+
+	case services.ScanQuarantine:
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		key := quarantineDir + "/" + uniqueFileName(upload.FileName)
+		if err := h.blobStore.Put(ctx, key, src, upload.FileSize, metadata.FileType); err != nil {
+			return err
+		}
+
+		h.logger.WithFields(logrus.Fields{
+			"sender":    upload.Sender,
+			"room_id":   upload.Room,
+			"file_name": upload.FileName,
+			"blob_key":  key,
+			"reason":    result.Reason,
+		}).Warn("Upload quarantined")
+		return &services.PolicyViolation{Reason: "File was quarantined for review"}
+
+	default:
+		err := &services.PolicyViolation{Reason: "File rejected by scanner"}
+		h.logUploadRejected(upload, fmt.Errorf("%w: %s", err, result.Reason))
+		return err
+	}
+}
+
+// logUploadRejected records why the policy refused an upload
+func (h *SocketIOHandler) logUploadRejected(upload *models.UploadSession, err error) {
+	h.logger.WithError(err).WithFields(logrus.Fields{
+		"sender":    upload.Sender,
+		"room_id":   upload.Room,
+		"file_name": upload.FileName,
+	}).Warn("Upload rejected by policy")
+}
+
+// uploadRejection returns the reason to show the client when err is a
+// policy violation rather than a server failure
+func uploadRejection(err error) (string, bool) {
+	var violation *services.PolicyViolation
+	if errors.As(err, &violation) {
+		return violation.Reason, true
+	}
+	return "", false
+}
+
+// storeProcessedImage saves a sanitized image and its thumbnails
+func (h *SocketIOHandler) storeProcessedImage(ctx context.Context, metadata *models.FileMetadata, processed *services.ProcessedImage) error {
+	metadata.FileType = processed.ContentType
+	metadata.FileSize = int64(len(processed.Data))
+	metadata.Width = processed.Width
+	metadata.Height = processed.Height
+
+	err := h.blobStore.Put(ctx, metadata.BlobKey, bytes.NewReader(processed.Data), metadata.FileSize, metadata.FileType)
+	if err != nil {
+		return err
+	}
+
+	for _, thumb := range processed.Thumbnails {
+		ext := ".jpg"
+		if thumb.ContentType == "image/png" {
+			ext = ".png"
+		}
+		key := fmt.Sprintf("%s.thumb%d%s", metadata.BlobKey, thumb.Size, ext)
+
+		if err := h.blobStore.Put(ctx, key, bytes.NewReader(thumb.Data), int64(len(thumb.Data)), thumb.ContentType); err != nil {
+			return err
+		}
+
+		metadata.Thumbnails = append(metadata.Thumbnails, models.Thumbnail{
+			Size:     thumb.Size,
+			Width:    thumb.Width,
+			Height:   thumb.Height,
+			FileType: thumb.ContentType,
+			BlobKey:  key,
+		})
+	}
+
+	return nil
+}
+
+// newFileMessage creates the message announcing an upload; its type and
+// file metadata are filled in once the contents are stored
+func newFileMessage(upload *models.UploadSession) *models.Message {
+	content := upload.Caption
+	if content == "" {
+		content = fmt.Sprintf("File: %s", upload.FileName)
+	}
+
+	message := &models.Message{
+		ID:        generateMessageID(),
+		Type:      models.FileMessage,
+		Content:   content,
+		Sender:    upload.Sender,
+		Room:      upload.Room,
+		Receiver:  upload.Receiver,
+		Timestamp: time.Now(),
+	}
+	applyEphemeralOptions(message, upload.TTL, upload.BurnAfterRead)
+	return message
+}
+
+// deliverFileMessage stores and broadcasts the message for an upload whose
+// contents have been saved
+func (h *SocketIOHandler) deliverFileMessage(upload *models.UploadSession, message *models.Message) error {
+	ctx := context.Background()
+
+	// Store message in Redis
+	if err := h.redisService.StoreMessage(ctx, message); err != nil {
+		return err
+	}
+
+	// Broadcast message
+	h.broadcastMessage(message)
+
+	h.logger.WithFields(logrus.Fields{
+		"message_id": message.ID,
+		"sender":     upload.Sender,
+		"room_id":    upload.Room,
+		"file_name":  upload.FileName,
+		"file_size":  upload.FileSize,
+	}).Info("File uploaded and message sent")
+
+	return nil
+}
+
+// handleUploadInit starts a chunked upload, or resumes one when an existing
+// uploadId is supplied. The client is told which offset to continue from.
+func (h *SocketIOHandler) handleUploadInit(client *socket.Socket, args ...any) error {
+	if len(args) == 0 {
+		return newEventError(errInvalidPayload, "No upload data")
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return newEventError(errInvalidPayload, "Invalid upload data")
+	}
+
+	user, ok := h.sessionUser(string(client.Id()))
+	if !ok {
+		return newEventError(errUnauthorized, "Join before uploading files")
+	}
+
+	ctx := context.Background()
+	uploadID, _ := data["uploadId"].(string)
+	sender := user.ID
+
+	// Resume an upload interrupted by a reconnect, possibly on another node
+	if uploadID != "" {
+		session, unlock, err := h.ownedUpload(ctx, client, uploadID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := h.redisService.StoreUploadSession(ctx, session, h.config.Upload.SessionTTL); err != nil {
+			h.logger.WithError(err).Error("Failed to resume upload")
+			return newEventError(errInternal, "Failed to resume upload")
+		}
+
+		h.emitUploadReady(client, session, session.Offset)
+		return nil
+	}
+
+	fileName, _ := data["fileName"].(string)
+	fileType, _ := data["fileType"].(string)
+	fileSize, _ := data["fileSize"].(float64)
+	checksum, _ := data["checksum"].(string)
+	roomID, _ := data["roomId"].(string)
+	receiver, _ := data["receiver"].(string)
+	caption, _ := data["caption"].(string)
+
+	if fileName == "" || fileSize <= 0 || !isSHA256Hex(checksum) {
+		return newEventError(errInvalidPayload, "Invalid upload data")
+	}
+
+	if int64(fileSize) > h.config.Upload.MaxFileSize {
+		return newEventError(errTooLarge, fmt.Sprintf("File too large, max size is %d bytes", h.config.Upload.MaxFileSize))
+	}
+
+	ttl, burnAfterRead, err := h.parseEphemeralOptions(data)
+	if err != nil {
+		return newEventError(errInvalidValue, err.Error())
+	}
+
+	session := &models.UploadSession{
+		ID:            newUploadID(),
+		FileName:      fileName,
+		FileType:      fileType,
+		FileSize:      int64(fileSize),
+		Checksum:      strings.ToLower(checksum),
+		ChunkSize:     h.config.Upload.MaxChunkSize,
+		Sender:        sender,
+		Room:          roomID,
+		Receiver:      receiver,
+		Caption:       caption,
+		TTL:           ttl,
+		BurnAfterRead: burnAfterRead,
+		CreatedAt:     time.Now(),
+	}
+
+	// Fail before any data is sent; everything is checked again on completion
+	if err := h.checkSendAccess(ctx, sender, roomID, receiver); err != nil {
+		return err
+	}
+
+	// The quota is taken now so that unfinished uploads count against it
+	release, err := h.uploadPolicy.ReserveQuota(ctx, sender, roomID, session.FileSize)
+	if reason, rejected := uploadRejection(err); rejected {
+		h.logUploadRejected(session, err)
+		return newEventError(errUploadRejected, reason)
+	}
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to reserve upload quota")
+		return newEventError(errInternal, "Failed to start upload")
+	}
+	session.QuotaReserved = true
+
+	opened, err := h.redisService.OpenUploadSession(ctx, session, h.config.Upload.SessionTTL, h.config.Upload.MaxOpenUploads)
+	if err != nil {
+		release()
+		h.logger.WithError(err).Error("Failed to store upload session")
+		return newEventError(errInternal, "Failed to start upload")
+	}
+	if !opened {
+		release()
+		return newEventError(errOutOfRange, fmt.Sprintf("At most %d uploads can be in progress", h.config.Upload.MaxOpenUploads))
+	}
+
+	h.emitUploadReady(client, session, 0)
+
+	h.logger.WithFields(logrus.Fields{
+		"upload_id": session.ID,
+		"sender":    sender,
+		"file_name": fileName,
+		"file_size": session.FileSize,
+	}).Info("Chunked upload started")
+
+	return nil
+}
+
+// handleUploadChunk verifies and appends one chunk of a chunked upload
+func (h *SocketIOHandler) handleUploadChunk(client *socket.Socket, args ...any) error {
+	if len(args) == 0 {
+		return newEventError(errInvalidPayload, "No chunk data")
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return newEventError(errInvalidPayload, "Invalid chunk data")
+	}
+
+	uploadID, _ := data["uploadId"].(string)
+	offset, _ := data["offset"].(float64)
+	chunkData, _ := data["data"].(string)
+	checksum, _ := data["checksum"].(string)
+
+	if uploadID == "" || chunkData == "" || !isSHA256Hex(checksum) {
+		return newEventError(errInvalidPayload, "Invalid chunk data")
+	}
+
+	ctx := context.Background()
+	session, unlock, err := h.ownedUpload(ctx, client, uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Out-of-order or duplicate chunk: tell the client where to continue
+	if int64(offset) != session.Offset {
+		h.emitUploadProgress(client, session)
+		return nil
+	}
+
+	chunk, err := base64.StdEncoding.DecodeString(chunkData)
+	if err != nil || len(chunk) == 0 {
+		return newEventError(errInvalidPayload, "Invalid chunk data")
+	}
+
+	if int64(len(chunk)) > session.ChunkSize || session.Offset+int64(len(chunk)) > session.FileSize {
+		return newEventError(errTooLarge, "Chunk exceeds upload size")
+	}
+
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+		return newEventError(errChecksum, "Chunk checksum mismatch")
+	}
+
+	// A chunk stored without being recorded is overwritten when it is resent
+	key := uploadChunkKey(session.ID, session.Chunks)
+	if err := h.blobStore.Put(ctx, key, bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+		h.logger.WithError(err).Error("Failed to save chunk")
+		return newEventError(errInternal, "Failed to save chunk")
+	}
+	if err := h.redisService.RecordUploadChunk(ctx, session, int64(len(chunk)), h.config.Upload.SessionTTL); err != nil {
+		h.logger.WithError(err).Error("Failed to save chunk")
+		return newEventError(errInternal, "Failed to save chunk")
+	}
+
+	h.emitUploadProgress(client, session)
+
+	return nil
+}
+
+// handleUploadComplete verifies the assembled file and publishes the file message
+func (h *SocketIOHandler) handleUploadComplete(client *socket.Socket, args ...any) error {
+	if len(args) == 0 {
+		return newEventError(errInvalidPayload, "No upload data")
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return newEventError(errInvalidPayload, "Invalid upload data")
+	}
+
+	uploadID, _ := data["uploadId"].(string)
+	if uploadID == "" {
+		return newEventError(errInvalidPayload, "Invalid upload data")
+	}
+
+	ctx := context.Background()
+	session, unlock, err := h.ownedUpload(ctx, client, uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !session.Completed() {
+		h.emitUploadProgress(client, session)
+		return nil
+	}
+
+	file, err := h.assembleUpload(ctx, session)
+	if errors.Is(err, errUploadCorrupt) {
+		// The file is corrupt; the client has to start over
+		h.discardUpload(ctx, session, true)
+		return newEventError(errChecksum, "Upload checksum mismatch")
+	}
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to assemble upload")
+		return newEventError(errInternal, "Failed to verify upload")
+	}
+	defer removeAssembledUpload(file)
+
+	message, eventErr := h.publishUpload(ctx, session, file)
+	if eventErr != nil {
+		// After a server failure the client can retry upload_complete;
+		// otherwise retrying would not change the outcome
+		if eventErr.kind != errInternal {
+			h.discardUpload(ctx, session, true)
+		}
+		return eventErr
+	}
+	// The quota now belongs to the sent file
+	h.discardUpload(ctx, session, false)
+
+	client.Emit("upload_completed", map[string]interface{}{
+		"uploadId":  uploadID,
+		"messageId": message.ID,
+	})
+
+	return nil
+}
+
+// handleUploadAbort cancels a chunked upload, removes its chunks and gives
+// back its quota
+func (h *SocketIOHandler) handleUploadAbort(client *socket.Socket, args ...any) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	uploadID, _ := data["uploadId"].(string)
+	if uploadID == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	session, unlock, err := h.ownedUpload(ctx, client, uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	h.discardUpload(ctx, session, true)
+
+	return nil
+}
+
+// assembleUpload joins the chunks of an upload into a file under UploadDir
+// and verifies its size and checksum. The caller removes the file with
+// removeAssembledUpload.
+func (h *SocketIOHandler) assembleUpload(ctx context.Context, session *models.UploadSession) (*os.File, error) {
+	dir := filepath.Join(h.config.Upload.UploadDir, assemblyDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create assembly directory: %w", err)
+	}
+	file, err := os.CreateTemp(dir, session.ID+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create assembled file: %w", err)
+	}
+
+	hash := sha256.New()
+	size, err := h.copyUploadChunks(ctx, session, io.MultiWriter(file, hash))
+	if err == nil && (size != session.FileSize || hex.EncodeToString(hash.Sum(nil)) != session.Checksum) {
+		err = errUploadCorrupt
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeAssembledUpload(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// copyUploadChunks writes the chunks of an upload to w in order and returns
+// the number of bytes written. A missing chunk makes the upload corrupt.
+func (h *SocketIOHandler) copyUploadChunks(ctx context.Context, session *models.UploadSession, w io.Writer) (int64, error) {
+	var size int64
+	for i := range session.Chunks {
+		r, err := h.blobStore.Open(ctx, uploadChunkKey(session.ID, i))
+		if errors.Is(err, services.ErrBlobNotFound) {
+			return size, errUploadCorrupt
+		}
+		if err != nil {
+			return size, err
+		}
+		n, err := io.Copy(w, r)
+		r.Close()
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+// removeAssembledUpload closes and deletes a file made by assembleUpload
+func removeAssembledUpload(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// discardUpload deletes the state and chunks of an upload and, when
+// releaseQuota is set, gives back the quota it took
+func (h *SocketIOHandler) discardUpload(ctx context.Context, session *models.UploadSession, releaseQuota bool) {
+	// One chunk past the last may have been stored but never recorded
+	for i := 0; i <= session.Chunks; i++ {
+		if err := h.blobStore.Delete(ctx, uploadChunkKey(session.ID, i)); err != nil {
+			h.logger.WithError(err).WithField("upload_id", session.ID).Error("Failed to remove upload chunk")
+		}
+	}
+
+	if releaseQuota && session.QuotaReserved {
+		if err := h.uploadPolicy.ReleaseQuota(ctx, session.Sender, session.Room, session.FileSize); err != nil {
+			h.logger.WithError(err).WithField("upload_id", session.ID).Error("Failed to release upload quota")
+		}
+	}
+
+	if err := h.redisService.DeleteUploadSession(ctx, session); err != nil {
+		h.logger.WithError(err).Error("Failed to remove partial upload")
+	}
+}
+
+// collectUploads discards chunked uploads that were not completed or
+// resumed before they expired
+func (h *SocketIOHandler) collectUploads() {
+	ctx := context.Background()
+	now := time.Now()
+
+	uploadIDs, err := h.redisService.GetDueUploads(ctx, now, uploadBatchSize)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fetch expired uploads")
+		return
+	}
+
+	collected := 0
+	for _, uploadID := range uploadIDs {
+		if h.collectUpload(ctx, uploadID, now) {
+			collected++
+		}
+	}
+
+	if collected > 0 {
+		h.logger.WithField("collected", collected).Info("Discarded expired uploads")
+	}
+}
+
+// collectUpload discards a single expired upload
+func (h *SocketIOHandler) collectUpload(ctx context.Context, uploadID string, now time.Time) bool {
+	// Skip uploads that are being changed; they are checked again next time
+	token, err := h.redisService.LockUpload(ctx, uploadID, uploadLockTTL)
+	if err != nil || token == "" {
+		return false
+	}
+	defer h.redisService.UnlockUpload(ctx, uploadID, token)
+
+	session, err := h.redisService.ClaimUpload(ctx, uploadID, now)
+	if err != nil {
+		h.logger.WithError(err).WithField("upload_id", uploadID).Error("Failed to claim upload")
+		return false
+	}
+	if session == nil {
+		return false
+	}
+
+	h.discardUpload(ctx, session, true)
+	return true
+}
+
+// emitUploadReady tells the client an upload can receive chunks from offset
+func (h *SocketIOHandler) emitUploadReady(client *socket.Socket, session *models.UploadSession, offset int64) {
+	client.Emit("upload_ready", map[string]interface{}{
+		"uploadId":  session.ID,
+		"offset":    offset,
+		"chunkSize": session.ChunkSize,
+		"fileSize":  session.FileSize,
+	})
+}
+
+// emitUploadProgress acknowledges received bytes of an upload
+func (h *SocketIOHandler) emitUploadProgress(client *socket.Socket, session *models.UploadSession) {
+	client.Emit("upload_progress", map[string]interface{}{
+		"uploadId": session.ID,
+		"offset":   session.Offset,
+		"fileSize": session.FileSize,
+	})
+}
+
+// isSHA256Hex reports whether s looks like a hex encoded SHA-256 digest
+func isSHA256Hex(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
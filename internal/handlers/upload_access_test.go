@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadPath sends an upload from alice and returns the error code, or ""
+type uploadPath func(t *testing.T, h *SocketIOHandler, fields map[string]interface{}, content []byte) string
+
+// socketUpload sends a file_upload event
+func socketUpload(t *testing.T, h *SocketIOHandler, fields map[string]interface{}, content []byte) string {
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	data := map[string]interface{}{
+		"sender":   "alice",
+		"fileName": "notes.txt",
+		"fileData": base64.StdEncoding.EncodeToString(content),
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+	return errorCode(c.emit("file_upload", data))
+}
+
+// chunkedUpload sends the file in one chunk of a chunked upload
+func chunkedUpload(t *testing.T, h *SocketIOHandler, fields map[string]interface{}, content []byte) string {
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	sum := sha256.Sum256(content)
+	data := map[string]interface{}{
+		"fileName": "notes.txt",
+		"fileSize": len(content),
+		"checksum": hex.EncodeToString(sum[:]),
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+	if code := errorCode(c.emit("upload_init", data)); code != "" {
+		return code
+	}
+
+	var ready struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal(c.waitEvent("upload_ready"), &ready); err != nil {
+		t.Fatalf("invalid upload_ready: %v", err)
+	}
+	c.emitOK("upload_chunk", chunkPayload(ready.UploadID, 0, content))
+	return errorCode(c.emit("upload_complete", map[string]interface{}{"uploadId": ready.UploadID}))
+}
+
+// httpUpload posts the file to the REST endpoint
+func httpUpload(t *testing.T, h *SocketIOHandler, fields map[string]interface{}, content []byte) string {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for k, v := range fields {
+		form.WriteField(k, v.(string))
+	}
+	part, _ := form.CreateFormFile("file", "notes.txt")
+	part.Write(content)
+	form.Close()
+
+	token, err := h.auth.IssueToken("alice", "sid-alice")
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+
+	router := gin.New()
+	router.POST("/api/upload", h.RequireAuth(), h.HandleFileUpload)
+	req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code == http.StatusCreated {
+		return ""
+	}
+	var reply struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	return reply.Error.Code
+}
+
+func TestUploadChecksMatchAcrossPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	paths := map[string]uploadPath{
+		"file_upload": socketUpload,
+		"chunked":     chunkedUpload,
+		"http":        httpUpload,
+	}
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		muted  bool
+		want   *errorKind
+	}{
+		{name: "room member", fields: map[string]interface{}{"roomId": "general"}},
+		{name: "direct", fields: map[string]interface{}{"receiver": "carol"}},
+		{name: "not a member", fields: map[string]interface{}{"roomId": "private"}, want: errForbidden},
+		{name: "blocked", fields: map[string]interface{}{"receiver": "bob"}, want: errForbidden},
+		{name: "room and receiver", fields: map[string]interface{}{"roomId": "general", "receiver": "carol"}, want: errInvalidValue},
+		{name: "rejected caption", fields: map[string]interface{}{"roomId": "general", "caption": "cheap pills"}, want: errMessageRejected},
+		{name: "muted", fields: map[string]interface{}{"roomId": "general"}, muted: true, want: errForbidden},
+	}
+
+	for pathName, upload := range paths {
+		for _, tt := range tests {
+			t.Run(pathName+"/"+tt.name, func(t *testing.T) {
+				h, mr := newTestHandler(t, func(cfg *config.Config) {
+					cfg.Moderation.Enabled = true
+					cfg.Moderation.WordList = config.WordListConfig{Words: []string{"pills"}, Action: "reject"}
+				})
+				addTestMembers(t, h, "general", "alice")
+				addTestMembers(t, h, "private", "bob")
+				if err := h.redisService.BlockUser(t.Context(), "bob", "alice"); err != nil {
+					t.Fatalf("failed to block: %v", err)
+				}
+				if tt.muted {
+					if err := h.redisService.SetSanction(t.Context(), &models.Sanction{Kind: models.SanctionMute, UserName: "alice"}); err != nil {
+						t.Fatalf("failed to mute: %v", err)
+					}
+				}
+
+				code := upload(t, h, tt.fields, []byte("quarterly numbers"))
+				want := ""
+				if tt.want != nil {
+					want = tt.want.Code
+				}
+				if code != want {
+					t.Fatalf("got %q, want %q", code, want)
+				}
+
+				// Refused uploads leave nothing behind
+				stored := slices.ContainsFunc(mr.Keys(), func(key string) bool {
+					return strings.HasPrefix(key, "message:")
+				})
+				if want != "" && (stored || len(storedFiles(t, h)) > 0) {
+					t.Errorf("refused upload was stored: %v", mr.Keys())
+				}
+			})
+		}
+	}
+}
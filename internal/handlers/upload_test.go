@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+	"im-demo/internal/services"
+
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+// startTestUpload starts a chunked upload of content and returns its ID
+func startTestUpload(t *testing.T, c *testClient, content []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	c.emitOK("upload_init", map[string]interface{}{
+		"fileName": "notes.txt",
+		"fileSize": len(content),
+		"checksum": hex.EncodeToString(sum[:]),
+		"roomId":   "general",
+	})
+
+	var ready struct {
+		UploadID string `json:"uploadId"`
+		Offset   int64  `json:"offset"`
+	}
+	if err := json.Unmarshal(c.waitEvent("upload_ready"), &ready); err != nil {
+		t.Fatalf("invalid upload_ready: %v", err)
+	}
+	return ready.UploadID
+}
+
+// chunkPayload builds an upload_chunk payload
+func chunkPayload(uploadID string, offset int, chunk []byte) map[string]interface{} {
+	sum := sha256.Sum256(chunk)
+	return map[string]interface{}{
+		"uploadId": uploadID,
+		"offset":   offset,
+		"data":     base64.StdEncoding.EncodeToString(chunk),
+		"checksum": hex.EncodeToString(sum[:]),
+	}
+}
+
+func TestUploadRequiresJoin(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := dialTestClient(t, newTestServer(t, h))
+
+	sum := sha256.Sum256([]byte("hello"))
+	reply := c.emit("upload_init", map[string]interface{}{
+		"sender":   "alice",
+		"fileName": "notes.txt",
+		"fileSize": 5,
+		"checksum": hex.EncodeToString(sum[:]),
+	})
+	if code := errorCode(reply); code != errUnauthorized.Code {
+		t.Errorf("got %v, want %s", reply, errUnauthorized.Code)
+	}
+}
+
+func TestUploadOwnership(t *testing.T) {
+	h, mr := newTestHandler(t)
+	endpoint := newTestServer(t, h)
+
+	addTestMembers(t, h, "general", "alice")
+	alice := dialTestClient(t, endpoint)
+	alice.join("alice")
+	mallory := dialTestClient(t, endpoint)
+	mallory.join("mallory")
+
+	content := []byte("hello, world")
+	uploadID := startTestUpload(t, alice, content)
+	if len(uploadID) < 20 || strings.Contains(uploadID, "_") {
+		t.Errorf("upload ID %q looks guessable", uploadID)
+	}
+
+	tests := []struct {
+		event string
+		data  map[string]interface{}
+	}{
+		{event: "upload_chunk", data: chunkPayload(uploadID, 0, content)},
+		{event: "upload_complete", data: map[string]interface{}{"uploadId": uploadID}},
+		{event: "upload_abort", data: map[string]interface{}{"uploadId": uploadID, "sender": "alice"}},
+		{event: "upload_init", data: map[string]interface{}{"uploadId": uploadID, "sender": "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			reply := mallory.emit(tt.event, tt.data)
+			if code := errorCode(reply); code != errNotFound.Code {
+				t.Errorf("got %v, want %s", reply, errNotFound.Code)
+			}
+		})
+	}
+
+	if !mr.Exists("upload_session:" + uploadID) {
+		t.Fatal("another user's request removed the upload")
+	}
+	if _, err := h.blobStore.Open(t.Context(), uploadChunkKey(uploadID, 0)); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Error("another user's chunk was stored")
+	}
+	// Locks are never taken for uploads that do not exist
+	mallory.emit("upload_chunk", chunkPayload("unknown", 0, content))
+	if keys := mr.Keys(); strings.Contains(strings.Join(keys, " "), "upload_lock:") {
+		t.Errorf("locks left behind: %v", keys)
+	}
+}
+
+func TestUploadResumesOnAnotherNode(t *testing.T) {
+	h, mr := newTestHandler(t)
+	// Nodes share the blob store, as they would a bucket or a volume
+	other := newTestNode(t, mr, func(cfg *config.Config) {
+		cfg.Upload.UploadDir = h.config.Upload.UploadDir
+	})
+
+	alice := dialTestClient(t, newTestServer(t, h))
+	alice.join("alice")
+	addTestMembers(t, h, "general", "alice")
+
+	content := []byte(strings.Repeat("0123456789", 10))
+	uploadID := startTestUpload(t, alice, content)
+	alice.emitOK("upload_chunk", chunkPayload(uploadID, 0, content[:40]))
+
+	// The connection drops and the client reconnects to another node
+	resumed := dialTestClient(t, newTestServer(t, other))
+	resumed.join("alice")
+	resumed.emitOK("upload_init", map[string]interface{}{"uploadId": uploadID})
+
+	var ready struct {
+		Offset int `json:"offset"`
+	}
+	if err := json.Unmarshal(resumed.waitEvent("upload_ready"), &ready); err != nil {
+		t.Fatalf("invalid upload_ready: %v", err)
+	}
+	if ready.Offset != 40 {
+		t.Fatalf("resumed at offset %d, want 40", ready.Offset)
+	}
+
+	resumed.emitOK("upload_chunk", chunkPayload(uploadID, 40, content[40:]))
+	resumed.emitOK("upload_complete", map[string]interface{}{"uploadId": uploadID})
+	resumed.waitEvent("upload_completed")
+
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "upload_session:") || strings.HasPrefix(key, "upload_lock:") {
+			t.Errorf("%s left behind", key)
+		}
+	}
+	for _, dir := range []string{partialDir, assemblyDir} {
+		if entries, _ := os.ReadDir(filepath.Join(h.config.Upload.UploadDir, dir)); len(entries) > 0 {
+			t.Errorf("%s left behind in %s", entries, dir)
+		}
+	}
+}
+
+// webpWithEXIF builds a minimal extended WebP carrying an EXIF chunk
+func webpWithEXIF() []byte {
+	chunk := func(fourCC string, payload []byte) []byte {
+		out := append([]byte(fourCC), byte(len(payload)), 0, 0, 0)
+		return append(out, payload...)
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	body = append(body, chunk("VP8L", []byte{0x2F, 0, 0, 0, 0, 0})...)
+	body = append(body, chunk("EXIF", []byte("GPS 51.5N 0.1W"))...)
+	return append([]byte{'R', 'I', 'F', 'F', byte(len(body)), 0, 0, 0}, body...)
+}
+
+func TestStoreUploadStripsImageMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		rejected bool
+	}{
+		{name: "corrupt png", content: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDRnot an image"), rejected: true},
+		{name: "webp with exif", content: webpWithEXIF()},
+		{name: "truncated webp", content: webpWithEXIF()[:30], rejected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t)
+			ctx := t.Context()
+			upload := &models.UploadSession{
+				Sender:   "alice",
+				Room:     "general",
+				FileName: "photo",
+				FileSize: int64(len(tt.content)),
+			}
+
+			addTestMembers(t, h, "general", "alice")
+			message, eventErr := h.publishUpload(ctx, upload, bytes.NewReader(tt.content))
+			if tt.rejected {
+				if eventErr == nil || eventErr.kind != errUploadRejected {
+					t.Fatalf("got %v, want a policy rejection", eventErr)
+				}
+				if entries, _ := os.ReadDir(h.config.Upload.UploadDir); len(entries) > 0 {
+					t.Errorf("rejected image was stored: %v", entries)
+				}
+				return
+			}
+			if eventErr != nil {
+				t.Fatalf("unexpected error: %v", eventErr)
+			}
+			metadata, err := message.DecodeFileMetadata()
+			if err != nil {
+				t.Fatalf("invalid file metadata: %v", err)
+			}
+
+			r, err := h.blobStore.Open(ctx, metadata.BlobKey)
+			if err != nil {
+				t.Fatalf("failed to open blob: %v", err)
+			}
+			defer r.Close()
+			stored, _ := io.ReadAll(r)
+			if bytes.Contains(stored, []byte("GPS")) || stored[20]&0x08 != 0 {
+				t.Errorf("metadata survived: %q", stored)
+			}
+			if metadata.FileSize != int64(len(stored)) {
+				t.Errorf("file size %d, stored %d bytes", metadata.FileSize, len(stored))
+			}
+		})
+	}
+}
+
+// stubScanner returns a fixed verdict for every upload
+type stubScanner struct {
+	result *services.ScanResult
+	err    error
+}
+
+func (s *stubScanner) Scan(ctx context.Context, fileName string, r io.Reader) (*services.ScanResult, error) {
+	return s.result, s.err
+}
+
+func TestPublishUploadScanning(t *testing.T) {
+	tests := []struct {
+		name        string
+		scanner     *stubScanner
+		want        *errorKind
+		quarantined bool
+	}{
+		{name: "clean", scanner: &stubScanner{result: &services.ScanResult{Verdict: services.ScanClean}}},
+		{name: "reject", scanner: &stubScanner{result: &services.ScanResult{Verdict: services.ScanReject, Reason: "malware"}}, want: errUploadRejected},
+		{name: "quarantine", scanner: &stubScanner{result: &services.ScanResult{Verdict: services.ScanQuarantine, Reason: "suspicious"}}, want: errUploadRejected, quarantined: true},
+		{name: "scanner failure", scanner: &stubScanner{err: errors.New("scanner unavailable")}, want: errInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mr := newTestHandler(t)
+			h.uploadPolicy = services.NewUploadPolicy(h.config.Upload.Policy, h.redisService, tt.scanner)
+
+			content := []byte("quarterly numbers")
+			upload := &models.UploadSession{Sender: "alice", Room: "general", FileName: "notes.txt", FileSize: int64(len(content))}
+			addTestMembers(t, h, "general", "alice")
+			message, err := h.publishUpload(t.Context(), upload, bytes.NewReader(content))
+
+			if (err == nil) != (tt.want == nil) || (err != nil && err.kind != tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil {
+				if !mr.Exists("message:" + message.ID) {
+					t.Error("clean upload was not sent")
+				}
+				return
+			}
+
+			entries, _ := os.ReadDir(filepath.Join(h.config.Upload.UploadDir, quarantineDir))
+			if tt.quarantined != (len(entries) == 1) {
+				t.Errorf("quarantined files: %v", entries)
+			}
+			for _, key := range mr.Keys() {
+				if strings.HasPrefix(key, "message:") || strings.HasPrefix(key, "blob:") || strings.HasPrefix(key, "upload_quota:") {
+					t.Errorf("refused upload left %s behind", key)
+				}
+			}
+		})
+	}
+}
+
+func TestQuarantinedUploadsAreKeptApart(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.uploadPolicy = services.NewUploadPolicy(h.config.Upload.Policy, h.redisService,
+		&stubScanner{result: &services.ScanResult{Verdict: services.ScanQuarantine, Reason: "suspicious"}})
+	addTestMembers(t, h, "general", "alice")
+
+	// Files with the same name quarantined within the same second
+	const uploads = 20
+	for i := range uploads {
+		content := []byte(fmt.Sprintf("suspicious file %d", i))
+		upload := &models.UploadSession{Sender: "alice", Room: "general", FileName: "invoice.pdf", FileSize: int64(len(content))}
+		if _, err := h.publishUpload(t.Context(), upload, bytes.NewReader(content)); err == nil || err.kind != errUploadRejected {
+			t.Fatalf("got %v, want a rejection", err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(h.config.Upload.UploadDir, quarantineDir))
+	if err != nil {
+		t.Fatalf("failed to list quarantine: %v", err)
+	}
+	if len(entries) != uploads {
+		t.Errorf("%d quarantined files, want %d", len(entries), uploads)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".pdf" {
+			t.Errorf("quarantined as %s", entry.Name())
+		}
+	}
+}
+
+func TestPublishUploadReleasesQuotaWhenDeliveryFails(t *testing.T) {
+	h, mr := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Upload.Policy.UserQuota = 1000
+		cfg.Upload.Policy.RoomQuota = 1000
+	})
+
+	// Redis drops the connection storing the message; everything before succeeds
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "SET" && len(args) > 0 && strings.HasPrefix(args[0], "message:") {
+			c.Close()
+			return true
+		}
+		return false
+	})
+
+	addTestMembers(t, h, "general", "alice")
+	content := []byte("quarterly numbers")
+	upload := &models.UploadSession{Sender: "alice", Room: "general", FileName: "notes.txt", FileSize: int64(len(content))}
+	if _, err := h.publishUpload(t.Context(), upload, bytes.NewReader(content)); err == nil {
+		t.Fatal("expected the delivery to fail")
+	}
+
+	for _, scope := range []string{"user:alice", "room:general"} {
+		if used, _ := mr.Get("upload_quota:" + scope); used != "0" {
+			t.Errorf("%s still has %s bytes reserved", scope, used)
+		}
+	}
+}
+
+func TestUploadQuotaAndLimits(t *testing.T) {
+	h, mr := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Upload.MaxOpenUploads = 2
+		cfg.Upload.Policy.UserQuota = 100
+	})
+	addTestMembers(t, h, "general", "alice")
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	used := func() string {
+		used, _ := mr.Get("upload_quota:user:alice")
+		return used
+	}
+	begin := func(size int) string {
+		content := bytes.Repeat([]byte("x"), size)
+		sum := sha256.Sum256(content)
+		return errorCode(c.emit("upload_init", map[string]interface{}{
+			"fileName": "notes.txt",
+			"fileSize": size,
+			"checksum": hex.EncodeToString(sum[:]),
+			"roomId":   "general",
+		}))
+	}
+
+	// The quota is taken when an upload starts, before any data is sent
+	first := startTestUpload(t, c, bytes.Repeat([]byte("x"), 60))
+	if used() != "60" {
+		t.Fatalf("%s bytes reserved, want 60", used())
+	}
+	if code := begin(50); code != errUploadRejected.Code {
+		t.Errorf("upload over the quota: got %q, want %s", code, errUploadRejected.Code)
+	}
+
+	// Open uploads are capped per user; a refused upload takes no quota
+	second := startTestUpload(t, c, bytes.Repeat([]byte("x"), 10))
+	if code := begin(10); code != errOutOfRange.Code {
+		t.Errorf("third upload: got %q, want %s", code, errOutOfRange.Code)
+	}
+	if used() != "70" {
+		t.Errorf("%s bytes reserved, want 70", used())
+	}
+
+	// Aborting gives the quota back and makes room for another upload
+	c.emitOK("upload_abort", map[string]interface{}{"uploadId": first})
+	if used() != "10" {
+		t.Errorf("%s bytes reserved after aborting, want 10", used())
+	}
+
+	// A sent file keeps its quota
+	content := bytes.Repeat([]byte("x"), 10)
+	c.emitOK("upload_chunk", chunkPayload(second, 0, content))
+	c.emitOK("upload_complete", map[string]interface{}{"uploadId": second})
+	c.waitEvent("upload_completed")
+	if used() != "10" {
+		t.Errorf("%s bytes reserved after sending, want 10", used())
+	}
+	if code := begin(10); code != "" {
+		t.Errorf("upload after others finished: got %q", code)
+	}
+}
+
+func TestCollectExpiredUploads(t *testing.T) {
+	h, mr := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Upload.SessionTTL = 100 * time.Millisecond
+		cfg.Upload.Policy.UserQuota = 100
+	})
+	addTestMembers(t, h, "general", "alice")
+	c := dialTestClient(t, newTestServer(t, h))
+	c.join("alice")
+
+	content := []byte(strings.Repeat("0123456789", 4))
+	uploadID := startTestUpload(t, c, content)
+	c.emitOK("upload_chunk", chunkPayload(uploadID, 0, content[:20]))
+
+	// Collecting before the upload expires leaves it alone
+	h.collectUploads()
+	if _, err := h.blobStore.Open(t.Context(), uploadChunkKey(uploadID, 0)); err != nil {
+		t.Fatalf("chunk of a live upload was removed: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if code := errorCode(c.emit("upload_chunk", chunkPayload(uploadID, 20, content[20:]))); code != errNotFound.Code {
+		t.Errorf("chunk for an expired upload: got %q, want %s", code, errNotFound.Code)
+	}
+
+	h.collectUploads()
+	if _, err := h.blobStore.Open(t.Context(), uploadChunkKey(uploadID, 0)); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("chunk of an expired upload was kept: %v", err)
+	}
+	if used, _ := mr.Get("upload_quota:user:alice"); used != "0" {
+		t.Errorf("%s bytes still reserved", used)
+	}
+	for _, key := range []string{"upload_session:" + uploadID, "uploads", "user_uploads:alice"} {
+		if mr.Exists(key) {
+			t.Errorf("%s left behind", key)
+		}
+	}
+}
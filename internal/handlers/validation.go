@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+)
+
+// Maximum lengths, in characters, of common payload fields
+const (
+	maxNameLength     = 64
+	maxRoomIDLength   = 128
+	maxIDLength       = 64
+	maxFileNameLength = 255
+	maxMimeTypeLength = 127
+	maxCaptionLength  = 1024
+	maxURLLength      = 2048
+)
+
+// fieldKind is the JSON type a payload field must have
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	numberField
+	integerField
+	boolField
+	objectField
+	stringListField
+)
+
+func (k fieldKind) String() string {
+	switch k {
+	case stringField:
+		return "a string"
+	case numberField:
+		return "a number"
+	case integerField:
+		return "an integer"
+	case boolField:
+		return "a boolean"
+	case stringListField:
+		return "a list of strings"
+	default:
+		return "an object"
+	}
+}
+
+// fieldRule describes one field of an event payload
+type fieldRule struct {
+	name     string
+	kind     fieldKind
+	required bool
+	maxLen   int      // characters for strings and list items, bytes of JSON for objects
+	enum     []string // allowed string values
+	max      float64  // upper bound for numbers; numbers are never negative
+	maxItems int      // upper bound for list lengths
+	fields   eventSchema
+}
+
+// eventSchema lists the known fields of an event payload. Fields that are
+// not listed are ignored so that older servers accept newer clients.
+type eventSchema []fieldRule
+
+// newEventSchemas builds the schemas of all inbound events
+func newEventSchemas(cfg *config.Config) map[string]eventSchema {
+	ephemeral := eventSchema{
+		{name: "ttl", kind: numberField, max: cfg.Message.MaxTTL.Seconds()},
+		{name: "burnAfterRead", kind: boolField},
+	}
+
+	// Rooms are joined and left by the session's user; older clients still
+	// send the user name
+	roomAndUser := eventSchema{
+		{name: "roomId", kind: stringField, required: true, maxLen: maxRoomIDLength},
+		{name: "userName", kind: stringField, maxLen: maxNameLength},
+	}
+
+	// Typing goes to a room or, in direct messages, to a receiver. The user
+	// name is taken from the session; older clients still send it.
+	typing := eventSchema{
+		{name: "roomId", kind: stringField, maxLen: maxRoomIDLength},
+		{name: "receiver", kind: stringField, maxLen: maxNameLength},
+		{name: "userName", kind: stringField, maxLen: maxNameLength},
+	}
+
+	// Base64 grows data by a third
+	maxFileData := base64Length(cfg.Upload.MaxFileSize)
+	maxChunkData := base64Length(cfg.Upload.MaxChunkSize)
+
+	return map[string]eventSchema{
+		"join": {
+			{name: "userName", kind: stringField, required: true, maxLen: maxNameLength},
+			{name: "deviceInfo", kind: stringField, maxLen: 256},
+			{name: "deviceType", kind: stringField, maxLen: 32},
+			{name: "avatar", kind: stringField, maxLen: maxURLLength},
+		},
+		"join_room":   roomAndUser,
+		"leave_room":  roomAndUser,
+		"typing":      typing,
+		"stop_typing": typing,
+		// Messages and uploads are sent as the session's user; older clients
+		// still send the sender
+		"message": append(eventSchema{
+			{name: "content", kind: stringField, required: true, maxLen: cfg.Message.MaxContentLength},
+			{name: "sender", kind: stringField, maxLen: maxNameLength},
+			{name: "roomId", kind: stringField, maxLen: maxRoomIDLength},
+			{name: "receiver", kind: stringField, maxLen: maxNameLength},
+			{name: "type", kind: stringField, enum: []string{
+				string(models.TextMessage),
+				string(models.MarkdownMessage),
+				string(models.CodeMessage),
+				string(models.LinkMessage),
+			}},
+			{name: "metadata", kind: objectField, maxLen: cfg.Message.MaxMetadataSize, fields: eventSchema{
+				{name: "language", kind: stringField, maxLen: 32},
+				{name: "fileName", kind: stringField, maxLen: maxFileNameLength},
+				{name: "url", kind: stringField, maxLen: maxURLLength},
+			}},
+		}, ephemeral...),
+		"file_upload": append(eventSchema{
+			{name: "fileName", kind: stringField, required: true, maxLen: maxFileNameLength},
+			{name: "fileData", kind: stringField, required: true, maxLen: maxFileData},
+			{name: "fileType", kind: stringField, maxLen: maxMimeTypeLength},
+			{name: "sender", kind: stringField, maxLen: maxNameLength},
+			{name: "roomId", kind: stringField, maxLen: maxRoomIDLength},
+			{name: "receiver", kind: stringField, maxLen: maxNameLength},
+			{name: "caption", kind: stringField, maxLen: maxCaptionLength},
+		}, ephemeral...),
+		"upload_init": append(eventSchema{
+			{name: "uploadId", kind: stringField, maxLen: maxIDLength},
+			{name: "sender", kind: stringField, maxLen: maxNameLength},
+			{name: "fileName", kind: stringField, maxLen: maxFileNameLength},
+			{name: "fileType", kind: stringField, maxLen: maxMimeTypeLength},
+			{name: "fileSize", kind: integerField, max: float64(cfg.Upload.MaxFileSize)},
+			{name: "checksum", kind: stringField, maxLen: 64},
+			{name: "roomId", kind: stringField, maxLen: maxRoomIDLength},
+			{name: "receiver", kind: stringField, maxLen: maxNameLength},
+			{name: "caption", kind: stringField, maxLen: maxCaptionLength},
+		}, ephemeral...),
+		"upload_chunk": {
+			{name: "uploadId", kind: stringField, required: true, maxLen: maxIDLength},
+			{name: "offset", kind: integerField, required: true, max: float64(cfg.Upload.MaxFileSize)},
+			{name: "data", kind: stringField, required: true, maxLen: maxChunkData},
+			{name: "checksum", kind: stringField, required: true, maxLen: 64},
+		},
+		"upload_complete": {
+			{name: "uploadId", kind: stringField, required: true, maxLen: maxIDLength},
+		},
+		"upload_abort": {
+			{name: "uploadId", kind: stringField, required: true, maxLen: maxIDLength},
+			{name: "sender", kind: stringField, maxLen: maxNameLength},
+		},
+		"read_cursor": {
+			{name: "messageId", kind: stringField, required: true, maxLen: maxIDLength},
+		},
+		"mute_room": {
+			{name: "roomId", kind: stringField, required: true, maxLen: maxRoomIDLength},
+			{name: "muted", kind: boolField, required: true},
+		},
+		"save_draft": {
+			{name: "conversationId", kind: stringField, required: true, maxLen: maxRoomIDLength},
+			{name: "content", kind: stringField, maxLen: cfg.Message.MaxContentLength},
+		},
+		"set_status": {
+			{name: "status", kind: stringField, required: true, enum: []string{
+				string(models.PresenceAvailable), string(models.PresenceAway),
+				string(models.PresenceDoNotDisturb), string(models.PresenceInvisible),
+			}},
+			{name: "text", kind: stringField, maxLen: cfg.Presence.MaxStatusText},
+			{name: "expiresIn", kind: integerField, max: maxStatusDuration.Seconds()},
+		},
+		"subscribe_presence": {
+			{name: "users", kind: stringListField, required: true, maxLen: maxNameLength, maxItems: cfg.Presence.MaxSubscriptions},
+		},
+		"unsubscribe_presence": {
+			{name: "users", kind: stringListField, required: true, maxLen: maxNameLength, maxItems: cfg.Presence.MaxSubscriptions},
+		},
+		"revoke_device": {
+			{name: "sessionId", kind: stringField, required: true, maxLen: maxIDLength},
+		},
+		"report_message": {
+			{name: "messageId", kind: stringField, required: true, maxLen: maxIDLength},
+			{name: "reason", kind: stringField, required: true, maxLen: maxReasonLength},
+		},
+		"message_read": {
+			{name: "messageId", kind: stringField, required: true, maxLen: maxIDLength},
+		},
+	}
+}
+
+// base64Length returns the encoded length of n bytes
+func base64Length(n int64) int {
+	return int((n + 2) / 3 * 4)
+}
+
+// validatePayload checks the first event argument against a schema
+func (s eventSchema) validatePayload(args []any) *eventError {
+	if len(args) == 0 {
+		return newEventError(errInvalidPayload, "Payload is required")
+	}
+
+	data, ok := args[0].(map[string]interface{})
+	if !ok {
+		return newEventError(errInvalidPayload, "Payload must be an object")
+	}
+
+	return s.validateObject("", data)
+}
+
+// validateObject checks every known field of an object
+func (s eventSchema) validateObject(prefix string, data map[string]interface{}) *eventError {
+	for _, rule := range s {
+		field := prefix + rule.name
+		value, present := data[rule.name]
+
+		if !present || value == nil || value == "" {
+			if rule.required {
+				return newEventError(errMissingField, fmt.Sprintf("%s is required", field)).withDetail("field", field)
+			}
+			continue
+		}
+
+		if err := rule.check(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check validates a single field value
+func (r fieldRule) check(field string, value interface{}) *eventError {
+	invalidType := newEventError(errInvalidType, fmt.Sprintf("%s must be %s", field, r.kind)).withDetail("field", field)
+
+	switch r.kind {
+	case stringField:
+		s, ok := value.(string)
+		if !ok {
+			return invalidType
+		}
+		if !utf8.ValidString(s) {
+			return newEventError(errInvalidValue, fmt.Sprintf("%s must be valid UTF-8", field)).withDetail("field", field)
+		}
+		if r.maxLen > 0 && utf8.RuneCountInString(s) > r.maxLen {
+			return newEventError(errTooLong, fmt.Sprintf("%s must be at most %d characters", field, r.maxLen)).withDetail("field", field)
+		}
+		if len(r.enum) > 0 && !slices.Contains(r.enum, s) {
+			return newEventError(errInvalidValue, fmt.Sprintf("%s must be one of %s", field, strings.Join(r.enum, ", "))).withDetail("field", field)
+		}
+
+	case numberField, integerField:
+		n, ok := value.(float64)
+		if !ok || (r.kind == integerField && n != math.Trunc(n)) {
+			return invalidType
+		}
+		if n < 0 {
+			return newEventError(errOutOfRange, fmt.Sprintf("%s must not be negative", field)).withDetail("field", field)
+		}
+		if r.max > 0 && n > r.max {
+			return newEventError(errOutOfRange, fmt.Sprintf("%s must be at most %g", field, r.max)).withDetail("field", field)
+		}
+
+	case boolField:
+		if _, ok := value.(bool); !ok {
+			return invalidType
+		}
+
+	case objectField:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalidType
+		}
+		if r.maxLen > 0 {
+			encoded, err := json.Marshal(object)
+			if err != nil || len(encoded) > r.maxLen {
+				return newEventError(errTooLong, fmt.Sprintf("%s must be at most %d bytes", field, r.maxLen)).withDetail("field", field)
+			}
+		}
+		return r.fields.validateObject(field+".", object)
+
+	case stringListField:
+		list, ok := value.([]interface{})
+		if !ok {
+			return invalidType
+		}
+		if r.maxItems > 0 && len(list) > r.maxItems {
+			return newEventError(errOutOfRange, fmt.Sprintf("%s must have at most %d items", field, r.maxItems)).withDetail("field", field)
+		}
+		item := fieldRule{kind: stringField, maxLen: r.maxLen}
+		for i, value := range list {
+			if err := item.check(fmt.Sprintf("%s[%d]", field, i), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateEvent checks an event payload against the event's schema
+func (h *SocketIOHandler) validateEvent(event string, args []any) error {
+	schema, ok := h.schemas[event]
+	if !ok {
+		return nil
+	}
+
+	if err := schema.validatePayload(args); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePayload(t *testing.T) {
+	schema := eventSchema{
+		{name: "name", kind: stringField, required: true, maxLen: 5},
+		{name: "color", kind: stringField, enum: []string{"red", "blue"}},
+		{name: "ttl", kind: numberField, max: 60},
+		{name: "size", kind: integerField},
+		{name: "flag", kind: boolField},
+		{name: "users", kind: stringListField, maxLen: 3, maxItems: 2},
+		{name: "meta", kind: objectField, maxLen: 40, fields: eventSchema{
+			{name: "lang", kind: stringField, required: true, maxLen: 4},
+		}},
+	}
+
+	tests := []struct {
+		name  string
+		args  []any
+		want  *errorKind
+		field string
+	}{
+		{name: "minimal", args: []any{map[string]interface{}{"name": "bob"}}},
+		{name: "all fields", args: []any{map[string]interface{}{
+			"name": "bob", "color": "red", "ttl": 1.5, "size": float64(3), "flag": true,
+			"users": []interface{}{"a", "b"}, "meta": map[string]interface{}{"lang": "go"},
+		}}},
+		{name: "unknown fields ignored", args: []any{map[string]interface{}{"name": "bob", "extra": 1}}},
+		{name: "no payload", args: nil, want: errInvalidPayload},
+		{name: "not an object", args: []any{"bob"}, want: errInvalidPayload},
+		{name: "missing", args: []any{map[string]interface{}{}}, want: errMissingField, field: "name"},
+		{name: "empty string is missing", args: []any{map[string]interface{}{"name": ""}}, want: errMissingField, field: "name"},
+		{name: "null is missing", args: []any{map[string]interface{}{"name": nil}}, want: errMissingField, field: "name"},
+		{name: "wrong type", args: []any{map[string]interface{}{"name": 5.0}}, want: errInvalidType, field: "name"},
+		{name: "counted in characters", args: []any{map[string]interface{}{"name": "héllo"}}},
+		{name: "too long", args: []any{map[string]interface{}{"name": "bobbyt"}}, want: errTooLong, field: "name"},
+		{name: "invalid utf-8", args: []any{map[string]interface{}{"name": "b\xffb"}}, want: errInvalidValue, field: "name"},
+		{name: "not in enum", args: []any{map[string]interface{}{"name": "bob", "color": "green"}}, want: errInvalidValue, field: "color"},
+		{name: "negative", args: []any{map[string]interface{}{"name": "bob", "ttl": -1.0}}, want: errOutOfRange, field: "ttl"},
+		{name: "above max", args: []any{map[string]interface{}{"name": "bob", "ttl": 61.0}}, want: errOutOfRange, field: "ttl"},
+		{name: "fractional integer", args: []any{map[string]interface{}{"name": "bob", "size": 1.5}}, want: errInvalidType, field: "size"},
+		{name: "bool as string", args: []any{map[string]interface{}{"name": "bob", "flag": "true"}}, want: errInvalidType, field: "flag"},
+		{name: "list not a list", args: []any{map[string]interface{}{"name": "bob", "users": "a"}}, want: errInvalidType, field: "users"},
+		{name: "too many items", args: []any{map[string]interface{}{"name": "bob", "users": []interface{}{"a", "b", "c"}}}, want: errOutOfRange, field: "users"},
+		{name: "item wrong type", args: []any{map[string]interface{}{"name": "bob", "users": []interface{}{"a", 1.0}}}, want: errInvalidType, field: "users[1]"},
+		{name: "item too long", args: []any{map[string]interface{}{"name": "bob", "users": []interface{}{"abcd"}}}, want: errTooLong, field: "users[0]"},
+		{name: "nested missing", args: []any{map[string]interface{}{"name": "bob", "meta": map[string]interface{}{}}}, want: errMissingField, field: "meta.lang"},
+		{name: "nested too long", args: []any{map[string]interface{}{"name": "bob", "meta": map[string]interface{}{"lang": "golang"}}}, want: errTooLong, field: "meta.lang"},
+		{name: "object too large", args: []any{map[string]interface{}{"name": "bob", "meta": map[string]interface{}{"lang": "go", "pad": strings.Repeat("x", 40)}}}, want: errTooLong, field: "meta"},
+	}
+	for _, tt := range tests {
+		err := schema.validatePayload(tt.args)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.kind != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.want.Code)
+			continue
+		}
+		if field, _ := err.details["field"].(string); field != tt.field {
+			t.Errorf("%s: field %q, want %q", tt.name, field, tt.field)
+		}
+	}
+}
+
+func TestEventSchemas(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	tests := []struct {
+		event string
+		data  map[string]interface{}
+		want  *errorKind
+	}{
+		{event: "message", data: map[string]interface{}{"content": "hi", "sender": "alice"}},
+		{event: "message", data: map[string]interface{}{"content": "hi", "sender": "alice", "type": "html"}, want: errInvalidValue},
+		{event: "message", data: map[string]interface{}{"content": strings.Repeat("x", h.config.Message.MaxContentLength+1), "sender": "alice"}, want: errTooLong},
+		{event: "message", data: map[string]interface{}{"content": "hi", "sender": "alice", "ttl": h.config.Message.MaxTTL.Seconds() + 1}, want: errOutOfRange},
+		{event: "upload_chunk", data: map[string]interface{}{"uploadId": "u", "offset": 0.0, "data": "AA==", "checksum": "x"}},
+		{event: "upload_chunk", data: map[string]interface{}{"uploadId": "u", "offset": 1.5, "data": "AA==", "checksum": "x"}, want: errInvalidType},
+		{event: "set_status", data: map[string]interface{}{"status": "busy"}, want: errInvalidValue},
+		{event: "message_read", data: map[string]interface{}{}, want: errMissingField},
+		// Events without a schema are not validated here
+		{event: "get_history", data: map[string]interface{}{"anything": 1.0}},
+	}
+	for _, tt := range tests {
+		err := h.validateEvent(tt.event, []any{tt.data})
+		if kind := eventErrorKind(err); kind != tt.want {
+			t.Errorf("%s %v: got %v, want %v", tt.event, tt.data, err, tt.want)
+		}
+	}
+}
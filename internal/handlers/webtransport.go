@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"im-demo/internal/config"
+	"im-demo/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/zishang520/socket.io/servers/engine/v3"
+	"github.com/zishang520/socket.io/v3/pkg/types"
+	"github.com/zishang520/webtransport-go"
+)
+
+// socketIOPath is where the Socket.IO endpoint is mounted
+const socketIOPath = "/socket.io/"
+
+// NewWebTransportServer creates the HTTP/3 listener, or returns nil when it
+// is disabled. It upgrades WebTransport sessions on the Socket.IO path and
+// passes every other request to the router, so that clients reaching the
+// server over QUIC can still poll and call the API.
+func (h *SocketIOHandler) NewWebTransportServer(router http.Handler) (*webtransport.Server, error) {
+	cfg := h.config.Server.WebTransport
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	certs, err := services.NewTLSReloader(config.TLSConfig{
+		CertFile:       cfg.CertFile,
+		KeyFile:        cfg.KeyFile,
+		ClientAuth:     "none",
+		ReloadInterval: h.config.Server.TLS.ReloadInterval,
+	}, h.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webtransport certificates: %w", err)
+	}
+
+	eio, ok := h.server.ServeHandler(nil).(engine.Server)
+	if !ok {
+		return nil, errors.New("socket.io engine does not support webtransport")
+	}
+	go certs.Watch()
+
+	origins := allowedOrigins(h.config.SocketIO)
+	wt := &webtransport.Server{
+		H3: http3.Server{
+			Addr:      fmt.Sprintf(":%d", cfg.Port),
+			TLSConfig: certs.TLSConfig(),
+		},
+		// Browsers always send an origin; other clients are not restricted
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origins == nil || origin == "" || slices.Contains(origins, origin)
+		},
+	}
+
+	wt.H3.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect && strings.HasPrefix(r.URL.Path, socketIOPath) {
+			eio.OnWebTransportSession(types.NewHttpContext(w, r), wt)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+	return wt, nil
+}
+
+// AdvertiseHTTP3 tells clients of the TCP listener that the server is also
+// reachable over HTTP/3, once wt is listening. wt is nil when the listener
+// is disabled.
+func AdvertiseHTTP3(wt *webtransport.Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if wt == nil {
+			c.Next()
+			return
+		}
+		// Fails only until the listener has started
+		_ = wt.H3.SetQUICHeaders(c.Writer.Header())
+		c.Next()
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zishang520/webtransport-go"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir and
+// returns their paths
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	files := map[string][]byte{
+		certFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// enableWebTransport turns on the HTTP/3 listener with the given files
+func enableWebTransport(certFile, keyFile string) func(*config.Config) {
+	return func(cfg *config.Config) {
+		cfg.Server.WebTransport = config.WebTransportConfig{
+			Enabled:  true,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		}
+	}
+}
+
+func TestNewWebTransportServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", garbage, err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	tests := []struct {
+		name      string
+		configure func(*config.Config)
+		server    bool
+		err       bool
+	}{
+		{name: "disabled", configure: func(cfg *config.Config) { cfg.Server.WebTransport.Enabled = false }},
+		{name: "enabled", configure: enableWebTransport(certFile, keyFile), server: true},
+		{name: "no files", configure: enableWebTransport("", ""), err: true},
+		{name: "missing cert", configure: enableWebTransport(missing, keyFile), err: true},
+		{name: "missing key", configure: enableWebTransport(certFile, missing), err: true},
+		{name: "invalid cert", configure: enableWebTransport(garbage, keyFile), err: true},
+		{name: "invalid key", configure: enableWebTransport(certFile, garbage), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, tt.configure)
+			wt, err := h.NewWebTransportServer(http.NotFoundHandler())
+			if tt.err {
+				if err == nil {
+					t.Error("created a server")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (wt != nil) != tt.server {
+				t.Errorf("created a server: %v, want %v", wt != nil, tt.server)
+			}
+		})
+	}
+}
+
+// altSvcHeader returns a function that makes a request through
+// AdvertiseHTTP3 and returns the Alt-Svc header of the response
+func altSvcHeader(wt *webtransport.Server) func() string {
+	router := gin.New()
+	router.Use(AdvertiseHTTP3(wt))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return func() string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Header().Get("Alt-Svc")
+	}
+}
+
+func TestAdvertiseHTTP3(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	// Nothing is advertised while the listener is disabled
+	if header := altSvcHeader(nil)(); header != "" {
+		t.Errorf("disabled listener advertised %q", header)
+	}
+
+	// Nor before it is listening
+	h, _ := newTestHandler(t, enableWebTransport(certFile, keyFile))
+	wt, err := h.NewWebTransportServer(http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	get := altSvcHeader(wt)
+	if header := get(); header != "" {
+		t.Errorf("advertised %q before listening", header)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { wt.Close() })
+	go wt.Serve(conn)
+
+	want := fmt.Sprintf(`h3=":%d"; ma=2592000`, conn.LocalAddr().(*net.UDPAddr).Port)
+	deadline := time.Now().Add(testTimeout)
+	for get() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got Alt-Svc %q, want %q", get(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
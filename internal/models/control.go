@@ -0,0 +1,34 @@
+package models
+
+// ControlType identifies a control event
+type ControlType string
+
+// Control events
+const (
+	ControlSanction       ControlType = "sanction"        // a user was muted or banned
+	ControlSanctionLifted ControlType = "sanction_lifted" // a mute or ban was lifted
+	ControlMessageDeleted ControlType = "message_deleted" // a moderator deleted a message
+	ControlDisconnect     ControlType = "disconnect"      // an admin disconnected a session or user
+	ControlAnnouncement   ControlType = "announcement"    // an admin broadcast a system message
+	ControlDeviceRevoked  ControlType = "device_revoked"  // a user signed out one of their devices
+	ControlStateUpdated   ControlType = "state_updated"   // a user's synced state changed on one device
+	ControlSessionEvicted ControlType = "session_evicted" // a login pushed a device over the device limits
+	ControlPresence       ControlType = "presence"        // a user's presence changed
+)
+
+// ControlEvent is published to every node so that moderation and admin
+// actions reach connections held by any of them
+type ControlEvent struct {
+	Type      ControlType       `json:"type"`
+	Sanction  *Sanction         `json:"sanction,omitempty"`
+	Tombstone *MessageTombstone `json:"tombstone,omitempty"`
+	SessionID string            `json:"sessionId,omitempty"`
+	UserName  string            `json:"userName,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	Message   *Message          `json:"message,omitempty"`
+	State     *StateUpdate      `json:"state,omitempty"`
+	Presence  *Presence         `json:"presence,omitempty"`
+	Rooms     []string          `json:"rooms,omitempty"`  // audience of a presence change
+	Users     []string          `json:"users,omitempty"`  // audience of a presence change
+	Except    []string          `json:"except,omitempty"` // users left out of a presence change
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -8,10 +9,13 @@ import (
 type MessageType string
 
 const (
-	TextMessage   MessageType = "text"
-	FileMessage   MessageType = "file"
-	ImageMessage  MessageType = "image"
-	SystemMessage MessageType = "system"
+	TextMessage     MessageType = "text"
+	FileMessage     MessageType = "file"
+	ImageMessage    MessageType = "image"
+	SystemMessage   MessageType = "system"
+	MarkdownMessage MessageType = "markdown"
+	CodeMessage     MessageType = "code"
+	LinkMessage     MessageType = "link"
 )
 
 // Message represents a chat message
@@ -24,6 +28,25 @@ type Message struct {
 	Room      string      `json:"room,omitempty"`
 	Timestamp time.Time   `json:"timestamp"`
 	Metadata  interface{} `json:"metadata,omitempty"`
+
+	// Ephemeral message settings; ExpiresAt is nil for regular messages
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	BurnAfterRead bool       `json:"burnAfterRead,omitempty"`
+}
+
+// IsEphemeral reports whether the message self-destructs
+func (m *Message) IsEphemeral() bool {
+	return m.ExpiresAt != nil
+}
+
+// MessageTombstone is broadcast in place of a message that has expired
+type MessageTombstone struct {
+	MessageID string    `json:"messageId"`
+	Room      string    `json:"room,omitempty"`
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver,omitempty"`
+	Reason    string    `json:"reason"`
+	ExpiredAt time.Time `json:"expiredAt"`
 }
 
 // FileMetadata represents file-specific metadata
@@ -32,6 +55,70 @@ type FileMetadata struct {
 	FileSize int64  `json:"fileSize"`
 	FileType string `json:"fileType"`
 	FileURL  string `json:"fileURL"`
+	BlobKey  string `json:"blobKey,omitempty"` // storage key of the file contents
+	// SHA-256 of the uploaded contents; identical uploads share one blob
+	ContentHash string `json:"contentHash,omitempty"`
+
+	// Image-only fields
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+}
+
+// Thumbnail represents a downscaled preview of an image message
+type Thumbnail struct {
+	Size     int    `json:"size"` // bounding box the thumbnail fits in
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileType string `json:"fileType"`
+	FileURL  string `json:"fileURL"`
+	BlobKey  string `json:"blobKey,omitempty"`
+}
+
+// DecodeFileMetadata returns the file metadata of a file or image message.
+// Messages loaded from Redis carry metadata as a generic map, so it is
+// converted through JSON when necessary.
+func (m *Message) DecodeFileMetadata() (*FileMetadata, error) {
+	if metadata, ok := m.Metadata.(*FileMetadata); ok {
+		return metadata, nil
+	}
+
+	data, err := json.Marshal(m.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata FileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// TextMetadata represents metadata of text and markdown messages
+type TextMetadata struct {
+	LinkPreviews []LinkPreview `json:"linkPreviews,omitempty"`
+}
+
+// CodeMetadata represents code snippet metadata
+type CodeMetadata struct {
+	Language string `json:"language"`
+	FileName string `json:"fileName,omitempty"`
+}
+
+// LinkMetadata represents link message metadata
+type LinkMetadata struct {
+	URL     string       `json:"url"`
+	Preview *LinkPreview `json:"preview,omitempty"`
+}
+
+// LinkPreview represents OpenGraph metadata fetched for a URL
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
 }
 
 // User represents a connected user
@@ -67,6 +154,25 @@ const (
 	EventRoomJoined Event = "room_joined"
 	EventRoomLeft   Event = "room_left"
 	EventError      Event = "error"
+
+	EventMessageRead    Event = "message_read"
+	EventMessageExpired Event = "message_expired"
+	EventMessageUpdated Event = "message_updated"
+
+	EventModerationReport Event = "moderation_report"
+	EventMention          Event = "mention"
+	EventMessageReported  Event = "message_reported"
+	EventReportCreated    Event = "report_created"
+	EventSanctioned       Event = "sanctioned"
+	EventSanctionLifted   Event = "sanction_lifted"
+	EventForceDisconnect  Event = "force_disconnect"
+
+	EventDevices        Event = "devices"
+	EventDeviceRevoked  Event = "device_revoked"
+	EventSyncState      Event = "sync_state"
+	EventStateUpdated   Event = "state_updated"
+	EventSessionEvicted Event = "session_evicted"
+	EventPresence       Event = "presence"
 )
 
 // SocketEvent represents a socket.io event
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+)
+
+// FilterAction is what a message filter does with a message
+type FilterAction string
+
+// Filter actions
+const (
+	FilterMask   FilterAction = "mask"   // the message is delivered with rewritten content
+	FilterReject FilterAction = "reject" // the message is not delivered
+)
+
+// FilterDecision is a message filter's verdict on a message
+type FilterDecision struct {
+	Filter  string       `json:"filter"`
+	Action  FilterAction `json:"action"`
+	Reason  string       `json:"reason"`
+	Content string       `json:"-"` // rewritten content of masked messages
+}
+
+// ModerationReport tells admins about filter decisions on a message
+type ModerationReport struct {
+	MessageID string           `json:"messageId"`
+	Sender    string           `json:"sender"`
+	Room      string           `json:"room,omitempty"`
+	Receiver  string           `json:"receiver,omitempty"`
+	Content   string           `json:"content"` // as sent, before masking
+	Decisions []FilterDecision `json:"decisions"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+// ReportStatus is the state of an abuse report in the moderation queue
+type ReportStatus string
+
+// Report states
+const (
+	ReportOpen     ReportStatus = "open"
+	ReportResolved ReportStatus = "resolved"
+)
+
+// MessageReport is a user's report of an abusive message. The message is
+// kept as sent so that it can be reviewed after it is deleted or expires.
+type MessageReport struct {
+	ID         string       `json:"id"`
+	MessageID  string       `json:"messageId"`
+	Reporter   string       `json:"reporter"`
+	Reason     string       `json:"reason"`
+	Message    *Message     `json:"message"`
+	Status     ReportStatus `json:"status"`
+	Resolution string       `json:"resolution,omitempty"`
+	Note       string       `json:"note,omitempty"`
+	ResolvedBy string       `json:"resolvedBy,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	ResolvedAt *time.Time   `json:"resolvedAt,omitempty"`
+}
+
+// SanctionKind is a restriction moderators put on a user
+type SanctionKind string
+
+// Sanctions
+const (
+	SanctionMute SanctionKind = "mute" // the user cannot send messages or files
+	SanctionBan  SanctionKind = "ban"  // the user cannot connect
+)
+
+// Sanction is a restriction on a user, permanent when Until is nil
+type Sanction struct {
+	Kind      SanctionKind `json:"kind"`
+	UserName  string       `json:"userName"`
+	Reason    string       `json:"reason,omitempty"`
+	By        string       `json:"by"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Until     *time.Time   `json:"until,omitempty"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+)
+
+// PresenceStatus is a user's availability
+type PresenceStatus string
+
+// Presence statuses. Users choose between available, away, do not disturb
+// and invisible; offline is reported for users with no connected device
+// and for invisible users.
+const (
+	PresenceAvailable    PresenceStatus = "available"
+	PresenceAway         PresenceStatus = "away"
+	PresenceDoNotDisturb PresenceStatus = "do_not_disturb"
+	PresenceInvisible    PresenceStatus = "invisible"
+	PresenceOffline      PresenceStatus = "offline"
+)
+
+// Settable reports whether users can choose the status themselves
+func (s PresenceStatus) Settable() bool {
+	switch s {
+	case PresenceAvailable, PresenceAway, PresenceDoNotDisturb, PresenceInvisible:
+		return true
+	}
+	return false
+}
+
+// UserStatus is the status a user chose, kept until it expires
+type UserStatus struct {
+	Status    PresenceStatus `json:"status"`
+	Text      string         `json:"text,omitempty"`
+	SetAt     time.Time      `json:"setAt"`
+	ExpiresAt *time.Time     `json:"expiresAt,omitempty"`
+}
+
+// Presence is a user's status as seen by other users
+type Presence struct {
+	UserName string         `json:"userName"`
+	Status   PresenceStatus `json:"status"`
+	Text     string         `json:"text,omitempty"`
+	Idle     bool           `json:"idle,omitempty"`     // away because no device was used for a while
+	LastSeen *time.Time     `json:"lastSeen,omitempty"` // only for offline users
+}
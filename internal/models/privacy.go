@@ -0,0 +1,20 @@
+package models
+
+// DMPrivacy controls who may send direct messages to a user
+type DMPrivacy string
+
+// DM privacy modes
+const (
+	DMPrivacyEveryone    DMPrivacy = "everyone"
+	DMPrivacySharedRooms DMPrivacy = "shared_rooms" // members of a room the user is in
+	DMPrivacyNobody      DMPrivacy = "nobody"
+)
+
+// Valid reports whether p is a known privacy mode
+func (p DMPrivacy) Valid() bool {
+	switch p {
+	case DMPrivacyEveryone, DMPrivacySharedRooms, DMPrivacyNobody:
+		return true
+	}
+	return false
+}
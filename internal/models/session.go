@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// SessionInfo describes a connected device in the cluster-wide session registry
+type SessionInfo struct {
+	SessionID    string    `json:"sessionId"`
+	UserName     string    `json:"userName"`
+	DeviceInfo   string    `json:"deviceInfo"`
+	DeviceType   string    `json:"deviceType"`
+	NodeID       string    `json:"nodeId"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+}
+
+// NodeStatus is the state a server node reports with each heartbeat
+type NodeStatus struct {
+	NodeID    string         `json:"nodeId"`
+	StartedAt time.Time      `json:"startedAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	Sockets   int            `json:"sockets"`
+	Rooms     map[string]int `json:"rooms"` // room ID -> sockets in the room on this node
+}
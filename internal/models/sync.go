@@ -0,0 +1,74 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// directConversationPrefix starts the conversation IDs of direct messages,
+// which are followed by the other user's name. Rooms use their room ID.
+const directConversationPrefix = "dm:"
+
+// ConversationID returns the conversation a message belongs to, as seen by
+// a user taking part in it, or "" for messages broadcast to everyone
+func ConversationID(message *Message, userName string) string {
+	if message.Room != "" {
+		return message.Room
+	}
+	if message.Receiver == "" {
+		return ""
+	}
+	other := message.Receiver
+	if other == userName {
+		other = message.Sender
+	}
+	return directConversationPrefix + other
+}
+
+// IsDirectConversation reports whether a conversation ID names a direct
+// message conversation
+func IsDirectConversation(conversationID string) bool {
+	return strings.HasPrefix(conversationID, directConversationPrefix)
+}
+
+// ReadCursor marks the last message a user has read in a conversation
+type ReadCursor struct {
+	MessageID string    `json:"messageId"`
+	Timestamp time.Time `json:"timestamp"` // of the message
+}
+
+// Draft is a message a user started writing but did not send
+type Draft struct {
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// UserState is client state shared by all devices of a user, keyed by
+// conversation ID
+type UserState struct {
+	ReadCursors map[string]*ReadCursor `json:"readCursors"`
+	MutedRooms  []string               `json:"mutedRooms"`
+	Drafts      map[string]*Draft      `json:"drafts"`
+	Status      *UserStatus            `json:"status,omitempty"` // nil when no status is set
+}
+
+// StateUpdateKind identifies what part of a user's state changed
+type StateUpdateKind string
+
+// State updates
+const (
+	StateReadCursor  StateUpdateKind = "read_cursor"
+	StateRoomMuted   StateUpdateKind = "room_muted"
+	StateRoomUnmuted StateUpdateKind = "room_unmuted"
+	StateDraft       StateUpdateKind = "draft"
+	StateStatus      StateUpdateKind = "status"
+)
+
+// StateUpdate is a change to a user's state made on one of their devices
+type StateUpdate struct {
+	Kind           StateUpdateKind `json:"kind"`
+	ConversationID string          `json:"conversationId,omitempty"`
+	ReadCursor     *ReadCursor     `json:"readCursor,omitempty"`
+	Draft          *Draft          `json:"draft,omitempty"`  // nil when the draft was cleared
+	Status         *UserStatus     `json:"status,omitempty"` // nil when the status was cleared
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// UploadSession tracks the state of a chunked file upload
+type UploadSession struct {
+	ID            string        `json:"uploadId"`
+	FileName      string        `json:"fileName"`
+	FileType      string        `json:"fileType"`
+	FileSize      int64         `json:"fileSize"`
+	Checksum      string        `json:"checksum"` // hex encoded SHA-256 of the whole file
+	ChunkSize     int64         `json:"chunkSize"`
+	Offset        int64         `json:"offset"` // bytes received so far
+	Chunks        int           `json:"chunks"` // chunks received so far, held in the blob store
+	Sender        string        `json:"sender"`
+	Room          string        `json:"room,omitempty"`
+	Receiver      string        `json:"receiver,omitempty"`
+	Caption       string        `json:"caption,omitempty"` // message text sent with the file
+	TTL           time.Duration `json:"ttl,omitempty"`
+	BurnAfterRead bool          `json:"burnAfterRead,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	ExpiresAt     time.Time     `json:"expiresAt"`               // discarded unless resumed before then
+	QuotaReserved bool          `json:"quotaReserved,omitempty"` // the file's quota was taken when the upload started
+}
+
+// Completed reports whether every byte of the file has been received
+func (s *UploadSession) Completed() bool {
+	return s.Offset == s.FileSize
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+func newTestAuth(secret string, ttl time.Duration) *AuthService {
+	return NewAuthService(&config.Config{Auth: config.AuthConfig{Secret: secret, TokenTTL: ttl}})
+}
+
+func TestVerifyToken(t *testing.T) {
+	auth := newTestAuth("secret", time.Hour)
+	token, err := auth.IssueToken("alice", "sid-1")
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	expired, err := newTestAuth("secret", -time.Minute).IssueToken("alice", "sid-1")
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	foreign, err := newTestAuth("other secret", time.Hour).IssueToken("alice", "sid-1")
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "valid", token: token, valid: true},
+		{name: "empty", token: ""},
+		{name: "no signature", token: payload},
+		{name: "tampered signature", token: payload + "." + strings.ToUpper(signature)},
+		{name: "tampered claims", token: "eyJ1IjoiYWRtaW4iLCJzIjoic2lkLTEiLCJleHAiOjk5OTk5OTk5OTl9." + signature},
+		{name: "expired", token: expired},
+		{name: "other secret", token: foreign},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := auth.VerifyToken(tt.token)
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("got claims %+v and %v, want ErrInvalidToken", claims, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claims.UserName != "alice" || claims.SessionID != "sid-1" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyResource(t *testing.T) {
+	auth := newTestAuth("secret", time.Hour)
+	expiresAt := time.Now().Add(time.Minute)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	signature := auth.SignResource("file:m1", expiresAt)
+
+	past := time.Now().Add(-time.Minute)
+	pastSignature := auth.SignResource("file:m1", past)
+
+	tests := []struct {
+		name      string
+		resource  string
+		expires   string
+		signature string
+		valid     bool
+	}{
+		{name: "valid", resource: "file:m1", expires: expires, signature: signature, valid: true},
+		{name: "other resource", resource: "file:m2", expires: expires, signature: signature},
+		{name: "extended expiry", resource: "file:m1", expires: strconv.FormatInt(expiresAt.Add(time.Hour).Unix(), 10), signature: signature},
+		{name: "expired", resource: "file:m1", expires: strconv.FormatInt(past.Unix(), 10), signature: pastSignature},
+		{name: "invalid expiry", resource: "file:m1", expires: "soon", signature: signature},
+		{name: "token signature", resource: "file:m1", expires: expires, signature: auth.sign("token", "file:m1|"+expires)},
+	}
+
+	for _, tt := range tests {
+		if got := auth.VerifyResource(tt.resource, tt.expires, tt.signature); got != tt.valid {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
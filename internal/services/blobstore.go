@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+// Supported blob storage backends
+const (
+	BlobBackendLocal = "local"
+	BlobBackendS3    = "s3"
+)
+
+// ErrBlobNotFound is returned when a blob does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the contents of uploaded files
+type BlobStore interface {
+	// Put stores size bytes read from r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open returns a reader for the blob stored under key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+	// URL returns a download URL for the blob that stays valid for at least
+	// expiry. Stores that serve the URL themselves send the overrides, when
+	// given, in place of the headers stored with the blob.
+	URL(ctx context.Context, key string, expiry time.Duration, overrides *ResponseOverrides) (string, error)
+}
+
+// ResponseOverrides are the headers a download URL is served with
+type ResponseOverrides struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// SeekableBlobStore is implemented by stores whose blobs can be served
+// directly with HTTP range support. Other stores redirect to their URLs.
+type SeekableBlobStore interface {
+	OpenSeeker(ctx context.Context, key string) (io.ReadSeekCloser, error)
+}
+
+// NewBlobStore creates the blob store selected by the upload configuration
+func NewBlobStore(cfg *config.Config) (BlobStore, error) {
+	switch cfg.Upload.Backend {
+	case BlobBackendLocal:
+		return NewLocalBlobStore(cfg.Upload.UploadDir, cfg.Upload.BaseURL)
+	case BlobBackendS3:
+		return NewS3BlobStore(cfg.Upload.S3)
+	default:
+		return nil, fmt.Errorf("unknown upload backend: %s", cfg.Upload.Backend)
+	}
+}
+
+// LocalBlobStore stores blobs as files in a local directory
+type LocalBlobStore struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocalBlobStore creates a blob store rooted at dir, served under baseURL
+func NewLocalBlobStore(dir, baseURL string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &LocalBlobStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// Put writes a blob to disk, replacing any existing file atomically
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	return nil
+}
+
+// Open opens a blob file for reading
+func (s *LocalBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.OpenSeeker(ctx, key)
+}
+
+// OpenSeeker opens a blob file for random access
+func (s *LocalBlobStore) OpenSeeker(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return file, nil
+}
+
+// Delete removes a blob file
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+// URL returns the static URL of a blob; local URLs do not expire. Local
+// blobs are downloaded through the server, which sets the headers itself.
+func (s *LocalBlobStore) URL(ctx context.Context, key string, expiry time.Duration, overrides *ResponseOverrides) (string, error) {
+	return fmt.Sprintf("%s/%s", s.baseURL, key), nil
+}
+
+// path maps a key to a file path, rejecting keys that escape the directory
+func (s *LocalBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"im-demo/internal/config"
+)
+
+// ErrUnsupportedImage is returned for content that is not a decodable image
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+// processableImageTypes are the formats the pipeline can decode and re-encode
+var processableImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// ProcessedImage is a sanitized image together with its thumbnails
+type ProcessedImage struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+	Thumbnails  []ProcessedThumbnail
+}
+
+// ProcessedThumbnail is a downscaled copy of an image
+type ProcessedThumbnail struct {
+	Size        int // bounding box the thumbnail was fitted into
+	Width       int
+	Height      int
+	Data        []byte
+	ContentType string
+}
+
+// ImageProcessor re-encodes uploaded images and generates thumbnails.
+// At most Workers images are processed concurrently.
+type ImageProcessor struct {
+	sizes       []int
+	maxPixels   int
+	maxFrames   int
+	jpegQuality int
+	slots       chan struct{}
+}
+
+// NewImageProcessor creates an image processor
+func NewImageProcessor(cfg config.ImageConfig) *ImageProcessor {
+	return &ImageProcessor{
+		sizes:       cfg.ThumbnailSizes,
+		maxPixels:   cfg.MaxPixels,
+		maxFrames:   cfg.MaxFrames,
+		jpegQuality: cfg.JPEGQuality,
+		slots:       make(chan struct{}, cfg.Workers),
+	}
+}
+
+// DetectImageType sniffs the content type of data and reports whether it is
+// an image format the processor can handle
+func DetectImageType(data []byte) (string, bool) {
+	contentType := http.DetectContentType(data)
+	return contentType, IsProcessableImage(contentType)
+}
+
+// IsProcessableImage reports whether the processor can handle a content type
+func IsProcessableImage(contentType string) bool {
+	return processableImageTypes[contentType]
+}
+
+// Process decodes an image and re-encodes it, which drops EXIF/GPS and any
+// other embedded metadata, then renders the configured thumbnail sizes.
+// JPEGs are rotated according to their EXIF orientation first.
+func (p *ImageProcessor) Process(ctx context.Context, data []byte) (*ProcessedImage, error) {
+	select {
+	case p.slots <- struct{}{}:
+		defer func() { <-p.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	contentType, ok := DetectImageType(data)
+	if !ok {
+		return nil, ErrUnsupportedImage
+	}
+
+	// Refuse decompression bombs before allocating pixel buffers
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+	if imgConfig.Width*imgConfig.Height > p.maxPixels {
+		return nil, fmt.Errorf("image too large: %dx%d", imgConfig.Width, imgConfig.Height)
+	}
+
+	var (
+		encoded bytes.Buffer
+		first   image.Image
+	)
+
+	switch contentType {
+	case "image/gif":
+		// Every frame is decoded into memory, so long animations are bombs too
+		frames, err := gifFrameCount(data)
+		if err != nil {
+			return nil, err
+		}
+		if frames > p.maxFrames || frames*imgConfig.Width*imgConfig.Height > p.maxPixels {
+			return nil, fmt.Errorf("animation too large: %d frames of %dx%d", frames, imgConfig.Width, imgConfig.Height)
+		}
+
+		// Keep animations, but only the frames and timing survive re-encoding
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+		}
+		if err := gif.EncodeAll(&encoded, animation); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+		first = animation.Image[0]
+
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+		}
+		if contentType == "image/jpeg" {
+			if orientation := jpegOrientation(data); orientation != 1 {
+				img = applyOrientation(toNRGBA(img), orientation)
+			}
+		}
+		if err := p.encode(&encoded, img, contentType); err != nil {
+			return nil, err
+		}
+		first = img
+	}
+
+	bounds := first.Bounds()
+	processed := &ProcessedImage{
+		Data:        encoded.Bytes(),
+		ContentType: contentType,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+	}
+
+	// Thumbnails of GIFs are rendered as still PNGs
+	thumbType := contentType
+	if thumbType == "image/gif" {
+		thumbType = "image/png"
+	}
+
+	src := toNRGBA(first)
+	for _, size := range p.sizes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Never upscale; images smaller than a size are displayed as-is
+		if bounds.Dx() <= size && bounds.Dy() <= size {
+			continue
+		}
+
+		thumb := resizeToFit(src, size)
+		var buf bytes.Buffer
+		if err := p.encode(&buf, thumb, thumbType); err != nil {
+			return nil, err
+		}
+
+		processed.Thumbnails = append(processed.Thumbnails, ProcessedThumbnail{
+			Size:        size,
+			Width:       thumb.Bounds().Dx(),
+			Height:      thumb.Bounds().Dy(),
+			Data:        buf.Bytes(),
+			ContentType: thumbType,
+		})
+	}
+
+	return processed, nil
+}
+
+// encode writes img in the given format
+func (p *ImageProcessor) encode(buf *bytes.Buffer, img image.Image, contentType string) error {
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: p.jpegQuality})
+	case "image/png":
+		err = png.Encode(buf, img)
+	default:
+		return ErrUnsupportedImage
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode image: %w", err)
+	}
+	return nil
+}
+
+// toNRGBA converts an image into a directly addressable pixel buffer
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// resizeToFit downscales src so that it fits in a size x size box, averaging
+// the source pixels covered by each destination pixel
+func resizeToFit(src *image.NRGBA, size int) *image.NRGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := size, size
+	if sw > sh {
+		dh = max(1, sh*size/sw)
+	} else {
+		dw = max(1, sw*size/sh)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					// Weight colors by alpha so transparent pixels do not darken edges
+					pa := uint64(p[3])
+					r += uint64(p[0]) * pa
+					g += uint64(p[1]) * pa
+					b += uint64(p[2]) * pa
+					a += pa
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			if a > 0 {
+				dst.Pix[i] = uint8(r / a)
+				dst.Pix[i+1] = uint8(g / a)
+				dst.Pix[i+2] = uint8(b / a)
+			}
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
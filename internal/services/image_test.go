@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"testing"
+
+	"im-demo/internal/config"
+)
+
+func testImageProcessor() *ImageProcessor {
+	return NewImageProcessor(config.ImageConfig{
+		ThumbnailSizes: []int{16},
+		Workers:        1,
+		MaxPixels:      64 * 64,
+		MaxFrames:      10,
+		JPEGQuality:    90,
+	})
+}
+
+func TestImageProcessorProcess(t *testing.T) {
+	p := testImageProcessor()
+	photo := halfRedHalfBlue(t, 40, 20)
+	geotagged := withEXIF(photo, exifSegment(binary.BigEndian, 6))
+	// Past the pixel limit only when every frame is counted
+	longAnimation := animation(t, 8, 32)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		w, h    int
+	}{
+		{name: "plain jpeg", data: photo, w: 40, h: 20},
+		{name: "rotated jpeg", data: geotagged, w: 20, h: 40},
+		{name: "short animation", data: animation(t, 3, 16), w: 16, h: 16},
+		{name: "too many frames", data: animation(t, 11, 4), wantErr: true},
+		{name: "too many pixels over all frames", data: longAnimation, wantErr: true},
+		{name: "too large", data: halfRedHalfBlue(t, 80, 80), wantErr: true},
+		{name: "corrupt png", data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDRgarbage"), wantErr: true},
+		{name: "not an image", data: []byte("hello"), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := p.Process(context.Background(), tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got.Width != tt.w || got.Height != tt.h {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, got.Width, got.Height, tt.w, tt.h)
+		}
+	}
+}
+
+func TestImageProcessorRotatesAndStripsJPEG(t *testing.T) {
+	p := testImageProcessor()
+	data := withEXIF(halfRedHalfBlue(t, 40, 20), exifSegment(binary.LittleEndian, 6))
+
+	got, err := p.Process(context.Background(), data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(got.Data, []byte("Exif")) {
+		t.Error("EXIF survived re-encoding")
+	}
+	if jpegOrientation(got.Data) != 1 {
+		t.Error("re-encoded image still carries an orientation")
+	}
+
+	// Turned clockwise, the red left half becomes the top half
+	img, err := jpeg.Decode(bytes.NewReader(got.Data))
+	if err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	top := toNRGBA(img).NRGBAAt(10, 5)
+	bottom := toNRGBA(img).NRGBAAt(10, 35)
+	if top.R < 200 || top.B > 60 || bottom.B < 200 || bottom.R > 60 {
+		t.Errorf("unexpected colours after rotation: top %v, bottom %v", top, bottom)
+	}
+
+	if len(got.Thumbnails) != 1 || got.Thumbnails[0].Width != 8 || got.Thumbnails[0].Height != 16 {
+		t.Errorf("unexpected thumbnails: %+v", got.Thumbnails)
+	}
+}
+
+func TestImageProcessorRejectsUnsupported(t *testing.T) {
+	_, err := testImageProcessor().Process(context.Background(), []byte("\x89PNG\r\n\x1a\nnot really"))
+	if !errors.Is(err, ErrUnsupportedImage) {
+		t.Errorf("got %v, want ErrUnsupportedImage", err)
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+// exifSegment builds an APP1 segment holding only an orientation tag
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // first IFD
+	order.PutUint16(tiff[8:], 1) // one entry
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// withEXIF inserts an EXIF segment right after the JPEG start marker
+func withEXIF(jpegData, segment []byte) []byte {
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegData[2:]...)
+}
+
+// halfRedHalfBlue returns a w x h JPEG whose left half is red
+func halfRedHalfBlue(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{B: 255, A: 255}
+			if x < w/2 {
+				c = color.NRGBA{R: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := halfRedHalfBlue(t, 4, 2)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{name: "no exif", data: plain, want: 1},
+		{name: "little endian", data: withEXIF(plain, exifSegment(binary.LittleEndian, 6)), want: 6},
+		{name: "big endian", data: withEXIF(plain, exifSegment(binary.BigEndian, 8)), want: 8},
+		{name: "out of range", data: withEXIF(plain, exifSegment(binary.BigEndian, 9)), want: 1},
+		{name: "truncated", data: withEXIF(plain, exifSegment(binary.BigEndian, 3))[:20], want: 1},
+		{name: "not a jpeg", data: []byte("GIF89a"), want: 1},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image with a marked top-left pixel
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		marked      image.Point // where the top-left pixel ends up
+	}{
+		{orientation: 1, w: 3, h: 2, marked: image.Pt(0, 0)},
+		{orientation: 2, w: 3, h: 2, marked: image.Pt(2, 0)},
+		{orientation: 3, w: 3, h: 2, marked: image.Pt(2, 1)},
+		{orientation: 4, w: 3, h: 2, marked: image.Pt(0, 1)},
+		{orientation: 5, w: 2, h: 3, marked: image.Pt(0, 0)},
+		{orientation: 6, w: 2, h: 3, marked: image.Pt(1, 0)},
+		{orientation: 7, w: 2, h: 3, marked: image.Pt(1, 2)},
+		{orientation: 8, w: 2, h: 3, marked: image.Pt(0, 2)},
+	}
+	for _, tt := range tests {
+		dst := applyOrientation(src, tt.orientation)
+		if dst.Rect.Dx() != tt.w || dst.Rect.Dy() != tt.h {
+			t.Errorf("orientation %d: size %v, want %dx%d", tt.orientation, dst.Rect.Size(), tt.w, tt.h)
+			continue
+		}
+		if got := dst.NRGBAAt(tt.marked.X, tt.marked.Y); got.R != 255 {
+			t.Errorf("orientation %d: top-left pixel not at %v", tt.orientation, tt.marked)
+		}
+	}
+}
+
+// animation encodes a GIF with the given number of frames
+func animation(t *testing.T, frames, size int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, size, size), palette)
+		frame.SetColorIndex(i%size, 0, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("failed to encode gif: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for _, frames := range []int{1, 2, 25} {
+		got, err := gifFrameCount(animation(t, frames, 8))
+		if err != nil || got != frames {
+			t.Errorf("got %d frames and %v, want %d", got, err, frames)
+		}
+	}
+
+	if _, err := gifFrameCount([]byte("GIF89a")); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+	corrupt := animation(t, 2, 8)
+	corrupt[len(corrupt)-1] = 0x99
+	if _, err := gifFrameCount(corrupt); err == nil {
+		t.Error("expected an error for an unknown block")
+	}
+}
+
+// riffChunk encodes a RIFF chunk with its padding
+func riffChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// webpFile wraps chunks in a RIFF WEBP container
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	file := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(file[4:], uint32(len(body)))
+	return append(file, body...)
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04 | 0x20          // EXIF, XMP and ICC flags
+	bitstream := []byte{0x2F, 1, 2, 3, 4} // odd size, padded
+
+	input := webpFile(
+		riffChunk("VP8X", vp8x),
+		riffChunk("ICCP", []byte("icc")),
+		riffChunk("VP8L", bitstream),
+		riffChunk("EXIF", []byte("GPS 51.5N 0.1W")),
+		riffChunk("XMP ", []byte("<x:xmpmeta/>")),
+	)
+	vp8x[0] = 0x20
+	want := webpFile(
+		riffChunk("VP8X", vp8x),
+		riffChunk("ICCP", []byte("icc")),
+		riffChunk("VP8L", bitstream),
+	)
+
+	got, err := StripWebPMetadata(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+
+	malformed := map[string][]byte{
+		"not riff":        []byte("GIF89a......"),
+		"truncated chunk": input[:len(input)-3],
+		"oversized chunk": webpFile([]byte("VP8L\xff\xff\xff\x7f")),
+	}
+	for name, data := range malformed {
+		if _, err := StripWebPMetadata(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// urlPattern matches http(s) URLs embedded in message text
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// errPrivateAddress is returned when a preview URL resolves to a private network
+var errPrivateAddress = errors.New("refusing to fetch private network address")
+
+// PreviewFetcher fetches link preview metadata for a URL
+type PreviewFetcher interface {
+	Fetch(ctx context.Context, rawURL string) (*models.LinkPreview, error)
+}
+
+// HTTPPreviewFetcher fetches OpenGraph metadata over HTTP
+type HTTPPreviewFetcher struct {
+	client      *http.Client
+	maxBodySize int64
+}
+
+// NewHTTPPreviewFetcher creates a fetcher that reads OpenGraph tags from HTML pages
+func NewHTTPPreviewFetcher(cfg config.LinkPreviewConfig) *HTTPPreviewFetcher {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateNetworks {
+		dialer.Control = rejectPrivateAddress
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &HTTPPreviewFetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("too many redirects")
+				}
+				return nil
+			},
+		},
+		maxBodySize: cfg.MaxBodySize,
+	}
+}
+
+// Fetch downloads a page and extracts its OpenGraph metadata
+func (f *HTTPPreviewFetcher) Fetch(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create preview request: %w", err)
+	}
+	req.Header.Set("User-Agent", "im-demo-link-preview/1.0")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch preview: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch preview: unexpected status %d", resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.Contains(contentType, "text/html") {
+		return nil, fmt.Errorf("failed to fetch preview: unsupported content type %q", contentType)
+	}
+
+	preview := parseOpenGraph(io.LimitReader(resp.Body, f.maxBodySize), resp.Request.URL)
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// parseOpenGraph extracts og:* meta tags, falling back to <title> and description
+func parseOpenGraph(r io.Reader, base *url.URL) *models.LinkPreview {
+	preview := &models.LinkPreview{}
+	var title, description string
+
+	finish := func() *models.LinkPreview {
+		if preview.Title == "" {
+			preview.Title = title
+		}
+		if preview.Description == "" {
+			preview.Description = description
+		}
+		return preview
+	}
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return finish()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				if tokenizer.Next() == html.TextToken {
+					title = strings.TrimSpace(string(tokenizer.Text()))
+				}
+			case "meta":
+				key, content := metaAttributes(token)
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "og:image":
+					if ref, err := base.Parse(content); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+						preview.Image = ref.String()
+					}
+				case "description":
+					description = content
+				}
+			}
+
+		case html.EndTagToken:
+			// Everything we need lives in <head>
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				return finish()
+			}
+		}
+	}
+}
+
+// metaAttributes returns the property/name and content of a <meta> tag
+func metaAttributes(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "property", "name":
+			key = strings.ToLower(attr.Val)
+		case "content":
+			content = strings.TrimSpace(attr.Val)
+		}
+	}
+	return key, content
+}
+
+// privatePrefixes are the networks previews may not reach: local, private,
+// shared, link-local, multicast and reserved ranges, and the IPv6 ranges
+// that embed IPv4 addresses
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// isPrivateAddress reports whether ip is in one of the private prefixes.
+// IPv4-mapped IPv6 addresses are checked as the IPv4 address they carry.
+func isPrivateAddress(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectPrivateAddress prevents previews from reaching internal services
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return errPrivateAddress
+	}
+	if isPrivateAddress(addrPort.Addr()) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// LinkPreviewService resolves previews for URLs found in messages, with caching
+type LinkPreviewService struct {
+	fetcher PreviewFetcher
+	redis   *RedisService
+	config  config.LinkPreviewConfig
+	logger  *logrus.Logger
+}
+
+// NewLinkPreviewService creates a new link preview service
+func NewLinkPreviewService(cfg *config.Config, redisService *RedisService, fetcher PreviewFetcher, logger *logrus.Logger) *LinkPreviewService {
+	return &LinkPreviewService{
+		fetcher: fetcher,
+		redis:   redisService,
+		config:  cfg.Message.LinkPreview,
+		logger:  logger,
+	}
+}
+
+// Enabled reports whether link previews should be generated
+func (s *LinkPreviewService) Enabled() bool {
+	return s.config.Enabled
+}
+
+// ExtractURLs returns the distinct http(s) URLs in a text, up to the configured limit
+func (s *LinkPreviewService) ExtractURLs(text string) []string {
+	seen := make(map[string]struct{})
+	urls := make([]string, 0)
+
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		// Drop trailing punctuation that is usually part of the sentence
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		if _, ok := seen[match]; ok {
+			continue
+		}
+		if _, err := url.ParseRequestURI(match); err != nil {
+			continue
+		}
+		seen[match] = struct{}{}
+		urls = append(urls, match)
+		if len(urls) >= s.config.MaxLinks {
+			break
+		}
+	}
+
+	return urls
+}
+
+// Preview returns the preview for a URL, fetching it if it is not cached
+func (s *LinkPreviewService) Preview(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	if preview, err := s.redis.GetLinkPreview(ctx, rawURL); err == nil {
+		return preview, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	preview, err := s.fetcher.Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.redis.StoreLinkPreview(ctx, rawURL, preview, s.config.CacheTTL); err != nil {
+		s.logger.WithError(err).Warn("Failed to cache link preview")
+	}
+
+	return preview, nil
+}
+
+// Previews resolves previews for several URLs, skipping the ones that fail
+func (s *LinkPreviewService) Previews(ctx context.Context, urls []string) []models.LinkPreview {
+	previews := make([]models.LinkPreview, 0, len(urls))
+	for _, u := range urls {
+		preview, err := s.Preview(ctx, u)
+		if err != nil {
+			s.logger.WithError(err).WithField("url", u).Debug("Failed to fetch link preview")
+			continue
+		}
+		if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+			continue
+		}
+		previews = append(previews, *preview)
+	}
+	return previews
+}
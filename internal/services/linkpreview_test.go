@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+// previewPage is served by the stub site
+const previewPage = `<!DOCTYPE html>
+<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="Stub title">
+<meta name="description" content="Stub description">
+<meta property="og:site_name" content="Stub">
+<meta property="og:image" content="/image.png">
+</head><body><meta property="og:title" content="Ignored"></body></html>`
+
+// newStubSite serves an OpenGraph page, a page without tags, a non-HTML
+// document and a missing page
+func newStubSite(t testing.TB) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, previewPage)
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>Only a title</title></head></html>`)
+	})
+	mux.HandleFunc("/file.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testPreviewConfig() config.LinkPreviewConfig {
+	return config.LinkPreviewConfig{
+		Enabled:              true,
+		Timeout:              5 * time.Second,
+		MaxBodySize:          512 * 1024,
+		MaxLinks:             3,
+		CacheTTL:             time.Hour,
+		AllowPrivateNetworks: true, // the stub listens on loopback
+	}
+}
+
+func TestHTTPPreviewFetcher(t *testing.T) {
+	site := newStubSite(t)
+	fetcher := NewHTTPPreviewFetcher(testPreviewConfig())
+
+	tests := []struct {
+		name        string
+		path        string
+		title       string
+		description string
+		image       string
+		wantErr     bool
+	}{
+		{name: "opengraph", path: "/page", title: "Stub title", description: "Stub description", image: site.URL + "/image.png"},
+		{name: "title only", path: "/plain", title: "Only a title"},
+		{name: "not html", path: "/file.json", wantErr: true},
+		{name: "not found", path: "/missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview, err := fetcher.Fetch(context.Background(), site.URL+tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", preview)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if preview.URL != site.URL+tt.path || preview.Title != tt.title ||
+				preview.Description != tt.description || preview.Image != tt.image {
+				t.Errorf("got %+v", preview)
+			}
+		})
+	}
+}
+
+func TestHTTPPreviewFetcherRejectsPrivateNetworks(t *testing.T) {
+	site := newStubSite(t)
+	cfg := testPreviewConfig()
+	cfg.AllowPrivateNetworks = false
+
+	_, err := NewHTTPPreviewFetcher(cfg).Fetch(context.Background(), site.URL+"/page")
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("got %v, want errPrivateAddress", err)
+	}
+}
+
+func TestRejectPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		private bool
+	}{
+		{address: "93.184.216.34:443"},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443"},
+		{address: "100.63.255.255:80"},
+		{address: "100.128.0.0:80"},
+		{address: "0.0.0.0:80", private: true},
+		{address: "0.1.2.3:80", private: true},
+		{address: "10.1.2.3:80", private: true},
+		{address: "100.64.0.1:80", private: true},
+		{address: "100.127.255.254:80", private: true},
+		{address: "127.0.0.1:80", private: true},
+		{address: "169.254.169.254:80", private: true},
+		{address: "172.16.0.1:80", private: true},
+		{address: "192.168.1.1:80", private: true},
+		{address: "198.18.0.1:80", private: true},
+		{address: "224.0.0.1:80", private: true},
+		{address: "255.255.255.255:80", private: true},
+		{address: "[::]:80", private: true},
+		{address: "[::1]:80", private: true},
+		{address: "[::ffff:127.0.0.1]:80", private: true},
+		{address: "[::ffff:10.0.0.1]:80", private: true},
+		{address: "[::ffff:100.64.0.1]:80", private: true},
+		{address: "[::ffff:0.0.0.0]:80", private: true},
+		{address: "[::127.0.0.1]:80", private: true},
+		{address: "[64:ff9b::a00:1]:80", private: true},
+		{address: "[2002:a00:1::]:80", private: true},
+		{address: "[fd00::1]:80", private: true},
+		{address: "[fe80::1%eth0]:80", private: true},
+		{address: "[ff02::1]:80", private: true},
+		{address: "not an address", private: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := rejectPrivateAddress("tcp", tt.address, nil)
+			if private := errors.Is(err, errPrivateAddress); private != tt.private {
+				t.Errorf("rejected: %v, want %v", err, tt.private)
+			}
+		})
+	}
+}
+
+func TestLinkPreviewServiceCachesPreviews(t *testing.T) {
+	r, _ := newTestRedis(t)
+	site := newStubSite(t)
+	cfg := &config.Config{Message: config.MessageConfig{LinkPreview: testPreviewConfig()}}
+	service := NewLinkPreviewService(cfg, r, NewHTTPPreviewFetcher(cfg.Message.LinkPreview), testLogger())
+
+	urls := []string{site.URL + "/page", site.URL + "/file.json"}
+	previews := service.Previews(context.Background(), urls)
+	if len(previews) != 1 || previews[0].Title != "Stub title" {
+		t.Fatalf("got %+v, want the preview of the page only", previews)
+	}
+
+	// Served from the cache once the site is gone
+	site.Close()
+	previews = service.Previews(context.Background(), urls)
+	if len(previews) != 1 || previews[0].Title != "Stub title" {
+		t.Errorf("got %+v, want the cached preview", previews)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	cfg := &config.Config{Message: config.MessageConfig{LinkPreview: config.LinkPreviewConfig{MaxLinks: 2}}}
+	service := NewLinkPreviewService(cfg, nil, nil, testLogger())
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "no links here", want: []string{}},
+		{text: "see https://example.com.", want: []string{"https://example.com"}},
+		{text: "(http://a.example/x) and http://a.example/x", want: []string{"http://a.example/x"}},
+		{text: "http://a.example http://b.example http://c.example", want: []string{"http://a.example", "http://b.example"}},
+		{text: "ftp://example.com", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		got := service.ExtractURLs(tt.text)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ExtractURLs(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MessageFilter inspects a message before it is stored and delivered.
+// Filters return nil to let the message through unchanged.
+type MessageFilter interface {
+	Name() string
+	Filter(ctx context.Context, message *models.Message) (*models.FilterDecision, error)
+}
+
+// FilterChain runs message filters in order. Masked content is seen by the
+// filters that follow, and the first rejection ends the chain. Filters may
+// be added while messages are being filtered.
+type FilterChain struct {
+	mu      sync.RWMutex
+	filters []MessageFilter
+	logger  *logrus.Logger
+}
+
+// NewFilterChain creates a filter chain with the built-in filters enabled by
+// the moderation configuration
+func NewFilterChain(cfg config.ModerationConfig, redis *RedisService, logger *logrus.Logger) (*FilterChain, error) {
+	chain := &FilterChain{logger: logger}
+	if !cfg.Enabled {
+		return chain, nil
+	}
+
+	if len(cfg.WordList.Words) > 0 {
+		filter, err := NewWordListFilter(cfg.WordList)
+		if err != nil {
+			return nil, err
+		}
+		chain.Use(filter)
+	}
+	if cfg.Flood.MaxRepeats > 0 {
+		chain.Use(NewFloodFilter(cfg.Flood, redis))
+	}
+	if len(cfg.BlockedDomains) > 0 {
+		chain.Use(NewLinkBlocklistFilter(cfg.BlockedDomains))
+	}
+
+	return chain, nil
+}
+
+// Use appends a filter to the chain
+func (c *FilterChain) Use(filter MessageFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters = append(c.filters, filter)
+}
+
+// Run passes a message through every filter and returns their decisions.
+// Masks are applied to the message. Filters that fail are skipped so that
+// an outage does not stop all messages.
+func (c *FilterChain) Run(ctx context.Context, message *models.Message) []models.FilterDecision {
+	// Filters may be slow, so run them on a snapshot rather than under the lock
+	c.mu.RLock()
+	filters := c.filters
+	c.mu.RUnlock()
+
+	var decisions []models.FilterDecision
+
+	for _, filter := range filters {
+		decision, err := filter.Filter(ctx, message)
+		if err != nil {
+			c.logger.WithError(err).WithField("filter", filter.Name()).Warn("Message filter failed")
+			continue
+		}
+		if decision == nil {
+			continue
+		}
+		if decision.Filter == "" {
+			decision.Filter = filter.Name()
+		}
+
+		c.logger.WithFields(logrus.Fields{
+			"message_id": message.ID,
+			"sender":     message.Sender,
+			"room_id":    message.Room,
+			"filter":     decision.Filter,
+			"action":     decision.Action,
+			"reason":     decision.Reason,
+		}).Info("Message filtered")
+
+		decisions = append(decisions, *decision)
+		if decision.Action == models.FilterReject {
+			break
+		}
+		if decision.Action == models.FilterMask {
+			message.Content = decision.Content
+		}
+	}
+
+	return decisions
+}
+
+// WordListFilter masks or rejects messages containing listed words
+type WordListFilter struct {
+	pattern *regexp.Regexp
+	action  models.FilterAction
+}
+
+// NewWordListFilter creates a word list filter
+func NewWordListFilter(cfg config.WordListConfig) (*WordListFilter, error) {
+	action := models.FilterAction(cfg.Action)
+	if action != models.FilterMask && action != models.FilterReject {
+		return nil, fmt.Errorf("unknown word list action: %s", cfg.Action)
+	}
+
+	// Words made of letters and digits only match whole words; others, such
+	// as CJK words which have no word boundaries, match anywhere
+	alternatives := make([]string, 0, len(cfg.Words))
+	for _, word := range cfg.Words {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		quoted := regexp.QuoteMeta(word)
+		if isASCIIWord(word) {
+			quoted = `\b` + quoted + `\b`
+		}
+		alternatives = append(alternatives, quoted)
+	}
+	if len(alternatives) == 0 {
+		return nil, fmt.Errorf("word list has no words")
+	}
+
+	pattern, err := regexp.Compile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid word list: %w", err)
+	}
+
+	return &WordListFilter{pattern: pattern, action: action}, nil
+}
+
+// isASCIIWord reports whether s consists of ASCII letters, digits and underscores
+func isASCIIWord(s string) bool {
+	for _, r := range s {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Name identifies the filter in decisions and logs
+func (f *WordListFilter) Name() string {
+	return "word_list"
+}
+
+// Filter masks listed words, or rejects messages containing them
+func (f *WordListFilter) Filter(ctx context.Context, message *models.Message) (*models.FilterDecision, error) {
+	if !f.pattern.MatchString(message.Content) {
+		return nil, nil
+	}
+
+	if f.action == models.FilterReject {
+		return &models.FilterDecision{Action: models.FilterReject, Reason: "Message contains blocked words"}, nil
+	}
+
+	masked := f.pattern.ReplaceAllStringFunc(message.Content, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return &models.FilterDecision{Action: models.FilterMask, Reason: "Blocked words were masked", Content: masked}, nil
+}
+
+// FloodFilter rejects a message a sender keeps repeating in a conversation
+type FloodFilter struct {
+	cfg   config.FloodConfig
+	redis *RedisService
+}
+
+// NewFloodFilter creates a repeated message filter
+func NewFloodFilter(cfg config.FloodConfig, redis *RedisService) *FloodFilter {
+	return &FloodFilter{cfg: cfg, redis: redis}
+}
+
+// Name identifies the filter in decisions and logs
+func (f *FloodFilter) Name() string {
+	return "flood"
+}
+
+// Filter rejects a message sent more often than allowed within the window
+func (f *FloodFilter) Filter(ctx context.Context, message *models.Message) (*models.FilterDecision, error) {
+	conversation := "room:" + message.Room
+	if message.Receiver != "" {
+		conversation = "user:" + message.Receiver
+	}
+
+	// Differences in case and spacing do not make a message new
+	normalized := strings.Join(strings.Fields(strings.ToLower(message.Content)), " ")
+	sum := sha256.Sum256([]byte(normalized))
+
+	count, err := f.redis.CountRepeatedMessage(ctx, message.Sender, conversation, hex.EncodeToString(sum[:16]), f.cfg.Window)
+	if err != nil {
+		return nil, err
+	}
+	if count <= int64(f.cfg.MaxRepeats) {
+		return nil, nil
+	}
+
+	return &models.FilterDecision{Action: models.FilterReject, Reason: "Message repeated too often"}, nil
+}
+
+// LinkBlocklistFilter rejects messages linking to blocked domains
+type LinkBlocklistFilter struct {
+	domains []string
+}
+
+// NewLinkBlocklistFilter creates a link blocklist filter
+func NewLinkBlocklistFilter(domains []string) *LinkBlocklistFilter {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return &LinkBlocklistFilter{domains: normalized}
+}
+
+// Name identifies the filter in decisions and logs
+func (f *LinkBlocklistFilter) Name() string {
+	return "link_blocklist"
+}
+
+// Filter rejects messages with a link to a blocked domain
+func (f *LinkBlocklistFilter) Filter(ctx context.Context, message *models.Message) (*models.FilterDecision, error) {
+	links := urlPattern.FindAllString(message.Content, -1)
+	if link, ok := message.Metadata.(*models.LinkMetadata); ok {
+		links = append(links, link.URL)
+	}
+
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		if domain, blocked := f.blocked(u.Hostname()); blocked {
+			return &models.FilterDecision{
+				Action: models.FilterReject,
+				Reason: fmt.Sprintf("Links to %s are not allowed", domain),
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// blocked returns the blocklist entry matching a host, if any
+func (f *LinkBlocklistFilter) blocked(host string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range f.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain, true
+		}
+	}
+	return "", false
+}
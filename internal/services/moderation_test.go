@@ -0,0 +1,273 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+)
+
+func TestWordListFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		words   []string
+		action  string
+		content string
+		want    *models.FilterDecision
+	}{
+		{name: "clean", words: []string{"darn"}, action: "mask", content: "hello there"},
+		{name: "masked", words: []string{"darn"}, action: "mask", content: "Darn it, darn", want: &models.FilterDecision{
+			Action: models.FilterMask, Reason: "Blocked words were masked", Content: "**** it, ****",
+		}},
+		{name: "whole words only", words: []string{"ass"}, action: "mask", content: "a classic assessment"},
+		{name: "not an ASCII word", words: []string{"笨蛋"}, action: "mask", content: "你是笨蛋吗", want: &models.FilterDecision{
+			Action: models.FilterMask, Reason: "Blocked words were masked", Content: "你是**吗",
+		}},
+		{name: "regexp characters", words: []string{"c++"}, action: "mask", content: "I like c++ and c", want: &models.FilterDecision{
+			Action: models.FilterMask, Reason: "Blocked words were masked", Content: "I like *** and c",
+		}},
+		{name: "rejected", words: []string{" spam "}, action: "reject", content: "buy SPAM now", want: &models.FilterDecision{
+			Action: models.FilterReject, Reason: "Message contains blocked words",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewWordListFilter(config.WordListConfig{Words: tt.words, Action: tt.action})
+			if err != nil {
+				t.Fatalf("failed to create filter: %v", err)
+			}
+			got, err := filter.Filter(context.Background(), &models.Message{Content: tt.content})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWordListFilterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.WordListConfig
+	}{
+		{name: "unknown action", cfg: config.WordListConfig{Words: []string{"darn"}, Action: "delete"}},
+		{name: "no words", cfg: config.WordListConfig{Words: []string{" ", ""}, Action: "mask"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWordListFilter(tt.cfg); err == nil {
+				t.Error("created a filter")
+			}
+		})
+	}
+}
+
+func TestLinkBlocklistFilter(t *testing.T) {
+	filter := NewLinkBlocklistFilter([]string{" Evil.example. ", "", "bad.test"})
+
+	tests := []struct {
+		name    string
+		message *models.Message
+		reason  string
+	}{
+		{name: "no links", message: &models.Message{Content: "evil.example is down"}},
+		{name: "allowed link", message: &models.Message{Content: "see https://good.example/evil.example"}},
+		{name: "blocked link", message: &models.Message{Content: "see http://evil.example/x"}, reason: "Links to evil.example are not allowed"},
+		{name: "subdomain", message: &models.Message{Content: "https://WWW.Evil.Example./login"}, reason: "Links to evil.example are not allowed"},
+		{name: "lookalike", message: &models.Message{Content: "https://notevil.example"}},
+		{name: "with port", message: &models.Message{Content: "https://bad.test:8443/"}, reason: "Links to bad.test are not allowed"},
+		{name: "link message", message: &models.Message{
+			Type:     models.LinkMessage,
+			Metadata: &models.LinkMetadata{URL: "https://cdn.bad.test/file"},
+		}, reason: "Links to bad.test are not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := filter.Filter(context.Background(), tt.message)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.reason == "" {
+				if decision != nil {
+					t.Errorf("got %+v, want nothing", decision)
+				}
+				return
+			}
+			if decision == nil || decision.Action != models.FilterReject || decision.Reason != tt.reason {
+				t.Errorf("got %+v, want rejection %q", decision, tt.reason)
+			}
+		})
+	}
+}
+
+func TestFloodFilter(t *testing.T) {
+	r, mr := newTestRedis(t)
+	ctx := context.Background()
+	filter := NewFloodFilter(config.FloodConfig{MaxRepeats: 2, Window: time.Minute}, r)
+
+	send := func(message *models.Message) bool {
+		t.Helper()
+		decision, err := filter.Filter(ctx, message)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return decision == nil
+	}
+
+	steps := []struct {
+		name    string
+		message *models.Message
+		allowed bool
+	}{
+		{name: "first", message: &models.Message{Sender: "alice", Room: "general", Content: "hello"}, allowed: true},
+		{name: "second", message: &models.Message{Sender: "alice", Room: "general", Content: "HELLO"}, allowed: true},
+		{name: "third with other spacing", message: &models.Message{Sender: "alice", Room: "general", Content: "  hello "}},
+		{name: "other content", message: &models.Message{Sender: "alice", Room: "general", Content: "hello!"}, allowed: true},
+		{name: "other room", message: &models.Message{Sender: "alice", Room: "random", Content: "hello"}, allowed: true},
+		{name: "direct message", message: &models.Message{Sender: "alice", Receiver: "bob", Content: "hello"}, allowed: true},
+		{name: "other sender", message: &models.Message{Sender: "bob", Room: "general", Content: "hello"}, allowed: true},
+	}
+	for _, step := range steps {
+		if allowed := send(step.message); allowed != step.allowed {
+			t.Errorf("%s: allowed %v, want %v", step.name, allowed, step.allowed)
+		}
+	}
+
+	// The count starts over after the window
+	mr.FastForward(time.Minute)
+	if !send(&models.Message{Sender: "alice", Room: "general", Content: "hello"}) {
+		t.Error("rejected after the window")
+	}
+}
+
+// stubFilter returns a fixed decision or error
+type stubFilter struct {
+	name     string
+	decision *models.FilterDecision
+	err      error
+	seen     string
+}
+
+func (f *stubFilter) Name() string { return f.name }
+
+func (f *stubFilter) Filter(ctx context.Context, message *models.Message) (*models.FilterDecision, error) {
+	f.seen = message.Content
+	if f.decision == nil {
+		return nil, f.err
+	}
+	decision := *f.decision
+	return &decision, f.err
+}
+
+func TestFilterChain(t *testing.T) {
+	failing := &stubFilter{name: "failing", err: errors.New("backend down")}
+	masking := &stubFilter{name: "masking", decision: &models.FilterDecision{Action: models.FilterMask, Content: "masked"}}
+	rejecting := &stubFilter{name: "rejecting", decision: &models.FilterDecision{Filter: "custom", Action: models.FilterReject}}
+	after := &stubFilter{name: "after"}
+
+	chain := &FilterChain{logger: testLogger()}
+	for _, filter := range []MessageFilter{failing, masking, rejecting, after} {
+		chain.Use(filter)
+	}
+
+	message := &models.Message{Content: "original"}
+	decisions := chain.Run(context.Background(), message)
+
+	want := []models.FilterDecision{
+		{Filter: "masking", Action: models.FilterMask, Content: "masked"},
+		{Filter: "custom", Action: models.FilterReject},
+	}
+	if !reflect.DeepEqual(decisions, want) {
+		t.Errorf("got decisions %+v, want %+v", decisions, want)
+	}
+	if message.Content != "masked" {
+		t.Errorf("content %q, want masked", message.Content)
+	}
+	if rejecting.seen != "masked" {
+		t.Errorf("later filters saw %q, want the masked content", rejecting.seen)
+	}
+	if after.seen != "" {
+		t.Error("the chain went on after a rejection")
+	}
+}
+
+func TestFilterChainConcurrentUse(t *testing.T) {
+	chain := &FilterChain{logger: testLogger()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			chain.Use(NewLinkBlocklistFilter([]string{"evil.example"}))
+		}()
+		go func() {
+			defer wg.Done()
+			chain.Run(context.Background(), &models.Message{Content: "see https://evil.example"})
+		}()
+	}
+	wg.Wait()
+
+	decisions := chain.Run(context.Background(), &models.Message{Content: "see https://evil.example"})
+	if len(decisions) != 1 || decisions[0].Action != models.FilterReject {
+		t.Errorf("got decisions %+v, want one rejection", decisions)
+	}
+}
+
+func TestNewFilterChain(t *testing.T) {
+	r, _ := newTestRedis(t)
+
+	tests := []struct {
+		name    string
+		cfg     config.ModerationConfig
+		filters []string
+		err     bool
+	}{
+		{name: "disabled", cfg: config.ModerationConfig{WordList: config.WordListConfig{Words: []string{"darn"}, Action: "mask"}}},
+		{name: "all", cfg: config.ModerationConfig{
+			Enabled:        true,
+			WordList:       config.WordListConfig{Words: []string{"darn"}, Action: "mask"},
+			Flood:          config.FloodConfig{MaxRepeats: 3, Window: time.Minute},
+			BlockedDomains: []string{"evil.example"},
+		}, filters: []string{"word_list", "flood", "link_blocklist"}},
+		{name: "flood only", cfg: config.ModerationConfig{
+			Enabled: true,
+			Flood:   config.FloodConfig{MaxRepeats: 3, Window: time.Minute},
+		}, filters: []string{"flood"}},
+		{name: "invalid word list", cfg: config.ModerationConfig{
+			Enabled:  true,
+			WordList: config.WordListConfig{Words: []string{"darn"}, Action: "delete"},
+		}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := NewFilterChain(tt.cfg, r, testLogger())
+			if tt.err {
+				if err == nil {
+					t.Error("created a chain")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var names []string
+			for _, filter := range chain.filters {
+				names = append(names, filter.Name())
+			}
+			if !reflect.DeepEqual(names, tt.filters) {
+				t.Errorf("got filters %v, want %v", names, tt.filters)
+			}
+		})
+	}
+}
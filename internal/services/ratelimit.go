@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"im-demo/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenBucket is an in-memory token bucket
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time elapsed and takes one token if
+// available, otherwise it returns how long until one is
+func (b *tokenBucket) take(limit config.RateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / limit.Rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// RateLimiter applies the configured token buckets to Socket.IO events.
+// Session buckets live in memory on the node holding the connection; user
+// and room buckets are shared through Redis.
+type RateLimiter struct {
+	cfg    config.RateLimitConfig
+	redis  *RedisService
+	logger *logrus.Logger
+
+	mu       sync.Mutex
+	sessions map[string]map[string]*tokenBucket // session_id -> event -> bucket
+}
+
+// NewRateLimiter creates a rate limiter
+func NewRateLimiter(cfg config.RateLimitConfig, redis *RedisService, logger *logrus.Logger) *RateLimiter {
+	return &RateLimiter{
+		cfg:      cfg,
+		redis:    redis,
+		logger:   logger,
+		sessions: make(map[string]map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token for an event from every bucket that applies to it.
+// userName and roomID may be empty when unknown. When the event is refused,
+// the returned duration says when to retry.
+func (l *RateLimiter) Allow(ctx context.Context, event, sessionID, userName, roomID string) (bool, time.Duration) {
+	if !l.cfg.Enabled {
+		return true, 0
+	}
+
+	limits, ok := l.cfg.Events[event]
+	if !ok {
+		return true, 0
+	}
+
+	if limits.Session.Rate > 0 {
+		if allowed, retryAfter := l.allowSession(event, sessionID, limits.Session); !allowed {
+			return false, retryAfter
+		}
+	}
+
+	if limits.User.Rate > 0 && userName != "" {
+		if allowed, retryAfter := l.allowShared(ctx, "user:"+event+":"+userName, limits.User); !allowed {
+			return false, retryAfter
+		}
+	}
+
+	if limits.Room.Rate > 0 && roomID != "" {
+		if allowed, retryAfter := l.allowShared(ctx, "room:"+event+":"+roomID, limits.Room); !allowed {
+			return false, retryAfter
+		}
+	}
+
+	return true, 0
+}
+
+// allowSession takes a token from a session's in-memory bucket
+func (l *RateLimiter) allowSession(event, sessionID string, limit config.RateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets, ok := l.sessions[sessionID]
+	if !ok {
+		buckets = make(map[string]*tokenBucket)
+		l.sessions[sessionID] = buckets
+	}
+
+	now := time.Now()
+	bucket, ok := buckets[event]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		buckets[event] = bucket
+	}
+
+	return bucket.take(limit, now)
+}
+
+// allowShared takes a token from a bucket kept in Redis. If Redis is
+// unavailable the event is let through rather than blocking all traffic.
+func (l *RateLimiter) allowShared(ctx context.Context, bucket string, limit config.RateLimit) (bool, time.Duration) {
+	allowed, retryAfter, err := l.redis.TakeRateLimitToken(ctx, bucket, limit.Rate, limit.Burst)
+	if err != nil {
+		l.logger.WithError(err).WithField("bucket", bucket).Warn("Rate limit check failed")
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// ForgetSession drops the buckets of a disconnected session
+func (l *RateLimiter) ForgetSession(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, sessionID)
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	limit := config.RateLimit{Rate: 2, Burst: 3}
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		allowed bool
+		wait    time.Duration
+		left    float64
+	}{
+		{name: "full", tokens: 3, allowed: true, left: 2},
+		{name: "last token", tokens: 1, allowed: true, left: 0},
+		{name: "empty", tokens: 0, wait: 500 * time.Millisecond},
+		{name: "half a token", tokens: 0.5, wait: 250 * time.Millisecond},
+		{name: "refilled", tokens: 0, elapsed: 500 * time.Millisecond, allowed: true, left: 0},
+		{name: "capped at burst", tokens: 2, elapsed: time.Hour, allowed: true, left: 2},
+	}
+	for _, tt := range tests {
+		b := &tokenBucket{tokens: tt.tokens, updated: start}
+		allowed, wait := b.take(limit, start.Add(tt.elapsed))
+		if allowed != tt.allowed || wait != tt.wait {
+			t.Errorf("%s: got %v and %v, want %v and %v", tt.name, allowed, wait, tt.allowed, tt.wait)
+		}
+		if allowed && b.tokens != tt.left {
+			t.Errorf("%s: %v tokens left, want %v", tt.name, b.tokens, tt.left)
+		}
+	}
+}
+
+func TestTakeRateLimitToken(t *testing.T) {
+	r, mr := newTestRedis(t)
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	mr.SetTime(now)
+
+	take := func() (bool, time.Duration) {
+		t.Helper()
+		allowed, wait, err := r.TakeRateLimitToken(ctx, "user:message:alice", 2, 2)
+		if err != nil {
+			t.Fatalf("failed to take token: %v", err)
+		}
+		return allowed, wait
+	}
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := take(); !allowed {
+			t.Fatalf("token %d refused within the burst", i+1)
+		}
+	}
+	if allowed, wait := take(); allowed || wait != 500*time.Millisecond {
+		t.Errorf("got %v and %v, want a refusal for 500ms", allowed, wait)
+	}
+
+	// The bucket is refilled by Redis' clock
+	mr.SetTime(now.Add(500 * time.Millisecond))
+	if allowed, _ := take(); !allowed {
+		t.Error("token refused after refill")
+	}
+	if ttl := mr.TTL("rate_limit:user:message:alice"); ttl <= 0 {
+		t.Errorf("bucket has no expiry: %v", ttl)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limit := config.RateLimit{Rate: 0.001, Burst: 2}
+
+	tests := []struct {
+		name   string
+		limits config.EventLimits
+		// calls are (session, user, room); the last one's outcome is checked
+		calls   [][3]string
+		allowed bool
+	}{
+		{
+			name:    "session burst",
+			limits:  config.EventLimits{Session: limit},
+			calls:   [][3]string{{"s1", "", ""}, {"s1", "", ""}, {"s1", "", ""}},
+			allowed: false,
+		},
+		{
+			name:    "sessions are separate",
+			limits:  config.EventLimits{Session: limit},
+			calls:   [][3]string{{"s1", "", ""}, {"s1", "", ""}, {"s2", "", ""}},
+			allowed: true,
+		},
+		{
+			name:    "user shared across sessions",
+			limits:  config.EventLimits{User: limit},
+			calls:   [][3]string{{"s1", "alice", ""}, {"s2", "alice", ""}, {"s3", "alice", ""}},
+			allowed: false,
+		},
+		{
+			name:    "unknown users are not limited per user",
+			limits:  config.EventLimits{User: limit},
+			calls:   [][3]string{{"s1", "", ""}, {"s1", "", ""}, {"s1", "", ""}},
+			allowed: true,
+		},
+		{
+			name:    "room shared across users",
+			limits:  config.EventLimits{Room: limit},
+			calls:   [][3]string{{"s1", "alice", "general"}, {"s2", "bob", "general"}, {"s3", "carol", "general"}},
+			allowed: false,
+		},
+		{
+			name:    "rooms are separate",
+			limits:  config.EventLimits{Room: limit},
+			calls:   [][3]string{{"s1", "alice", "general"}, {"s1", "alice", "general"}, {"s1", "alice", "random"}},
+			allowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRedis(t)
+			cfg := config.RateLimitConfig{Enabled: true, Events: map[string]config.EventLimits{"message": tt.limits}}
+			l := NewRateLimiter(cfg, r, testLogger())
+
+			var allowed bool
+			var retryAfter time.Duration
+			for _, call := range tt.calls {
+				allowed, retryAfter = l.Allow(context.Background(), "message", call[0], call[1], call[2])
+			}
+			if allowed != tt.allowed {
+				t.Fatalf("got %v, want %v", allowed, tt.allowed)
+			}
+			if !allowed && retryAfter <= 0 {
+				t.Errorf("refusal without a retry delay")
+			}
+
+			// Other events are not limited
+			if ok, _ := l.Allow(context.Background(), "typing", "s1", "alice", "general"); !ok {
+				t.Error("unconfigured event was limited")
+			}
+		})
+	}
+}
+
+func TestRateLimiterForgetSession(t *testing.T) {
+	r, _ := newTestRedis(t)
+	cfg := config.RateLimitConfig{Enabled: true, Events: map[string]config.EventLimits{
+		"message": {Session: config.RateLimit{Rate: 0.001, Burst: 1}},
+	}}
+	l := NewRateLimiter(cfg, r, testLogger())
+	ctx := context.Background()
+
+	l.Allow(ctx, "message", "s1", "", "")
+	if ok, _ := l.Allow(ctx, "message", "s1", "", ""); ok {
+		t.Fatal("second message allowed")
+	}
+	l.ForgetSession("s1")
+	if ok, _ := l.Allow(ctx, "message", "s1", "", ""); !ok {
+		t.Error("forgotten session still limited")
+	}
+}
+
+func TestRateLimiterDisabledAndRedisDown(t *testing.T) {
+	r, mr := newTestRedis(t)
+	events := map[string]config.EventLimits{"message": {User: config.RateLimit{Rate: 0.001, Burst: 1}}}
+	ctx := context.Background()
+
+	disabled := NewRateLimiter(config.RateLimitConfig{Events: events}, r, testLogger())
+	for i := 0; i < 3; i++ {
+		if ok, _ := disabled.Allow(ctx, "message", "s1", "alice", ""); !ok {
+			t.Fatal("disabled limiter refused an event")
+		}
+	}
+
+	// Shared buckets let traffic through while Redis is unavailable
+	l := NewRateLimiter(config.RateLimitConfig{Enabled: true, Events: events}, r, testLogger())
+	mr.Close()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(ctx, "message", "s1", "alice", ""); !ok {
+			t.Fatal("event refused while Redis is down")
+		}
+	}
+}
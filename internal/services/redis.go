@@ -2,8 +2,13 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"im-demo/internal/config"
@@ -13,6 +18,39 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// messageRetention is how long regular messages are kept
+	messageRetention = 24 * time.Hour
+	// ephemeralGrace keeps expired payloads readable until the sweeper runs
+	ephemeralGrace = time.Minute
+	// ephemeralMessagesKey is a sorted set of message IDs scored by expiry time
+	ephemeralMessagesKey = "ephemeral_messages"
+	// blobsKey is a sorted set of content hashes scored by when each blob
+	// should next be checked for remaining references
+	blobsKey = "blobs"
+	// uploadsKey is a sorted set of chunked upload IDs scored by expiry time
+	uploadsKey = "uploads"
+	// uploadRetention keeps the state of an expired upload until the
+	// collector has released its chunks and quota
+	uploadRetention = 24 * time.Hour
+	// reportRetention is how long is remembered who reported a message
+	reportRetention = 30 * 24 * time.Hour
+	// nodesKey is the set of node IDs that have sent heartbeats
+	nodesKey = "nodes"
+	// controlChannel carries moderation and session control events between nodes
+	controlChannel = "control"
+	// userStateRetention is how long read cursors, muted rooms and drafts
+	// are kept after they last changed
+	userStateRetention = 90 * 24 * time.Hour
+)
+
+// ErrReportNotFound is returned for unknown abuse reports
+var ErrReportNotFound = errors.New("report not found")
+
+// ErrMessageNotFound is returned for messages that expired, were burnt or
+// were deleted
+var ErrMessageNotFound = errors.New("message not found")
+
 // RedisService handles Redis operations
 type RedisService struct {
 	client *redis.Client
@@ -99,21 +137,139 @@ func (r *RedisService) StoreMessage(ctx context.Context, message *models.Message
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	// Store message with 24 hour expiration
-	if err := r.client.Set(ctx, key, data, 24*time.Hour).Err(); err != nil {
+	// Store message with 24 hour expiration, or with its own TTL when ephemeral.
+	// Ephemeral payloads are kept slightly longer than the TTL so the expiry
+	// sweeper can still read them when cleaning up attached files.
+	expiresAt := message.Timestamp.Add(messageRetention)
+	if message.IsEphemeral() {
+		expiresAt = message.ExpiresAt.Add(ephemeralGrace)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, time.Until(expiresAt))
+		if message.IsEphemeral() {
+			pipe.ZAdd(ctx, ephemeralMessagesKey, redis.Z{
+				Score:  float64(message.ExpiresAt.UnixMilli()),
+				Member: message.ID,
+			})
+		}
+
+		// Attached blobs are referenced until the message expires
+		if metadata, err := message.DecodeFileMetadata(); err == nil && metadata.ContentHash != "" {
+			score := float64(expiresAt.UnixMilli())
+			pipe.ZAdd(ctx, blobRefsKey(metadata.ContentHash), redis.Z{Score: score, Member: message.ID})
+			pipe.ZAddGT(ctx, blobsKey, redis.Z{Score: score, Member: metadata.ContentHash})
+		}
+
+		// Users who exchanged direct messages follow each other's presence
+		if message.Receiver != "" && message.Receiver != message.Sender {
+			senderContacts := fmt.Sprintf("dm_contacts:%s", message.Sender)
+			receiverContacts := fmt.Sprintf("dm_contacts:%s", message.Receiver)
+			pipe.SAdd(ctx, senderContacts, message.Receiver)
+			pipe.SAdd(ctx, receiverContacts, message.Sender)
+			pipe.Expire(ctx, senderContacts, userStateRetention)
+			pipe.Expire(ctx, receiverContacts, userStateRetention)
+		}
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("failed to store message: %w", err)
 	}
 
 	return nil
 }
 
+// UpdateMessage overwrites a stored message, keeping its remaining TTL.
+// It returns ErrMessageNotFound if the message is gone.
+func (r *RedisService) UpdateMessage(ctx context.Context, message *models.Message) error {
+	key := fmt.Sprintf("message:%s", message.ID)
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	err = r.client.SetArgs(ctx, key, data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return ErrMessageNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteMessage removes a stored message
+func (r *RedisService) DeleteMessage(ctx context.Context, messageID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, fmt.Sprintf("message:%s", messageID), fmt.Sprintf("message_reads:%s", messageID))
+		pipe.ZRem(ctx, ephemeralMessagesKey, messageID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	return nil
+}
+
+// GetDueEphemeralMessages returns IDs of ephemeral messages whose expiry has passed
+func (r *RedisService) GetDueEphemeralMessages(ctx context.Context, now time.Time, limit int64) ([]string, error) {
+	ids, err := r.client.ZRangeByScore(ctx, ephemeralMessagesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due ephemeral messages: %w", err)
+	}
+	return ids, nil
+}
+
+// ClaimEphemeralMessage removes a message from the expiry schedule. It returns
+// true only for the caller that removed it, so a single node handles each expiry.
+func (r *RedisService) ClaimEphemeralMessage(ctx context.Context, messageID string) (bool, error) {
+	removed, err := r.client.ZRem(ctx, ephemeralMessagesKey, messageID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim ephemeral message: %w", err)
+	}
+	return removed == 1, nil
+}
+
+// ExpireMessageNow reschedules an ephemeral message to expire immediately
+func (r *RedisService) ExpireMessageNow(ctx context.Context, messageID string) error {
+	err := r.client.ZAddXX(ctx, ephemeralMessagesKey, redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: messageID,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to expire message: %w", err)
+	}
+	return nil
+}
+
+// MarkMessageRead records that a user has read a message and returns the readers so far
+func (r *RedisService) MarkMessageRead(ctx context.Context, messageID, userID string, ttl time.Duration) ([]string, error) {
+	key := fmt.Sprintf("message_reads:%s", messageID)
+	var members *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, userID)
+		pipe.Expire(ctx, key, ttl)
+		members = pipe.SMembers(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark message read: %w", err)
+	}
+	return members.Val(), nil
+}
+
 // GetMessage retrieves a message from Redis
 func (r *RedisService) GetMessage(ctx context.Context, messageID string) (*models.Message, error) {
 	key := fmt.Sprintf("message:%s", messageID)
 	data, err := r.client.Get(ctx, key).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, fmt.Errorf("message not found")
+			return nil, ErrMessageNotFound
 		}
 		return nil, fmt.Errorf("failed to get message: %w", err)
 	}
@@ -126,74 +282,1377 @@ func (r *RedisService) GetMessage(ctx context.Context, messageID string) (*model
 	return &message, nil
 }
 
-// StoreUserSession stores user session information
-func (r *RedisService) StoreUserSession(ctx context.Context, userID, sessionID string) error {
-	key := fmt.Sprintf("user_session:%s", userID)
-	if err := r.client.Set(ctx, key, sessionID, 12*time.Hour).Err(); err != nil {
-		return fmt.Errorf("failed to store user session: %w", err)
+// StoreLinkPreview caches the preview fetched for a URL
+func (r *RedisService) StoreLinkPreview(ctx context.Context, rawURL string, preview *models.LinkPreview, ttl time.Duration) error {
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return fmt.Errorf("failed to marshal link preview: %w", err)
+	}
+
+	if err := r.client.Set(ctx, linkPreviewKey(rawURL), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store link preview: %w", err)
 	}
 	return nil
 }
 
-// GetUserSession retrieves user session information
-func (r *RedisService) GetUserSession(ctx context.Context, userID string) (string, error) {
-	key := fmt.Sprintf("user_session:%s", userID)
-	sessionID, err := r.client.Get(ctx, key).Result()
+// GetLinkPreview retrieves a cached link preview
+func (r *RedisService) GetLinkPreview(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	data, err := r.client.Get(ctx, linkPreviewKey(rawURL)).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return "", fmt.Errorf("user session not found")
+			return nil, fmt.Errorf("link preview not found")
 		}
-		return "", fmt.Errorf("failed to get user session: %w", err)
+		return nil, fmt.Errorf("failed to get link preview: %w", err)
 	}
-	return sessionID, nil
+
+	var preview models.LinkPreview
+	if err := json.Unmarshal([]byte(data), &preview); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal link preview: %w", err)
+	}
+
+	return &preview, nil
 }
 
-// DeleteUserSession deletes user session information
-func (r *RedisService) DeleteUserSession(ctx context.Context, userID string) error {
-	key := fmt.Sprintf("user_session:%s", userID)
-	if err := r.client.Del(ctx, key).Err(); err != nil {
-		return fmt.Errorf("failed to delete user session: %w", err)
+// linkPreviewKey returns the cache key for a URL
+func linkPreviewKey(rawURL string) string {
+	sum := sha1.Sum([]byte(rawURL))
+	return fmt.Sprintf("link_preview:%s", hex.EncodeToString(sum[:]))
+}
+
+// uploadSessionKey returns the key holding the state of a chunked upload
+func uploadSessionKey(uploadID string) string {
+	return fmt.Sprintf("upload_session:%s", uploadID)
+}
+
+// userUploadsKey returns the sorted set of a user's chunked uploads, scored
+// by when each expires
+func userUploadsKey(userID string) string {
+	return fmt.Sprintf("user_uploads:%s", userID)
+}
+
+// openUploadScript stores a new chunked upload unless the user already has
+// ARGV[3] unexpired uploads. Expired uploads no longer count; the collector
+// removes them.
+var openUploadScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if tonumber(ARGV[3]) > 0 and redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[4])
+redis.call('SET', KEYS[3], ARGV[5], 'PX', ARGV[6])
+return 1
+`)
+
+// OpenUploadSession stores the state of a new chunked upload, reporting
+// false if the sender already has limit uploads in progress
+func (r *RedisService) OpenUploadSession(ctx context.Context, session *models.UploadSession, ttl time.Duration, limit int) (bool, error) {
+	now := time.Now()
+	session.ExpiresAt = now.Add(ttl)
+	data, err := json.Marshal(session)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal upload session: %w", err)
+	}
+
+	keys := []string{userUploadsKey(session.Sender), uploadsKey, uploadSessionKey(session.ID)}
+	opened, err := openUploadScript.Run(ctx, r.client, keys, now.UnixMilli(), session.ExpiresAt.UnixMilli(),
+		limit, session.ID, data, (ttl + uploadRetention).Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to open upload session: %w", err)
+	}
+	return opened == 1, nil
+}
+
+// StoreUploadSession stores the state of a chunked upload and extends its
+// lifetime by ttl. The state outlives the upload so that the collector can
+// release what it holds.
+func (r *RedisService) StoreUploadSession(ctx context.Context, session *models.UploadSession, ttl time.Duration) error {
+	extended := *session
+	extended.ExpiresAt = time.Now().Add(ttl)
+	data, err := json.Marshal(&extended)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload session: %w", err)
 	}
+
+	expiry := float64(extended.ExpiresAt.UnixMilli())
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, uploadSessionKey(session.ID), data, ttl+uploadRetention)
+		pipe.ZAdd(ctx, uploadsKey, redis.Z{Score: expiry, Member: session.ID})
+		pipe.ZAdd(ctx, userUploadsKey(session.Sender), redis.Z{Score: expiry, Member: session.ID})
+		pipe.PExpire(ctx, userUploadsKey(session.Sender), ttl+uploadRetention)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store upload session: %w", err)
+	}
+
+	session.ExpiresAt = extended.ExpiresAt
 	return nil
 }
 
-// StoreRoomMembers stores room members
-func (r *RedisService) StoreRoomMembers(ctx context.Context, roomID string, members []string) error {
-	key := fmt.Sprintf("room_members:%s", roomID)
-	if err := r.client.SAdd(ctx, key, members).Err(); err != nil {
-		return fmt.Errorf("failed to store room members: %w", err)
+// RecordUploadChunk advances a chunked upload past a chunk of size bytes
+// that has been stored
+func (r *RedisService) RecordUploadChunk(ctx context.Context, session *models.UploadSession, size int64, ttl time.Duration) error {
+	advanced := *session
+	advanced.Offset += size
+	advanced.Chunks++
+	if err := r.StoreUploadSession(ctx, &advanced, ttl); err != nil {
+		return err
 	}
+
+	*session = advanced
 	return nil
 }
 
-// GetRoomMembers retrieves room members
-func (r *RedisService) GetRoomMembers(ctx context.Context, roomID string) ([]string, error) {
-	key := fmt.Sprintf("room_members:%s", roomID)
-	members, err := r.client.SMembers(ctx, key).Result()
+// GetUploadSession retrieves the state of a chunked upload that has not
+// expired
+func (r *RedisService) GetUploadSession(ctx context.Context, uploadID string) (*models.UploadSession, error) {
+	data, err := r.client.Get(ctx, uploadSessionKey(uploadID)).Result()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get room members: %w", err)
+		if err == redis.Nil {
+			return nil, fmt.Errorf("upload session not found")
+		}
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
 	}
-	return members, nil
+
+	var session models.UploadSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload session: %w", err)
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("upload session expired")
+	}
+
+	return &session, nil
 }
 
-// AddUserToRoom adds a user to a room
-func (r *RedisService) AddUserToRoom(ctx context.Context, roomID, userID string) error {
-	key := fmt.Sprintf("room_members:%s", roomID)
-	if err := r.client.SAdd(ctx, key, userID).Err(); err != nil {
-		return fmt.Errorf("failed to add user to room: %w", err)
+// DeleteUploadSession deletes the state of a chunked upload
+func (r *RedisService) DeleteUploadSession(ctx context.Context, session *models.UploadSession) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, uploadSessionKey(session.ID))
+		pipe.ZRem(ctx, uploadsKey, session.ID)
+		pipe.ZRem(ctx, userUploadsKey(session.Sender), session.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
 	}
 	return nil
 }
 
-// RemoveUserFromRoom removes a user from a room
-func (r *RedisService) RemoveUserFromRoom(ctx context.Context, roomID, userID string) error {
-	key := fmt.Sprintf("room_members:%s", roomID)
-	if err := r.client.SRem(ctx, key, userID).Err(); err != nil {
-		return fmt.Errorf("failed to remove user from room: %w", err)
+// GetDueUploads returns IDs of chunked uploads that expired before now
+func (r *RedisService) GetDueUploads(ctx context.Context, now time.Time, limit int64) ([]string, error) {
+	ids, err := r.client.ZRangeByScore(ctx, uploadsKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due uploads: %w", err)
+	}
+	return ids, nil
+}
+
+// claimUploadScript removes an upload from the expiry schedule if it is
+// still due, and returns its state. An upload resumed since it was found
+// due is left alone.
+var claimUploadScript = redis.NewScript(`
+local expiry = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not expiry or tonumber(expiry) > tonumber(ARGV[2]) then
+	return false
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+return redis.call('GET', KEYS[2]) or ''
+`)
+
+// ClaimUpload takes an expired upload off the schedule and returns its
+// state for the caller to discard. It returns nil if the upload was resumed
+// or another node claimed it, and an empty session if its state is gone.
+func (r *RedisService) ClaimUpload(ctx context.Context, uploadID string, now time.Time) (*models.UploadSession, error) {
+	keys := []string{uploadsKey, uploadSessionKey(uploadID)}
+	data, err := claimUploadScript.Run(ctx, r.client, keys, uploadID, now.UnixMilli()).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim upload: %w", err)
+	}
+
+	session := models.UploadSession{ID: uploadID}
+	if data == "" {
+		return &session, nil
+	}
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload session: %w", err)
+	}
+	return &session, nil
+}
+
+// unlockScript deletes a lock only while it still holds the caller's token,
+// so a holder whose lock expired cannot release a lock taken since
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// acquireLock takes a lock that expires after ttl. It returns the token
+// that releases it, or an empty token if the lock is held elsewhere.
+func (r *RedisService) acquireLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token := rand.Text()
+	locked, err := r.client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !locked {
+		return "", err
+	}
+	return token, nil
+}
+
+// releaseLock releases a lock taken by acquireLock with token
+func (r *RedisService) releaseLock(ctx context.Context, key, token string) error {
+	return unlockScript.Run(ctx, r.client, []string{key}, token).Err()
+}
+
+// LockUpload takes the lock that serializes changes to a chunked upload
+// across nodes. It returns the token that releases the lock, or an empty
+// token if another node holds it.
+func (r *RedisService) LockUpload(ctx context.Context, uploadID string, ttl time.Duration) (string, error) {
+	token, err := r.acquireLock(ctx, fmt.Sprintf("upload_lock:%s", uploadID), ttl)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock upload: %w", err)
+	}
+	return token, nil
+}
+
+// UnlockUpload releases a lock taken by LockUpload
+func (r *RedisService) UnlockUpload(ctx context.Context, uploadID, token string) error {
+	if err := r.releaseLock(ctx, fmt.Sprintf("upload_lock:%s", uploadID), token); err != nil {
+		return fmt.Errorf("failed to unlock upload: %w", err)
+	}
+	return nil
+}
+
+// reserveQuotaScript adds to a usage counter unless that would exceed the
+// limit. The window starts with the first reservation.
+var reserveQuotaScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used + tonumber(ARGV[1]) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// ReserveUploadQuota reserves size bytes of an upload quota, reporting
+// whether the reservation fit within limit for the current window
+func (r *RedisService) ReserveUploadQuota(ctx context.Context, scope string, size, limit int64, window time.Duration) (bool, error) {
+	key := fmt.Sprintf("upload_quota:%s", scope)
+	reserved, err := reserveQuotaScript.Run(ctx, r.client, []string{key}, size, limit, window.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve upload quota: %w", err)
+	}
+	return reserved == 1, nil
+}
+
+// releaseQuotaScript gives bytes back to a usage counter without going below
+// zero. A counter whose window has ended is not recreated.
+var releaseQuotaScript = redis.NewScript(`
+local used = redis.call('GET', KEYS[1])
+if not used then
+	return 0
+end
+local left = math.max(tonumber(used) - tonumber(ARGV[1]), 0)
+redis.call('SET', KEYS[1], left, 'KEEPTTL')
+return 1
+`)
+
+// ReleaseUploadQuota returns bytes reserved for an upload that was not stored
+func (r *RedisService) ReleaseUploadQuota(ctx context.Context, scope string, size int64) error {
+	key := fmt.Sprintf("upload_quota:%s", scope)
+	if err := releaseQuotaScript.Run(ctx, r.client, []string{key}, size).Err(); err != nil {
+		return fmt.Errorf("failed to release upload quota: %w", err)
+	}
+	return nil
+}
+
+// blobKey returns the key holding the metadata of a stored blob
+func blobKey(hash string) string {
+	return fmt.Sprintf("blob:%s", hash)
+}
+
+// blobRefsKey returns the sorted set of messages referencing a blob, scored
+// by when each message expires
+func blobRefsKey(hash string) string {
+	return fmt.Sprintf("blob_refs:%s", hash)
+}
+
+// GetBlob returns the metadata of a stored blob and marks it as in use, so
+// the garbage collector leaves it alone while a new message is created
+func (r *RedisService) GetBlob(ctx context.Context, hash string) (*models.FileMetadata, error) {
+	// Touch before reading: a blob collected in between is then seen as missing
+	err := r.client.ZAddGT(ctx, blobsKey, redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: hash,
+	}).Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to touch blob: %w", err)
+	}
+
+	data, err := r.client.Get(ctx, blobKey(hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrBlobNotFound
+		}
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	var metadata models.FileMetadata
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blob: %w", err)
+	}
+	return &metadata, nil
+}
+
+// StoreBlob records the metadata of a newly stored blob
+func (r *RedisService) StoreBlob(ctx context.Context, hash string, metadata *models.FileMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blob: %w", err)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, blobKey(hash), data, 0)
+		pipe.ZAddGT(ctx, blobsKey, redis.Z{
+			Score:  float64(time.Now().UnixMilli()),
+			Member: hash,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	return nil
+}
+
+// ReleaseBlob drops a message's reference to a blob and schedules the blob
+// to be checked by the garbage collector
+func (r *RedisService) ReleaseBlob(ctx context.Context, hash, messageID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, blobRefsKey(hash), messageID)
+		pipe.ZAddXX(ctx, blobsKey, redis.Z{
+			Score:  float64(time.Now().UnixMilli()),
+			Member: hash,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release blob: %w", err)
+	}
+	return nil
+}
+
+// GetDueBlobs returns hashes of blobs that were last used before cutoff
+func (r *RedisService) GetDueBlobs(ctx context.Context, cutoff time.Time, limit int64) ([]string, error) {
+	hashes, err := r.client.ZRangeByScore(ctx, blobsKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(cutoff.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due blobs: %w", err)
+	}
+	return hashes, nil
+}
+
+// claimBlobScript removes a blob's record if it is unused: it must not have
+// been touched since the cutoff and every referencing message must have
+// expired. Blobs still referenced are rescheduled for when their last
+// reference expires.
+var claimBlobScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[3]) then
+	return false
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', ARGV[2])
+local last = redis.call('ZRANGE', KEYS[3], -1, -1, 'WITHSCORES')
+if #last > 0 then
+	redis.call('ZADD', KEYS[1], last[2], ARGV[1])
+	return false
+end
+local data = redis.call('GET', KEYS[2]) or ''
+redis.call('DEL', KEYS[2], KEYS[3])
+redis.call('ZREM', KEYS[1], ARGV[1])
+return data
+`)
+
+// ClaimBlob deletes the record of an unreferenced blob and returns its
+// metadata so the caller can remove the stored files. It returns nil if the
+// blob is still in use.
+func (r *RedisService) ClaimBlob(ctx context.Context, hash string, cutoff time.Time) (*models.FileMetadata, error) {
+	keys := []string{blobsKey, blobKey(hash), blobRefsKey(hash)}
+	data, err := claimBlobScript.Run(ctx, r.client, keys, hash, time.Now().UnixMilli(), cutoff.UnixMilli()).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to claim blob: %w", err)
+	}
+
+	var metadata models.FileMetadata
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal blob: %w", err)
+		}
+	}
+	return &metadata, nil
+}
+
+// LockBlob takes the lock that serializes writing and collecting a blob. It
+// returns the token that releases the lock, or an empty token if another
+// node holds it.
+func (r *RedisService) LockBlob(ctx context.Context, hash string, ttl time.Duration) (string, error) {
+	token, err := r.acquireLock(ctx, fmt.Sprintf("blob_lock:%s", hash), ttl)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock blob: %w", err)
+	}
+	return token, nil
+}
+
+// UnlockBlob releases a lock taken by LockBlob
+func (r *RedisService) UnlockBlob(ctx context.Context, hash, token string) error {
+	if err := r.releaseLock(ctx, fmt.Sprintf("blob_lock:%s", hash), token); err != nil {
+		return fmt.Errorf("failed to unlock blob: %w", err)
+	}
+	return nil
+}
+
+// takeTokenScript takes one token from a bucket refilled at ARGV[1] tokens
+// per second up to ARGV[2]. It returns whether a token was taken and, if
+// not, how many milliseconds until one is available. Redis' clock is used so
+// that all nodes agree on elapsed time.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+// TakeRateLimitToken takes a token from a shared rate limit bucket
+func (r *RedisService) TakeRateLimitToken(ctx context.Context, bucket string, rate float64, burst int) (bool, time.Duration, error) {
+	key := fmt.Sprintf("rate_limit:%s", bucket)
+	result, err := takeTokenScript.Run(ctx, r.client, []string{key}, rate, burst).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// CountRepeatedMessage counts how often a sender sent the same content to
+// a conversation within the window, including this time
+func (r *RedisService) CountRepeatedMessage(ctx context.Context, sender, conversation, contentHash string, window time.Duration) (int64, error) {
+	key := fmt.Sprintf("flood:%s:%s:%s", sender, conversation, contentHash)
+
+	var count *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, key)
+		pipe.ExpireNX(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count repeated message: %w", err)
+	}
+	return count.Val(), nil
+}
+
+// AddMessageReporter records that a user reported a message, reporting
+// false if they already had
+func (r *RedisService) AddMessageReporter(ctx context.Context, messageID, reporter string) (bool, error) {
+	key := fmt.Sprintf("message_reporters:%s", messageID)
+
+	var added *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		added = pipe.SAdd(ctx, key, reporter)
+		pipe.Expire(ctx, key, reportRetention)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to add message reporter: %w", err)
+	}
+	return added.Val() == 1, nil
+}
+
+// reportsKey returns the sorted set of reports in a state, scored by creation time
+func reportsKey(status models.ReportStatus) string {
+	return fmt.Sprintf("reports:%s", status)
+}
+
+// StoreReport stores an abuse report and files it under its status
+func (r *RedisService) StoreReport(ctx context.Context, report *models.MessageReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("report:%s", report.ID), data, 0)
+		for _, status := range []models.ReportStatus{models.ReportOpen, models.ReportResolved} {
+			if status != report.Status {
+				pipe.ZRem(ctx, reportsKey(status), report.ID)
+			}
+		}
+		pipe.ZAdd(ctx, reportsKey(report.Status), redis.Z{
+			Score:  float64(report.CreatedAt.UnixMilli()),
+			Member: report.ID,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store report: %w", err)
 	}
 	return nil
 }
 
+// GetReport retrieves an abuse report
+func (r *RedisService) GetReport(ctx context.Context, reportID string) (*models.MessageReport, error) {
+	data, err := r.client.Get(ctx, fmt.Sprintf("report:%s", reportID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrReportNotFound
+		}
+		return nil, fmt.Errorf("failed to get report: %w", err)
+	}
+
+	var report models.MessageReport
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal report: %w", err)
+	}
+	return &report, nil
+}
+
+// ListReports returns the most recent reports in a state, newest first
+func (r *RedisService) ListReports(ctx context.Context, status models.ReportStatus, limit int64) ([]*models.MessageReport, error) {
+	ids, err := r.client.ZRevRange(ctx, reportsKey(status), 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reports: %w", err)
+	}
+	if len(ids) == 0 {
+		return []*models.MessageReport{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("report:%s", id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reports: %w", err)
+	}
+
+	reports := make([]*models.MessageReport, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var report models.MessageReport
+		if err := json.Unmarshal([]byte(data), &report); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal report")
+			continue
+		}
+		reports = append(reports, &report)
+	}
+	return reports, nil
+}
+
+// sanctionKey returns the key holding a sanction on a user
+func sanctionKey(kind models.SanctionKind, userName string) string {
+	return fmt.Sprintf("sanction:%s:%s", kind, userName)
+}
+
+// SetSanction stores a sanction, which lifts itself when it has an end
+func (r *RedisService) SetSanction(ctx context.Context, sanction *models.Sanction) error {
+	data, err := json.Marshal(sanction)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sanction: %w", err)
+	}
+
+	var ttl time.Duration
+	if sanction.Until != nil {
+		ttl = time.Until(*sanction.Until)
+	}
+	if err := r.client.Set(ctx, sanctionKey(sanction.Kind, sanction.UserName), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set sanction: %w", err)
+	}
+	return nil
+}
+
+// ClearSanction lifts a sanction, reporting whether there was one
+func (r *RedisService) ClearSanction(ctx context.Context, kind models.SanctionKind, userName string) (bool, error) {
+	deleted, err := r.client.Del(ctx, sanctionKey(kind, userName)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to clear sanction: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// GetSanctions returns the sanctions in effect on a user
+func (r *RedisService) GetSanctions(ctx context.Context, userName string) ([]*models.Sanction, error) {
+	values, err := r.client.MGet(ctx,
+		sanctionKey(models.SanctionBan, userName),
+		sanctionKey(models.SanctionMute, userName),
+	).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sanctions: %w", err)
+	}
+
+	var sanctions []*models.Sanction
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var sanction models.Sanction
+		if err := json.Unmarshal([]byte(data), &sanction); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sanction: %w", err)
+		}
+		sanctions = append(sanctions, &sanction)
+	}
+	return sanctions, nil
+}
+
+// PublishControl sends a control event to every node
+func (r *RedisService) PublishControl(ctx context.Context, event *models.ControlEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal control event: %w", err)
+	}
+
+	if err := r.client.Publish(ctx, controlChannel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish control event: %w", err)
+	}
+	return nil
+}
+
+// SubscribeToControl delivers control events published by any node,
+// including this one, to the callback
+func (r *RedisService) SubscribeToControl(ctx context.Context, callback func(*models.ControlEvent)) {
+	go func() {
+		pubsub := r.client.Subscribe(ctx, controlChannel)
+		defer pubsub.Close()
+
+		if _, err := pubsub.Receive(ctx); err != nil {
+			r.logger.WithError(err).Error("Failed to subscribe to control channel")
+			return
+		}
+
+		r.logger.WithField("channel", controlChannel).Info("Subscribed to Redis channel")
+
+		for msg := range pubsub.Channel() {
+			var event models.ControlEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				r.logger.WithError(err).Error("Failed to unmarshal control event")
+				continue
+			}
+
+			callback(&event)
+		}
+	}()
+}
+
+// nodeSessionsKey returns the hash of sessions connected to a node
+func nodeSessionsKey(nodeID string) string {
+	return fmt.Sprintf("node_sessions:%s", nodeID)
+}
+
+// RegisterSession adds a connected device to the session registry
+func (r *RedisService) RegisterSession(ctx context.Context, info *models.SessionInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	if err := r.client.HSet(ctx, nodeSessionsKey(info.NodeID), info.SessionID, data).Err(); err != nil {
+		return fmt.Errorf("failed to register session: %w", err)
+	}
+	return nil
+}
+
+// UnregisterSession removes a disconnected device from the session registry
+func (r *RedisService) UnregisterSession(ctx context.Context, nodeID, sessionID string) error {
+	if err := r.client.HDel(ctx, nodeSessionsKey(nodeID), sessionID).Err(); err != nil {
+		return fmt.Errorf("failed to unregister session: %w", err)
+	}
+	return nil
+}
+
+// GetNodeSessions returns the sessions connected to a node
+func (r *RedisService) GetNodeSessions(ctx context.Context, nodeID string) ([]*models.SessionInfo, error) {
+	values, err := r.client.HVals(ctx, nodeSessionsKey(nodeID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node sessions: %w", err)
+	}
+
+	sessions := make([]*models.SessionInfo, 0, len(values))
+	for _, data := range values {
+		var info models.SessionInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal session")
+			continue
+		}
+		sessions = append(sessions, &info)
+	}
+	return sessions, nil
+}
+
+// GetClusterSessions returns the sessions connected to every live node
+func (r *RedisService) GetClusterSessions(ctx context.Context) ([]*models.SessionInfo, error) {
+	nodes, err := r.GetNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*models.SessionInfo
+	for _, node := range nodes {
+		nodeSessions, err := r.GetNodeSessions(ctx, node.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, nodeSessions...)
+	}
+	return sessions, nil
+}
+
+// LockUserDevices takes the lock that serializes logins of a user while
+// device limits are enforced. It returns the token that releases the lock,
+// or an empty token if another node holds it.
+func (r *RedisService) LockUserDevices(ctx context.Context, userID string, ttl time.Duration) (string, error) {
+	token, err := r.acquireLock(ctx, fmt.Sprintf("device_lock:%s", userID), ttl)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock user devices: %w", err)
+	}
+	return token, nil
+}
+
+// UnlockUserDevices releases a lock taken by LockUserDevices
+func (r *RedisService) UnlockUserDevices(ctx context.Context, userID, token string) error {
+	if err := r.releaseLock(ctx, fmt.Sprintf("device_lock:%s", userID), token); err != nil {
+		return fmt.Errorf("failed to unlock user devices: %w", err)
+	}
+	return nil
+}
+
+// RevokeSession marks a session as signed out for the remaining lifetime of
+// its tokens, which the REST API then refuses
+func (r *RedisService) RevokeSession(ctx context.Context, sessionID string, ttl time.Duration) error {
+	key := fmt.Sprintf("revoked_session:%s", sessionID)
+	if err := r.client.Set(ctx, key, 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// IsSessionRevoked reports whether a session has been revoked
+func (r *RedisService) IsSessionRevoked(ctx context.Context, sessionID string) (bool, error) {
+	key := fmt.Sprintf("revoked_session:%s", sessionID)
+	n, err := r.client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check session revocation: %w", err)
+	}
+	return n > 0, nil
+}
+
+// StoreNodeStatus records a node's heartbeat. A node whose status expires
+// is considered gone.
+func (r *RedisService) StoreNodeStatus(ctx context.Context, status *models.NodeStatus, ttl time.Duration) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node status: %w", err)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("node:%s", status.NodeID), data, ttl)
+		pipe.SAdd(ctx, nodesKey, status.NodeID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store node status: %w", err)
+	}
+	return nil
+}
+
+// RemoveNode forgets a node and the sessions registered by it
+func (r *RedisService) RemoveNode(ctx context.Context, nodeID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, fmt.Sprintf("node:%s", nodeID), nodeSessionsKey(nodeID))
+		pipe.SRem(ctx, nodesKey, nodeID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove node: %w", err)
+	}
+	return nil
+}
+
+// GetNodes returns the status of every live node. Nodes that stopped
+// sending heartbeats are removed along with their sessions.
+func (r *RedisService) GetNodes(ctx context.Context) ([]*models.NodeStatus, error) {
+	ids, err := r.client.SMembers(ctx, nodesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(ids) == 0 {
+		return []*models.NodeStatus{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("node:%s", id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node status: %w", err)
+	}
+
+	nodes := make([]*models.NodeStatus, 0, len(ids))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			if err := r.RemoveNode(ctx, ids[i]); err != nil {
+				r.logger.WithError(err).Warn("Failed to remove dead node")
+			}
+			continue
+		}
+		var status models.NodeStatus
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal node status")
+			continue
+		}
+		nodes = append(nodes, &status)
+	}
+	return nodes, nil
+}
+
+// StoreUserSession stores user session information
+func (r *RedisService) StoreUserSession(ctx context.Context, userID, sessionID string) error {
+	key := fmt.Sprintf("user_session:%s", userID)
+	if err := r.client.Set(ctx, key, sessionID, 12*time.Hour).Err(); err != nil {
+		return fmt.Errorf("failed to store user session: %w", err)
+	}
+	return nil
+}
+
+// GetUserSession retrieves user session information
+func (r *RedisService) GetUserSession(ctx context.Context, userID string) (string, error) {
+	key := fmt.Sprintf("user_session:%s", userID)
+	sessionID, err := r.client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", fmt.Errorf("user session not found")
+		}
+		return "", fmt.Errorf("failed to get user session: %w", err)
+	}
+	return sessionID, nil
+}
+
+// DeleteUserSession deletes user session information
+func (r *RedisService) DeleteUserSession(ctx context.Context, userID string) error {
+	key := fmt.Sprintf("user_session:%s", userID)
+	if err := r.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete user session: %w", err)
+	}
+	return nil
+}
+
+// SetUserStatus stores the status a user chose, until it expires
+func (r *RedisService) SetUserStatus(ctx context.Context, userID string, status *models.UserStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user status: %w", err)
+	}
+
+	var ttl time.Duration
+	if status.ExpiresAt != nil {
+		ttl = time.Until(*status.ExpiresAt)
+	}
+	if err := r.client.Set(ctx, fmt.Sprintf("user_status:%s", userID), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set user status: %w", err)
+	}
+	return nil
+}
+
+// ClearUserStatus removes the status a user chose
+func (r *RedisService) ClearUserStatus(ctx context.Context, userID string) error {
+	if err := r.client.Del(ctx, fmt.Sprintf("user_status:%s", userID)).Err(); err != nil {
+		return fmt.Errorf("failed to clear user status: %w", err)
+	}
+	return nil
+}
+
+// GetUserStatus returns the status a user chose, or nil if they have none
+func (r *RedisService) GetUserStatus(ctx context.Context, userID string) (*models.UserStatus, error) {
+	data, err := r.client.Get(ctx, fmt.Sprintf("user_status:%s", userID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user status: %w", err)
+	}
+
+	var status models.UserStatus
+	if err := json.Unmarshal([]byte(data), &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user status: %w", err)
+	}
+	return &status, nil
+}
+
+// SetLastSeen records when a user was last seen online
+func (r *RedisService) SetLastSeen(ctx context.Context, userID string, lastSeen time.Time) error {
+	key := fmt.Sprintf("last_seen:%s", userID)
+	if err := r.client.Set(ctx, key, lastSeen.UnixMilli(), userStateRetention).Err(); err != nil {
+		return fmt.Errorf("failed to set last seen: %w", err)
+	}
+	return nil
+}
+
+// GetLastSeen returns when a user was last seen online, or nil if unknown
+func (r *RedisService) GetLastSeen(ctx context.Context, userID string) (*time.Time, error) {
+	millis, err := r.client.Get(ctx, fmt.Sprintf("last_seen:%s", userID)).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get last seen: %w", err)
+	}
+	lastSeen := time.UnixMilli(millis)
+	return &lastSeen, nil
+}
+
+// storePresenceScript stores a presence snapshot and reports whether it
+// differs from the previous one
+var storePresenceScript = redis.NewScript(`
+local previous = redis.call('GET', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+if previous == ARGV[1] then
+	return 0
+end
+return 1
+`)
+
+// StorePresence stores the presence of an online user, reporting whether
+// it changed. Snapshots that are not refreshed expire, after which the
+// user is reported offline.
+func (r *RedisService) StorePresence(ctx context.Context, presence *models.Presence, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal presence: %w", err)
+	}
+
+	key := fmt.Sprintf("presence:%s", presence.UserName)
+	changed, err := storePresenceScript.Run(ctx, r.client, []string{key}, data, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to store presence: %w", err)
+	}
+	return changed == 1, nil
+}
+
+// announcePresenceScript records the presence last announced to a user's
+// audience and reports whether it differs from the one before
+var announcePresenceScript = redis.NewScript(`
+local previous = redis.call('GET', KEYS[1])
+if previous == ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// AnnouncePresence records that a presence is being announced, reporting
+// whether it differs from the last one announced by any node
+func (r *RedisService) AnnouncePresence(ctx context.Context, presence *models.Presence) (bool, error) {
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal presence: %w", err)
+	}
+
+	key := fmt.Sprintf("presence_announced:%s", presence.UserName)
+	changed, err := announcePresenceScript.Run(ctx, r.client, []string{key}, data, userStateRetention.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to announce presence: %w", err)
+	}
+	return changed == 1, nil
+}
+
+// GetPresences returns the presence of users, in order. Users without a
+// presence snapshot are offline since they were last seen.
+func (r *RedisService) GetPresences(ctx context.Context, userIDs []string) ([]*models.Presence, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, 2*len(userIDs))
+	for _, userID := range userIDs {
+		keys = append(keys, fmt.Sprintf("presence:%s", userID))
+	}
+	for _, userID := range userIDs {
+		keys = append(keys, fmt.Sprintf("last_seen:%s", userID))
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presences: %w", err)
+	}
+
+	presences := make([]*models.Presence, len(userIDs))
+	for i, userID := range userIDs {
+		if data, ok := values[i].(string); ok {
+			var presence models.Presence
+			err := json.Unmarshal([]byte(data), &presence)
+			if err == nil {
+				presences[i] = &presence
+				continue
+			}
+			r.logger.WithError(err).Warn("Failed to unmarshal presence")
+		}
+
+		presences[i] = &models.Presence{UserName: userID, Status: models.PresenceOffline}
+		if data, ok := values[len(userIDs)+i].(string); ok {
+			if millis, err := strconv.ParseInt(data, 10, 64); err == nil {
+				lastSeen := time.UnixMilli(millis)
+				presences[i].LastSeen = &lastSeen
+			}
+		}
+	}
+	return presences, nil
+}
+
+// StoreRoomMembers stores room members
+func (r *RedisService) StoreRoomMembers(ctx context.Context, roomID string, members []string) error {
+	key := fmt.Sprintf("room_members:%s", roomID)
+	if err := r.client.SAdd(ctx, key, members).Err(); err != nil {
+		return fmt.Errorf("failed to store room members: %w", err)
+	}
+	return nil
+}
+
+// GetRoomMembers retrieves room members
+func (r *RedisService) GetRoomMembers(ctx context.Context, roomID string) ([]string, error) {
+	key := fmt.Sprintf("room_members:%s", roomID)
+	members, err := r.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room members: %w", err)
+	}
+	return members, nil
+}
+
+// IsRoomMember reports whether a user is a member of a room
+func (r *RedisService) IsRoomMember(ctx context.Context, roomID, userID string) (bool, error) {
+	key := fmt.Sprintf("room_members:%s", roomID)
+	isMember, err := r.client.SIsMember(ctx, key, userID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check room membership: %w", err)
+	}
+	return isMember, nil
+}
+
+// AddUserToRoom adds a user to a room
+func (r *RedisService) AddUserToRoom(ctx context.Context, roomID, userID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, fmt.Sprintf("room_members:%s", roomID), userID)
+		pipe.SAdd(ctx, fmt.Sprintf("user_rooms:%s", userID), roomID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add user to room: %w", err)
+	}
+	return nil
+}
+
+// RemoveUserFromRoom removes a user from a room
+func (r *RedisService) RemoveUserFromRoom(ctx context.Context, roomID, userID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, fmt.Sprintf("room_members:%s", roomID), userID)
+		pipe.SRem(ctx, fmt.Sprintf("user_rooms:%s", userID), roomID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove user from room: %w", err)
+	}
+	return nil
+}
+
+// GetUserRooms returns the rooms a user has joined
+func (r *RedisService) GetUserRooms(ctx context.Context, userID string) ([]string, error) {
+	rooms, err := r.client.SMembers(ctx, fmt.Sprintf("user_rooms:%s", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user rooms: %w", err)
+	}
+	return rooms, nil
+}
+
+// GetDMContacts returns the users a user has exchanged direct messages with
+func (r *RedisService) GetDMContacts(ctx context.Context, userID string) ([]string, error) {
+	contacts, err := r.client.SMembers(ctx, fmt.Sprintf("dm_contacts:%s", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DM contacts: %w", err)
+	}
+	return contacts, nil
+}
+
+// ShareRoom reports whether two users are members of a common room
+func (r *RedisService) ShareRoom(ctx context.Context, userA, userB string) (bool, error) {
+	rooms, err := r.client.SInter(ctx, fmt.Sprintf("user_rooms:%s", userA), fmt.Sprintf("user_rooms:%s", userB)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check shared rooms: %w", err)
+	}
+	return len(rooms) > 0, nil
+}
+
+// BlockUser adds a user to another user's block list
+func (r *RedisService) BlockUser(ctx context.Context, userID, blockedID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, fmt.Sprintf("blocked:%s", userID), blockedID)
+		pipe.SAdd(ctx, fmt.Sprintf("blocked_by:%s", blockedID), userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+	return nil
+}
+
+// UnblockUser removes a user from another user's block list
+func (r *RedisService) UnblockUser(ctx context.Context, userID, blockedID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, fmt.Sprintf("blocked:%s", userID), blockedID)
+		pipe.SRem(ctx, fmt.Sprintf("blocked_by:%s", blockedID), userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unblock user: %w", err)
+	}
+	return nil
+}
+
+// GetBlockedUsers returns the users a user has blocked
+func (r *RedisService) GetBlockedUsers(ctx context.Context, userID string) ([]string, error) {
+	users, err := r.client.SMembers(ctx, fmt.Sprintf("blocked:%s", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blocked users: %w", err)
+	}
+	return users, nil
+}
+
+// GetBlockers returns the users who have blocked a user
+func (r *RedisService) GetBlockers(ctx context.Context, userID string) ([]string, error) {
+	users, err := r.client.SMembers(ctx, fmt.Sprintf("blocked_by:%s", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blockers: %w", err)
+	}
+	return users, nil
+}
+
+// IsBlocked reports whether a user has blocked another user
+func (r *RedisService) IsBlocked(ctx context.Context, userID, otherID string) (bool, error) {
+	blocked, err := r.client.SIsMember(ctx, fmt.Sprintf("blocked:%s", userID), otherID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check block list: %w", err)
+	}
+	return blocked, nil
+}
+
+// SetDMPrivacy stores who may send direct messages to a user
+func (r *RedisService) SetDMPrivacy(ctx context.Context, userID string, privacy models.DMPrivacy) error {
+	key := fmt.Sprintf("dm_privacy:%s", userID)
+	if err := r.client.Set(ctx, key, string(privacy), 0).Err(); err != nil {
+		return fmt.Errorf("failed to set DM privacy: %w", err)
+	}
+	return nil
+}
+
+// GetDMPrivacy returns who may send direct messages to a user
+func (r *RedisService) GetDMPrivacy(ctx context.Context, userID string) (models.DMPrivacy, error) {
+	key := fmt.Sprintf("dm_privacy:%s", userID)
+	privacy, err := r.client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return models.DMPrivacyEveryone, nil
+		}
+		return "", fmt.Errorf("failed to get DM privacy: %w", err)
+	}
+	return models.DMPrivacy(privacy), nil
+}
+
+// readCursorScript moves a read cursor forward. Positions are message
+// timestamps in milliseconds, kept apart from the cursors so that they
+// can be compared.
+var readCursorScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or '0')
+local position = tonumber(ARGV[2])
+if position < current or (position == current and redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return 1
+`)
+
+// SetReadCursor records the last message a user has read in a conversation,
+// reporting whether the cursor moved. Cursors never move back to older
+// messages.
+func (r *RedisService) SetReadCursor(ctx context.Context, userID, conversationID string, cursor *models.ReadCursor) (bool, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal read cursor: %w", err)
+	}
+
+	keys := []string{fmt.Sprintf("read_cursors:%s", userID), fmt.Sprintf("read_positions:%s", userID)}
+	moved, err := readCursorScript.Run(ctx, r.client, keys, conversationID, cursor.Timestamp.UnixMilli(), data, userStateRetention.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set read cursor: %w", err)
+	}
+	return moved == 1, nil
+}
+
+// addCappedScript adds a member to a set, or a field to a hash when a value
+// is given, unless the key already holds the maximum number of entries
+var addCappedScript = redis.NewScript(`
+local hash = ARGV[4] ~= nil
+local exists, size
+if hash then
+	exists = redis.call('HEXISTS', KEYS[1], ARGV[1])
+	size = redis.call('HLEN', KEYS[1])
+else
+	exists = redis.call('SISMEMBER', KEYS[1], ARGV[1])
+	size = redis.call('SCARD', KEYS[1])
+end
+if exists == 0 and size >= tonumber(ARGV[2]) then
+	return 0
+end
+if hash then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[4])
+else
+	redis.call('SADD', KEYS[1], ARGV[1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// MuteRoom adds a room to a user's muted rooms, reporting whether it fit
+// within limit
+func (r *RedisService) MuteRoom(ctx context.Context, userID, roomID string, limit int) (bool, error) {
+	key := fmt.Sprintf("muted_rooms:%s", userID)
+	added, err := addCappedScript.Run(ctx, r.client, []string{key}, roomID, limit, userStateRetention.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to mute room: %w", err)
+	}
+	return added == 1, nil
+}
+
+// UnmuteRoom removes a room from a user's muted rooms
+func (r *RedisService) UnmuteRoom(ctx context.Context, userID, roomID string) error {
+	key := fmt.Sprintf("muted_rooms:%s", userID)
+	if err := r.client.SRem(ctx, key, roomID).Err(); err != nil {
+		return fmt.Errorf("failed to unmute room: %w", err)
+	}
+	return nil
+}
+
+// SaveDraft stores a user's draft for a conversation, reporting whether it
+// fit within limit
+func (r *RedisService) SaveDraft(ctx context.Context, userID, conversationID string, draft *models.Draft, limit int) (bool, error) {
+	data, err := json.Marshal(draft)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal draft: %w", err)
+	}
+
+	key := fmt.Sprintf("drafts:%s", userID)
+	saved, err := addCappedScript.Run(ctx, r.client, []string{key}, conversationID, limit, userStateRetention.Milliseconds(), data).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save draft: %w", err)
+	}
+	return saved == 1, nil
+}
+
+// DeleteDraft removes a user's draft for a conversation
+func (r *RedisService) DeleteDraft(ctx context.Context, userID, conversationID string) error {
+	key := fmt.Sprintf("drafts:%s", userID)
+	if err := r.client.HDel(ctx, key, conversationID).Err(); err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+	return nil
+}
+
+// GetUserState returns the read cursors, muted rooms, drafts and status of
+// a user
+func (r *RedisService) GetUserState(ctx context.Context, userID string) (*models.UserState, error) {
+	var cursors, drafts *redis.MapStringStringCmd
+	var muted *redis.StringSliceCmd
+	var status *redis.StringCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		cursors = pipe.HGetAll(ctx, fmt.Sprintf("read_cursors:%s", userID))
+		muted = pipe.SMembers(ctx, fmt.Sprintf("muted_rooms:%s", userID))
+		drafts = pipe.HGetAll(ctx, fmt.Sprintf("drafts:%s", userID))
+		status = pipe.Get(ctx, fmt.Sprintf("user_status:%s", userID))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get user state: %w", err)
+	}
+
+	state := &models.UserState{
+		ReadCursors: make(map[string]*models.ReadCursor, len(cursors.Val())),
+		MutedRooms:  muted.Val(),
+		Drafts:      make(map[string]*models.Draft, len(drafts.Val())),
+	}
+	for conversationID, data := range cursors.Val() {
+		var cursor models.ReadCursor
+		if err := json.Unmarshal([]byte(data), &cursor); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal read cursor")
+			continue
+		}
+		state.ReadCursors[conversationID] = &cursor
+	}
+	for conversationID, data := range drafts.Val() {
+		var draft models.Draft
+		if err := json.Unmarshal([]byte(data), &draft); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal draft")
+			continue
+		}
+		state.Drafts[conversationID] = &draft
+	}
+	if data, err := status.Result(); err == nil {
+		var userStatus models.UserStatus
+		if err := json.Unmarshal([]byte(data), &userStatus); err != nil {
+			r.logger.WithError(err).Warn("Failed to unmarshal user status")
+		} else {
+			state.Status = &userStatus
+		}
+	}
+	return state, nil
+}
+
 // SubscribeToMessages subscribes to all message channels
 func (r *RedisService) SubscribeToMessages(ctx context.Context, callback func(*models.Message)) {
 	go func() {
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+	"im-demo/internal/models"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// testLogger returns a logger that discards its output
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// newTestRedis creates a Redis service backed by an in-memory Redis
+func newTestRedis(t testing.TB) (*RedisService, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	cfg := &config.Config{Redis: config.RedisConfig{Addr: mr.Addr()}}
+	r, err := NewRedisService(cfg, testLogger())
+	if err != nil {
+		t.Fatalf("failed to connect to redis: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, mr
+}
+
+func TestUpdateMessage(t *testing.T) {
+	r, mr := newTestRedis(t)
+	ctx := context.Background()
+
+	message := &models.Message{
+		ID:        "m1",
+		Type:      models.TextMessage,
+		Content:   "hello",
+		Sender:    "alice",
+		Timestamp: time.Now(),
+	}
+	if err := r.StoreMessage(ctx, message); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	ttl := mr.TTL("message:m1")
+
+	message.Content = "hello, world"
+	if err := r.UpdateMessage(ctx, message); err != nil {
+		t.Fatalf("failed to update message: %v", err)
+	}
+	stored, err := r.GetMessage(ctx, "m1")
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if stored.Content != "hello, world" {
+		t.Errorf("content = %q, want the updated content", stored.Content)
+	}
+	if got := mr.TTL("message:m1"); got != ttl {
+		t.Errorf("ttl = %s, want %s to be kept", got, ttl)
+	}
+
+	if err := r.DeleteMessage(ctx, "m1"); err != nil {
+		t.Fatalf("failed to delete message: %v", err)
+	}
+	if err := r.UpdateMessage(ctx, message); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("update of a deleted message: got %v, want ErrMessageNotFound", err)
+	}
+	if mr.Exists("message:m1") {
+		t.Error("update recreated a deleted message")
+	}
+}
+
+func TestLockTokens(t *testing.T) {
+	r, mr := newTestRedis(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		lock   func(ttl time.Duration) (string, error)
+		unlock func(token string) error
+		key    string
+	}{
+		{name: "upload", key: "upload_lock:u1",
+			lock:   func(ttl time.Duration) (string, error) { return r.LockUpload(ctx, "u1", ttl) },
+			unlock: func(token string) error { return r.UnlockUpload(ctx, "u1", token) }},
+		{name: "blob", key: "blob_lock:h1",
+			lock:   func(ttl time.Duration) (string, error) { return r.LockBlob(ctx, "h1", ttl) },
+			unlock: func(token string) error { return r.UnlockBlob(ctx, "h1", token) }},
+		{name: "user devices", key: "device_lock:alice",
+			lock:   func(ttl time.Duration) (string, error) { return r.LockUserDevices(ctx, "alice", ttl) },
+			unlock: func(token string) error { return r.UnlockUserDevices(ctx, "alice", token) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale, err := tt.lock(time.Second)
+			if err != nil || stale == "" {
+				t.Fatalf("first lock: %q, %v", stale, err)
+			}
+			if token, _ := tt.lock(time.Second); token != "" {
+				t.Fatal("lock taken twice")
+			}
+
+			// The first holder stalls past its lock and someone else takes it
+			mr.FastForward(2 * time.Second)
+			current, err := tt.lock(time.Minute)
+			if err != nil || current == "" || current == stale {
+				t.Fatalf("second lock: %q, %v", current, err)
+			}
+			if err := tt.unlock(stale); err != nil {
+				t.Fatalf("stale unlock: %v", err)
+			}
+			if !mr.Exists(tt.key) {
+				t.Fatal("a stale holder released the current lock")
+			}
+
+			if err := tt.unlock(current); err != nil {
+				t.Fatalf("unlock: %v", err)
+			}
+			if mr.Exists(tt.key) {
+				t.Error("lock still held after unlocking")
+			}
+		})
+	}
+}
+
+func TestUploadSessions(t *testing.T) {
+	r, _ := newTestRedis(t)
+	ctx := context.Background()
+	const ttl = time.Minute
+
+	open := func(id, sender string) bool {
+		t.Helper()
+		opened, err := r.OpenUploadSession(ctx, &models.UploadSession{ID: id, Sender: sender, FileSize: 10}, ttl, 2)
+		if err != nil {
+			t.Fatalf("failed to open upload: %v", err)
+		}
+		return opened
+	}
+
+	if !open("a1", "alice") || !open("a2", "alice") {
+		t.Fatal("uploads within the limit were refused")
+	}
+	if open("a3", "alice") {
+		t.Error("third upload was opened")
+	}
+	if !open("b1", "bob") {
+		t.Error("another user's upload was refused")
+	}
+
+	session, err := r.GetUploadSession(ctx, "a1")
+	if err != nil {
+		t.Fatalf("failed to get upload: %v", err)
+	}
+	if err := r.RecordUploadChunk(ctx, session, 4, ttl); err != nil {
+		t.Fatalf("failed to record chunk: %v", err)
+	}
+	if stored, _ := r.GetUploadSession(ctx, "a1"); stored.Offset != 4 || stored.Chunks != 1 {
+		t.Errorf("offset %d and %d chunks, want 4 and 1", stored.Offset, stored.Chunks)
+	}
+
+	if err := r.DeleteUploadSession(ctx, session); err != nil {
+		t.Fatalf("failed to delete upload: %v", err)
+	}
+	if !open("a3", "alice") {
+		t.Error("upload refused after another finished")
+	}
+
+	// Expired uploads are claimed once, and not before they expire
+	later := time.Now().Add(2 * ttl)
+	due, err := r.GetDueUploads(ctx, later, 10)
+	if err != nil || len(due) != 3 {
+		t.Fatalf("due uploads %v, %v", due, err)
+	}
+	claimed, err := r.ClaimUpload(ctx, "a2", later)
+	if err != nil || claimed == nil || claimed.Sender != "alice" {
+		t.Fatalf("claimed %+v, %v", claimed, err)
+	}
+	if again, _ := r.ClaimUpload(ctx, "a2", later); again != nil {
+		t.Error("upload claimed twice")
+	}
+	if resumed, _ := r.ClaimUpload(ctx, "b1", time.Now()); resumed != nil {
+		t.Error("upload claimed before it expired")
+	}
+}
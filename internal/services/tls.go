@@ -0,0 +1,157 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"im-demo/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientAuthModes maps the configured client_auth to how client
+// certificates are checked
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// TLSReloader serves the configured certificate and client CA and reloads
+// them when their files change. New handshakes use the new files while
+// established connections keep going.
+type TLSReloader struct {
+	cfg    config.TLSConfig
+	logger *logrus.Logger
+
+	mu       sync.RWMutex
+	current  *tls.Config
+	modTimes map[string]time.Time // file -> modification time when loaded
+}
+
+// NewTLSReloader loads the certificate, and the client CA if any
+func NewTLSReloader(cfg config.TLSConfig, logger *logrus.Logger) (*TLSReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls requires cert_file and key_file")
+	}
+	if _, ok := clientAuthModes[cfg.ClientAuth]; !ok {
+		return nil, fmt.Errorf("unknown client auth: %s", cfg.ClientAuth)
+	}
+	if cfg.ClientAuth != "none" && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("client auth %s requires client_ca_file", cfg.ClientAuth)
+	}
+
+	r := &TLSReloader{cfg: cfg, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a server configuration that always hands out the latest
+// files. nextProtos are offered during ALPN, e.g. "h2" and "http/1.1".
+func (r *TLSReloader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			conf := r.current.Clone()
+			conf.NextProtos = nextProtos
+			return conf, nil
+		},
+	}
+}
+
+// Watch reloads the files whenever they change. A failed reload is logged
+// and the previous files stay in use, so a half-written renewal does not
+// take the server down.
+func (r *TLSReloader) Watch() {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !r.changed() {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			r.logger.WithError(err).Warn("Failed to reload TLS certificates")
+			continue
+		}
+		r.logger.WithField("cert_file", r.cfg.CertFile).Info("TLS certificates reloaded")
+	}
+}
+
+// files lists the files the configuration is loaded from
+func (r *TLSReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// changed reports whether any file was modified since it was loaded
+func (r *TLSReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Missing while being replaced; check again next time
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads the files and swaps in a new configuration
+func (r *TLSReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthModes[r.cfg.ClientAuth],
+	}
+
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+	}
+
+	r.mu.Lock()
+	r.current = conf
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
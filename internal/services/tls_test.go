@@ -0,0 +1,345 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+// testCert is a generated certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert generates a certificate for name, signed by parent or, when
+// parent is nil, a self-signed CA
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// keyPEM encodes the certificate's key
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// tlsPair returns the certificate as a pair usable by a TLS client
+func (c *testCert) tlsPair(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair(c.pem, c.keyPEM(t))
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+	return pair
+}
+
+// writeTestFile writes data to a file and moves its modification time
+// forward by age, as a later write would
+func writeTestFile(t *testing.T, path string, data []byte, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	modTime := time.Now().Add(age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to touch %s: %v", path, err)
+	}
+}
+
+// testTLSFiles writes a server certificate, its key and a client CA and
+// returns a configuration using them
+func testTLSFiles(t *testing.T, server, ca *testCert) config.TLSConfig {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.TLSConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientAuth:   "none",
+	}
+	writeTestFile(t, cfg.CertFile, server.pem, 0)
+	writeTestFile(t, cfg.KeyFile, server.keyPEM(t), 0)
+	writeTestFile(t, cfg.ClientCAFile, ca.pem, 0)
+	return cfg
+}
+
+// servedName returns the common name of the certificate handed out to
+// new connections
+func servedName(t *testing.T, r *TLSReloader) string {
+	t.Helper()
+	conf, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse served certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestNewTLSReloader(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil)
+	valid := testTLSFiles(t, newTestCert(t, "server", ca), ca)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	writeTestFile(t, garbage, []byte("not a certificate"), 0)
+
+	tests := []struct {
+		name      string
+		configure func(*config.TLSConfig)
+		err       string
+	}{
+		{name: "no client auth", configure: func(cfg *config.TLSConfig) {}},
+		{name: "no client CA", configure: func(cfg *config.TLSConfig) { cfg.ClientCAFile = "" }},
+		{name: "request", configure: func(cfg *config.TLSConfig) { cfg.ClientAuth = "request" }},
+		{name: "require", configure: func(cfg *config.TLSConfig) { cfg.ClientAuth = "require" }},
+		{name: "no certificate", configure: func(cfg *config.TLSConfig) { cfg.CertFile = "" }, err: "requires cert_file and key_file"},
+		{name: "no key", configure: func(cfg *config.TLSConfig) { cfg.KeyFile = "" }, err: "requires cert_file and key_file"},
+		{name: "unknown client auth", configure: func(cfg *config.TLSConfig) { cfg.ClientAuth = "optional" }, err: "unknown client auth"},
+		{name: "request without CA", configure: func(cfg *config.TLSConfig) {
+			cfg.ClientAuth = "request"
+			cfg.ClientCAFile = ""
+		}, err: "requires client_ca_file"},
+		{name: "require without CA", configure: func(cfg *config.TLSConfig) {
+			cfg.ClientAuth = "require"
+			cfg.ClientCAFile = ""
+		}, err: "requires client_ca_file"},
+		{name: "missing certificate", configure: func(cfg *config.TLSConfig) { cfg.CertFile += ".missing" }, err: "failed to stat"},
+		{name: "invalid certificate", configure: func(cfg *config.TLSConfig) { cfg.CertFile = garbage }, err: "failed to load certificate"},
+		{name: "invalid client CA", configure: func(cfg *config.TLSConfig) { cfg.ClientCAFile = garbage }, err: "no certificates found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.configure(&cfg)
+			r, err := NewTLSReloader(cfg, testLogger())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name := servedName(t, r); name != "server" {
+				t.Errorf("served %q, want server", name)
+			}
+		})
+	}
+}
+
+func TestTLSReloaderReload(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil)
+	cfg := testTLSFiles(t, newTestCert(t, "first", ca), ca)
+	r, err := NewTLSReloader(cfg, testLogger())
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if r.changed() {
+		t.Error("files changed right after loading")
+	}
+
+	// A renewal is picked up by new connections
+	renewed := newTestCert(t, "second", ca)
+	writeTestFile(t, cfg.CertFile, renewed.pem, time.Minute)
+	writeTestFile(t, cfg.KeyFile, renewed.keyPEM(t), time.Minute)
+	if !r.changed() {
+		t.Fatal("renewal not detected")
+	}
+	if err := r.reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if name := servedName(t, r); name != "second" {
+		t.Errorf("served %q after renewal, want second", name)
+	}
+	if r.changed() {
+		t.Error("files changed right after reloading")
+	}
+
+	// Bad files are reported and the renewed certificate stays in use
+	bad := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{name: "half-written certificate", file: cfg.CertFile, data: renewed.pem[:len(renewed.pem)/2]},
+		{name: "mismatched key", file: cfg.KeyFile, data: newTestCert(t, "third", ca).keyPEM(t)},
+		{name: "empty client CA", file: cfg.ClientCAFile, data: nil},
+	}
+	for i, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			original, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", tt.file, err)
+			}
+			age := time.Duration(i+2) * time.Minute
+			writeTestFile(t, tt.file, tt.data, age)
+			defer writeTestFile(t, tt.file, original, age+30*time.Second)
+
+			if !r.changed() {
+				t.Fatal("change not detected")
+			}
+			if err := r.reload(); err == nil {
+				t.Fatal("reload succeeded")
+			}
+			if name := servedName(t, r); name != "second" {
+				t.Errorf("served %q, want second", name)
+			}
+		})
+	}
+
+	// Removed files are left alone until they come back
+	if err := r.reload(); err != nil {
+		t.Fatalf("failed to reload restored files: %v", err)
+	}
+	if err := os.Remove(cfg.CertFile); err != nil {
+		t.Fatalf("failed to remove certificate: %v", err)
+	}
+	if r.changed() {
+		t.Error("missing certificate reported as changed")
+	}
+}
+
+func TestTLSReloaderClientAuth(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil)
+	client := newTestCert(t, "admin", ca).tlsPair(t)
+	stranger := newTestCert(t, "admin", newTestCert(t, "other CA", nil)).tlsPair(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		mode   string
+		cert   *tls.Certificate
+		ok     bool
+		client string // verified client certificate
+	}{
+		{mode: "none", ok: true},
+		{mode: "none", cert: &client, ok: true},
+		{mode: "request", ok: true},
+		{mode: "request", cert: &client, ok: true, client: "admin"},
+		// Certificates from other CAs are not offered to the server
+		{mode: "request", cert: &stranger, ok: true},
+		{mode: "require"},
+		{mode: "require", cert: &client, ok: true, client: "admin"},
+		{mode: "require", cert: &stranger},
+	}
+
+	for _, tt := range tests {
+		name := tt.mode + "/no certificate"
+		if tt.cert != nil {
+			name = tt.mode + "/" + tt.cert.Leaf.Issuer.CommonName
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := testTLSFiles(t, newTestCert(t, "server", ca), ca)
+			cfg.ClientAuth = tt.mode
+			r, err := NewTLSReloader(cfg, testLogger())
+			if err != nil {
+				t.Fatalf("failed to load: %v", err)
+			}
+
+			listener, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			verified := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					verified <- ""
+					return
+				}
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					verified <- ""
+					return
+				}
+				name := ""
+				if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+					name = chains[0][0].Subject.CommonName
+				}
+				verified <- name
+				conn.Write([]byte("x"))
+			}()
+
+			clientConf := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.cert != nil {
+				clientConf.Certificates = []tls.Certificate{*tt.cert}
+			}
+			conn, err := tls.Dial("tcp", listener.Addr().String(), clientConf)
+			if err == nil {
+				// TLS 1.3 clients learn that their certificate was refused
+				// on their first read
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("handshake error %v, want success %v", err, tt.ok)
+			}
+			if name := <-verified; name != tt.client {
+				t.Errorf("verified client %q, want %q", name, tt.client)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"im-demo/internal/config"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Supported upload scanners
+const (
+	ScannerNone  = "none"
+	ScannerEICAR = "eicar"
+)
+
+// ScanVerdict is the outcome of scanning an upload
+type ScanVerdict string
+
+// Scan verdicts
+const (
+	ScanClean      ScanVerdict = "clean"
+	ScanReject     ScanVerdict = "reject"
+	ScanQuarantine ScanVerdict = "quarantine"
+)
+
+// ScanResult is a scanner's verdict on an upload
+type ScanResult struct {
+	Verdict ScanVerdict
+	Reason  string
+}
+
+// UploadScanner inspects the contents of an upload before it is published
+type UploadScanner interface {
+	Scan(ctx context.Context, fileName string, r io.Reader) (*ScanResult, error)
+}
+
+// PolicyViolation describes why an upload was refused; Reason is safe to
+// show to the uploader
+type PolicyViolation struct {
+	Reason string
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.Reason
+}
+
+// NewUploadScanner creates the scanner selected by the upload policy
+func NewUploadScanner(cfg config.PolicyConfig) (UploadScanner, error) {
+	verdict := ScanVerdict(cfg.ScanAction)
+	if verdict != ScanReject && verdict != ScanQuarantine {
+		return nil, fmt.Errorf("unknown scan action: %s", cfg.ScanAction)
+	}
+
+	switch cfg.Scanner {
+	case ScannerNone:
+		return NoopScanner{}, nil
+	case ScannerEICAR:
+		return &EICARScanner{Verdict: verdict}, nil
+	default:
+		return nil, fmt.Errorf("unknown upload scanner: %s", cfg.Scanner)
+	}
+}
+
+// NoopScanner accepts every upload
+type NoopScanner struct{}
+
+// Scan reports every upload as clean
+func (NoopScanner) Scan(ctx context.Context, fileName string, r io.Reader) (*ScanResult, error) {
+	return &ScanResult{Verdict: ScanClean}, nil
+}
+
+// eicarSignature is the standard anti-virus test string
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// EICARScanner flags files containing the EICAR test string. It stands in
+// for a real scanner in development and when exercising the quarantine path.
+type EICARScanner struct {
+	Verdict ScanVerdict
+}
+
+// Scan looks for the EICAR signature anywhere in the file
+func (s *EICARScanner) Scan(ctx context.Context, fileName string, r io.Reader) (*ScanResult, error) {
+	buf := make([]byte, 32*1024)
+	var tail []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// Keep the end of the previous read so matches across reads are found
+			window := append(tail, buf[:n]...)
+			if bytes.Contains(window, eicarSignature) {
+				return &ScanResult{Verdict: s.Verdict, Reason: "EICAR test file"}, nil
+			}
+			tail = append(tail[:0], window[max(0, len(window)-len(eicarSignature)+1):]...)
+		}
+		if err == io.EOF {
+			return &ScanResult{Verdict: ScanClean}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// UploadPolicy decides which uploads are accepted
+type UploadPolicy struct {
+	allowedTypes  []string
+	maxNameLength int
+	userQuota     int64
+	roomQuota     int64
+	quotaWindow   time.Duration
+	scanTimeout   time.Duration
+	scanner       UploadScanner
+	redis         *RedisService
+}
+
+// NewUploadPolicy creates an upload policy
+func NewUploadPolicy(cfg config.PolicyConfig, redis *RedisService, scanner UploadScanner) *UploadPolicy {
+	return &UploadPolicy{
+		allowedTypes:  cfg.AllowedTypes,
+		maxNameLength: cfg.MaxFileNameLength,
+		userQuota:     cfg.UserQuota,
+		roomQuota:     cfg.RoomQuota,
+		quotaWindow:   cfg.QuotaWindow,
+		scanTimeout:   cfg.ScanTimeout,
+		scanner:       scanner,
+		redis:         redis,
+	}
+}
+
+// CheckType verifies that a content type detected from an upload is allowed
+func (p *UploadPolicy) CheckType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return &PolicyViolation{Reason: "File type not allowed"}
+	}
+
+	for _, allowed := range p.allowedTypes {
+		if allowed == "*/*" || allowed == mediaType {
+			return nil
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return nil
+		}
+	}
+	return &PolicyViolation{Reason: fmt.Sprintf("File type %s not allowed", mediaType)}
+}
+
+// quotaReservation is a quota an upload counts against
+type quotaReservation struct {
+	scope string
+	limit int64
+}
+
+// quotas returns the quotas an upload from sender to room counts against
+func (p *UploadPolicy) quotas(sender, room string) []quotaReservation {
+	var quotas []quotaReservation
+	if p.userQuota > 0 && sender != "" {
+		quotas = append(quotas, quotaReservation{"user:" + sender, p.userQuota})
+	}
+	if p.roomQuota > 0 && room != "" {
+		quotas = append(quotas, quotaReservation{"room:" + room, p.roomQuota})
+	}
+	return quotas
+}
+
+// ReserveQuota counts an upload against its sender's and room's quotas. The
+// returned function gives the bytes back if the upload is not stored after all.
+func (p *UploadPolicy) ReserveQuota(ctx context.Context, sender, room string, size int64) (func(), error) {
+	var reserved []string
+	release := func() {
+		for _, scope := range reserved {
+			p.redis.ReleaseUploadQuota(context.Background(), scope, size)
+		}
+	}
+
+	for _, r := range p.quotas(sender, room) {
+		ok, err := p.redis.ReserveUploadQuota(ctx, r.scope, size, r.limit, p.quotaWindow)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if !ok {
+			release()
+			if strings.HasPrefix(r.scope, "room:") {
+				return nil, &PolicyViolation{Reason: "Room upload quota exceeded"}
+			}
+			return nil, &PolicyViolation{Reason: "Upload quota exceeded"}
+		}
+		reserved = append(reserved, r.scope)
+	}
+
+	return release, nil
+}
+
+// ReleaseQuota gives back the bytes ReserveQuota took for an upload that
+// was abandoned after the reservation's function was lost, such as one
+// that expired on another node
+func (p *UploadPolicy) ReleaseQuota(ctx context.Context, sender, room string, size int64) error {
+	for _, r := range p.quotas(sender, room) {
+		if err := p.redis.ReleaseUploadQuota(ctx, r.scope, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan runs the configured scanner over an upload
+func (p *UploadPolicy) Scan(ctx context.Context, fileName string, r io.Reader) (*ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.scanTimeout)
+	defer cancel()
+
+	result, err := p.scanner.Scan(ctx, fileName, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan upload: %w", err)
+	}
+	return result, nil
+}
+
+// windowsReservedNames cannot be used as file names on Windows, with or
+// without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName turns a client supplied file name into one that is safe
+// to store and display: directories are dropped, the name is normalized,
+// invisible and direction-changing characters are removed and the length is
+// bounded while keeping the extension
+func (p *UploadPolicy) SanitizeFileName(name string) string {
+	// NFKC also folds look-alikes such as fullwidth slashes into ASCII
+	name = norm.NFKC.String(name)
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError:
+			return -1
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			// Cf covers bidi overrides and zero-width characters
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		case !unicode.IsPrint(r):
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.Join(strings.Fields(name), " ")
+	name = strings.Trim(name, ". ")
+
+	ext := path.Ext(name)
+	base := strings.TrimRight(strings.TrimSuffix(name, ext), ". ")
+	if windowsReservedNames[strings.ToUpper(base)] {
+		base = "_" + base
+	}
+
+	if len(ext) > p.maxNameLength/2 {
+		ext = ""
+	}
+	base = truncateUTF8(base, p.maxNameLength-len(ext))
+	if base == "" {
+		base = "file"
+	}
+
+	return base + ext
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return strings.TrimRight(s[:n], ". ")
+}
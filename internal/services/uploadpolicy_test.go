@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"im-demo/internal/config"
+)
+
+// stubScanner returns a fixed verdict, or blocks until the scan times out
+type stubScanner struct {
+	result *ScanResult
+	err    error
+	block  bool
+}
+
+func (s *stubScanner) Scan(ctx context.Context, fileName string, r io.Reader) (*ScanResult, error) {
+	if s.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return s.result, s.err
+}
+
+// testPolicy creates a policy with the default configuration
+func testPolicy(t *testing.T, scanner UploadScanner) (*UploadPolicy, *RedisService) {
+	t.Helper()
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	r, _ := newTestRedis(t)
+	cfg.Upload.Policy.UserQuota = 100
+	cfg.Upload.Policy.RoomQuota = 150
+	cfg.Upload.Policy.ScanTimeout = 50 * time.Millisecond
+	return NewUploadPolicy(cfg.Upload.Policy, r, scanner), r
+}
+
+func TestUploadPolicyCheckType(t *testing.T) {
+	p, _ := testPolicy(t, NoopScanner{})
+
+	tests := []struct {
+		contentType string
+		allowed     bool
+	}{
+		{contentType: "image/png", allowed: true},
+		{contentType: "video/mp4", allowed: true},
+		{contentType: "text/plain; charset=utf-8", allowed: true},
+		{contentType: "application/pdf", allowed: true},
+		{contentType: "application/octet-stream", allowed: false},
+		{contentType: "text/html; charset=utf-8", allowed: false},
+		{contentType: "imagex/png", allowed: false},
+		{contentType: "", allowed: false},
+	}
+	for _, tt := range tests {
+		err := p.CheckType(tt.contentType)
+		var violation *PolicyViolation
+		if tt.allowed && err != nil {
+			t.Errorf("%q: unexpected error %v", tt.contentType, err)
+		}
+		if !tt.allowed && !errors.As(err, &violation) {
+			t.Errorf("%q: got %v, want a policy violation", tt.contentType, err)
+		}
+	}
+}
+
+func TestUploadPolicySanitizeFileName(t *testing.T) {
+	p, _ := testPolicy(t, NoopScanner{})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "report.pdf", want: "report.pdf"},
+		{name: "../../etc/passwd", want: "passwd"},
+		{name: `C:\Users\me\photo.jpg`, want: "photo.jpg"},
+		{name: "invoice\u202Efdp.exe", want: "invoicefdp.exe"},
+		{name: "zero\u200Bwidth.txt", want: "zerowidth.txt"},
+		{name: "ｆｕｌｌ／ｗｉｄｔｈ.txt", want: "width.txt"},
+		{name: "a<b>c?.txt", want: "a_b_c_.txt"},
+		{name: "  spaced \t name .txt ", want: "spaced name.txt"},
+		{name: "CON.txt", want: "_CON.txt"},
+		{name: "...", want: "file"},
+		{name: "", want: "file"},
+		{name: strings.Repeat("é", 100) + ".txt", want: strings.Repeat("é", 62) + ".txt"},
+	}
+	for _, tt := range tests {
+		if got := p.SanitizeFileName(tt.name); got != tt.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadPolicyScan(t *testing.T) {
+	flagged := &ScanResult{Verdict: ScanQuarantine, Reason: "test"}
+	failure := errors.New("scanner unavailable")
+
+	tests := []struct {
+		name    string
+		scanner *stubScanner
+		want    *ScanResult
+		wantErr error
+	}{
+		{name: "clean", scanner: &stubScanner{result: &ScanResult{Verdict: ScanClean}}, want: &ScanResult{Verdict: ScanClean}},
+		{name: "flagged", scanner: &stubScanner{result: flagged}, want: flagged},
+		{name: "failure", scanner: &stubScanner{err: failure}, wantErr: failure},
+		{name: "timeout", scanner: &stubScanner{block: true}, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		p, _ := testPolicy(t, tt.scanner)
+		got, err := p.Scan(context.Background(), "file.txt", strings.NewReader("data"))
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("%s: got %+v and %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestEICARScanner(t *testing.T) {
+	s := &EICARScanner{Verdict: ScanReject}
+	padding := strings.Repeat("x", 32*1024-10)
+
+	tests := []struct {
+		name    string
+		content string
+		want    ScanVerdict
+	}{
+		{name: "clean", content: "hello", want: ScanClean},
+		{name: "signature", content: string(eicarSignature), want: ScanReject},
+		// The signature straddles two reads
+		{name: "across reads", content: padding + string(eicarSignature), want: ScanReject},
+	}
+	for _, tt := range tests {
+		got, err := s.Scan(context.Background(), "file", strings.NewReader(tt.content))
+		if err != nil || got.Verdict != tt.want {
+			t.Errorf("%s: got %+v and %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestUploadPolicyReserveQuota(t *testing.T) {
+	p, r := testPolicy(t, NoopScanner{})
+	ctx := context.Background()
+
+	used := func(scope string) int64 {
+		n, _ := r.client.Get(ctx, "upload_quota:"+scope).Int64()
+		return n
+	}
+
+	release, err := p.ReserveQuota(ctx, "alice", "general", 60)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The user quota is exhausted first
+	var violation *PolicyViolation
+	if _, err := p.ReserveQuota(ctx, "alice", "general", 60); !errors.As(err, &violation) || violation.Reason != "Upload quota exceeded" {
+		t.Errorf("got %v, want the user quota exceeded", err)
+	}
+	// The room quota is shared, and a refused reservation gives back its user share
+	if _, err := p.ReserveQuota(ctx, "bob", "general", 100); !errors.As(err, &violation) || violation.Reason != "Room upload quota exceeded" {
+		t.Errorf("got %v, want the room quota exceeded", err)
+	}
+	if used("user:bob") != 0 {
+		t.Errorf("refused reservation kept %d bytes", used("user:bob"))
+	}
+
+	release()
+	if used("user:alice") != 0 || used("room:general") != 0 {
+		t.Errorf("release left %d and %d bytes", used("user:alice"), used("room:general"))
+	}
+	if ttl := r.client.PTTL(ctx, "upload_quota:user:alice").Val(); ttl <= 0 {
+		t.Errorf("release dropped the window, ttl %v", ttl)
+	}
+}
+
+func TestReleaseUploadQuota(t *testing.T) {
+	r, mr := newTestRedis(t)
+	ctx := context.Background()
+
+	if _, err := r.ReserveUploadQuota(ctx, "user:alice", 10, 100, time.Hour); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+
+	// Releasing more than is reserved stops at zero
+	if err := r.ReleaseUploadQuota(ctx, "user:alice", 25); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if got, _ := mr.Get("upload_quota:user:alice"); got != "0" {
+		t.Errorf("got %s bytes, want 0", got)
+	}
+
+	// A window that has ended is not brought back with a negative count
+	mr.FastForward(time.Hour)
+	if err := r.ReleaseUploadQuota(ctx, "user:alice", 10); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if mr.Exists("upload_quota:user:alice") {
+		t.Error("released quota recreated the counter")
+	}
+}